@@ -0,0 +1,209 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"rtmp/logger"
+	"rtmp/server"
+	"strings"
+	"sync"
+)
+
+const (
+	ActionConnect = "connect"
+	ActionPublish = "publish"
+	ActionPlay    = "play"
+)
+
+// AnyApp is the application whose rules apply to the applications without rules of their own
+const AnyApp = "*"
+
+var (
+	ErrInvalidRule = errors.New("invalid access rule")
+	ErrDenied      = errors.New("not allowed from the address")
+)
+
+// Rules are the rules of each action of an application, a rule is "allow" or "deny" followed by a network in the
+// cidr notation, an address or "all". The first rule matching the client address decides, the clients matching
+// none are allowed
+type Rules struct {
+	Connect []string
+	Publish []string
+	Play    []string
+}
+
+type Config struct {
+	// Apps are the rules by application, AnyApp applies to the applications missing
+	Apps map[string]Rules
+}
+
+type rule struct {
+	allow  bool
+	prefix netip.Prefix
+	// all matches every address
+	all bool
+}
+
+func (rule rule) matches(address netip.Addr) bool {
+	return rule.all || rule.prefix.Contains(address)
+}
+
+// Filter rejects the connections, publishers and players whose address the rules of the application deny, the
+// address of the clients behind a proxy is the one of its proxy protocol header. The filter should come first in
+// the handlers so the denied clients reach no other handler
+type Filter struct {
+	server.NopHandler
+	Config Config
+	rules  map[string]map[string][]rule
+	mutex  sync.RWMutex
+}
+
+func NewFilter(config Config) (*Filter, error) {
+	rules, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{Config: config, rules: rules}, nil
+}
+
+// SetConfig replaces the rules, the connections already accepted are not checked again
+func (filter *Filter) SetConfig(config Config) error {
+	rules, err := parseRules(config)
+	if err != nil {
+		return err
+	}
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.Config = config
+	filter.rules = rules
+	return nil
+}
+
+func (filter *Filter) OnConnect(session *server.Session, request *server.ConnectRequest) error {
+	if filter.allowed(session, request.App, ActionConnect) {
+		return nil
+	}
+	return &server.StatusError{Code: "NetConnection.Connect.Rejected", Description: "Connection not allowed from your address."}
+}
+
+func (filter *Filter) OnPublish(session *server.Session, request *server.PublishRequest) error {
+	if filter.allowed(session, request.App, ActionPublish) {
+		return nil
+	}
+	return &server.StatusError{Code: "NetStream.Publish.Rejected", Description: "Publishing not allowed from your address."}
+}
+
+func (filter *Filter) OnPlay(session *server.Session, request *server.PlayRequest) error {
+	if filter.allowed(session, request.App, ActionPlay) {
+		return nil
+	}
+	return &server.StatusError{Code: "NetStream.Play.Failed", Description: "Playing not allowed from your address."}
+}
+
+// Allowed tells whether an address may perform an action on an application
+func (filter *Filter) Allowed(app string, action string, address netip.Addr) bool {
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	appRules, ok := filter.rules[app]
+	if !ok {
+		appRules = filter.rules[AnyApp]
+	}
+	address = address.Unmap()
+	for _, actionRule := range appRules[action] {
+		if actionRule.matches(address) {
+			return actionRule.allow
+		}
+	}
+	return true
+}
+
+// CheckViewer applies the connect and play rules to the http-flv and hls viewers, the address is the one of the
+// peer of the http connection
+func (filter *Filter) CheckViewer(request *http.Request, app string) error {
+	var address netip.Addr
+	addrPort, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err == nil {
+		address = addrPort.Addr().Unmap()
+	}
+	for _, action := range []string{ActionConnect, ActionPlay} {
+		if !filter.Allowed(app, action, address) {
+			logger.Get().Infof("denied http %s on %s to %s", action, app, request.RemoteAddr)
+			return fmt.Errorf("%w: %s on %s", ErrDenied, action, app)
+		}
+	}
+	return nil
+}
+
+// allowed checks the address of a session, the clients without ip address such as the ones of the unix sockets
+// only match the rules applying to all
+func (filter *Filter) allowed(session *server.Session, app string, action string) bool {
+	address := clientAddress(session.RemoteAddr())
+	if filter.Allowed(app, action, address) {
+		return true
+	}
+	logger.Get().Infof("denied %s on %s to %s", action, app, session.RemoteAddr())
+	return false
+}
+
+func parseRules(config Config) (map[string]map[string][]rule, error) {
+	rules := make(map[string]map[string][]rule, len(config.Apps))
+	for app, appRules := range config.Apps {
+		rules[app] = make(map[string][]rule, 3)
+		for action, rawRules := range map[string][]string{
+			ActionConnect: appRules.Connect,
+			ActionPublish: appRules.Publish,
+			ActionPlay:    appRules.Play,
+		} {
+			for _, rawRule := range rawRules {
+				parsedRule, err := parseRule(rawRule)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %s %s: %s", err, app, action, rawRule)
+				}
+				rules[app][action] = append(rules[app][action], parsedRule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// parseRule parses "allow 10.0.0.0/8", "deny 192.168.1.10" or "deny all"
+func parseRule(rawRule string) (rule, error) {
+	fields := strings.Fields(rawRule)
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return rule{}, ErrInvalidRule
+	}
+	parsedRule := rule{allow: fields[0] == "allow"}
+	if fields[1] == "all" {
+		parsedRule.all = true
+		return parsedRule, nil
+	}
+	if strings.Contains(fields[1], "/") {
+		prefix, err := netip.ParsePrefix(fields[1])
+		if err != nil {
+			return rule{}, ErrInvalidRule
+		}
+		parsedRule.prefix = prefix.Masked()
+		return parsedRule, nil
+	}
+	address, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		return rule{}, ErrInvalidRule
+	}
+	parsedRule.prefix = netip.PrefixFrom(address, address.BitLen())
+	return parsedRule, nil
+}
+
+// clientAddress is the ip address of a client, the invalid address when it has none
+func clientAddress(addr net.Addr) netip.Addr {
+	if addr == nil {
+		return netip.Addr{}
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
@@ -0,0 +1,117 @@
+package access_test
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"rtmp/access"
+	"rtmp/amf"
+	"rtmp/testutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowed(t *testing.T) {
+	filter, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{
+		"live": {
+			Publish: []string{"allow 10.1.0.0/16", "deny 10.0.0.0/8", "allow 192.168.1.10", "deny all"},
+		},
+		access.AnyApp: {
+			Play: []string{"deny 2001:db8::/32"},
+		},
+	}})
+	assert.Nil(t, err)
+	assert.True(t, filter.Allowed("live", access.ActionPublish, netip.MustParseAddr("10.1.2.3")))
+	assert.False(t, filter.Allowed("live", access.ActionPublish, netip.MustParseAddr("10.2.2.3")))
+	assert.True(t, filter.Allowed("live", access.ActionPublish, netip.MustParseAddr("192.168.1.10")))
+	assert.True(t, filter.Allowed("live", access.ActionPublish, netip.MustParseAddr("::ffff:192.168.1.10")))
+	assert.False(t, filter.Allowed("live", access.ActionPublish, netip.MustParseAddr("192.168.1.11")))
+	// the actions without rules are allowed
+	assert.True(t, filter.Allowed("live", access.ActionPlay, netip.MustParseAddr("2001:db8::1")))
+	assert.True(t, filter.Allowed("live", access.ActionConnect, netip.MustParseAddr("8.8.8.8")))
+	// the other applications follow the rules of any application
+	assert.False(t, filter.Allowed("vod", access.ActionPlay, netip.MustParseAddr("2001:db8::1")))
+	assert.True(t, filter.Allowed("vod", access.ActionPlay, netip.MustParseAddr("2001:db9::1")))
+	assert.True(t, filter.Allowed("vod", access.ActionPublish, netip.MustParseAddr("8.8.8.8")))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rawRule := range []string{"allow", "permit 10.0.0.0/8", "deny 10.0.0.0/33", "allow localhost", "deny all now"} {
+		_, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{"live": {Connect: []string{rawRule}}}})
+		assert.ErrorIs(t, err, access.ErrInvalidRule, rawRule)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	filter, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{"live": {Play: []string{"deny all"}}}})
+	assert.Nil(t, err)
+	address := netip.MustParseAddr("10.1.2.3")
+	assert.False(t, filter.Allowed("live", access.ActionPlay, address))
+	// the invalid rules leave the current ones
+	err = filter.SetConfig(access.Config{Apps: map[string]access.Rules{"live": {Play: []string{"deny everyone"}}}})
+	assert.ErrorIs(t, err, access.ErrInvalidRule)
+	assert.False(t, filter.Allowed("live", access.ActionPlay, address))
+	err = filter.SetConfig(access.Config{Apps: map[string]access.Rules{"live": {Play: []string{"allow 10.0.0.0/8", "deny all"}}}})
+	assert.Nil(t, err)
+	assert.True(t, filter.Allowed("live", access.ActionPlay, address))
+	assert.False(t, filter.Allowed("live", access.ActionPlay, netip.MustParseAddr("192.168.1.1")))
+}
+
+func TestCheckViewer(t *testing.T) {
+	filter, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{
+		"live":    {Play: []string{"allow 10.0.0.0/8", "deny all"}},
+		"private": {Connect: []string{"deny all"}},
+	}})
+	assert.Nil(t, err)
+	request := httptest.NewRequest("GET", "/live/testStream.flv", nil)
+	request.RemoteAddr = "10.1.2.3:50000"
+	assert.Nil(t, filter.CheckViewer(request, "live"))
+	assert.Nil(t, filter.CheckViewer(request, "other"))
+	assert.ErrorIs(t, filter.CheckViewer(request, "private"), access.ErrDenied)
+	request.RemoteAddr = "[::ffff:192.168.1.1]:50000"
+	assert.ErrorIs(t, filter.CheckViewer(request, "live"), access.ErrDenied)
+}
+
+func TestFilterRejectsPublishing(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	filter, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{
+		"testApp": {Publish: []string{"allow 10.0.0.0/8", "deny all"}},
+	}})
+	assert.Nil(t, err)
+	testServer.Handler = filter
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err = connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Publish.Rejected")
+	_, published := testServer.Streams.Get("testApp", "testStream")
+	assert.False(t, published)
+}
+
+func TestFilterRejectsConnectionsAndPlayers(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	filter, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{
+		"testApp":  {Play: []string{"deny 127.0.0.1"}},
+		"otherApp": {Connect: []string{"deny 127.0.0.0/8"}},
+	}})
+	assert.Nil(t, err)
+	testServer.Handler = filter
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "testStream")
+
+	playerConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err = connectCommand.Send(playerConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, playerConn, "_result")
+	testutil.SendTestCommand(t, playerConn, 1, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Failed")
+
+	otherConn := testutil.DialTestingServer(t, testServer)
+	testutil.SendTestCommand(t, otherConn, 0, amf.NewString("connect"), amf.NewNumber(1), amf.NewObject(
+		amf.ObjectProperty{Name: "app", Value: amf.NewString("otherApp")},
+	))
+	errorCommand := testutil.WaitTestCommand(t, otherConn, "_error")
+	assert.Equal(t, "NetConnection.Connect.Rejected", testutil.StatusCode(errorCommand.Parts[3].(amf.Object)))
+}
@@ -0,0 +1,284 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rtmp/logger"
+	"rtmp/server"
+	"rtmp/stream"
+	"strconv"
+	"time"
+)
+
+type Connection struct {
+	Id            uint64             `json:"id"`
+	Address       string             `json:"address"`
+	App           string             `json:"app"`
+	State         string             `json:"state"`
+	ConnectedAt   time.Time          `json:"connected_at"`
+	BytesIn       uint64             `json:"bytes_in"`
+	BytesOut      uint64             `json:"bytes_out"`
+	InChunkSize   uint32             `json:"in_chunk_size"`
+	OutChunkSize  uint32             `json:"out_chunk_size"`
+	RoundTripTime float64            `json:"rtt_ms"`
+	Streams       []ConnectionStream `json:"streams"`
+}
+
+type ConnectionStream struct {
+	Id   uint32 `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type Stream struct {
+	App           string     `json:"app"`
+	Name          string     `json:"name"`
+	Publisher     *Client    `json:"publisher,omitempty"`
+	Players       []Client   `json:"players"`
+	Subscribers   int        `json:"subscribers"`
+	Video         *VideoInfo `json:"video,omitempty"`
+	Audio         *AudioInfo `json:"audio,omitempty"`
+	Tracks        []Track    `json:"tracks,omitempty"`
+	Bitrate       float64    `json:"bitrate_kbps"`
+	BytesIn       uint64     `json:"bytes_in"`
+	PublishedAt   time.Time  `json:"published_at"`
+	UptimeSeconds float64    `json:"uptime_seconds"`
+}
+
+type Client struct {
+	Id      uint64 `json:"id"`
+	Address string `json:"address"`
+}
+
+type VideoInfo struct {
+	Codec        string  `json:"codec"`
+	Profile      string  `json:"profile,omitempty"`
+	Level        string  `json:"level,omitempty"`
+	ChromaFormat string  `json:"chroma_format,omitempty"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	FrameRate    float64 `json:"fps,omitempty"`
+	// SampleAspectRatio is the pixel aspect ratio, such as 1:1
+	SampleAspectRatio string `json:"sar,omitempty"`
+}
+
+type AudioInfo struct {
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+}
+
+// Track is a track of the enhanced rtmp multitrack streams
+type Track struct {
+	Type  string `json:"type"`
+	Id    int    `json:"id"`
+	Codec string `json:"codec"`
+}
+
+// API serves the state of the server as json and lets operators kick clients and stop streams:
+//
+//	GET    /api/connections
+//	GET    /api/connections/{id}
+//	DELETE /api/connections/{id}
+//	GET    /api/streams
+//	GET    /api/streams/{app}/{name}
+//	DELETE /api/streams/{app}/{name}
+type API struct {
+	Server *server.Server
+	mux    *http.ServeMux
+}
+
+func NewAPI(rtmpServer *server.Server) *API {
+	api := &API{Server: rtmpServer, mux: http.NewServeMux()}
+	api.mux.HandleFunc("GET /api/connections", api.listConnections)
+	api.mux.HandleFunc("GET /api/connections/{id}", api.getConnection)
+	api.mux.HandleFunc("DELETE /api/connections/{id}", api.kickConnection)
+	api.mux.HandleFunc("GET /api/streams", api.listStreams)
+	api.mux.HandleFunc("GET /api/streams/{app}/{name}", api.getStream)
+	api.mux.HandleFunc("DELETE /api/streams/{app}/{name}", api.stopStream)
+	return api
+}
+
+func (api *API) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	api.mux.ServeHTTP(writer, request)
+}
+
+func (api *API) listConnections(writer http.ResponseWriter, _ *http.Request) {
+	sessions := api.Server.Sessions()
+	connections := make([]Connection, 0, len(sessions))
+	for _, session := range sessions {
+		connections = append(connections, newConnection(session))
+	}
+	writeJson(writer, http.StatusOK, connections)
+}
+
+func (api *API) getConnection(writer http.ResponseWriter, request *http.Request) {
+	session, ok := api.session(writer, request)
+	if !ok {
+		return
+	}
+	writeJson(writer, http.StatusOK, newConnection(session))
+}
+
+func (api *API) kickConnection(writer http.ResponseWriter, request *http.Request) {
+	session, ok := api.session(writer, request)
+	if !ok {
+		return
+	}
+	logger.Get().Infof("kicking connection %d from %s", session.Id, session.RemoteAddr())
+	_ = session.Close()
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (api *API) listStreams(writer http.ResponseWriter, _ *http.Request) {
+	publishedStreams := api.Server.Streams.Streams()
+	streams := make([]Stream, 0, len(publishedStreams))
+	clients := api.streamClients()
+	for _, publishedStream := range publishedStreams {
+		streams = append(streams, newStream(publishedStream, clients[publishedStream]))
+	}
+	writeJson(writer, http.StatusOK, streams)
+}
+
+func (api *API) getStream(writer http.ResponseWriter, request *http.Request) {
+	publishedStream, ok := api.Server.Streams.Get(request.PathValue("app"), request.PathValue("name"))
+	if !ok {
+		writeError(writer, http.StatusNotFound, "stream not found")
+		return
+	}
+	writeJson(writer, http.StatusOK, newStream(publishedStream, api.streamClients()[publishedStream]))
+}
+
+func (api *API) stopStream(writer http.ResponseWriter, request *http.Request) {
+	app, name := request.PathValue("app"), request.PathValue("name")
+	if !api.Server.StopStream(app, name) {
+		writeError(writer, http.StatusNotFound, "stream not found")
+		return
+	}
+	logger.Get().Infof("stopped stream %s", stream.Key(app, name))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (api *API) session(writer http.ResponseWriter, request *http.Request) (*server.Session, bool) {
+	id, err := strconv.ParseUint(request.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid connection id")
+		return nil, false
+	}
+	session, ok := api.Server.Session(id)
+	if !ok {
+		writeError(writer, http.StatusNotFound, "connection not found")
+		return nil, false
+	}
+	return session, true
+}
+
+type streamClients struct {
+	publisher *Client
+	players   []Client
+}
+
+// streamClients maps every stream to the sessions publishing and playing it
+func (api *API) streamClients() map[*stream.Stream]*streamClients {
+	clients := make(map[*stream.Stream]*streamClients)
+	for _, session := range api.Server.Sessions() {
+		info := session.Info()
+		for _, sessionStream := range info.Streams {
+			if sessionStream.Stream == nil {
+				continue
+			}
+			if clients[sessionStream.Stream] == nil {
+				clients[sessionStream.Stream] = &streamClients{}
+			}
+			client := Client{Id: info.Id, Address: info.RemoteAddr.String()}
+			if sessionStream.Type == "publish" {
+				clients[sessionStream.Stream].publisher = &client
+			} else {
+				clients[sessionStream.Stream].players = append(clients[sessionStream.Stream].players, client)
+			}
+		}
+	}
+	return clients
+}
+
+func newConnection(session *server.Session) Connection {
+	info := session.Info()
+	inChunkSize, outChunkSize := session.Conn.ChunkSizes()
+	connection := Connection{
+		Id:            info.Id,
+		Address:       info.RemoteAddr.String(),
+		App:           info.App,
+		State:         info.State,
+		ConnectedAt:   info.ConnectedAt,
+		BytesIn:       session.Conn.BytesReceived.Load(),
+		BytesOut:      session.Conn.BytesSent.Load(),
+		InChunkSize:   inChunkSize,
+		OutChunkSize:  outChunkSize,
+		RoundTripTime: float64(session.Conn.RoundTripTime().Microseconds()) / 1000,
+		Streams:       make([]ConnectionStream, 0, len(info.Streams)),
+	}
+	for _, sessionStream := range info.Streams {
+		connection.Streams = append(connection.Streams, ConnectionStream{Id: sessionStream.Id, Name: sessionStream.Name, Type: sessionStream.Type})
+	}
+	return connection
+}
+
+func newStream(publishedStream *stream.Stream, clients *streamClients) Stream {
+	info := publishedStream.Info()
+	stats := publishedStream.Stats()
+	result := Stream{
+		App:           publishedStream.App,
+		Name:          publishedStream.Name,
+		Players:       make([]Client, 0),
+		Subscribers:   len(publishedStream.Subscribers()),
+		Bitrate:       stats.Bitrate / 1000,
+		BytesIn:       stats.BytesReceived,
+		PublishedAt:   publishedStream.PublishedAt,
+		UptimeSeconds: time.Since(publishedStream.PublishedAt).Seconds(),
+	}
+	if clients != nil {
+		result.Publisher = clients.publisher
+		result.Players = append(result.Players, clients.players...)
+	}
+	if info.VideoCodec != "" {
+		result.Video = &VideoInfo{
+			Codec:        info.VideoCodec,
+			Profile:      info.VideoProfile,
+			Level:        info.VideoLevel,
+			ChromaFormat: info.ChromaFormat,
+			Width:        info.Width,
+			Height:       info.Height,
+			FrameRate:    info.FrameRate,
+		}
+		if info.SARWidth > 0 && info.SARHeight > 0 {
+			result.Video.SampleAspectRatio = fmt.Sprintf("%d:%d", info.SARWidth, info.SARHeight)
+		}
+	}
+	if info.AudioCodec != "" {
+		result.Audio = &AudioInfo{
+			Codec:      info.AudioCodec,
+			Profile:    info.AudioProfile,
+			SampleRate: info.AudioSampleRate,
+			Channels:   info.AudioChannels,
+		}
+	}
+	for _, track := range info.Tracks {
+		result.Tracks = append(result.Tracks, Track{Type: track.Type, Id: track.Id, Codec: track.Codec})
+	}
+	return result
+}
+
+func writeJson(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		logger.Get().Debugf("error writing admin response: %s", err)
+	}
+}
+
+func writeError(writer http.ResponseWriter, status int, message string) {
+	writeJson(writer, status, map[string]string{"error": message})
+}
@@ -0,0 +1,208 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/admin"
+	"rtmp/amf"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestingAPI(t *testing.T, rtmpServer *server.Server) *httptest.Server {
+	t.Helper()
+	apiServer := httptest.NewServer(admin.NewAPI(rtmpServer))
+	t.Cleanup(apiServer.Close)
+	return apiServer
+}
+
+func getTestJson(t *testing.T, url string, value any) int {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		err = json.NewDecoder(response.Body).Decode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func deleteTest(t *testing.T, url string) int {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	return response.StatusCode
+}
+
+func publishTestMedia(t *testing.T, testServer *server.Server) uint32 {
+	t.Helper()
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	metadata := amf.NewCommand(
+		amf.NewString("@setDataFrame"),
+		amf.NewString("onMetaData"),
+		amf.NewEcmaArray(
+			amf.ObjectProperty{Name: "width", Value: amf.NewNumber(1280)},
+			amf.ObjectProperty{Name: "height", Value: amf.NewNumber(720)},
+			amf.ObjectProperty{Name: "framerate", Value: amf.NewNumber(30)},
+		),
+	)
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeDataMessageAmf0, 0, metadata.Encode())
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x01, 0, 0, 0, 1, 2, 3})
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeAudio, 0, []byte{0xAF, 0x01, 1, 2, 3})
+	return streamId
+}
+
+func TestListConnectionsAndStreams(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.PingInterval = 20 * time.Millisecond
+	apiServer := startTestingAPI(t, testServer)
+	publishTestMedia(t, testServer)
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+
+	var streams []admin.Stream
+	assert.Equal(t, http.StatusOK, getTestJson(t, apiServer.URL+"/api/streams", &streams))
+	assert.Len(t, streams, 1)
+	assert.Equal(t, "testApp", streams[0].App)
+	assert.Equal(t, "testStream", streams[0].Name)
+	assert.NotNil(t, streams[0].Publisher)
+	assert.Len(t, streams[0].Players, 1)
+	assert.Equal(t, playerConn.LocalAddr().String(), streams[0].Players[0].Address)
+	assert.Equal(t, "H264", streams[0].Video.Codec)
+	assert.Equal(t, 1280, streams[0].Video.Width)
+	assert.Equal(t, 720, streams[0].Video.Height)
+	assert.Equal(t, "AAC", streams[0].Audio.Codec)
+	assert.Greater(t, streams[0].BytesIn, uint64(0))
+
+	assert.Eventually(t, func() bool {
+		var connections []admin.Connection
+		getTestJson(t, apiServer.URL+"/api/connections", &connections)
+		return len(connections) == 2 && connections[0].RoundTripTime > 0 && connections[1].RoundTripTime > 0
+	}, 3*time.Second, 20*time.Millisecond)
+	var connections []admin.Connection
+	assert.Equal(t, http.StatusOK, getTestJson(t, apiServer.URL+"/api/connections", &connections))
+	assert.Equal(t, server.SessionStatePublishing, connections[0].State)
+	assert.Equal(t, server.SessionStatePlaying, connections[1].State)
+	assert.Equal(t, "testApp", connections[0].App)
+	assert.Greater(t, connections[0].BytesIn, uint64(0))
+	assert.Greater(t, connections[0].BytesOut, uint64(0))
+	assert.Equal(t, uint32(128), connections[0].InChunkSize)
+	assert.Equal(t, []admin.ConnectionStream{{Id: 1, Name: "testStream", Type: "play"}}, connections[1].Streams)
+}
+
+func TestStreamInfoFromSequenceHeader(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	apiServer := startTestingAPI(t, testServer)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	// the metadata is wrong, the sequence header is a baseline 128x96 stream
+	metadata := amf.NewCommand(
+		amf.NewString("@setDataFrame"),
+		amf.NewString("onMetaData"),
+		amf.NewEcmaArray(
+			amf.ObjectProperty{Name: "width", Value: amf.NewNumber(1920)},
+			amf.ObjectProperty{Name: "height", Value: amf.NewNumber(1080)},
+			amf.ObjectProperty{Name: "framerate", Value: amf.NewNumber(30)},
+		),
+	)
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeDataMessageAmf0, 0, metadata.Encode())
+	sequenceHeader := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0x00, 0x0A, 0xFF, 0xE1, 0x00, 0x07, 0x67, 0x42, 0x00, 0x0A, 0xF8, 0x41, 0xA2, 0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80}
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, sequenceHeader)
+
+	var streams []admin.Stream
+	assert.Eventually(t, func() bool {
+		getTestJson(t, apiServer.URL+"/api/streams", &streams)
+		return len(streams) == 1 && streams[0].Video != nil && streams[0].Video.Profile != ""
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, &admin.VideoInfo{
+		Codec:             "H264",
+		Profile:           "Baseline",
+		Level:             "1.0",
+		ChromaFormat:      "4:2:0",
+		Width:             128,
+		Height:            96,
+		FrameRate:         30,
+		SampleAspectRatio: "1:1",
+	}, streams[0].Video)
+}
+
+func TestStreamAudioInfo(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	apiServer := startTestingAPI(t, testServer)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	// an he-aac v2 sequence header, the legacy header always says 44.1 kHz stereo
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeAudio, 0, []byte{0xAF, 0x00, 0xEB, 0x09, 0x88})
+
+	var streams []admin.Stream
+	assert.Eventually(t, func() bool {
+		getTestJson(t, apiServer.URL+"/api/streams", &streams)
+		return len(streams) == 1 && streams[0].Audio != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, &admin.AudioInfo{Codec: "AAC", Profile: "HE-AAC v2", SampleRate: 48000, Channels: 2}, streams[0].Audio)
+
+	// then an enhanced rtmp opus stream
+	publisherConn = testutil.DialTestingServer(t, testServer)
+	streamId = testutil.PublishTestStream(t, publisherConn, "opusStream")
+	opusHead := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 1, 0x38, 0x01, 0x80, 0x3E, 0, 0, 0, 0, 0}
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeAudio, 0, append([]byte{0x90, 'O', 'p', 'u', 's'}, opusHead...))
+	var opusStream admin.Stream
+	assert.Eventually(t, func() bool {
+		getTestJson(t, apiServer.URL+"/api/streams/testApp/opusStream", &opusStream)
+		return opusStream.Audio != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, &admin.AudioInfo{Codec: "Opus", SampleRate: 48000, Channels: 1}, opusStream.Audio)
+}
+
+func TestKickConnection(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	apiServer := startTestingAPI(t, testServer)
+	publishTestMedia(t, testServer)
+	publisher, ok := testServer.Publisher("testApp", "testStream")
+	assert.True(t, ok)
+	connectionUrl := apiServer.URL + "/api/connections/" + strconv.FormatUint(publisher.Id, 10)
+	assert.Equal(t, http.StatusNoContent, deleteTest(t, connectionUrl))
+	assert.Eventually(t, func() bool {
+		_, ok := testServer.Streams.Get("testApp", "testStream")
+		return !ok
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return getTestJson(t, connectionUrl, &admin.Connection{}) == http.StatusNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusBadRequest, deleteTest(t, apiServer.URL+"/api/connections/abc"))
+}
+
+func TestStopStream(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	apiServer := startTestingAPI(t, testServer)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+
+	assert.Equal(t, http.StatusNoContent, deleteTest(t, apiServer.URL+"/api/streams/testApp/testStream"))
+	testutil.WaitTestStatus(t, publisherConn, "NetStream.Unpublish.Success")
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+	assert.Equal(t, http.StatusNotFound, getTestJson(t, apiServer.URL+"/api/streams/testApp/testStream", &admin.Stream{}))
+	assert.Equal(t, http.StatusNotFound, deleteTest(t, apiServer.URL+"/api/streams/testApp/testStream"))
+}
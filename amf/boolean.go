@@ -1,5 +1,7 @@
 package amf
 
+import "errors"
+
 var booleanMarker = byte(0x01)
 
 type Boolean uint8
@@ -12,7 +14,10 @@ func (bool Boolean) Encode() []byte {
 	return []byte{booleanMarker, uint8(bool)}
 }
 
-func decodeNextBoolean(bytes []byte) (int, Boolean) {
+func decodeNextBoolean(bytes []byte) (int, Boolean, error) {
 	length := 2
-	return length, Boolean(bytes[length-1])
+	if len(bytes) < length {
+		return 0, 0, errors.New("Can't decode boolean, not enough bytes")
+	}
+	return length, Boolean(bytes[length-1]), nil
 }
@@ -17,7 +17,8 @@ func TestBooleanEncoding(t *testing.T) {
 	assert.Equal(t, 2, len(encodedBoolean))
 	assert.Equal(t, booleanMarker, encodedBoolean[0])
 	assert.Equal(t, testBoolean, encodedBoolean[1])
-	_, decodedBoolean := decodeNextBoolean(encodedBoolean)
+	_, decodedBoolean, err := decodeNextBoolean(encodedBoolean)
+	assert.Nil(t, err)
 	assert.Equal(t, amfBoolean, decodedBoolean)
 	assert.Equal(t, encodedMessage, encodedBoolean)
 }
@@ -27,6 +28,7 @@ func TestBooleanDecoding(t *testing.T) {
 	bytes := make([]byte, 0)
 	bytes = append(bytes, 0x01)
 	bytes = append(bytes, testBoolean)
-	_, decodedBoolean := decodeNextBoolean(bytes)
+	_, decodedBoolean, err := decodeNextBoolean(bytes)
+	assert.Nil(t, err)
 	assert.Equal(t, decodedBoolean, NewBoolean(testBoolean))
 }
@@ -69,3 +69,19 @@ func TestMultipleObjectsDecode(t *testing.T) {
 	assert.Equal(t, amfCommand.Parts[0], NewObject(testObject...))
 	assert.Equal(t, amfCommand.Parts[1], NewObject(testObject2...))
 }
+
+func TestTruncatedCommandDecode(t *testing.T) {
+	testObject, _ := generateTestAmfObject()
+	bytes := NewCommand(NewString("connect"), NewNumber(1), testObject).Encode()
+	_, err := DecodeCommand(bytes[:len(bytes)-5])
+	assert.Error(t, err)
+	// the values cut anywhere are errors
+	for _, value := range []ValueType{NewString("connect"), NewNumber(1), NewBoolean(1), testObject,
+		NewEcmaArray(ObjectProperty{"duration", NewNumber(1)}), NewStrictArray(NewNumber(1))} {
+		encoded := value.Encode()
+		for length := 1; length < len(encoded); length++ {
+			_, err := DecodeCommand(encoded[:length])
+			assert.Error(t, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ecmaArrayMarker = byte(0x08)
+
+type EcmaArray []ObjectProperty
+
+func NewEcmaArray(properties ...ObjectProperty) EcmaArray {
+	return properties
+}
+
+func (array EcmaArray) Encode() []byte {
+	bytes := make([]byte, 0)
+	bytes = append(bytes, ecmaArrayMarker)
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(len(array)))
+	// the properties are encoded like the ones of an object
+	bytes = append(bytes, Object(array).Encode()[1:]...)
+	return bytes
+}
+
+func decodeNextEcmaArray(bytes []byte) (int, EcmaArray, error) {
+	if len(bytes) < 8 {
+		return 0, nil, errors.New("Can't decode ecma array, not enough bytes")
+	}
+	if bytes[0] != ecmaArrayMarker {
+		return 0, nil, errors.New("Can't decode ecma array, ecma array marker is not 0x08")
+	}
+	// the associative count is only a hint, the properties end with the object end marker
+	objectBytes := append([]byte{objectMarker}, bytes[5:]...)
+	length, object, err := decodeNextObject(objectBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	return length + 4, EcmaArray(object), nil
+}
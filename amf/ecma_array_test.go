@@ -0,0 +1,35 @@
+package amf
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEcmaArrayEncoding(t *testing.T) {
+	testObject, _ := generateTestAmfObject()
+	array := NewEcmaArray(testObject...)
+	bytes := array.Encode()
+	assert.Equal(t, ecmaArrayMarker, bytes[0])
+	assert.Equal(t, uint32(len(testObject)), binary.BigEndian.Uint32(bytes[1:5]))
+	length, decodedArray, err := decodeNextEcmaArray(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, len(bytes), length)
+	assert.Equal(t, array, decodedArray)
+}
+
+func TestEcmaArrayDecodingInCommand(t *testing.T) {
+	array := NewEcmaArray(
+		ObjectProperty{"width", NewNumber(1280)},
+		ObjectProperty{"height", NewNumber(720)},
+	)
+	command, err := DecodeCommand(NewCommand(NewString("onMetaData"), array).Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, array, command.Parts[1])
+}
+
+func TestEcmaArrayDecodingFailNotEnoughBytes(t *testing.T) {
+	_, _, err := decodeNextEcmaArray([]byte{ecmaArrayMarker, 0x00})
+	assert.Error(t, err)
+}
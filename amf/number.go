@@ -2,6 +2,7 @@ package amf
 
 import (
 	"encoding/binary"
+	"errors"
 	"math"
 )
 
@@ -20,7 +21,10 @@ func (number Number) Encode() []byte {
 	return bytes
 }
 
-func decodeNextNumber(bytes []byte) (int, Number) {
+func decodeNextNumber(bytes []byte) (int, Number, error) {
 	length := 9
-	return length, Number(math.Float64frombits(binary.BigEndian.Uint64(bytes[1:length])))
+	if len(bytes) < length {
+		return 0, 0, errors.New("Can't decode number, not enough bytes")
+	}
+	return length, Number(math.Float64frombits(binary.BigEndian.Uint64(bytes[1:length]))), nil
 }
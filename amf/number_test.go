@@ -13,7 +13,8 @@ func TestNumberDecoding(t *testing.T) {
 	bytes := make([]byte, 0)
 	bytes = append(bytes, 0x00)
 	bytes = binary.BigEndian.AppendUint64(bytes, math.Float64bits(testNumber))
-	_, decodedNumber := decodeNextNumber(bytes)
+	_, decodedNumber, err := decodeNextNumber(bytes)
+	assert.Nil(t, err)
 	assert.Equal(t, decodedNumber, NewNumber(testNumber))
 }
 
@@ -22,7 +23,8 @@ func TestNumberEncoding(t *testing.T) {
 	amfNumber := NewNumber(testNumber)
 	amfMessage := NewCommand(amfNumber)
 	assert.NotNil(t, amfMessage)
-	_, decodedNumber := decodeNextNumber(amfNumber.Encode())
+	_, decodedNumber, err := decodeNextNumber(amfNumber.Encode())
+	assert.Nil(t, err)
 	assert.Equal(t, decodedNumber, amfNumber)
 	assert.Equal(t, amfMessage.Encode(), amfNumber.Encode())
 }
@@ -43,8 +43,15 @@ func decodeNextObject(bytes []byte) (int, Object, error) {
 	pointer := 1
 
 	for {
+		if len(bytes) < pointer+2 {
+			return 0, nil, errors.New("Can't decode object, not enough bytes")
+		}
 		propertyNameLength := binary.BigEndian.Uint16(bytes[pointer : pointer+2])
 		pointer += 2
+		// the property name is followed by at least the marker of its value
+		if len(bytes) < pointer+int(propertyNameLength)+1 {
+			return 0, nil, errors.New("Can't decode object, not enough bytes")
+		}
 		propertyName := string(bytes[pointer : pointer+int(propertyNameLength)])
 		pointer += int(propertyNameLength)
 		if propertyNameLength == 0 && bytes[pointer] == objectEndMarker {
@@ -0,0 +1,48 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var strictArrayMarker = byte(0x0A)
+
+type StrictArray []ValueType
+
+func NewStrictArray(values ...ValueType) StrictArray {
+	return values
+}
+
+func (array StrictArray) Encode() []byte {
+	bytes := make([]byte, 0)
+	bytes = append(bytes, strictArrayMarker)
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(len(array)))
+	for _, value := range array {
+		bytes = append(bytes, value.Encode()...)
+	}
+	return bytes
+}
+
+func decodeNextStrictArray(bytes []byte) (int, StrictArray, error) {
+	if len(bytes) < 5 {
+		return 0, nil, errors.New("Can't decode strict array, not enough bytes")
+	}
+	if bytes[0] != strictArrayMarker {
+		return 0, nil, errors.New("Can't decode strict array, strict array marker is not 0x0A")
+	}
+	count := binary.BigEndian.Uint32(bytes[1:5])
+	array := make(StrictArray, 0, min(count, 1024))
+	offset := 5
+	for range count {
+		if offset >= len(bytes) {
+			return 0, nil, errors.New("Can't decode strict array, not enough bytes")
+		}
+		length, value := decodeNextValueType(bytes[offset:])
+		if value == nil {
+			return 0, nil, errors.New("Can't decode strict array, invalid value")
+		}
+		array = append(array, value)
+		offset += length
+	}
+	return offset, array, nil
+}
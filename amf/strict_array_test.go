@@ -0,0 +1,34 @@
+package amf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictArrayEncoding(t *testing.T) {
+	array := NewStrictArray(NewNumber(0), NewNumber(2.5), NewString("keyframe"))
+	bytes := array.Encode()
+	assert.Equal(t, strictArrayMarker, bytes[0])
+	length, decodedArray, err := decodeNextStrictArray(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, len(bytes), length)
+	assert.Equal(t, array, decodedArray)
+}
+
+func TestStrictArrayDecodingInObject(t *testing.T) {
+	keyframes := NewObject(
+		ObjectProperty{"times", NewStrictArray(NewNumber(0), NewNumber(2))},
+		ObjectProperty{"filepositions", NewStrictArray(NewNumber(13), NewNumber(4096))},
+	)
+	command, err := DecodeCommand(NewCommand(NewString("onMetaData"), NewEcmaArray(ObjectProperty{"keyframes", keyframes})).Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, NewEcmaArray(ObjectProperty{"keyframes", keyframes}), command.Parts[1])
+}
+
+func TestStrictArrayDecodingFailNotEnoughBytes(t *testing.T) {
+	_, _, err := decodeNextStrictArray([]byte{strictArrayMarker, 0x00, 0x00})
+	assert.Error(t, err)
+	_, err = DecodeCommand([]byte{strictArrayMarker, 0x00, 0x00, 0x00, 0x02, numberMarker})
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package amf
 
 import (
 	"encoding/binary"
+	"errors"
 	"unicode/utf8"
 )
 
@@ -13,9 +14,15 @@ func NewString(str string) String {
 	return String(str)
 }
 
-func decodeNextString(bytes []byte) (int, String) {
+func decodeNextString(bytes []byte) (int, String, error) {
+	if len(bytes) < 3 {
+		return 0, "", errors.New("Can't decode string, not enough bytes")
+	}
 	length := 3 + int(binary.BigEndian.Uint16(bytes[1:3]))
-	return length, String(bytes[3:length])
+	if len(bytes) < length {
+		return 0, "", errors.New("Can't decode string, not enough bytes")
+	}
+	return length, String(bytes[3:length]), nil
 }
 
 func (str String) Encode() []byte {
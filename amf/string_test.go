@@ -15,7 +15,8 @@ func TestStringDecoding(t *testing.T) {
 	numberOfRunes := utf8.RuneCountInString(testString)
 	bytes = binary.BigEndian.AppendUint16(bytes, uint16(numberOfRunes))
 	bytes = append(bytes, []byte(testString)...)
-	_, decodedString := decodeNextString(bytes)
+	_, decodedString, err := decodeNextString(bytes)
+	assert.Nil(t, err)
 	assert.Equal(t, decodedString, NewString(testString))
 }
 
@@ -24,7 +25,8 @@ func TestStringEncoding(t *testing.T) {
 	amfString := NewString(testString)
 	amfMessage := NewCommand(amfString)
 	assert.NotNil(t, amfMessage)
-	_, decodedString := decodeNextString(amfString.Encode())
+	_, decodedString, err := decodeNextString(amfString.Encode())
+	assert.Nil(t, err)
 	assert.Equal(t, decodedString, amfString)
 	assert.Equal(t, amfMessage.Encode(), amfString.Encode())
 }
@@ -5,22 +5,46 @@ type ValueType interface {
 }
 
 func decodeNextValueType(bytes []byte) (int, ValueType) {
+	if len(bytes) == 0 {
+		return 0, nil
+	}
 	valueTypeMarker := bytes[0]
 	var valueType ValueType
 	var length int
+	var err error
 	switch valueTypeMarker {
 	case numberMarker:
-		length, valueType = decodeNextNumber(bytes)
+		var number Number
+		length, number, err = decodeNextNumber(bytes)
+		valueType = number
 	case stringMarker:
-		length, valueType = decodeNextString(bytes)
+		var str String
+		length, str, err = decodeNextString(bytes)
+		valueType = str
 	case booleanMarker:
-		length, valueType = decodeNextBoolean(bytes)
+		var boolean Boolean
+		length, boolean, err = decodeNextBoolean(bytes)
+		valueType = boolean
 	case objectMarker:
-		length, valueType, _ = decodeNextObject(bytes)
+		var object Object
+		length, object, err = decodeNextObject(bytes)
+		valueType = object
 	case nullMarker:
 		length, valueType = decodeNextNull()
+	case ecmaArrayMarker:
+		var array EcmaArray
+		length, array, err = decodeNextEcmaArray(bytes)
+		valueType = array
+	case strictArrayMarker:
+		var array StrictArray
+		length, array, err = decodeNextStrictArray(bytes)
+		valueType = array
 	default:
 		return 0, nil
 	}
+	if err != nil {
+		// a nil interface signals the failure, not one holding a nil value
+		return 0, nil
+	}
 	return length, valueType
 }
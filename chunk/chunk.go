@@ -71,6 +71,9 @@ func (chunk *Chunk) encodeMessageHeader() ([]byte, []byte) {
 		} else {
 			messageHeader = append(messageHeader, binary.BigEndian.AppendUint32(make([]byte, 0), chunk.Header.MessageHeader.Timestamp)[1:]...)
 		}
+	} else if chunk.Header.ExtendedTimestamp >= 0xFFFFFF {
+		// a type 3 chunk repeats the extended timestamp of the previous header on its chunk stream
+		extendedTimeStamp = binary.BigEndian.AppendUint32(extendedTimeStamp, chunk.Header.ExtendedTimestamp)
 	}
 	if chunk.Header.BasicHeader.Fmt <= 1 {
 		messageHeader = append(messageHeader, binary.BigEndian.AppendUint32(make([]byte, 0), chunk.Header.MessageHeader.MessageLength)[1:]...)
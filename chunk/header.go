@@ -2,6 +2,7 @@ package chunk
 
 import (
 	"encoding/binary"
+	"io"
 	"rtmp/conn"
 )
 
@@ -28,11 +29,19 @@ func ReadChunkHeader(connection *conn.Conn) (*Header, error) {
 	if err != nil {
 		return nil, err
 	}
+	hasExtendedTimestamp := messageHeader.Timestamp >= 16777215
+	chunkStream := connection.ChunkStream(basicHeader.ChunkStreamId)
+	if basicHeader.Fmt == 3 {
+		// a type 3 chunk carries an extended timestamp when the previous header on its chunk stream did
+		hasExtendedTimestamp = chunkStream.ExtendedTimestamp
+	} else {
+		chunkStream.ExtendedTimestamp = hasExtendedTimestamp
+	}
 	var extendedTimestamp uint32
 	extendedTimestampBuffer := make([]byte, 0)
-	if messageHeader.Timestamp >= 16777215 {
+	if hasExtendedTimestamp {
 		extendedTimestampBuffer = make([]byte, 4)
-		_, err = connection.Read(extendedTimestampBuffer)
+		_, err = io.ReadFull(connection, extendedTimestampBuffer)
 		if err != nil {
 			return nil, err
 		}
@@ -119,7 +128,7 @@ func ReadMessageHeader(conn *conn.Conn, basicHeader BasicHeader) (*MessageHeader
 	messageStreamIdBuffer := make([]byte, 0)
 	var messageStreamId uint32
 	if basicHeader.Fmt <= 2 {
-		_, err := conn.Read(timestampBuffer)
+		_, err := io.ReadFull(conn, timestampBuffer)
 		if err != nil {
 			return nil, err
 		}
@@ -127,7 +136,7 @@ func ReadMessageHeader(conn *conn.Conn, basicHeader BasicHeader) (*MessageHeader
 	}
 	if basicHeader.Fmt <= 1 {
 		messageLengthBuffer = make([]byte, 3)
-		_, err := conn.Read(messageLengthBuffer)
+		_, err := io.ReadFull(conn, messageLengthBuffer)
 		if err != nil {
 			return nil, err
 		}
@@ -141,7 +150,7 @@ func ReadMessageHeader(conn *conn.Conn, basicHeader BasicHeader) (*MessageHeader
 	}
 	if basicHeader.Fmt == 0 {
 		messageStreamIdBuffer = make([]byte, 4)
-		_, err := conn.Read(messageStreamIdBuffer)
+		_, err := io.ReadFull(conn, messageStreamIdBuffer)
 		if err != nil {
 			return nil, err
 		}
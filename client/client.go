@@ -0,0 +1,401 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/handshake"
+	"rtmp/message"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPort is the port of the rtmp urls without one
+const defaultPort = "1935"
+
+// chunkSize is the size of the chunks of a new connection, the client never changes it since a server echoing the
+// set chunk size messages would answer its own echo forever
+const chunkSize = 128
+
+// clientQueueSize is the number of messages received ahead of the reader
+const clientQueueSize = 256
+
+var (
+	ErrInvalidURL = errors.New("invalid rtmp url")
+	// ErrRejected wraps the status code of a connection, publish or play the server refused
+	ErrRejected = errors.New("rejected by the server")
+	// ErrTimeout is returned when the server does not answer a command in time
+	ErrTimeout = errors.New("the server did not answer in time")
+)
+
+// RedirectError is the rejection of a server telling the client to connect to another url
+type RedirectError struct {
+	Code string
+	URL  string
+}
+
+func (redirectError *RedirectError) Error() string {
+	return fmt.Sprintf("%s: %s, redirected to %s", ErrRejected, redirectError.Code, redirectError.URL)
+}
+
+func (redirectError *RedirectError) Unwrap() error {
+	return ErrRejected
+}
+
+// URL is an rtmp url, rtmp://host[:port]/app[/stream]
+type URL struct {
+	Address string
+	App     string
+	// TcUrl is the url of the application sent in the connect command
+	TcUrl string
+	// Stream is the rest of the path, empty when the url only names the application
+	Stream string
+}
+
+func ParseURL(rawURL string) (*URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidURL, err)
+	}
+	app, stream, _ := strings.Cut(strings.TrimPrefix(parsed.Path, "/"), "/")
+	if parsed.Scheme != "rtmp" || parsed.Hostname() == "" || app == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidURL, rawURL)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if parsed.RawQuery != "" {
+		// the query usually authenticates the stream
+		stream += "?" + parsed.RawQuery
+	}
+	return &URL{
+		Address: net.JoinHostPort(parsed.Hostname(), port),
+		App:     app,
+		TcUrl:   "rtmp://" + parsed.Host + "/" + app,
+		Stream:  stream,
+	}, nil
+}
+
+// Client is an rtmp connection to a server, it publishes or plays a single stream
+type Client struct {
+	Conn     *conn.Conn
+	URL      *URL
+	Timeout  time.Duration
+	streamId uint32
+	// messages are the messages received, the protocol control messages excepted
+	messages chan *conn.Message
+	// done is closed by Close
+	done chan struct{}
+	// closed is closed once the reading stopped
+	closed        chan struct{}
+	err           error
+	closeOnce     sync.Once
+	transactionId float64
+}
+
+// Dial connects to the application of an rtmp url, the timeout bounds every network operation and command
+func Dial(ctx context.Context, rawURL string, timeout time.Duration) (*Client, error) {
+	parsedURL, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", parsedURL.Address)
+	if err != nil {
+		return nil, err
+	}
+	_ = netConn.SetDeadline(time.Now().Add(timeout))
+	err = handshake.Request(netConn)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	rtmpConn, err := conn.NewConn(netConn, chunkSize, timeout)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	rtmpConn.Errors = make(chan error, 1)
+	newClient := &Client{
+		Conn:     rtmpConn,
+		URL:      parsedURL,
+		Timeout:  timeout,
+		messages: make(chan *conn.Message, clientQueueSize),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go newClient.read()
+	stop := context.AfterFunc(ctx, func() { _ = newClient.Close() })
+	defer stop()
+	result, err := newClient.call(0, "connect", amf.NewObject(
+		amf.ObjectProperty{Name: "app", Value: amf.NewString(parsedURL.App)},
+		amf.ObjectProperty{Name: "type", Value: amf.NewString("nonprivate")},
+		amf.ObjectProperty{Name: "flashVer", Value: amf.NewString("FMLE/3.0 (compatible; rtmp)")},
+		amf.ObjectProperty{Name: "tcUrl", Value: amf.NewString(parsedURL.TcUrl)},
+	))
+	if err == nil {
+		err = resultError(result, "NetConnection.Connect.Rejected")
+	}
+	if err != nil {
+		_ = newClient.Close()
+		return nil, err
+	}
+	return newClient, nil
+}
+
+// Publish starts publishing a live stream
+func (client *Client) Publish(name string) error {
+	err := client.createStream()
+	if err != nil {
+		return err
+	}
+	err = client.send(client.streamId, "publish", amf.NewNull(), amf.NewString(name), amf.NewString("live"))
+	if err != nil {
+		return err
+	}
+	return client.waitStatus("NetStream.Publish.Start")
+}
+
+// Play starts playing a stream, ReadMessage returns its messages
+func (client *Client) Play(name string) error {
+	err := client.createStream()
+	if err != nil {
+		return err
+	}
+	err = client.send(client.streamId, "play", amf.NewNull(), amf.NewString(name), amf.NewNumber(-2))
+	if err != nil {
+		return err
+	}
+	return client.waitStatus("NetStream.Play.Start")
+}
+
+func (client *Client) createStream() error {
+	result, err := client.call(0, "createStream", amf.NewNull())
+	if err != nil {
+		return err
+	}
+	if err = resultError(result, "NetStream.CreateStream.Failed"); err != nil {
+		return err
+	}
+	if len(result.Parts) < 4 {
+		return fmt.Errorf("%w: createStream result without stream id", ErrRejected)
+	}
+	streamId, ok := result.Parts[3].(amf.Number)
+	if !ok {
+		return fmt.Errorf("%w: createStream result without stream id", ErrRejected)
+	}
+	client.streamId = uint32(streamId)
+	return nil
+}
+
+// WriteMessage sends a media or data message on the published stream
+func (client *Client) WriteMessage(media *conn.Message) error {
+	outgoingMessage := message.NewMessage(media.TypeId, client.streamId, media.Data)
+	outgoingMessage.Timestamp = media.Timestamp
+	_, err := outgoingMessage.Send(client.Conn)
+	return err
+}
+
+// ReadMessage returns the next media or data message of the played stream, io.EOF once the stream ended
+func (client *Client) ReadMessage() (*conn.Message, error) {
+	for {
+		receivedMessage, err := client.receive(nil)
+		if err != nil {
+			return nil, err
+		}
+		switch receivedMessage.TypeId {
+		case message.TypeAudio, message.TypeVideo, message.TypeDataMessageAmf0:
+			return receivedMessage, nil
+		case message.TypeCommandMessageAmf0:
+			command, err := amf.DecodeCommand(receivedMessage.Data)
+			if err == nil && isStreamEnd(command) {
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+// Done is closed once the connection is lost or closed
+func (client *Client) Done() <-chan struct{} {
+	return client.closed
+}
+
+// Close closes the connection, the messages received and not read yet are dropped
+func (client *Client) Close() error {
+	var err error
+	client.closeOnce.Do(func() {
+		close(client.done)
+		err = client.Conn.Close()
+	})
+	<-client.closed
+	return err
+}
+
+func (client *Client) read() {
+	defer close(client.closed)
+	for {
+		receivedMessage, err := message.AcceptMessage(client.Conn)
+		if err != nil {
+			client.err = err
+			return
+		}
+		switch receivedMessage.TypeId {
+		case message.TypeAudio, message.TypeVideo, message.TypeDataMessageAmf0, message.TypeCommandMessageAmf0:
+		default:
+			// the protocol control messages are handled while accepting them
+			continue
+		}
+		select {
+		case client.messages <- receivedMessage:
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// receive returns the next message, waiting for the timeout at most when one is given
+func (client *Client) receive(timeout <-chan time.Time) (*conn.Message, error) {
+	select {
+	case receivedMessage := <-client.messages:
+		return receivedMessage, nil
+	case <-client.closed:
+		// the messages read before the connection closed are returned first
+		select {
+		case receivedMessage := <-client.messages:
+			return receivedMessage, nil
+		default:
+		}
+		if client.err == nil || errors.Is(client.err, net.ErrClosed) {
+			return nil, io.EOF
+		}
+		return nil, client.err
+	case <-timeout:
+		return nil, ErrTimeout
+	}
+}
+
+func (client *Client) send(streamId uint32, name string, parts ...amf.ValueType) error {
+	client.transactionId++
+	parts = append([]amf.ValueType{amf.NewString(name), amf.NewNumber(client.transactionId)}, parts...)
+	_, err := message.NewCommandMessage(streamId, amf.NewCommand(parts...)).Send(client.Conn)
+	return err
+}
+
+// call sends a command and waits for its _result or _error
+func (client *Client) call(streamId uint32, name string, parts ...amf.ValueType) (*amf.Command, error) {
+	err := client.send(streamId, name, parts...)
+	if err != nil {
+		return nil, err
+	}
+	transactionId := amf.NewNumber(client.transactionId)
+	return client.waitCommand(func(command *amf.Command) bool {
+		return len(command.Parts) > 1 && (command.Parts[0] == amf.NewString("_result") || command.Parts[0] == amf.NewString("_error")) &&
+			command.Parts[1] == transactionId
+	})
+}
+
+// waitStatus waits for the onStatus command with the given code, the errors reject the command
+func (client *Client) waitStatus(statusCode string) error {
+	status, err := client.waitCommand(func(command *amf.Command) bool {
+		if len(command.Parts) < 4 || command.Parts[0] != amf.NewString("onStatus") {
+			return false
+		}
+		level, code := statusInfo(command)
+		return level == "error" || code == statusCode
+	})
+	if err != nil {
+		return err
+	}
+	if level, _ := statusInfo(status); level == "error" {
+		return rejection(status, "")
+	}
+	return nil
+}
+
+func (client *Client) waitCommand(matches func(*amf.Command) bool) (*amf.Command, error) {
+	timeout := time.After(client.Timeout)
+	for {
+		receivedMessage, err := client.receive(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if receivedMessage.TypeId != message.TypeCommandMessageAmf0 {
+			continue
+		}
+		command, err := amf.DecodeCommand(receivedMessage.Data)
+		if err == nil && matches(command) {
+			return command, nil
+		}
+	}
+}
+
+// resultError returns the rejection of an _error command
+func resultError(result *amf.Command, defaultCode string) error {
+	if result.Parts[0] != amf.NewString("_error") {
+		return nil
+	}
+	return rejection(result, defaultCode)
+}
+
+// rejection is the error of a rejected command, a *RedirectError when the server gave another url
+func rejection(command *amf.Command, defaultCode string) error {
+	_, code := statusInfo(command)
+	if code == "" {
+		code = defaultCode
+	}
+	for _, part := range command.Parts[2:] {
+		info, _ := part.(amf.Object)
+		for _, property := range info {
+			ex, _ := property.Value.(amf.Object)
+			if property.Name != "ex" {
+				continue
+			}
+			for _, exProperty := range ex {
+				if redirect, ok := exProperty.Value.(amf.String); ok && exProperty.Name == "redirect" && redirect != "" {
+					return &RedirectError{Code: code, URL: string(redirect)}
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrRejected, code)
+}
+
+// statusInfo reads the level and code of the information object of a status or result command
+func statusInfo(command *amf.Command) (string, string) {
+	for _, part := range command.Parts[2:] {
+		info, ok := part.(amf.Object)
+		if !ok {
+			continue
+		}
+		var level, code string
+		for _, property := range info {
+			value, _ := property.Value.(amf.String)
+			switch property.Name {
+			case "level":
+				level = string(value)
+			case "code":
+				code = string(value)
+			}
+		}
+		if code != "" {
+			return level, code
+		}
+	}
+	return "", ""
+}
+
+// isStreamEnd tells the status commands ending a played stream
+func isStreamEnd(command *amf.Command) bool {
+	if len(command.Parts) < 4 || command.Parts[0] != amf.NewString("onStatus") {
+		return false
+	}
+	_, code := statusInfo(command)
+	return code == "NetStream.Play.Stop" || code == "NetStream.Play.UnpublishNotify" || code == "NetStream.Play.Complete"
+}
@@ -0,0 +1,71 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"rtmp/client"
+	"rtmp/conn"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dialTestClient(t *testing.T, testServer *server.Server, path string) *client.Client {
+	t.Helper()
+	testClient, err := client.Dial(context.Background(), "rtmp://"+testServer.Addr().String()+path, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = testClient.Close()
+	})
+	return testClient
+}
+
+func TestParseURL(t *testing.T) {
+	parsedURL, err := client.ParseURL("rtmp://example.com/live/stream?key=secret")
+	assert.Nil(t, err)
+	assert.Equal(t, &client.URL{Address: "example.com:1935", App: "live", TcUrl: "rtmp://example.com/live", Stream: "stream?key=secret"}, parsedURL)
+	parsedURL, err = client.ParseURL("rtmp://127.0.0.1:1936/live")
+	assert.Nil(t, err)
+	assert.Equal(t, &client.URL{Address: "127.0.0.1:1936", App: "live", TcUrl: "rtmp://127.0.0.1:1936/live"}, parsedURL)
+	_, err = client.ParseURL("http://example.com/live")
+	assert.ErrorIs(t, err, client.ErrInvalidURL)
+	_, err = client.ParseURL("rtmp://example.com/")
+	assert.ErrorIs(t, err, client.ErrInvalidURL)
+}
+
+func TestPublishAndPlay(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	publisher := dialTestClient(t, testServer, "/testApp")
+	assert.Nil(t, publisher.Publish("testStream"))
+	player := dialTestClient(t, testServer, "/testApp")
+	assert.Nil(t, player.Play("testStream"))
+
+	data := make([]byte, 1000)
+	data[0], data[1] = 0x17, 0x01
+	assert.Nil(t, publisher.WriteMessage(&conn.Message{TypeId: message.TypeVideo, Timestamp: 40, Data: data}))
+	received, err := player.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, message.TypeVideo, received.TypeId)
+	assert.Equal(t, uint32(40), received.Timestamp)
+	assert.Equal(t, data, received.Data)
+
+	assert.Nil(t, publisher.Close())
+	_, err = player.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestPublishRejected(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	publisher := dialTestClient(t, testServer, "/testApp")
+	assert.Nil(t, publisher.Publish("testStream"))
+	secondPublisher := dialTestClient(t, testServer, "/testApp")
+	err := secondPublisher.Publish("testStream")
+	assert.ErrorIs(t, err, client.ErrRejected)
+	assert.ErrorContains(t, err, "NetStream.Publish.BadName")
+}
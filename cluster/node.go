@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"rtmp/logger"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/stream"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// announcedLifetime is the number of announce intervals the streams of a node are located after its last announcement
+const announcedLifetime = 3
+
+type Config struct {
+	// Name identifies the node, it must be unique in the cluster
+	Name string
+	// URL is the rtmp url the other nodes pull the streams of the node from and redirect the players to,
+	// rtmp://host[:port]
+	URL string
+	// Peers are the urls of the cluster api of the other nodes, http://host[:port], the node learns the streams
+	// of the nodes whose url has the host of a peer only
+	Peers []string
+	// Secret authenticates the announcements, the nodes of the cluster share it and send it as a bearer token,
+	// the announcements are accepted without one when empty
+	Secret string
+	// AnnounceInterval is the interval the node announces its streams to its peers at, they are also announced
+	// as soon as one is published or unpublished
+	AnnounceInterval time.Duration
+	// Redirect rejects the players of the streams published on another node with the url of that node instead
+	// of pulling the streams from it
+	Redirect bool
+	// Pull configures the pulls of the streams published on the other nodes, the origins are located instead
+	Pull relay.PullConfig
+}
+
+// Announcement lists the streams published on a node
+type Announcement struct {
+	Node    string      `json:"node"`
+	URL     string      `json:"url"`
+	Streams []StreamKey `json:"streams"`
+}
+
+type StreamKey struct {
+	App  string `json:"app"`
+	Name string `json:"name"`
+}
+
+// Location is the node a stream is published on
+type Location struct {
+	App  string `json:"app"`
+	Name string `json:"name"`
+	Node string `json:"node"`
+	URL  string `json:"url"`
+}
+
+type announced struct {
+	announcement Announcement
+	expiresAt    time.Time
+}
+
+// Node announces the streams published on it to its peers and learns theirs, the players of a stream published on
+// a peer are redirected to it or the stream is pulled from it:
+//
+//	POST /cluster/announce
+//	GET  /cluster/streams
+type Node struct {
+	server.NopHandler
+	Config  Config
+	Streams *stream.Registry
+	// Puller pulls the streams located on the peers
+	Puller     *relay.Puller
+	HTTPClient *http.Client
+	peers      map[string]announced
+	mutex      sync.Mutex
+	// changed wakes the announcements up once a stream is published or unpublished
+	changed chan struct{}
+	mux     *http.ServeMux
+}
+
+func NewNode(config Config, streams *stream.Registry) *Node {
+	if config.AnnounceInterval == 0 {
+		config.AnnounceInterval = 5 * time.Second
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	node := &Node{
+		Config:     config,
+		Streams:    streams,
+		Puller:     relay.NewPuller(config.Pull, streams),
+		HTTPClient: &http.Client{Timeout: config.AnnounceInterval},
+		peers:      make(map[string]announced),
+		changed:    make(chan struct{}, 1),
+		mux:        http.NewServeMux(),
+	}
+	node.Puller.Locate = node.locateOrigin
+	node.mux.HandleFunc("POST /cluster/announce", node.receiveAnnouncement)
+	node.mux.HandleFunc("GET /cluster/streams", node.listLocations)
+	return node
+}
+
+// Run announces the streams of the node to its peers until the context is done
+func (node *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(node.Config.AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		node.announce(ctx)
+		select {
+		case <-ticker.C:
+		case <-node.changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (node *Node) OnPublish(*server.Session, *server.PublishRequest) error {
+	node.notifyChange()
+	return nil
+}
+
+func (node *Node) OnUnpublish(*server.Session, *server.PublishRequest) {
+	node.notifyChange()
+}
+
+// OnPlay redirects or pulls the streams published on a peer
+func (node *Node) OnPlay(session *server.Session, request *server.PlayRequest) error {
+	if _, live := node.Streams.Get(request.App, request.Name); live {
+		return nil
+	}
+	location, ok := node.Locate(request.App, request.Name)
+	if !ok {
+		return nil
+	}
+	if node.Config.Redirect {
+		logger.Get().Infof("redirecting the player of %s to %s", stream.Key(request.App, request.Name), location.Node)
+		return &server.StatusError{
+			Code:        "NetConnection.Connect.Rejected",
+			Description: fmt.Sprintf("%s is published on %s.", request.Name, location.Node),
+			Redirect:    location.URL + "/" + request.App,
+		}
+	}
+	return node.Puller.OnPlay(session, request)
+}
+
+// Locate finds the peer a stream is published on
+func (node *Node) Locate(app string, name string) (Location, bool) {
+	now := time.Now()
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	names := make([]string, 0, len(node.peers))
+	for peerName := range node.peers {
+		names = append(names, peerName)
+	}
+	sort.Strings(names)
+	for _, peerName := range names {
+		peer := node.peers[peerName]
+		if now.After(peer.expiresAt) {
+			continue
+		}
+		if slices.Contains(peer.announcement.Streams, StreamKey{App: app, Name: name}) {
+			return Location{App: app, Name: name, Node: peerName, URL: peer.announcement.URL}, true
+		}
+	}
+	return Location{}, false
+}
+
+// Locations lists the streams published on the node and on its peers
+func (node *Node) Locations() []Location {
+	locations := make([]Location, 0)
+	for _, key := range node.announcement().Streams {
+		locations = append(locations, Location{App: key.App, Name: key.Name, Node: node.Config.Name, URL: node.Config.URL})
+	}
+	now := time.Now()
+	node.mutex.Lock()
+	for peerName, peer := range node.peers {
+		if now.After(peer.expiresAt) {
+			continue
+		}
+		for _, key := range peer.announcement.Streams {
+			locations = append(locations, Location{App: key.App, Name: key.Name, Node: peerName, URL: peer.announcement.URL})
+		}
+	}
+	node.mutex.Unlock()
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].App != locations[j].App {
+			return locations[i].App < locations[j].App
+		}
+		if locations[i].Name != locations[j].Name {
+			return locations[i].Name < locations[j].Name
+		}
+		return locations[i].Node < locations[j].Node
+	})
+	return locations
+}
+
+func (node *Node) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	node.mux.ServeHTTP(writer, request)
+}
+
+func (node *Node) receiveAnnouncement(writer http.ResponseWriter, request *http.Request) {
+	if !node.authorized(request) {
+		writeJson(writer, http.StatusUnauthorized, map[string]string{"error": "invalid cluster secret"})
+		return
+	}
+	var announcement Announcement
+	err := json.NewDecoder(request.Body).Decode(&announcement)
+	if err != nil || announcement.Node == "" {
+		writeJson(writer, http.StatusBadRequest, map[string]string{"error": "invalid announcement"})
+		return
+	}
+	err = node.checkPeer(announcement)
+	if err != nil {
+		logger.Get().Warnf("rejecting the announcement of %s from %s: %s", announcement.Node, request.RemoteAddr, err)
+		writeJson(writer, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	node.learn(announcement)
+	// the peer learns the streams of the node in return
+	writeJson(writer, http.StatusOK, node.announcement())
+}
+
+func (node *Node) listLocations(writer http.ResponseWriter, _ *http.Request) {
+	writeJson(writer, http.StatusOK, node.Locations())
+}
+
+// announcement lists the streams published on the node, the pulled ones are published on their origin
+func (node *Node) announcement() Announcement {
+	announcement := Announcement{Node: node.Config.Name, URL: node.Config.URL, Streams: make([]StreamKey, 0)}
+	for _, publishedStream := range node.Streams.Streams() {
+		if !node.Puller.Pulling(publishedStream.App, publishedStream.Name) {
+			announcement.Streams = append(announcement.Streams, StreamKey{App: publishedStream.App, Name: publishedStream.Name})
+		}
+	}
+	return announcement
+}
+
+func (node *Node) announce(ctx context.Context) {
+	body, err := json.Marshal(node.announcement())
+	if err != nil {
+		return
+	}
+	for _, peerURL := range node.Config.Peers {
+		announcement, err := node.post(ctx, strings.TrimSuffix(peerURL, "/")+"/cluster/announce", body)
+		if err == nil {
+			err = node.checkPeer(*announcement)
+		}
+		if err != nil {
+			logger.Get().Debugf("error announcing the streams to %s: %s", peerURL, err)
+			continue
+		}
+		node.learn(*announcement)
+	}
+}
+
+func (node *Node) post(ctx context.Context, url string, body []byte) (*Announcement, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if node.Config.Secret != "" {
+		request.Header.Set("Authorization", "Bearer "+node.Config.Secret)
+	}
+	response, err := node.HTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	var announcement Announcement
+	err = json.NewDecoder(response.Body).Decode(&announcement)
+	if err != nil {
+		return nil, err
+	}
+	return &announcement, nil
+}
+
+// authorized checks the secret of the cluster sent along with an announcement
+func (node *Node) authorized(request *http.Request) bool {
+	if node.Config.Secret == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(node.Config.Secret)) == 1
+}
+
+// checkPeer accepts the announcements of the peers only, the url the streams are pulled from and the players
+// redirected to must be on the host of a peer
+func (node *Node) checkPeer(announcement Announcement) error {
+	announcedURL, err := url.Parse(announcement.URL)
+	if err != nil || announcedURL.Hostname() == "" {
+		return fmt.Errorf("%w: invalid url %q", ErrUnknownPeer, announcement.URL)
+	}
+	for _, peer := range node.Config.Peers {
+		peerURL, err := url.Parse(peer)
+		if err == nil && strings.EqualFold(peerURL.Hostname(), announcedURL.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not the host of a peer", ErrUnknownPeer, announcedURL.Hostname())
+}
+
+func (node *Node) learn(announcement Announcement) {
+	if announcement.Node == node.Config.Name {
+		return
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.peers[announcement.Node] = announced{
+		announcement: announcement,
+		expiresAt:    time.Now().Add(announcedLifetime * node.Config.AnnounceInterval),
+	}
+}
+
+// locateOrigin is the application of the peer a stream is pulled from
+func (node *Node) locateOrigin(app string, name string) (string, bool) {
+	location, ok := node.Locate(app, name)
+	if !ok {
+		return "", false
+	}
+	return location.URL + "/" + app, true
+}
+
+func (node *Node) notifyChange() {
+	select {
+	case node.changed <- struct{}{}:
+	default:
+	}
+}
+
+func writeJson(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		logger.Get().Debugf("error writing cluster response: %s", err)
+	}
+}
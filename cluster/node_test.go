@@ -0,0 +1,170 @@
+package cluster_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/client"
+	"rtmp/cluster"
+	"rtmp/message"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	server *server.Server
+	node   *cluster.Node
+	api    *httptest.Server
+	// stop stops the announcements of the node
+	stop context.CancelFunc
+}
+
+// startTestingCluster starts nodes knowing each other, the last one redirecting the players when redirect is set
+func startTestingCluster(t *testing.T, count int, redirect bool) []testNode {
+	t.Helper()
+	nodes := make([]testNode, count)
+	for i := range nodes {
+		testServer := testutil.StartTestingServer(t)
+		node := cluster.NewNode(cluster.Config{
+			Name:             string(rune('a' + i)),
+			URL:              "rtmp://" + testServer.Addr().String(),
+			AnnounceInterval: 50 * time.Millisecond,
+			Redirect:         redirect && i == count-1,
+			Secret:           "testSecret",
+			Pull:             relay.PullConfig{IdleTimeout: 100 * time.Millisecond, Timeout: time.Second},
+		}, testServer.Streams)
+		testServer.Handler = node
+		apiServer := httptest.NewServer(node)
+		t.Cleanup(apiServer.Close)
+		t.Cleanup(func() {
+			_ = node.Puller.Close()
+		})
+		nodes[i] = testNode{server: testServer, node: node, api: apiServer}
+	}
+	for i := range nodes {
+		for j := range nodes {
+			if i != j {
+				nodes[i].node.Config.Peers = append(nodes[i].node.Config.Peers, nodes[j].api.URL)
+			}
+		}
+	}
+	for i := range nodes {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		nodes[i].stop = cancel
+		go nodes[i].node.Run(ctx)
+	}
+	return nodes
+}
+
+func waitTestLocation(t *testing.T, node *cluster.Node, name string, located bool) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		_, ok := node.Locate("testApp", name)
+		return ok == located
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPlayFromAnotherNode(t *testing.T) {
+	nodes := startTestingCluster(t, 3, false)
+	publisherConn := testutil.DialTestingServer(t, nodes[0].server)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x00, 0, 0, 0, 1, 2, 3})
+	waitTestLocation(t, nodes[1].node, "testStream", true)
+	location, _ := nodes[1].node.Locate("testApp", "testStream")
+	assert.Equal(t, cluster.Location{App: "testApp", Name: "testStream", Node: "a", URL: "rtmp://" + nodes[0].server.Addr().String()}, location)
+
+	playerConn := testutil.DialTestingServer(t, nodes[1].server)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	assert.Equal(t, []byte{0x17, 0x00, 0, 0, 0, 1, 2, 3}, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	assert.True(t, nodes[1].node.Puller.Pulling("testApp", "testStream"))
+
+	// the pulled stream is not announced, the other nodes keep locating it on its origin
+	time.Sleep(200 * time.Millisecond)
+	var locations []cluster.Location
+	response, err := http.Get(nodes[2].api.URL + "/cluster/streams")
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&locations))
+	_ = response.Body.Close()
+	assert.Equal(t, []cluster.Location{location}, locations)
+
+	// the stream is forgotten once unpublished
+	_ = publisherConn.Close()
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+	waitTestLocation(t, nodes[1].node, "testStream", false)
+	waitTestLocation(t, nodes[2].node, "testStream", false)
+}
+
+func TestRedirectToAnotherNode(t *testing.T) {
+	nodes := startTestingCluster(t, 2, true)
+	publisherConn := testutil.DialTestingServer(t, nodes[0].server)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	waitTestLocation(t, nodes[1].node, "testStream", true)
+
+	player, err := client.Dial(context.Background(), "rtmp://"+nodes[1].server.Addr().String()+"/testApp", time.Second)
+	assert.Nil(t, err)
+	defer player.Close()
+	err = player.Play("testStream")
+	var redirectError *client.RedirectError
+	if !errors.As(err, &redirectError) {
+		t.Fatalf("play not redirected: %v", err)
+	}
+	assert.Equal(t, "NetConnection.Connect.Rejected", redirectError.Code)
+	assert.Equal(t, "rtmp://"+nodes[0].server.Addr().String()+"/testApp", redirectError.URL)
+	assert.False(t, nodes[1].node.Puller.Pulling("testApp", "testStream"))
+
+	redirectedPlayer, err := client.Dial(context.Background(), redirectError.URL, time.Second)
+	assert.Nil(t, err)
+	defer redirectedPlayer.Close()
+	assert.Nil(t, redirectedPlayer.Play("testStream"))
+}
+
+func TestNodeForgetsSilentPeers(t *testing.T) {
+	nodes := startTestingCluster(t, 2, false)
+	publisherConn := testutil.DialTestingServer(t, nodes[0].server)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	waitTestLocation(t, nodes[1].node, "testStream", true)
+	nodes[0].stop()
+	nodes[0].api.Close()
+	// the location expires after three missed announcements
+	waitTestLocation(t, nodes[1].node, "testStream", false)
+}
+
+func postTestAnnouncement(t *testing.T, apiURL string, secret string, announcement cluster.Announcement) int {
+	t.Helper()
+	body, err := json.Marshal(announcement)
+	assert.Nil(t, err)
+	request, err := http.NewRequest(http.MethodPost, apiURL+"/cluster/announce", bytes.NewReader(body))
+	assert.Nil(t, err)
+	request.Header.Set("Authorization", "Bearer "+secret)
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	return response.StatusCode
+}
+
+func TestNodeRejectsUnknownAnnouncements(t *testing.T) {
+	nodes := startTestingCluster(t, 2, false)
+	announcement := cluster.Announcement{
+		Node:    "intruder",
+		URL:     "rtmp://intruder.example.com",
+		Streams: []cluster.StreamKey{{App: "testApp", Name: "testStream"}},
+	}
+	assert.Equal(t, http.StatusUnauthorized, postTestAnnouncement(t, nodes[1].api.URL, "wrongSecret", announcement))
+	// the secret is not enough, the url must be on a peer
+	assert.Equal(t, http.StatusForbidden, postTestAnnouncement(t, nodes[1].api.URL, "testSecret", announcement))
+	_, located := nodes[1].node.Locate("testApp", "testStream")
+	assert.False(t, located)
+
+	announcement.URL = "rtmp://" + nodes[0].server.Addr().String()
+	assert.Equal(t, http.StatusOK, postTestAnnouncement(t, nodes[1].api.URL, "testSecret", announcement))
+	waitTestLocation(t, nodes[1].node, "testStream", true)
+}
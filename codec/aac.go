@@ -0,0 +1,216 @@
+package codec
+
+import (
+	"fmt"
+	"slices"
+)
+
+// the audio object types of ISO/IEC 14496-3 1.5.1.1
+const (
+	AudioObjectTypeAACMain = 1
+	AudioObjectTypeAACLC   = 2
+	AudioObjectTypeSBR     = 5
+	AudioObjectTypePS      = 29
+)
+
+var audioObjectTypes = map[int]string{
+	1:  "Main",
+	2:  "LC",
+	3:  "SSR",
+	4:  "LTP",
+	5:  "HE-AAC",
+	6:  "Scalable",
+	17: "ER LC",
+	19: "ER LTP",
+	20: "ER Scalable",
+	23: "LD",
+	29: "HE-AAC v2",
+	39: "ELD",
+}
+
+var samplingFrequencies = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+const (
+	explicitSamplingFrequency = 15
+	syncExtensionSBR          = 0x2B7
+	syncExtensionPS           = 0x548
+)
+
+// AudioSpecificConfig is the payload of the AAC sequence header, defined by ISO/IEC 14496-3 1.6.2.1
+type AudioSpecificConfig struct {
+	// ObjectType is the type of the core decoder, HE-AAC signals AAC LC with SBR
+	ObjectType int
+	// SamplingFrequency is the rate of the core decoder, the output rate is doubled by SBR
+	SamplingFrequency int
+	// ChannelConfiguration is zero when the channels are described by a program config element
+	ChannelConfiguration int
+	// SBR and PS tell the spectral band replication and parametric stereo extensions, explicitly signaled or with
+	// the backward compatible sync extension
+	SBR                        bool
+	PS                         bool
+	ExtensionSamplingFrequency int
+}
+
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	reader := &bitReader{data: data}
+	config := &AudioSpecificConfig{}
+	config.ObjectType = readAudioObjectType(reader)
+	config.SamplingFrequency = readSamplingFrequency(reader)
+	config.ChannelConfiguration = int(reader.readBits(4))
+	if config.ObjectType == AudioObjectTypeSBR || config.ObjectType == AudioObjectTypePS {
+		config.SBR = true
+		config.PS = config.ObjectType == AudioObjectTypePS
+		config.ExtensionSamplingFrequency = readSamplingFrequency(reader)
+		config.ObjectType = readAudioObjectType(reader)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if config.ObjectType == 0 || config.SamplingFrequency == 0 {
+		return nil, fmt.Errorf("%w: object type %d at %d Hz", ErrUnsupported, config.ObjectType, config.SamplingFrequency)
+	}
+	if config.ChannelConfiguration > 7 {
+		return nil, fmt.Errorf("%w: channel configuration %d", ErrUnsupported, config.ChannelConfiguration)
+	}
+	if !readGASpecificConfig(reader, config) || config.SBR {
+		return config, nil
+	}
+	// the sync extensions of the backward compatible signaling, the decoders ignoring them play the core
+	if len(data)*8-reader.position >= 16 && reader.readBits(11) == syncExtensionSBR {
+		if readAudioObjectType(reader) == AudioObjectTypeSBR {
+			config.SBR = reader.readFlag()
+			if config.SBR {
+				config.ExtensionSamplingFrequency = readSamplingFrequency(reader)
+				if len(data)*8-reader.position >= 12 && reader.readBits(11) == syncExtensionPS {
+					config.PS = reader.readFlag()
+				}
+			}
+		}
+	}
+	if reader.err != nil {
+		// the extensions are optional, a truncated one is ignored
+		config.SBR, config.PS, config.ExtensionSamplingFrequency = false, false, 0
+	}
+	return config, nil
+}
+
+// readGASpecificConfig skips the general audio configuration, false when the configuration can't be read past it
+func readGASpecificConfig(reader *bitReader, config *AudioSpecificConfig) bool {
+	switch config.ObjectType {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+	default:
+		return false
+	}
+	if config.ChannelConfiguration == 0 {
+		// the program config element is not read
+		return false
+	}
+	// frame length
+	reader.readFlag()
+	if reader.readFlag() {
+		// core coder delay
+		reader.readBits(14)
+	}
+	extension := reader.readFlag()
+	if config.ObjectType == 6 || config.ObjectType == 20 {
+		// layer number
+		reader.readBits(3)
+	}
+	if extension {
+		switch config.ObjectType {
+		case 22:
+			// number of sub frames and layer length
+			reader.readBits(16)
+		case 17, 19, 20, 23:
+			// resilience flags
+			reader.readBits(3)
+		}
+		// extension flag 3
+		reader.readFlag()
+	}
+	return reader.err == nil
+}
+
+func readAudioObjectType(reader *bitReader) int {
+	objectType := int(reader.readBits(5))
+	if objectType == 31 {
+		objectType = 32 + int(reader.readBits(6))
+	}
+	return objectType
+}
+
+func readSamplingFrequency(reader *bitReader) int {
+	index := int(reader.readBits(4))
+	if index == explicitSamplingFrequency {
+		return int(reader.readBits(24))
+	}
+	if index < len(samplingFrequencies) {
+		return samplingFrequencies[index]
+	}
+	return 0
+}
+
+// Profile names the object type with its extensions, such as LC or HE-AAC v2
+func (config *AudioSpecificConfig) Profile() string {
+	switch {
+	case config.PS:
+		return audioObjectTypes[AudioObjectTypePS]
+	case config.SBR:
+		return audioObjectTypes[AudioObjectTypeSBR]
+	}
+	if name, ok := audioObjectTypes[config.ObjectType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown %d", config.ObjectType)
+}
+
+// SampleRate is the rate of the decoded audio, SBR doubles the core rate when its rate is not given
+func (config *AudioSpecificConfig) SampleRate() int {
+	switch {
+	case config.SBR && config.ExtensionSamplingFrequency > 0:
+		return config.ExtensionSamplingFrequency
+	case config.SBR:
+		return 2 * config.SamplingFrequency
+	}
+	return config.SamplingFrequency
+}
+
+// Channels is the number of decoded channels, zero when they are described by a program config element. Parametric
+// stereo decodes a mono core to stereo
+func (config *AudioSpecificConfig) Channels() int {
+	switch {
+	case config.PS && config.ChannelConfiguration == 1:
+		return 2
+	case config.ChannelConfiguration == 7:
+		return 8
+	}
+	return config.ChannelConfiguration
+}
+
+const adtsHeaderSize = 7
+
+// ADTSHeader returns the header preceding a raw frame of the given size in an ADTS stream, ISO/IEC 14496-3 1.A.2.
+// The explicit sampling frequencies, the object types above LTP and the program config elements can't be signaled.
+func (config *AudioSpecificConfig) ADTSHeader(frameSize int) ([]byte, error) {
+	index := slices.Index(samplingFrequencies, config.SamplingFrequency)
+	if index < 0 || config.ObjectType > 4 || config.ChannelConfiguration == 0 {
+		return nil, fmt.Errorf("%w: object type %d at %d Hz can't be sent in adts", ErrUnsupported, config.ObjectType, config.SamplingFrequency)
+	}
+	length := adtsHeaderSize + frameSize
+	if length >= 1<<13 {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrUnsupported, frameSize)
+	}
+	profile := byte(config.ObjectType - 1)
+	channels := byte(config.ChannelConfiguration)
+	return []byte{
+		0xFF,
+		// mpeg-4 without crc
+		0xF1,
+		profile<<6 | byte(index)<<2 | channels>>2,
+		channels&0x03<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&0x07)<<5 | 0x1F,
+		// buffer fullness of a variable bitrate and one raw data block
+		0xFC,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package codec_test
+
+import (
+	"rtmp/codec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	// AAC LC at 44.1 kHz in stereo
+	config, err := codec.ParseAudioSpecificConfig([]byte{0x12, 0x10})
+	assert.NoError(t, err)
+	assert.Equal(t, &codec.AudioSpecificConfig{ObjectType: 2, SamplingFrequency: 44100, ChannelConfiguration: 2}, config)
+	assert.Equal(t, "LC", config.Profile())
+	assert.Equal(t, 44100, config.SampleRate())
+	assert.Equal(t, 2, config.Channels())
+}
+
+func TestParseExplicitHEAACv2Config(t *testing.T) {
+	writer := &bitWriter{}
+	// parametric stereo over a 24 kHz mono AAC LC core, 48 kHz output
+	writer.write(29, 5).write(6, 4).write(1, 4).write(3, 4).write(2, 5).write(0, 3)
+	config, err := codec.ParseAudioSpecificConfig(writer.data)
+	assert.NoError(t, err)
+	assert.Equal(t, &codec.AudioSpecificConfig{
+		ObjectType:                 2,
+		SamplingFrequency:          24000,
+		ChannelConfiguration:       1,
+		SBR:                        true,
+		PS:                         true,
+		ExtensionSamplingFrequency: 48000,
+	}, config)
+	assert.Equal(t, "HE-AAC v2", config.Profile())
+	assert.Equal(t, 48000, config.SampleRate())
+	assert.Equal(t, 2, config.Channels())
+}
+
+func TestParseImplicitHEAACConfig(t *testing.T) {
+	writer := &bitWriter{}
+	// an explicit 22050 Hz core in 5.1 with the backward compatible sbr extension
+	writer.write(2, 5).write(15, 4).write(22050, 24).write(6, 4).write(0, 3)
+	writer.write(0x2B7, 11).write(5, 5).write(1, 1).write(3, 4).write(0, 4)
+	config, err := codec.ParseAudioSpecificConfig(writer.data)
+	assert.NoError(t, err)
+	assert.Equal(t, "HE-AAC", config.Profile())
+	assert.Equal(t, 22050, config.SamplingFrequency)
+	assert.Equal(t, 48000, config.SampleRate())
+	assert.Equal(t, 6, config.Channels())
+	assert.False(t, config.PS)
+}
+
+func TestParseInvalidAudioSpecificConfig(t *testing.T) {
+	_, err := codec.ParseAudioSpecificConfig([]byte{0x12})
+	assert.ErrorIs(t, err, codec.ErrTruncated)
+	// reserved sampling frequency index
+	_, err = codec.ParseAudioSpecificConfig([]byte{0x16, 0x90})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+	// reserved channel configuration
+	_, err = codec.ParseAudioSpecificConfig([]byte{0x12, 0x40})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+}
+
+func TestParseOpusHead(t *testing.T) {
+	data := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0}
+	head, err := codec.ParseOpusHead(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &codec.OpusHead{Version: 1, Channels: 2, PreSkip: 312, InputSampleRate: 48000}, head)
+
+	_, err = codec.ParseOpusHead(data[:18])
+	assert.ErrorIs(t, err, codec.ErrTruncated)
+	_, err = codec.ParseOpusHead(append([]byte("OpusTags"), data[8:]...))
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+}
+
+func TestADTSHeader(t *testing.T) {
+	config, err := codec.ParseAudioSpecificConfig([]byte{0x12, 0x10})
+	assert.NoError(t, err)
+	header, err := config.ADTSHeader(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x3F, 0xFC}, header)
+
+	// an explicit sampling frequency
+	config.SamplingFrequency = 44000
+	_, err = config.ADTSHeader(2)
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+}
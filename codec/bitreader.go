@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"errors"
+)
+
+var ErrTruncated = errors.New("codec: truncated data")
+
+// bitReader reads the most significant bits first, the first read past the end sets err and the following
+// reads return zero so the parsers check the error once
+type bitReader struct {
+	data     []byte
+	position int
+	err      error
+}
+
+// unescape removes the emulation prevention bytes of a NAL unit, the 3 following two zero bytes
+func unescape(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, value := range nalu {
+		if zeros >= 2 && value == 3 {
+			zeros = 0
+			continue
+		}
+		if value == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, value)
+	}
+	return rbsp
+}
+
+func (reader *bitReader) readBits(count int) uint32 {
+	if reader.err != nil {
+		return 0
+	}
+	if reader.position+count > len(reader.data)*8 {
+		reader.err = ErrTruncated
+		return 0
+	}
+	value := uint32(0)
+	for range count {
+		bit := reader.data[reader.position/8] >> (7 - reader.position%8) & 1
+		value = value<<1 | uint32(bit)
+		reader.position++
+	}
+	return value
+}
+
+func (reader *bitReader) readFlag() bool {
+	return reader.readBits(1) == 1
+}
+
+func (reader *bitReader) skipBits(count int) {
+	for count > 0 {
+		skipped := min(count, 32)
+		reader.readBits(skipped)
+		count -= skipped
+	}
+}
+
+// readUE reads an unsigned exp-Golomb code
+func (reader *bitReader) readUE() uint32 {
+	zeros := 0
+	for !reader.readFlag() {
+		if reader.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			reader.err = ErrTruncated
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + reader.readBits(zeros)
+}
+
+// readSE reads a signed exp-Golomb code
+func (reader *bitReader) readSE() int32 {
+	value := reader.readUE()
+	if value&1 == 1 {
+		return int32((value + 1) / 2)
+	}
+	return -int32(value / 2)
+}
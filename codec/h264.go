@@ -0,0 +1,186 @@
+package codec
+
+import (
+	"fmt"
+)
+
+const h264NALUTypeSPS = 7
+
+var h264Profiles = map[uint32]string{
+	44:  "CAVLC 4:4:4 Intra",
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4 Predictive",
+	118: "Multiview High",
+	128: "Stereo High",
+}
+
+// ParseH264SPS parses an H.264 sequence parameter set NAL unit, defined by ITU-T H.264 7.3.2.1
+func ParseH264SPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 {
+		return nil, ErrTruncated
+	}
+	if nalu[0]&0x1F != h264NALUTypeSPS {
+		return nil, fmt.Errorf("%w: nal unit type %d", ErrUnsupported, nalu[0]&0x1F)
+	}
+	reader := &bitReader{data: unescape(nalu[1:])}
+	profileIdc := reader.readBits(8)
+	constraints := reader.readBits(8)
+	levelIdc := reader.readBits(8)
+	reader.readUE()
+	sps := &SPS{
+		Profile:   h264ProfileName(profileIdc, constraints),
+		Level:     h264LevelName(profileIdc, levelIdc, constraints),
+		BitDepth:  8,
+		SARWidth:  1,
+		SARHeight: 1,
+	}
+	chromaFormatIdc := uint32(1)
+	separateColourPlanes := false
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = reader.readUE()
+		if chromaFormatIdc == 3 {
+			separateColourPlanes = reader.readFlag()
+		}
+		sps.BitDepth = int(reader.readUE()) + 8
+		// bit depth chroma
+		reader.readUE()
+		// qpprime y zero transform bypass
+		reader.readFlag()
+		if reader.readFlag() {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for list := range lists {
+				if !reader.readFlag() {
+					continue
+				}
+				size := 16
+				if list >= 6 {
+					size = 64
+				}
+				skipH264ScalingList(reader, size)
+			}
+		}
+	}
+	sps.ChromaFormat = chromaFormat(chromaFormatIdc)
+	// log2 max frame num
+	reader.readUE()
+	switch reader.readUE() {
+	case 0:
+		// log2 max pic order cnt lsb
+		reader.readUE()
+	case 1:
+		// delta pic order always zero, offsets for non ref pic and top to bottom field
+		reader.readFlag()
+		reader.readSE()
+		reader.readSE()
+		cycle := reader.readUE()
+		for range min(cycle, 255) {
+			reader.readSE()
+		}
+	}
+	// max num ref frames and gaps in frame num allowed
+	reader.readUE()
+	reader.readFlag()
+	widthInMbs := int(reader.readUE()) + 1
+	heightInMapUnits := int(reader.readUE()) + 1
+	frameMbsOnly := reader.readFlag()
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	} else {
+		// mb adaptive frame field
+		reader.readFlag()
+	}
+	// direct 8x8 inference
+	reader.readFlag()
+	sps.Width = widthInMbs * 16
+	sps.Height = heightInMapUnits * 16 * fieldFactor
+	if reader.readFlag() {
+		cropUnitX, cropUnitY := chromaSubsampling(chromaFormatIdc, separateColourPlanes)
+		cropUnitY *= fieldFactor
+		left, right := int(reader.readUE()), int(reader.readUE())
+		top, bottom := int(reader.readUE()), int(reader.readUE())
+		sps.Width -= cropUnitX * (left + right)
+		sps.Height -= cropUnitY * (top + bottom)
+	}
+	if reader.readFlag() {
+		readH264VUI(reader, sps)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if sps.Width <= 0 || sps.Height <= 0 {
+		return nil, fmt.Errorf("%w: invalid cropping", ErrUnsupported)
+	}
+	return sps, nil
+}
+
+func readH264VUI(reader *bitReader, sps *SPS) {
+	if reader.readFlag() {
+		readSAR(reader, sps)
+	}
+	if reader.readFlag() {
+		// overscan appropriate
+		reader.readFlag()
+	}
+	if reader.readFlag() {
+		// video format and full range
+		reader.readBits(4)
+		if reader.readFlag() {
+			// colour primaries, transfer characteristics and matrix coefficients
+			reader.readBits(24)
+		}
+	}
+	if reader.readFlag() {
+		// chroma sample locations
+		reader.readUE()
+		reader.readUE()
+	}
+	if reader.readFlag() {
+		unitsInTick := reader.readBits(32)
+		timeScale := reader.readBits(32)
+		if unitsInTick > 0 && reader.err == nil {
+			// a frame lasts two ticks, one per field
+			sps.FrameRate = float64(timeScale) / float64(2*unitsInTick)
+		}
+	}
+}
+
+func skipH264ScalingList(reader *bitReader, size int) {
+	lastScale, nextScale := int32(8), int32(8)
+	for range size {
+		if nextScale != 0 {
+			nextScale = (lastScale + reader.readSE() + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
+
+func h264ProfileName(profileIdc uint32, constraints uint32) string {
+	if profileIdc == 66 && constraints&0x40 != 0 {
+		return "Constrained Baseline"
+	}
+	if name, ok := h264Profiles[profileIdc]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown %d", profileIdc)
+}
+
+func h264LevelName(profileIdc uint32, levelIdc uint32, constraints uint32) string {
+	// level 1b is signaled with the constraint set 3 flag below the high profiles
+	lowProfile := profileIdc == 66 || profileIdc == 77 || profileIdc == 88
+	if levelIdc == 9 || (lowProfile && levelIdc == 11 && constraints&0x10 != 0) {
+		return "1b"
+	}
+	return fmt.Sprintf("%d.%d", levelIdc/10, levelIdc%10)
+}
@@ -0,0 +1,141 @@
+package codec_test
+
+import (
+	"math/bits"
+	"rtmp/codec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bitWriter writes the fields of the test parameter sets
+type bitWriter struct {
+	data  []byte
+	count int
+}
+
+func (writer *bitWriter) write(value uint32, count int) *bitWriter {
+	for bit := count - 1; bit >= 0; bit-- {
+		if writer.count%8 == 0 {
+			writer.data = append(writer.data, 0)
+		}
+		writer.data[len(writer.data)-1] |= byte(value>>bit&1) << (7 - writer.count%8)
+		writer.count++
+	}
+	return writer
+}
+
+func (writer *bitWriter) ue(value uint32) *bitWriter {
+	length := bits.Len32(value + 1)
+	return writer.write(0, length-1).write(value+1, length)
+}
+
+func (writer *bitWriter) se(value int32) *bitWriter {
+	if value > 0 {
+		return writer.ue(uint32(2*value - 1))
+	}
+	return writer.ue(uint32(-2 * value))
+}
+
+// nalu ends the payload with the stop bit and inserts the emulation prevention bytes
+func (writer *bitWriter) nalu(header ...byte) []byte {
+	writer.write(1, 1)
+	nalu := append([]byte{}, header...)
+	zeros := 0
+	for _, value := range writer.data {
+		if zeros >= 2 && value <= 3 {
+			nalu = append(nalu, 3)
+			zeros = 0
+		}
+		nalu = append(nalu, value)
+		if value == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nalu
+}
+
+func TestParseH264SPS(t *testing.T) {
+	sps, err := codec.ParseH264SPS([]byte{0x67, 0x42, 0x00, 0x0A, 0xF8, 0x41, 0xA2})
+	assert.NoError(t, err)
+	assert.Equal(t, &codec.SPS{
+		Profile:      "Baseline",
+		Level:        "1.0",
+		ChromaFormat: "4:2:0",
+		BitDepth:     8,
+		Width:        128,
+		Height:       96,
+		SARWidth:     1,
+		SARHeight:    1,
+	}, sps)
+}
+
+func TestParseH264HighProfileSPS(t *testing.T) {
+	writer := &bitWriter{}
+	writer.write(100, 8).write(0, 8).write(40, 8).ue(0)
+	// 4:2:0 8 bits with a flat 4x4 scaling list and a default 8x8 one
+	writer.ue(1).ue(0).ue(0).write(0, 1).write(1, 1)
+	for list := range 8 {
+		switch list {
+		case 0:
+			writer.write(1, 1)
+			for range 16 {
+				writer.se(0)
+			}
+		case 6:
+			writer.write(1, 1).se(-8)
+		default:
+			writer.write(0, 1)
+		}
+	}
+	// pic order count type 1
+	writer.ue(0).ue(1).write(0, 1).se(-2).se(1).ue(2).se(1).se(-1)
+	// 1920x1088 cropped to 1080
+	writer.ue(4).write(0, 1).ue(119).ue(67).write(1, 1).write(1, 1)
+	writer.write(1, 1).ue(0).ue(0).ue(0).ue(4)
+	// vui with the aspect ratio, the colour description and the timing
+	writer.write(1, 1).write(1, 1).write(1, 8).write(0, 1).write(1, 1).write(5, 3).write(0, 1).write(1, 1).write(0x010101, 24)
+	writer.write(0, 1).write(1, 1).write(1001, 32).write(60000, 32).write(1, 1)
+
+	sps, err := codec.ParseH264SPS(writer.nalu(0x67))
+	assert.NoError(t, err)
+	assert.Equal(t, "High", sps.Profile)
+	assert.Equal(t, "4.0", sps.Level)
+	assert.Equal(t, "4:2:0", sps.ChromaFormat)
+	assert.Equal(t, 1920, sps.Width)
+	assert.Equal(t, 1080, sps.Height)
+	assert.Equal(t, 1, sps.SARWidth)
+	assert.Equal(t, 1, sps.SARHeight)
+	assert.InDelta(t, 29.97, sps.FrameRate, 0.001)
+}
+
+func TestParseH264InterlacedSPS(t *testing.T) {
+	writer := &bitWriter{}
+	writer.write(77, 8).write(0, 8).write(30, 8).ue(0)
+	writer.ue(0).ue(0).ue(2).ue(1).write(0, 1)
+	// 720x576 in 18 map units of two fields
+	writer.ue(44).ue(17).write(0, 1).write(1, 1).write(1, 1).write(0, 1)
+	// explicit 16:11 sample aspect ratio
+	writer.write(1, 1).write(1, 1).write(255, 8).write(16, 16).write(11, 16).write(0, 4)
+
+	sps, err := codec.ParseH264SPS(writer.nalu(0x67))
+	assert.NoError(t, err)
+	assert.Equal(t, "Main", sps.Profile)
+	assert.Equal(t, "3.0", sps.Level)
+	assert.Equal(t, 720, sps.Width)
+	assert.Equal(t, 576, sps.Height)
+	assert.Equal(t, 16, sps.SARWidth)
+	assert.Equal(t, 11, sps.SARHeight)
+	assert.Equal(t, float64(0), sps.FrameRate)
+}
+
+func TestParseInvalidH264SPS(t *testing.T) {
+	_, err := codec.ParseH264SPS([]byte{0x67, 0x42, 0x00, 0x0A, 0xF8})
+	assert.ErrorIs(t, err, codec.ErrTruncated)
+	_, err = codec.ParseH264SPS([]byte{0x68, 0xEB, 0xE3, 0xCB})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+	_, err = codec.ParseH264SPS([]byte{0x67})
+	assert.ErrorIs(t, err, codec.ErrTruncated)
+}
@@ -0,0 +1,242 @@
+package codec
+
+import (
+	"fmt"
+)
+
+const hevcNALUTypeSPS = 33
+
+var hevcProfiles = map[uint32]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Format Range Extensions",
+	5: "High Throughput",
+	9: "Screen Content Coding",
+}
+
+// ParseHEVCSPS parses an HEVC sequence parameter set NAL unit, defined by ITU-T H.265 7.3.2.2
+func ParseHEVCSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 3 {
+		return nil, ErrTruncated
+	}
+	if nalu[0]>>1&0x3F != hevcNALUTypeSPS {
+		return nil, fmt.Errorf("%w: nal unit type %d", ErrUnsupported, nalu[0]>>1&0x3F)
+	}
+	reader := &bitReader{data: unescape(nalu[2:])}
+	// video parameter set id
+	reader.readBits(4)
+	maxSubLayersMinus1 := int(reader.readBits(3))
+	// temporal id nesting
+	reader.readFlag()
+	sps := &SPS{SARWidth: 1, SARHeight: 1}
+	readHEVCProfileTierLevel(reader, sps, maxSubLayersMinus1)
+	// seq parameter set id
+	reader.readUE()
+	chromaFormatIdc := reader.readUE()
+	separateColourPlanes := false
+	if chromaFormatIdc == 3 {
+		separateColourPlanes = reader.readFlag()
+	}
+	sps.ChromaFormat = chromaFormat(chromaFormatIdc)
+	sps.Width = int(reader.readUE())
+	sps.Height = int(reader.readUE())
+	if reader.readFlag() {
+		subWidth, subHeight := chromaSubsampling(chromaFormatIdc, separateColourPlanes)
+		left, right := int(reader.readUE()), int(reader.readUE())
+		top, bottom := int(reader.readUE()), int(reader.readUE())
+		sps.Width -= subWidth * (left + right)
+		sps.Height -= subHeight * (top + bottom)
+	}
+	sps.BitDepth = int(reader.readUE()) + 8
+	// bit depth chroma
+	reader.readUE()
+	log2MaxPicOrderCntLsb := int(reader.readUE()) + 4
+	firstSubLayer := maxSubLayersMinus1
+	if reader.readFlag() {
+		firstSubLayer = 0
+	}
+	for range maxSubLayersMinus1 - firstSubLayer + 1 {
+		// max dec pic buffering, num reorder pics and max latency increase
+		reader.readUE()
+		reader.readUE()
+		reader.readUE()
+	}
+	// coding and transform block sizes, transform hierarchy depths
+	for range 6 {
+		reader.readUE()
+	}
+	if reader.readFlag() && reader.readFlag() {
+		skipHEVCScalingListData(reader)
+	}
+	// amp and sample adaptive offset
+	reader.readFlag()
+	reader.readFlag()
+	if reader.readFlag() {
+		// pcm sample bit depths, coding block sizes and loop filter
+		reader.readBits(8)
+		reader.readUE()
+		reader.readUE()
+		reader.readFlag()
+	}
+	shortTermRefPicSets := int(reader.readUE())
+	if shortTermRefPicSets > 64 {
+		return nil, fmt.Errorf("%w: %d short term reference picture sets", ErrUnsupported, shortTermRefPicSets)
+	}
+	deltaPocs := make([]int, shortTermRefPicSets)
+	for index := range shortTermRefPicSets {
+		deltaPocs[index] = readHEVCShortTermRefPicSet(reader, index, deltaPocs)
+		if reader.err != nil {
+			return nil, reader.err
+		}
+	}
+	if reader.readFlag() {
+		longTermRefPics := int(reader.readUE())
+		for range min(longTermRefPics, 32) {
+			reader.readBits(log2MaxPicOrderCntLsb)
+			reader.readFlag()
+		}
+	}
+	// temporal mvp and strong intra smoothing
+	reader.readFlag()
+	reader.readFlag()
+	if reader.readFlag() {
+		readHEVCVUI(reader, sps)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if sps.Width <= 0 || sps.Height <= 0 {
+		return nil, fmt.Errorf("%w: invalid conformance window", ErrUnsupported)
+	}
+	return sps, nil
+}
+
+func readHEVCProfileTierLevel(reader *bitReader, sps *SPS, maxSubLayersMinus1 int) {
+	// profile space
+	reader.readBits(2)
+	highTier := reader.readFlag()
+	profileIdc := reader.readBits(5)
+	// compatibility and constraint flags
+	reader.skipBits(32 + 48)
+	levelIdc := reader.readBits(8)
+	sps.Profile = fmt.Sprintf("unknown %d", profileIdc)
+	if name, ok := hevcProfiles[profileIdc]; ok {
+		sps.Profile = name
+	}
+	sps.Tier = "Main"
+	if highTier {
+		sps.Tier = "High"
+	}
+	// the level is signaled as 30 times its number
+	sps.Level = fmt.Sprintf("%d.%d", levelIdc/30, levelIdc%30/3)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for index := range maxSubLayersMinus1 {
+		profilePresent[index] = reader.readFlag()
+		levelPresent[index] = reader.readFlag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		reader.skipBits(2 * (8 - maxSubLayersMinus1))
+	}
+	for index := range maxSubLayersMinus1 {
+		if profilePresent[index] {
+			reader.skipBits(88)
+		}
+		if levelPresent[index] {
+			reader.skipBits(8)
+		}
+	}
+}
+
+func skipHEVCScalingListData(reader *bitReader) {
+	for sizeId := range 4 {
+		step := 1
+		if sizeId == 3 {
+			step = 3
+		}
+		for matrixId := 0; matrixId < 6; matrixId += step {
+			if !reader.readFlag() {
+				// delta of the reference matrix
+				reader.readUE()
+				continue
+			}
+			coefficients := min(64, 1<<(4+sizeId<<1))
+			if sizeId > 1 {
+				// dc coefficient
+				reader.readSE()
+			}
+			for range coefficients {
+				reader.readSE()
+			}
+		}
+	}
+}
+
+// readHEVCShortTermRefPicSet skips a reference picture set and returns its number of pictures, the sets of the
+// sequence parameter set can be predicted from the previous one
+func readHEVCShortTermRefPicSet(reader *bitReader, index int, deltaPocs []int) int {
+	if index > 0 && reader.readFlag() {
+		// delta rps sign and abs delta rps
+		reader.readFlag()
+		reader.readUE()
+		count := 0
+		for range deltaPocs[index-1] + 1 {
+			used := reader.readFlag()
+			if used || reader.readFlag() {
+				count++
+			}
+		}
+		return count
+	}
+	negative := reader.readUE()
+	positive := reader.readUE()
+	if negative > 16 || positive > 16 {
+		reader.err = fmt.Errorf("%w: too many reference pictures", ErrUnsupported)
+		return 0
+	}
+	for range negative + positive {
+		// delta poc and used by current picture
+		reader.readUE()
+		reader.readFlag()
+	}
+	return int(negative + positive)
+}
+
+func readHEVCVUI(reader *bitReader, sps *SPS) {
+	if reader.readFlag() {
+		readSAR(reader, sps)
+	}
+	if reader.readFlag() {
+		// overscan appropriate
+		reader.readFlag()
+	}
+	if reader.readFlag() {
+		// video format and full range
+		reader.readBits(4)
+		if reader.readFlag() {
+			// colour primaries, transfer characteristics and matrix coefficients
+			reader.readBits(24)
+		}
+	}
+	if reader.readFlag() {
+		// chroma sample locations
+		reader.readUE()
+		reader.readUE()
+	}
+	// neutral chroma, field seq and frame field info
+	reader.readBits(3)
+	if reader.readFlag() {
+		// default display window
+		for range 4 {
+			reader.readUE()
+		}
+	}
+	if reader.readFlag() {
+		unitsInTick := reader.readBits(32)
+		timeScale := reader.readBits(32)
+		if unitsInTick > 0 && reader.err == nil {
+			sps.FrameRate = float64(timeScale) / float64(unitsInTick)
+		}
+	}
+}
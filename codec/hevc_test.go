@@ -0,0 +1,116 @@
+package codec_test
+
+import (
+	"rtmp/codec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeHEVCProfileTierLevel(writer *bitWriter, highTier uint32, profile uint32, level uint32) {
+	writer.write(0, 2).write(highTier, 1).write(profile, 5).write(1<<(31-profile), 32)
+	// progressive and frame only
+	writer.write(0x9, 4).write(0, 32).write(0, 12)
+	writer.write(level, 8)
+}
+
+func TestParseHEVCSPS(t *testing.T) {
+	writer := &bitWriter{}
+	writer.write(0, 4).write(0, 3).write(1, 1)
+	writeHEVCProfileTierLevel(writer, 0, 1, 123)
+	// 4:2:0 1920x1088 with a conformance window to 1080
+	writer.ue(0).ue(1).ue(1920).ue(1088).write(1, 1).ue(0).ue(0).ue(0).ue(4)
+	writer.ue(0).ue(0).ue(4).write(1, 1).ue(4).ue(2).ue(0)
+	writer.ue(0).ue(3).ue(0).ue(3).ue(1).ue(1)
+	// no scaling list, amp, sao and pcm
+	writer.write(0, 1).write(1, 1).write(1, 1).write(0, 1)
+	// an explicit reference picture set and two predicted ones
+	writer.ue(3)
+	writer.ue(2).ue(0).ue(0).write(1, 1).ue(1).write(1, 1)
+	writer.write(1, 1).write(0, 1).ue(0).write(1, 1).write(0, 1).write(1, 1).write(0, 1).write(0, 1)
+	writer.write(1, 1).write(1, 1).ue(1).write(1, 1).write(1, 1).write(1, 1)
+	// a long term reference picture
+	writer.write(1, 1).ue(1).write(5, 8).write(1, 1)
+	writer.write(1, 1).write(1, 1)
+	// vui with the aspect ratio and the timing
+	writer.write(1, 1).write(1, 1).write(1, 8).write(0, 1).write(0, 1).write(0, 1).write(0, 3).write(0, 1)
+	writer.write(1, 1).write(1, 32).write(50, 32).write(0, 1)
+
+	sps, err := codec.ParseHEVCSPS(writer.nalu(0x42, 0x01))
+	assert.NoError(t, err)
+	assert.Equal(t, &codec.SPS{
+		Profile:      "Main",
+		Level:        "4.1",
+		Tier:         "Main",
+		ChromaFormat: "4:2:0",
+		BitDepth:     8,
+		Width:        1920,
+		Height:       1080,
+		SARWidth:     1,
+		SARHeight:    1,
+		FrameRate:    50,
+	}, sps)
+}
+
+func TestParseHEVCRangeExtensionsSPS(t *testing.T) {
+	writer := &bitWriter{}
+	writer.write(0, 4).write(1, 3).write(0, 1)
+	writeHEVCProfileTierLevel(writer, 1, 4, 153)
+	// a sub layer with its profile and level
+	writer.write(1, 1).write(1, 1).write(0, 14).write(0, 32).write(0, 32).write(0, 24).write(150, 8)
+	// 4:2:2 10 bits 3840x2160
+	writer.ue(0).ue(2).ue(3840).ue(2160).write(0, 1).ue(2).ue(2).ue(8).write(0, 1).ue(5).ue(3).ue(0)
+	writer.ue(0).ue(3).ue(0).ue(3).ue(2).ue(2)
+	// a scaling list with an explicit 16x16 matrix
+	writer.write(1, 1).write(1, 1)
+	for sizeId := range 4 {
+		step := 1
+		if sizeId == 3 {
+			step = 3
+		}
+		for matrixId := 0; matrixId < 6; matrixId += step {
+			if sizeId == 2 && matrixId == 0 {
+				writer.write(1, 1).se(8)
+				for range 64 {
+					writer.se(1)
+				}
+				continue
+			}
+			writer.write(0, 1).ue(0)
+		}
+	}
+	// pcm
+	writer.write(0, 1).write(0, 1).write(1, 1).write(0x77, 8).ue(0).ue(1).write(0, 1)
+	writer.ue(1).ue(1).ue(0).ue(0).write(1, 1)
+	writer.write(0, 1).write(1, 1).write(0, 1)
+	// vui with an explicit aspect ratio, a default display window and the timing
+	writer.write(1, 1).write(1, 1).write(255, 8).write(4, 16).write(3, 16).write(1, 1).write(1, 1).write(0, 1).write(0, 1)
+	writer.write(0, 3).write(1, 1).ue(8).ue(8).ue(0).ue(0)
+	writer.write(1, 1).write(1001, 32).write(60000, 32).write(0, 1)
+
+	sps, err := codec.ParseHEVCSPS(writer.nalu(0x42, 0x01))
+	assert.NoError(t, err)
+	assert.Equal(t, "Format Range Extensions", sps.Profile)
+	assert.Equal(t, "5.1", sps.Level)
+	assert.Equal(t, "High", sps.Tier)
+	assert.Equal(t, "4:2:2", sps.ChromaFormat)
+	assert.Equal(t, 10, sps.BitDepth)
+	assert.Equal(t, 3840, sps.Width)
+	assert.Equal(t, 2160, sps.Height)
+	assert.Equal(t, 4, sps.SARWidth)
+	assert.Equal(t, 3, sps.SARHeight)
+	assert.InDelta(t, 59.94, sps.FrameRate, 0.001)
+}
+
+func TestParseInvalidHEVCSPS(t *testing.T) {
+	writer := &bitWriter{}
+	writer.write(0, 4).write(0, 3).write(1, 1)
+	writeHEVCProfileTierLevel(writer, 0, 1, 123)
+	writer.ue(0).ue(1)
+	truncated := writer.nalu(0x42, 0x01)
+	_, err := codec.ParseHEVCSPS(truncated[:len(truncated)-1])
+	assert.ErrorIs(t, err, codec.ErrTruncated)
+	// a video parameter set
+	_, err = codec.ParseHEVCSPS([]byte{0x40, 0x01, 0x0C})
+	assert.ErrorIs(t, err, codec.ErrUnsupported)
+}
@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OpusHead is the identification header of an Opus stream, defined by RFC 7845 5.1
+type OpusHead struct {
+	Version  uint8
+	Channels int
+	// PreSkip is the number of samples at 48 kHz to drop at the start
+	PreSkip int
+	// InputSampleRate is the rate of the encoded audio, the decoders always output 48 kHz
+	InputSampleRate      int
+	OutputGain           int16
+	ChannelMappingFamily uint8
+}
+
+const opusHeadSize = 19
+
+func ParseOpusHead(data []byte) (*OpusHead, error) {
+	if len(data) < opusHeadSize {
+		return nil, ErrTruncated
+	}
+	if string(data[:8]) != "OpusHead" {
+		return nil, fmt.Errorf("%w: missing OpusHead signature", ErrUnsupported)
+	}
+	head := &OpusHead{
+		Version:              data[8],
+		Channels:             int(data[9]),
+		PreSkip:              int(binary.LittleEndian.Uint16(data[10:12])),
+		InputSampleRate:      int(binary.LittleEndian.Uint32(data[12:16])),
+		OutputGain:           int16(binary.LittleEndian.Uint16(data[16:18])),
+		ChannelMappingFamily: data[18],
+	}
+	// the major version is in the 4 upper bits, only version 0 exists
+	if head.Version>>4 != 0 || head.Channels == 0 {
+		return nil, fmt.Errorf("%w: opus version %d with %d channels", ErrUnsupported, head.Version, head.Channels)
+	}
+	return head, nil
+}
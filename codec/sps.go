@@ -0,0 +1,68 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnsupported = errors.New("codec: unsupported parameter set")
+
+// SPS is the description of the video a sequence parameter set carries
+type SPS struct {
+	Profile string
+	Level   string
+	// Tier is Main or High for HEVC and empty for H.264
+	Tier string
+	// ChromaFormat is 4:0:0, 4:2:0, 4:2:2 or 4:4:4
+	ChromaFormat string
+	BitDepth     int
+	// Width and Height are the displayed size, the cropping applied
+	Width  int
+	Height int
+	// SARWidth and SARHeight are the sample aspect ratio, 1:1 when not signaled
+	SARWidth  int
+	SARHeight int
+	// FrameRate comes from the timing information, zero when not signaled
+	FrameRate float64
+}
+
+// sampleAspectRatios are the predefined ratios indexed by aspect_ratio_idc, 255 is explicit
+var sampleAspectRatios = [][2]int{
+	{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+const extendedSAR = 255
+
+var chromaFormats = []string{"4:0:0", "4:2:0", "4:2:2", "4:4:4"}
+
+// readSAR reads the aspect ratio of the vui parameters, shared by H.264 and HEVC
+func readSAR(reader *bitReader, sps *SPS) {
+	aspectRatioIdc := int(reader.readBits(8))
+	switch {
+	case aspectRatioIdc == extendedSAR:
+		sps.SARWidth = int(reader.readBits(16))
+		sps.SARHeight = int(reader.readBits(16))
+	case aspectRatioIdc < len(sampleAspectRatios) && aspectRatioIdc > 0:
+		sps.SARWidth = sampleAspectRatios[aspectRatioIdc][0]
+		sps.SARHeight = sampleAspectRatios[aspectRatioIdc][1]
+	}
+}
+
+// chromaSubsampling returns the horizontal and vertical divisors of the chroma planes
+func chromaSubsampling(chromaFormatIdc uint32, separateColourPlanes bool) (int, int) {
+	switch {
+	case separateColourPlanes || chromaFormatIdc == 3 || chromaFormatIdc == 0:
+		return 1, 1
+	case chromaFormatIdc == 2:
+		return 2, 1
+	}
+	return 2, 2
+}
+
+func chromaFormat(chromaFormatIdc uint32) string {
+	if int(chromaFormatIdc) < len(chromaFormats) {
+		return chromaFormats[chromaFormatIdc]
+	}
+	return fmt.Sprintf("unknown %d", chromaFormatIdc)
+}
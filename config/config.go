@@ -0,0 +1,403 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"rtmp/access"
+	"rtmp/cluster"
+	"rtmp/hls"
+	"rtmp/record"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/webhook"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Config is the configuration of the rtmp command read from a yaml or toml file, the settings missing keep the
+// defaults of the packages they configure
+type Config struct {
+	// Listeners are the addresses the rtmp clients connect to, DefaultListener when empty and no socket is passed
+	// by systemd. They are not reloaded
+	Listeners []Listener `yaml:"listeners" toml:"listeners"`
+	// HTTP serves hls and http-flv to the viewers
+	HTTP HTTP `yaml:"http" toml:"http"`
+	// Admin serves the admin api, the push and pull relays and the metrics, it is not authenticated and listens
+	// on the loopback by default
+	Admin  HTTP   `yaml:"admin" toml:"admin"`
+	Server Server `yaml:"server" toml:"server"`
+	// Applications are the settings of each application, access.AnyApp holds the access rules of the
+	// applications missing
+	Applications map[string]Application `yaml:"applications" toml:"applications"`
+	Auth         Auth                   `yaml:"auth" toml:"auth"`
+	Recording    Recording              `yaml:"recording" toml:"recording"`
+	HLS          HLS                    `yaml:"hls" toml:"hls"`
+	Relay        Relay                  `yaml:"relay" toml:"relay"`
+	Cluster      Cluster                `yaml:"cluster" toml:"cluster"`
+	Limits       Limits                 `yaml:"limits" toml:"limits"`
+	Log          Log                    `yaml:"log" toml:"log"`
+}
+
+type Listener struct {
+	// Network is tcp, tls, unix or rtmpt, tcp when empty
+	Network string `yaml:"network" toml:"network"`
+	// Address is host:port, or the path of the socket of the unix listeners
+	Address string `yaml:"address" toml:"address"`
+	// TLSCert and TLSKey are the pem files of the certificate of the tls listeners, the rtmpt listeners serve
+	// https with them
+	TLSCert       string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey        string `yaml:"tls_key" toml:"tls_key"`
+	ProxyProtocol bool   `yaml:"proxy_protocol" toml:"proxy_protocol"`
+}
+
+type HTTP struct {
+	// Address is host:port, empty disables the http server
+	Address string `yaml:"address" toml:"address"`
+}
+
+// Server holds the protocol settings, zero keeps the default of the server
+type Server struct {
+	ChunkSize       uint32   `yaml:"chunk_size" toml:"chunk_size"`
+	Timeout         Duration `yaml:"timeout" toml:"timeout"`
+	WindowSize      uint32   `yaml:"window_size" toml:"window_size"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	PingInterval    Duration `yaml:"ping_interval" toml:"ping_interval"`
+	PlaybackBurst   Duration `yaml:"playback_burst" toml:"playback_burst"`
+}
+
+type Application struct {
+	Access Access `yaml:"access" toml:"access"`
+	// Push lists the servers the streams of the application are published to
+	Push []Push `yaml:"push" toml:"push"`
+	// Pull is the origin application the unknown streams are pulled from, rtmp://host[:port]/app
+	Pull string `yaml:"pull" toml:"pull"`
+}
+
+// Access holds the rules of each action, "allow" or "deny" followed by a network, an address or "all"
+type Access struct {
+	Connect []string `yaml:"connect" toml:"connect"`
+	Publish []string `yaml:"publish" toml:"publish"`
+	Play    []string `yaml:"play" toml:"play"`
+}
+
+type Push struct {
+	URL  string `yaml:"url" toml:"url"`
+	Name string `yaml:"name" toml:"name"`
+}
+
+// Auth holds the webhooks, a non 2xx answer to on_connect is ignored while one to on_publish or on_play rejects
+// the client
+type Auth struct {
+	OnConnect     string   `yaml:"on_connect" toml:"on_connect"`
+	OnPublish     string   `yaml:"on_publish" toml:"on_publish"`
+	OnPublishDone string   `yaml:"on_publish_done" toml:"on_publish_done"`
+	OnPlay        string   `yaml:"on_play" toml:"on_play"`
+	OnPlayDone    string   `yaml:"on_play_done" toml:"on_play_done"`
+	OnRecordDone  string   `yaml:"on_record_done" toml:"on_record_done"`
+	Timeout       Duration `yaml:"timeout" toml:"timeout"`
+}
+
+type Recording struct {
+	// Directory stores the recordings, the recorded streams are played from it too
+	Directory         string   `yaml:"directory" toml:"directory"`
+	Apps              []string `yaml:"apps" toml:"apps"`
+	Append            bool     `yaml:"append" toml:"append"`
+	Template          string   `yaml:"template" toml:"template"`
+	AppendTemplate    string   `yaml:"append_template" toml:"append_template"`
+	MaxDuration       Duration `yaml:"max_duration" toml:"max_duration"`
+	MaxSize           int64    `yaml:"max_size" toml:"max_size"`
+	KeyframeIndexSize int      `yaml:"keyframe_index_size" toml:"keyframe_index_size"`
+}
+
+type HLS struct {
+	Directory      string   `yaml:"directory" toml:"directory"`
+	Apps           []string `yaml:"apps" toml:"apps"`
+	TargetDuration Duration `yaml:"target_duration" toml:"target_duration"`
+	PlaylistSize   int      `yaml:"playlist_size" toml:"playlist_size"`
+	Event          bool     `yaml:"event" toml:"event"`
+	Retention      Duration `yaml:"retention" toml:"retention"`
+	Format         string   `yaml:"format" toml:"format"`
+	PartDuration   Duration `yaml:"part_duration" toml:"part_duration"`
+}
+
+type Relay struct {
+	Push PushRelay `yaml:"push" toml:"push"`
+	Pull PullRelay `yaml:"pull" toml:"pull"`
+}
+
+type PushRelay struct {
+	ReconnectDelay    Duration `yaml:"reconnect_delay" toml:"reconnect_delay"`
+	MaxReconnectDelay Duration `yaml:"max_reconnect_delay" toml:"max_reconnect_delay"`
+	Timeout           Duration `yaml:"timeout" toml:"timeout"`
+}
+
+type PullRelay struct {
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// Cluster makes the server a node of a cluster once it has a name
+type Cluster struct {
+	Name string `yaml:"name" toml:"name"`
+	// Address is host:port of the http server receiving the announcements of the peers, apart from the admin api
+	Address          string   `yaml:"address" toml:"address"`
+	URL              string   `yaml:"url" toml:"url"`
+	Peers            []string `yaml:"peers" toml:"peers"`
+	AnnounceInterval Duration `yaml:"announce_interval" toml:"announce_interval"`
+	Redirect         bool     `yaml:"redirect" toml:"redirect"`
+	Secret           string   `yaml:"secret" toml:"secret"`
+}
+
+// Limits bounds the connections and streams, zero is unlimited
+type Limits struct {
+	MaxConnections      int `yaml:"max_connections" toml:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip" toml:"max_connections_per_ip"`
+	MaxHandshakes       int `yaml:"max_handshakes" toml:"max_handshakes"`
+	MaxPublishersPerApp int `yaml:"max_publishers_per_app" toml:"max_publishers_per_app"`
+	MaxPlayersPerApp    int `yaml:"max_players_per_app" toml:"max_players_per_app"`
+	MaxPlayersPerStream int `yaml:"max_players_per_stream" toml:"max_players_per_stream"`
+}
+
+type Log struct {
+	// Level is debug, info, warn or error, info when empty
+	Level string `yaml:"level" toml:"level"`
+	// Format is console or json
+	Format string `yaml:"format" toml:"format"`
+}
+
+// Duration is a duration written as "10s" or "1m30s"
+type Duration time.Duration
+
+func (duration *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+func (duration Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(duration).String()), nil
+}
+
+// DefaultListener is the listener of the configs without any
+var DefaultListener = Listener{Network: server.NetworkTCP, Address: "127.0.0.1:9999"}
+
+// Default is the configuration used without file, it serves http on 127.0.0.1:8080 and the admin api on
+// 127.0.0.1:8090
+func Default() *Config {
+	return &Config{
+		HTTP:      HTTP{Address: "127.0.0.1:8080"},
+		Admin:     HTTP{Address: "127.0.0.1:8090"},
+		Recording: Recording{Directory: "recordings"},
+	}
+}
+
+// Load reads a .yaml, .yml or .toml file over the defaults and validates it, the unknown settings are errors
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := Default()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = decodeYAML(data, config)
+	case ".toml":
+		err = decodeTOML(data, config)
+	default:
+		return nil, fmt.Errorf("%w: %s is neither .yaml, .yml nor .toml", ErrInvalidConfig, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, path, err)
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func decodeYAML(data []byte, config *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(config)
+	// an empty file keeps the defaults
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func decodeTOML(data []byte, config *Config) error {
+	metadata, err := toml.Decode(string(data), config)
+	if err != nil {
+		return err
+	}
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("unknown settings %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// ListenerConfig is the config of the listener with its certificate loaded
+func (listener Listener) ListenerConfig() (server.ListenerConfig, error) {
+	listenerConfig := server.ListenerConfig{
+		Network:       listener.Network,
+		Address:       listener.Address,
+		ProxyProtocol: listener.ProxyProtocol,
+	}
+	if listener.TLSCert != "" {
+		certificate, err := tls.LoadX509KeyPair(listener.TLSCert, listener.TLSKey)
+		if err != nil {
+			return server.ListenerConfig{}, err
+		}
+		listenerConfig.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	return listenerConfig, nil
+}
+
+// Configure applies the protocol settings and the limits to a server
+func (config *Config) Configure(rtmpServer *server.Server) {
+	if config.Server.ChunkSize > 0 {
+		rtmpServer.DefaultMaxChunkSize = config.Server.ChunkSize
+	}
+	if config.Server.Timeout > 0 {
+		rtmpServer.DefaultNetworkTimeout = time.Duration(config.Server.Timeout)
+	}
+	if config.Server.WindowSize > 0 {
+		rtmpServer.DefaultWindowAcknowledgementSize = config.Server.WindowSize
+	}
+	if config.Server.ShutdownTimeout > 0 {
+		rtmpServer.ShutdownTimeout = time.Duration(config.Server.ShutdownTimeout)
+	}
+	if config.Server.PingInterval > 0 {
+		rtmpServer.PingInterval = time.Duration(config.Server.PingInterval)
+	}
+	if config.Server.PlaybackBurst > 0 {
+		rtmpServer.PlaybackBurst = time.Duration(config.Server.PlaybackBurst)
+	}
+	rtmpServer.Limits = config.ServerLimits()
+}
+
+func (config *Config) ServerLimits() server.Limits {
+	return server.Limits(config.Limits)
+}
+
+func (config *Config) AccessConfig() access.Config {
+	accessConfig := access.Config{Apps: make(map[string]access.Rules, len(config.Applications))}
+	for app, application := range config.Applications {
+		accessConfig.Apps[app] = access.Rules(application.Access)
+	}
+	return accessConfig
+}
+
+func (config *Config) WebhookConfig() webhook.Config {
+	return webhook.Config{
+		OnConnect:     config.Auth.OnConnect,
+		OnPublish:     config.Auth.OnPublish,
+		OnPublishDone: config.Auth.OnPublishDone,
+		OnPlay:        config.Auth.OnPlay,
+		OnPlayDone:    config.Auth.OnPlayDone,
+		OnRecordDone:  config.Auth.OnRecordDone,
+		Timeout:       time.Duration(config.Auth.Timeout),
+	}
+}
+
+func (config *Config) RecordConfig() record.Config {
+	return record.Config{
+		Directory:         config.Recording.Directory,
+		Apps:              config.Recording.Apps,
+		Append:            config.Recording.Append,
+		Template:          config.Recording.Template,
+		AppendTemplate:    config.Recording.AppendTemplate,
+		MaxDuration:       time.Duration(config.Recording.MaxDuration),
+		MaxSize:           config.Recording.MaxSize,
+		KeyframeIndexSize: config.Recording.KeyframeIndexSize,
+	}
+}
+
+func (config *Config) HLSConfig() hls.Config {
+	return hls.Config{
+		Directory:      config.HLS.Directory,
+		Apps:           config.HLS.Apps,
+		TargetDuration: time.Duration(config.HLS.TargetDuration),
+		PlaylistSize:   config.HLS.PlaylistSize,
+		Event:          config.HLS.Event,
+		Retention:      time.Duration(config.HLS.Retention),
+		Format:         config.HLS.Format,
+		PartDuration:   time.Duration(config.HLS.PartDuration),
+	}
+}
+
+// PushTargets are the push targets by application
+func (config *Config) PushTargets() map[string][]relay.Target {
+	targets := make(map[string][]relay.Target)
+	for app, application := range config.Applications {
+		for _, push := range application.Push {
+			targets[app] = append(targets[app], relay.Target(push))
+		}
+	}
+	return targets
+}
+
+func (config *Config) PushConfig() relay.Config {
+	return relay.Config{
+		Targets:           config.PushTargets(),
+		ReconnectDelay:    time.Duration(config.Relay.Push.ReconnectDelay),
+		MaxReconnectDelay: time.Duration(config.Relay.Push.MaxReconnectDelay),
+		Timeout:           time.Duration(config.Relay.Push.Timeout),
+	}
+}
+
+// PullOrigins are the pull origins by application
+func (config *Config) PullOrigins() map[string]string {
+	origins := make(map[string]string)
+	for app, application := range config.Applications {
+		if application.Pull != "" {
+			origins[app] = application.Pull
+		}
+	}
+	return origins
+}
+
+func (config *Config) PullConfig() relay.PullConfig {
+	return relay.PullConfig{
+		Origins:     config.PullOrigins(),
+		IdleTimeout: time.Duration(config.Relay.Pull.IdleTimeout),
+		Timeout:     time.Duration(config.Relay.Pull.Timeout),
+	}
+}
+
+// ClusterConfig is the config of the cluster node, false when the server is not part of a cluster
+func (config *Config) ClusterConfig() (cluster.Config, bool) {
+	if config.Cluster.Name == "" {
+		return cluster.Config{}, false
+	}
+	return cluster.Config{
+		Name:             config.Cluster.Name,
+		URL:              config.Cluster.URL,
+		Peers:            config.Cluster.Peers,
+		AnnounceInterval: time.Duration(config.Cluster.AnnounceInterval),
+		Redirect:         config.Cluster.Redirect,
+		Secret:           config.Cluster.Secret,
+		Pull:             config.PullConfig(),
+	}, true
+}
@@ -0,0 +1,153 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"rtmp/config"
+	"rtmp/relay"
+	"rtmp/server"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o644)
+	assert.Nil(t, err)
+	return path
+}
+
+func TestLoadExamples(t *testing.T) {
+	yamlConfig, err := config.Load("../rtmp.example.yaml")
+	assert.Nil(t, err)
+	tomlConfig, err := config.Load("../rtmp.example.toml")
+	assert.Nil(t, err)
+	assert.Equal(t, yamlConfig, tomlConfig)
+
+	assert.Len(t, yamlConfig.Listeners, 4)
+	assert.Equal(t, server.NetworkUnix, yamlConfig.Listeners[3].Network)
+	assert.True(t, yamlConfig.Listeners[3].ProxyProtocol)
+	assert.Equal(t, config.Duration(10*time.Second), yamlConfig.Server.Timeout)
+	assert.Equal(t, uint32(2500000), yamlConfig.Server.WindowSize)
+	assert.Equal(t, "127.0.0.1:8090", yamlConfig.Admin.Address)
+	assert.Equal(t, map[string][]relay.Target{"live": {{URL: "rtmp://backup.example.com/live", Name: "{stream}"}}}, yamlConfig.PushTargets())
+	assert.Equal(t, map[string]string{"mirror": "rtmp://origin.example.com/live"}, yamlConfig.PullOrigins())
+	assert.Equal(t, []string{"allow 127.0.0.1", "deny all"}, yamlConfig.AccessConfig().Apps["*"].Publish)
+	assert.Equal(t, time.Hour, yamlConfig.RecordConfig().MaxDuration)
+	assert.Equal(t, 500*time.Millisecond, yamlConfig.HLSConfig().PartDuration)
+	assert.Equal(t, 20, yamlConfig.ServerLimits().MaxConnectionsPerIP)
+	_, ok := yamlConfig.ClusterConfig()
+	assert.False(t, ok)
+}
+
+func TestLoadCluster(t *testing.T) {
+	loaded, err := config.Load(writeTestConfig(t, "cluster.yaml", `
+cluster:
+  name: edge-1
+  address: 0.0.0.0:8091
+  url: rtmp://edge-1.example.com:1935
+  peers: [http://edge-2.example.com:8091]
+  secret: testSecret
+relay:
+  pull:
+    idle_timeout: 30s
+`))
+	assert.Nil(t, err)
+	clusterConfig, ok := loaded.ClusterConfig()
+	assert.True(t, ok)
+	assert.Equal(t, "edge-1", clusterConfig.Name)
+	assert.Equal(t, []string{"http://edge-2.example.com:8091"}, clusterConfig.Peers)
+	assert.Equal(t, "0.0.0.0:8091", loaded.Cluster.Address)
+	assert.Equal(t, "testSecret", clusterConfig.Secret)
+	assert.Equal(t, 30*time.Second, clusterConfig.Pull.IdleTimeout)
+
+	_, err = config.Load(writeTestConfig(t, "origin.yaml", `
+applications:
+  live:
+    pull: rtmp://origin.example.com/live
+cluster:
+  name: edge-1
+  url: rtmp://edge-1.example.com:1935
+`))
+	assert.ErrorContains(t, err, "applications.live.pull")
+}
+
+func TestLoadKeepsDefaults(t *testing.T) {
+	loaded, err := config.Load(writeTestConfig(t, "empty.yaml", ""))
+	assert.Nil(t, err)
+	assert.Equal(t, config.Default(), loaded)
+
+	loaded, err = config.Load(writeTestConfig(t, "limits.toml", "[limits]\nmax_connections = 10\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, config.Default().Listeners, loaded.Listeners)
+	assert.Equal(t, 10, loaded.Limits.MaxConnections)
+	_, ok := loaded.ClusterConfig()
+	assert.False(t, ok)
+
+	testServer := server.NewServer()
+	loaded.Configure(testServer)
+	assert.Equal(t, uint32(128), testServer.DefaultMaxChunkSize)
+	assert.Equal(t, 10, testServer.Limits.MaxConnections)
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	_, err := config.Load(writeTestConfig(t, "typo.yaml", "server:\n  chunk_sise: 4096\n"))
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+	assert.ErrorContains(t, err, "chunk_sise")
+	_, err = config.Load(writeTestConfig(t, "typo.toml", "[server]\nchunk_sise = 4096\n"))
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+	assert.ErrorContains(t, err, "server.chunk_sise")
+	_, err = config.Load(writeTestConfig(t, "duration.yaml", "server:\n  timeout: 10\n"))
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+	_, err = config.Load(writeTestConfig(t, "rtmp.json", "{}"))
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+	_, err = config.Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestValidateReportsEverySetting(t *testing.T) {
+	_, err := config.Load(writeTestConfig(t, "invalid.yaml", `
+listeners:
+  - network: udp
+    address: 0.0.0.0:1935
+  - network: tls
+    address: 0.0.0.0:1936
+admin:
+  address: 127.0.0.1:8080
+applications:
+  live:
+    access:
+      publish: ["allow everyone"]
+    push:
+      - url: http://example.com/live
+auth:
+  on_publish: example.com/on_publish
+hls:
+  part_duration: 500ms
+cluster:
+  peers: [http://edge-2.example.com:8080]
+limits:
+  max_connections: -1
+log:
+  level: verbose
+`))
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+	for _, field := range []string{
+		"listeners[0].network",
+		"listeners[1].tls_cert",
+		"admin.address",
+		"applications.live.access",
+		"applications.live.push[0].url",
+		"auth.on_publish",
+		"hls.part_duration",
+		"cluster.name",
+		"limits.max_connections",
+		"log.level",
+	} {
+		assert.ErrorContains(t, err, field)
+	}
+	assert.Nil(t, config.Default().Validate())
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"rtmp/access"
+	"rtmp/client"
+	"rtmp/hls"
+	"rtmp/logger"
+	"rtmp/server"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// maxChunkSize is the largest chunk size, the length of a message
+const maxChunkSize = 0xFFFFFF
+
+// validator gathers every problem of a config so they are all reported at once
+type validator struct {
+	errs []error
+}
+
+func (validator *validator) check(ok bool, field string, format string, args ...any) {
+	if !ok {
+		validator.errs = append(validator.errs, fmt.Errorf("%w: %s: %s", ErrInvalidConfig, field, fmt.Sprintf(format, args...)))
+	}
+}
+
+func (validator *validator) checkDuration(duration Duration, field string) {
+	validator.check(duration >= 0, field, "negative duration %s", time.Duration(duration))
+}
+
+func (validator *validator) checkCount(count int, field string) {
+	validator.check(count >= 0, field, "negative value %d", count)
+}
+
+// checkURL checks a url of the given schemes with a host
+func (validator *validator) checkURL(rawURL string, field string, schemes ...string) {
+	parsed, err := url.Parse(rawURL)
+	validator.check(err == nil && slices.Contains(schemes, parsed.Scheme) && parsed.Host != "", field,
+		"%q is not a %s url", rawURL, schemes[0])
+}
+
+// Validate reports every invalid setting, each error wraps ErrInvalidConfig and names the setting
+func (config *Config) Validate() error {
+	validator := &validator{}
+	config.validateListeners(validator)
+	validator.check(config.Server.ChunkSize <= maxChunkSize, "server.chunk_size", "%d is above %d", config.Server.ChunkSize, maxChunkSize)
+	validator.checkDuration(config.Server.Timeout, "server.timeout")
+	validator.checkDuration(config.Server.ShutdownTimeout, "server.shutdown_timeout")
+	validator.checkDuration(config.Server.PingInterval, "server.ping_interval")
+	validator.checkDuration(config.Server.PlaybackBurst, "server.playback_burst")
+	validator.check(config.Admin.Address == "" || config.Admin.Address != config.HTTP.Address, "admin.address",
+		"the admin api does not share the address of the http server")
+	config.validateApplications(validator)
+	for _, webhook := range []struct{ field, url string }{
+		{"auth.on_connect", config.Auth.OnConnect},
+		{"auth.on_publish", config.Auth.OnPublish},
+		{"auth.on_publish_done", config.Auth.OnPublishDone},
+		{"auth.on_play", config.Auth.OnPlay},
+		{"auth.on_play_done", config.Auth.OnPlayDone},
+		{"auth.on_record_done", config.Auth.OnRecordDone},
+	} {
+		if webhook.url != "" {
+			validator.checkURL(webhook.url, webhook.field, "http", "https")
+		}
+	}
+	validator.checkDuration(config.Auth.Timeout, "auth.timeout")
+	validator.checkDuration(config.Recording.MaxDuration, "recording.max_duration")
+	validator.check(config.Recording.MaxSize >= 0, "recording.max_size", "negative size %d", config.Recording.MaxSize)
+	validator.checkCount(config.Recording.KeyframeIndexSize, "recording.keyframe_index_size")
+	validator.check(slices.Contains([]string{"", hls.FormatTS, hls.FormatFMP4}, config.HLS.Format), "hls.format",
+		"%q is neither %s nor %s", config.HLS.Format, hls.FormatTS, hls.FormatFMP4)
+	validator.check(config.HLS.PartDuration == 0 || config.HLS.Format == hls.FormatFMP4, "hls.part_duration",
+		"low latency needs the %s format", hls.FormatFMP4)
+	validator.checkDuration(config.HLS.TargetDuration, "hls.target_duration")
+	validator.checkDuration(config.HLS.Retention, "hls.retention")
+	validator.checkDuration(config.HLS.PartDuration, "hls.part_duration")
+	validator.checkCount(config.HLS.PlaylistSize, "hls.playlist_size")
+	validator.checkDuration(config.Relay.Push.ReconnectDelay, "relay.push.reconnect_delay")
+	validator.checkDuration(config.Relay.Push.MaxReconnectDelay, "relay.push.max_reconnect_delay")
+	validator.checkDuration(config.Relay.Push.Timeout, "relay.push.timeout")
+	validator.checkDuration(config.Relay.Pull.IdleTimeout, "relay.pull.idle_timeout")
+	validator.checkDuration(config.Relay.Pull.Timeout, "relay.pull.timeout")
+	config.validateCluster(validator)
+	validator.checkCount(config.Limits.MaxConnections, "limits.max_connections")
+	validator.checkCount(config.Limits.MaxConnectionsPerIP, "limits.max_connections_per_ip")
+	validator.checkCount(config.Limits.MaxHandshakes, "limits.max_handshakes")
+	validator.checkCount(config.Limits.MaxPublishersPerApp, "limits.max_publishers_per_app")
+	validator.checkCount(config.Limits.MaxPlayersPerApp, "limits.max_players_per_app")
+	validator.checkCount(config.Limits.MaxPlayersPerStream, "limits.max_players_per_stream")
+	if config.Log.Level != "" {
+		_, err := zapcore.ParseLevel(config.Log.Level)
+		validator.check(err == nil, "log.level", "%q is not a level, debug, info, warn or error", config.Log.Level)
+	}
+	validator.check(slices.Contains([]string{"", logger.FormatConsole, logger.FormatJSON}, config.Log.Format), "log.format",
+		"%q is neither %s nor %s", config.Log.Format, logger.FormatConsole, logger.FormatJSON)
+	return errors.Join(validator.errs...)
+}
+
+func (config *Config) validateListeners(validator *validator) {
+	networks := []string{"", server.NetworkTCP, server.NetworkTLS, server.NetworkUnix, server.NetworkRTMPT}
+	for index, listener := range config.Listeners {
+		field := fmt.Sprintf("listeners[%d]", index)
+		validator.check(slices.Contains(networks, listener.Network), field+".network",
+			"%q is neither tcp, tls, unix nor rtmpt", listener.Network)
+		validator.check(listener.Address != "", field+".address", "missing")
+		validator.check(listener.Network != server.NetworkTLS || listener.TLSCert != "", field+".tls_cert",
+			"required by the tls listeners")
+		validator.check((listener.TLSCert == "") == (listener.TLSKey == ""), field+".tls_key",
+			"the certificate and its key go together")
+		validator.check(listener.TLSCert == "" || listener.Network == server.NetworkTLS || listener.Network == server.NetworkRTMPT,
+			field+".tls_cert", "only the tls and rtmpt listeners use a certificate")
+		validator.check(!listener.ProxyProtocol || listener.Network != server.NetworkRTMPT, field+".proxy_protocol",
+			"the rtmpt listeners do not support the proxy protocol")
+	}
+}
+
+func (config *Config) validateApplications(validator *validator) {
+	apps := make([]string, 0, len(config.Applications))
+	for app := range config.Applications {
+		apps = append(apps, app)
+	}
+	// the errors come in the same order on every run
+	sort.Strings(apps)
+	for _, app := range apps {
+		application := config.Applications[app]
+		field := "applications." + app
+		_, err := access.NewFilter(access.Config{Apps: map[string]access.Rules{app: access.Rules(application.Access)}})
+		validator.check(err == nil, field+".access", "%s", err)
+		validator.check(app != access.AnyApp || (len(application.Push) == 0 && application.Pull == ""), field,
+			"only the access rules apply to any application")
+		for index, push := range application.Push {
+			_, err := client.ParseURL(push.URL)
+			validator.check(err == nil, fmt.Sprintf("%s.push[%d].url", field, index), "%s", err)
+		}
+		if application.Pull != "" {
+			_, err := client.ParseURL(application.Pull)
+			validator.check(err == nil, field+".pull", "%s", err)
+			validator.check(config.Cluster.Name == "", field+".pull", "the cluster nodes pull from the node publishing the stream")
+		}
+	}
+}
+
+func (config *Config) validateCluster(validator *validator) {
+	if config.Cluster.Name == "" {
+		validator.check(len(config.Cluster.Peers) == 0 && !config.Cluster.Redirect && config.Cluster.URL == "",
+			"cluster.name", "required by the cluster nodes")
+		return
+	}
+	validator.checkURL(config.Cluster.URL, "cluster.url", "rtmp")
+	validator.check(config.Cluster.Address != "", "cluster.address", "required by the cluster nodes")
+	validator.check(config.Cluster.Address != config.HTTP.Address && config.Cluster.Address != config.Admin.Address,
+		"cluster.address", "the announcements do not share the address of the http server or the admin api")
+	for index, peer := range config.Cluster.Peers {
+		validator.checkURL(peer, fmt.Sprintf("cluster.peers[%d]", index), "http", "https")
+	}
+	validator.checkDuration(config.Cluster.AnnounceInterval, "cluster.announce_interval")
+}
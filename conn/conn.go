@@ -2,32 +2,57 @@ package conn
 
 import (
 	"net"
+	"rtmp/proxyproto"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Message struct {
-	Length   uint32
-	TypeId   uint8
-	StreamId uint32
-	Data     []byte
+	Length         uint32
+	TypeId         uint8
+	StreamId       uint32
+	Timestamp      uint32
+	TimestampDelta uint32
+	Data           []byte
 }
 
 func (message *Message) DataSize() uint32 {
 	return uint32(len(message.Data))
 }
 
+// ChunkStream is what a chunk stream received keeps between its chunks, the headers of types 1, 2 and 3 reuse
+// the fields of its last header
+type ChunkStream struct {
+	// Message is the message being read, it holds the header of the previous message until its first chunk
+	Message *Message
+	// ExtendedTimestamp tells whether the last type 0, 1 or 2 header carried an extended timestamp, the type 3
+	// chunks that follow carry one too
+	ExtendedTimestamp bool
+}
+
 type Conn struct {
-	Conn                          net.Conn
-	PeerMaxChunkSize              uint32
-	MaxChunkSize                  uint32
-	NetworkTimeout                time.Duration
-	CurrentMessage                *Message
+	Conn                 net.Conn
+	PeerMaxChunkSize     uint32
+	MaxChunkSize         uint32
+	NetworkTimeout       time.Duration
+	PendingChunkDataSize uint32
+	PendingChunkStreamId uint32
+	// ChunkStreams are the chunk streams received by id, the peer interleaves the chunks of their messages
+	ChunkStreams                  map[uint32]*ChunkStream
 	Messages                      chan *Message
 	UnacknowledgedBytesReceived   uint32
 	UnacknowledgedBytesSent       uint32
 	WindowAcknowledgementSize     uint32
 	PeerWindowAcknowledgementSize uint32
 	Errors                        chan error
+	SendMutex                     sync.Mutex
+	CreatedAt                     time.Time
+	BytesReceived                 atomic.Uint64
+	BytesSent                     atomic.Uint64
+	Stats                         Stats
+	roundTripTime                 atomic.Int64
+	proxyHeader                   atomic.Pointer[proxyproto.Header]
 }
 
 func NewConn(conn net.Conn, defaultMaxChunkSize uint32, networkTimeout time.Duration) (*Conn, error) {
@@ -36,20 +61,21 @@ func NewConn(conn net.Conn, defaultMaxChunkSize uint32, networkTimeout time.Dura
 		PeerMaxChunkSize:              defaultMaxChunkSize,
 		MaxChunkSize:                  defaultMaxChunkSize,
 		NetworkTimeout:                networkTimeout,
-		CurrentMessage:                &Message{},
+		ChunkStreams:                  make(map[uint32]*ChunkStream),
 		PeerWindowAcknowledgementSize: 2 * 1024,
 		Messages:                      make(chan *Message),
 		Errors:                        make(chan error),
+		CreatedAt:                     time.Now(),
 	}
 	if newConn.Conn != nil {
 		err := newConn.Conn.SetReadDeadline(time.Now().Add(newConn.NetworkTimeout))
 		if err != nil {
-			newConn.Errors <- err
+			newConn.reportError(err)
 			return nil, err
 		}
 		err = newConn.Conn.SetWriteDeadline(time.Now().Add(newConn.NetworkTimeout))
 		if err != nil {
-			newConn.Errors <- err
+			newConn.reportError(err)
 			return nil, err
 		}
 	}
@@ -57,14 +83,33 @@ func NewConn(conn net.Conn, defaultMaxChunkSize uint32, networkTimeout time.Dura
 	return newConn, nil
 }
 
+// LocalAddr is the address the client connected to, behind a proxy too
 func (rtmpConn *Conn) LocalAddr() net.Addr {
+	if header := rtmpConn.proxyHeader.Load(); header != nil && header.Destination != nil {
+		return header.Destination
+	}
 	return rtmpConn.Conn.LocalAddr()
 }
 
+// RemoteAddr is the address of the client, behind a proxy too
 func (rtmpConn *Conn) RemoteAddr() net.Addr {
+	if header := rtmpConn.proxyHeader.Load(); header != nil && header.Source != nil {
+		return header.Source
+	}
 	return rtmpConn.Conn.RemoteAddr()
 }
 
+// SetProxyHeader sets the proxy protocol header received before the handshake, its addresses replace the ones
+// of the proxy connection
+func (rtmpConn *Conn) SetProxyHeader(header *proxyproto.Header) {
+	rtmpConn.proxyHeader.Store(header)
+}
+
+// ProxyHeader is the proxy protocol header received before the handshake, nil without proxy
+func (rtmpConn *Conn) ProxyHeader() *proxyproto.Header {
+	return rtmpConn.proxyHeader.Load()
+}
+
 func (rtmpConn *Conn) SetDeadline(t time.Time) error {
 	return rtmpConn.Conn.SetDeadline(t)
 }
@@ -78,18 +123,35 @@ func (rtmpConn *Conn) SetWriteDeadline(t time.Time) error {
 }
 
 func (rtmpConn *Conn) Read(buffer []byte) (int, error) {
+	// the deadline is extended on every read so only idle connections time out
+	if rtmpConn.NetworkTimeout > 0 {
+		err := rtmpConn.Conn.SetReadDeadline(time.Now().Add(rtmpConn.NetworkTimeout))
+		if err != nil {
+			rtmpConn.reportError(err)
+			return 0, err
+		}
+	}
 	n, err := rtmpConn.Conn.Read(buffer)
+	rtmpConn.BytesReceived.Add(uint64(n))
 	if err != nil {
-		rtmpConn.Errors <- err
+		rtmpConn.reportError(err)
 		return 0, err
 	}
 	return n, err
 }
 
 func (rtmpConn *Conn) Write(buffer []byte) (int, error) {
+	if rtmpConn.NetworkTimeout > 0 {
+		err := rtmpConn.Conn.SetWriteDeadline(time.Now().Add(rtmpConn.NetworkTimeout))
+		if err != nil {
+			rtmpConn.reportError(err)
+			return 0, err
+		}
+	}
 	n, err := rtmpConn.Conn.Write(buffer)
+	rtmpConn.BytesSent.Add(uint64(n))
 	if err != nil {
-		rtmpConn.Errors <- err
+		rtmpConn.reportError(err)
 		return 0, err
 	}
 	return n, err
@@ -98,3 +160,46 @@ func (rtmpConn *Conn) Write(buffer []byte) (int, error) {
 func (rtmpConn *Conn) Close() error {
 	return rtmpConn.Conn.Close()
 }
+
+// ChunkStream returns the state of a chunk stream received, it is created on its first chunk
+func (rtmpConn *Conn) ChunkStream(chunkStreamId uint32) *ChunkStream {
+	if rtmpConn.ChunkStreams == nil {
+		rtmpConn.ChunkStreams = make(map[uint32]*ChunkStream)
+	}
+	chunkStream, ok := rtmpConn.ChunkStreams[chunkStreamId]
+	if !ok {
+		chunkStream = &ChunkStream{Message: &Message{}}
+		rtmpConn.ChunkStreams[chunkStreamId] = chunkStream
+	}
+	return chunkStream
+}
+
+// Uptime is used as the timestamp of the ping requests
+func (rtmpConn *Conn) Uptime() time.Duration {
+	return time.Since(rtmpConn.CreatedAt)
+}
+
+// RoundTripTime is the time the peer took to answer the last ping request, zero until it answered one
+func (rtmpConn *Conn) RoundTripTime() time.Duration {
+	return time.Duration(rtmpConn.roundTripTime.Load())
+}
+
+func (rtmpConn *Conn) SetRoundTripTime(roundTripTime time.Duration) {
+	rtmpConn.roundTripTime.Store(int64(roundTripTime))
+	rtmpConn.Stats.addRoundTrip(roundTripTime)
+}
+
+// ChunkSizes returns the size of the chunks read and written, they only change with the send lock held
+func (rtmpConn *Conn) ChunkSizes() (incoming uint32, outgoing uint32) {
+	rtmpConn.SendMutex.Lock()
+	defer rtmpConn.SendMutex.Unlock()
+	return rtmpConn.PeerMaxChunkSize, rtmpConn.MaxChunkSize
+}
+
+// reportError never blocks, nobody may be listening on the errors channel
+func (rtmpConn *Conn) reportError(err error) {
+	select {
+	case rtmpConn.Errors <- err:
+	default:
+	}
+}
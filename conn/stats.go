@@ -0,0 +1,20 @@
+package conn
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts the messages of a connection by type id, the counters are updated atomically
+type Stats struct {
+	MessagesReceived [256]atomic.Uint64
+	MessagesSent     [256]atomic.Uint64
+	RoundTrips       atomic.Uint64
+	// RoundTripsTime is the sum of the round trip times in nanoseconds
+	RoundTripsTime atomic.Int64
+}
+
+func (stats *Stats) addRoundTrip(roundTripTime time.Duration) {
+	stats.RoundTrips.Add(1)
+	stats.RoundTripsTime.Add(int64(roundTripTime))
+}
@@ -0,0 +1,161 @@
+package flv
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	SoundFormatLinearPCM         = uint8(0)
+	SoundFormatADPCM             = uint8(1)
+	SoundFormatMP3               = uint8(2)
+	SoundFormatLinearPCMLE       = uint8(3)
+	SoundFormatNellymoser16kMono = uint8(4)
+	SoundFormatNellymoser8kMono  = uint8(5)
+	SoundFormatNellymoser        = uint8(6)
+	SoundFormatG711ALaw          = uint8(7)
+	SoundFormatG711MuLaw         = uint8(8)
+	// SoundFormatExHeader marks the enhanced rtmp audio tags, a FourCC follows the packet type
+	SoundFormatExHeader = uint8(9)
+	SoundFormatAAC      = uint8(10)
+	SoundFormatSpeex    = uint8(11)
+	SoundFormatMP38k    = uint8(14)
+)
+
+const (
+	AACPacketTypeSequenceHeader = uint8(0)
+	AACPacketTypeRaw            = uint8(1)
+)
+
+// the packet types of the enhanced rtmp audio tags
+const (
+	AudioPacketTypeSequenceStart      = uint8(0)
+	AudioPacketTypeCodedFrames        = uint8(1)
+	AudioPacketTypeSequenceEnd        = uint8(2)
+	AudioPacketTypeMultichannelConfig = uint8(4)
+	AudioPacketTypeMultitrack         = uint8(5)
+)
+
+// the audio codecs of the enhanced rtmp tags
+const (
+	FourCCAC3  = "ac-3"
+	FourCCEAC3 = "ec-3"
+	FourCCOpus = "Opus"
+	FourCCMP3  = ".mp3"
+	FourCCFLAC = "fLaC"
+	FourCCAAC  = "mp4a"
+)
+
+var ErrInvalidAudioTag = errors.New("flv: invalid audio tag")
+
+// soundRates are the rates of the legacy header, the codecs with a fixed rate ignore it
+var soundRates = []int{5512, 11025, 22050, 44100}
+
+// AudioTagHeader is the header preceding the audio data, AACPacketType is only present for AAC. The enhanced rtmp
+// headers have the IsExHeader bit set and identify the codec with a FourCC, the header of a multitrack tag stops
+// before its tracks and FourCC is empty when every track has its own codec.
+type AudioTagHeader struct {
+	SoundFormat uint8
+	// SoundRate, SoundSize and SoundType are the 2 bits rate index, 8 or 16 bits samples and mono or stereo
+	SoundRate      uint8
+	SoundSize      uint8
+	SoundType      uint8
+	AACPacketType  uint8
+	IsExHeader     bool
+	PacketType     uint8
+	FourCC         string
+	IsMultitrack   bool
+	MultitrackType uint8
+}
+
+func ParseAudioTagHeader(data []byte) (*AudioTagHeader, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidAudioTag)
+	}
+	header := &AudioTagHeader{SoundFormat: data[0] >> 4}
+	if header.SoundFormat == SoundFormatExHeader {
+		return parseAudioExHeader(data)
+	}
+	header.SoundRate = data[0] >> 2 & 0x03
+	header.SoundSize = data[0] >> 1 & 0x01
+	header.SoundType = data[0] & 0x01
+	if header.SoundFormat == SoundFormatAAC {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidAudioTag)
+		}
+		header.AACPacketType = data[1]
+	}
+	return header, nil
+}
+
+func parseAudioExHeader(data []byte) (*AudioTagHeader, error) {
+	header := &AudioTagHeader{SoundFormat: SoundFormatExHeader, IsExHeader: true, PacketType: data[0] & 0x0F}
+	if header.PacketType == AudioPacketTypeMultitrack {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidAudioTag)
+		}
+		header.IsMultitrack = true
+		header.MultitrackType, header.PacketType = data[1]>>4, data[1]&0x0F
+		data = data[1:]
+	}
+	if header.MultitrackType == MultitrackTypeManyTracksManyCodecs {
+		return header, nil
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidAudioTag)
+	}
+	header.FourCC = string(data[1:5])
+	return header, nil
+}
+
+// Size is the length of the header, the audio data follows it
+func (header *AudioTagHeader) Size() int {
+	switch {
+	case header.IsMultitrack:
+		return 2 + len(header.FourCC)
+	case header.IsExHeader:
+		return 5
+	case header.SoundFormat == SoundFormatAAC:
+		return 2
+	}
+	return 1
+}
+
+func (header *AudioTagHeader) IsSequenceHeader() bool {
+	if header.IsExHeader {
+		return header.PacketType == AudioPacketTypeSequenceStart
+	}
+	return header.SoundFormat == SoundFormatAAC && header.AACPacketType == AACPacketTypeSequenceHeader
+}
+
+// SampleRate is the rate of the legacy header, with the fixed rates of Speex, G.711, Nellymoser and MP3 8 kHz,
+// zero for AAC and the enhanced headers whose rate is in the sequence header
+func (header *AudioTagHeader) SampleRate() int {
+	switch header.SoundFormat {
+	case SoundFormatAAC, SoundFormatExHeader:
+		return 0
+	case SoundFormatSpeex, SoundFormatNellymoser16kMono:
+		return 16000
+	case SoundFormatG711ALaw, SoundFormatG711MuLaw, SoundFormatNellymoser8kMono, SoundFormatMP38k:
+		return 8000
+	}
+	return soundRates[header.SoundRate]
+}
+
+// Channels is the channels of the legacy header, zero for AAC and the enhanced headers
+func (header *AudioTagHeader) Channels() int {
+	switch header.SoundFormat {
+	case SoundFormatAAC, SoundFormatExHeader:
+		return 0
+	case SoundFormatSpeex, SoundFormatNellymoser16kMono, SoundFormatNellymoser8kMono, SoundFormatG711ALaw, SoundFormatG711MuLaw:
+		return 1
+	}
+	return int(header.SoundType) + 1
+}
+
+// IsAudioSequenceHeader tells whether the audio tag data holds an AudioSpecificConfig or an enhanced rtmp
+// sequence start
+func IsAudioSequenceHeader(data []byte) bool {
+	header, err := ParseAudioTagHeader(data)
+	return err == nil && header.IsSequenceHeader()
+}
@@ -0,0 +1,57 @@
+package flv_test
+
+import (
+	"rtmp/flv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAudioTagHeader(t *testing.T) {
+	for _, test := range []struct {
+		data       []byte
+		format     uint8
+		sampleRate int
+		channels   int
+	}{
+		{[]byte{0x2F}, flv.SoundFormatMP3, 44100, 2},
+		{[]byte{0xEE}, flv.SoundFormatMP38k, 8000, 1},
+		{[]byte{0xB6}, flv.SoundFormatSpeex, 16000, 1},
+		{[]byte{0x72}, flv.SoundFormatG711ALaw, 8000, 1},
+		{[]byte{0x82}, flv.SoundFormatG711MuLaw, 8000, 1},
+		{[]byte{0x3A}, flv.SoundFormatLinearPCMLE, 22050, 1},
+		{[]byte{0xAF, 0x01}, flv.SoundFormatAAC, 0, 0},
+	} {
+		header, err := flv.ParseAudioTagHeader(test.data)
+		assert.NoError(t, err)
+		assert.Equal(t, test.format, header.SoundFormat)
+		assert.Equal(t, test.sampleRate, header.SampleRate())
+		assert.Equal(t, test.channels, header.Channels())
+		assert.Equal(t, len(test.data), header.Size())
+	}
+	_, err := flv.ParseAudioTagHeader([]byte{0xAF})
+	assert.ErrorIs(t, err, flv.ErrInvalidAudioTag)
+}
+
+func TestParseAudioExHeader(t *testing.T) {
+	header, err := flv.ParseAudioTagHeader([]byte{0x90, 'O', 'p', 'u', 's', 'O'})
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.AudioTagHeader{
+		SoundFormat: flv.SoundFormatExHeader,
+		IsExHeader:  true,
+		PacketType:  flv.AudioPacketTypeSequenceStart,
+		FourCC:      flv.FourCCOpus,
+	}, header)
+	assert.Equal(t, 5, header.Size())
+	assert.True(t, header.IsSequenceHeader())
+
+	header, err = flv.ParseAudioTagHeader([]byte{0x95, 0x20, 'm', 'p', '4', 'a', 0})
+	assert.NoError(t, err)
+	assert.True(t, header.IsMultitrack)
+	assert.Equal(t, "", header.FourCC)
+	assert.Equal(t, 2, header.Size())
+	assert.True(t, header.IsSequenceHeader())
+
+	_, err = flv.ParseAudioTagHeader([]byte{0x91, '.', 'm', 'p'})
+	assert.ErrorIs(t, err, flv.ErrInvalidAudioTag)
+}
@@ -0,0 +1,172 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	TagTypeAudio      = uint8(8)
+	TagTypeVideo      = uint8(9)
+	TagTypeScriptData = uint8(18)
+)
+
+const (
+	// HeaderSize includes the first previous tag size, always zero
+	HeaderSize    = 13
+	TagHeaderSize = 11
+	// TagTrailerSize is the previous tag size following every tag
+	TagTrailerSize = 4
+)
+
+var ErrInvalidHeader = errors.New("not an flv file")
+
+type Header struct {
+	HasAudio bool
+	HasVideo bool
+}
+
+func (header Header) Encode() []byte {
+	bytes := []byte{'F', 'L', 'V', 1, 0}
+	if header.HasAudio {
+		bytes[4] |= 0x04
+	}
+	if header.HasVideo {
+		bytes[4] |= 0x01
+	}
+	bytes = binary.BigEndian.AppendUint32(bytes, 9)
+	return binary.BigEndian.AppendUint32(bytes, 0)
+}
+
+func ReadHeader(reader io.Reader) (*Header, error) {
+	bytes := make([]byte, HeaderSize)
+	_, err := io.ReadFull(reader, bytes)
+	if err != nil {
+		return nil, err
+	}
+	if string(bytes[0:3]) != "FLV" {
+		return nil, ErrInvalidHeader
+	}
+	dataOffset := binary.BigEndian.Uint32(bytes[5:9])
+	if dataOffset < 9 {
+		return nil, ErrInvalidHeader
+	}
+	// skips the header extension some writers add, the first previous tag size follows it
+	_, err = io.CopyN(io.Discard, reader, int64(dataOffset-9))
+	if err != nil {
+		return nil, err
+	}
+	return &Header{
+		HasAudio: bytes[4]&0x04 != 0,
+		HasVideo: bytes[4]&0x01 != 0,
+	}, nil
+}
+
+type Tag struct {
+	Type      uint8
+	Timestamp uint32
+	Data      []byte
+}
+
+// Encode returns the tag followed by its previous tag size back pointer
+func (tag Tag) Encode() []byte {
+	bytes := make([]byte, 0, tag.Size())
+	bytes = append(bytes, tag.Type)
+	bytes = appendUint24(bytes, uint32(len(tag.Data)))
+	bytes = appendUint24(bytes, tag.Timestamp&0xFFFFFF)
+	bytes = append(bytes, uint8(tag.Timestamp>>24))
+	bytes = appendUint24(bytes, 0)
+	bytes = append(bytes, tag.Data...)
+	return binary.BigEndian.AppendUint32(bytes, uint32(TagHeaderSize+len(tag.Data)))
+}
+
+// Size is the number of bytes of the encoded tag
+func (tag Tag) Size() int {
+	return TagHeaderSize + len(tag.Data) + TagTrailerSize
+}
+
+type TagHeader struct {
+	Type      uint8
+	DataSize  uint32
+	Timestamp uint32
+}
+
+func ReadTagHeader(reader io.Reader) (*TagHeader, error) {
+	header := make([]byte, TagHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	return &TagHeader{
+		Type:      header[0] & 0x1F,
+		DataSize:  uint24(header[1:4]),
+		Timestamp: uint24(header[4:7]) | uint32(header[7])<<24,
+	}, nil
+}
+
+// ReadTag reads a tag and its previous tag size, io.EOF means no tag is left
+func ReadTag(reader io.Reader) (*Tag, error) {
+	header, err := ReadTagHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	tag := &Tag{
+		Type:      header.Type,
+		Timestamp: header.Timestamp,
+		Data:      make([]byte, header.DataSize),
+	}
+	_, err = io.ReadFull(reader, tag.Data)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	_, err = io.ReadFull(reader, make([]byte, TagTrailerSize))
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return tag, nil
+}
+
+// ReadLastTagHeader reads the header of the last tag following the back pointer at the end of the file
+func ReadLastTagHeader(reader io.ReadSeeker) (*TagHeader, error) {
+	end, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if end < HeaderSize+TagHeaderSize+TagTrailerSize {
+		return nil, io.EOF
+	}
+	trailer := make([]byte, TagTrailerSize)
+	_, err = reader.Seek(end-TagTrailerSize, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(reader, trailer)
+	if err != nil {
+		return nil, err
+	}
+	tagStart := end - TagTrailerSize - int64(binary.BigEndian.Uint32(trailer))
+	if tagStart < HeaderSize {
+		return nil, errors.New("invalid flv previous tag size")
+	}
+	_, err = reader.Seek(tagStart, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return ReadTagHeader(reader)
+}
+
+func appendUint24(bytes []byte, value uint32) []byte {
+	return append(bytes, uint8(value>>16), uint8(value>>8), uint8(value))
+}
+
+func uint24(bytes []byte) uint32 {
+	return uint32(bytes[0])<<16 | uint32(bytes[1])<<8 | uint32(bytes[2])
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
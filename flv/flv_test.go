@@ -0,0 +1,58 @@
+package flv_test
+
+import (
+	"bytes"
+	"io"
+	"rtmp/flv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderEncoding(t *testing.T) {
+	encoded := flv.Header{HasAudio: true, HasVideo: true}.Encode()
+	assert.Equal(t, []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}, encoded)
+	header, err := flv.ReadHeader(bytes.NewReader(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.Header{HasAudio: true, HasVideo: true}, header)
+}
+
+func TestReadHeaderFailsOnOtherFiles(t *testing.T) {
+	_, err := flv.ReadHeader(bytes.NewReader([]byte("ftypisom\x00\x00\x00\x00\x00")))
+	assert.ErrorIs(t, err, flv.ErrInvalidHeader)
+}
+
+func TestTagEncoding(t *testing.T) {
+	tag := flv.Tag{Type: flv.TagTypeVideo, Timestamp: 0x12345678, Data: []byte{0x17, 0x01, 0, 0, 0}}
+	encoded := tag.Encode()
+	assert.Equal(t, tag.Size(), len(encoded))
+	assert.Equal(t, []byte{flv.TagTypeVideo, 0, 0, 5, 0x34, 0x56, 0x78, 0x12, 0, 0, 0}, encoded[:flv.TagHeaderSize])
+	assert.Equal(t, []byte{0, 0, 0, 16}, encoded[len(encoded)-flv.TagTrailerSize:])
+	decoded, err := flv.ReadTag(bytes.NewReader(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, &tag, decoded)
+}
+
+func TestReadTags(t *testing.T) {
+	file := flv.Header{HasAudio: true}.Encode()
+	first := flv.Tag{Type: flv.TagTypeAudio, Timestamp: 0, Data: []byte{0xAF, 0x00, 0x12, 0x10}}
+	last := flv.Tag{Type: flv.TagTypeAudio, Timestamp: 23, Data: []byte{0xAF, 0x01, 0x21}}
+	file = append(file, first.Encode()...)
+	file = append(file, last.Encode()...)
+	reader := bytes.NewReader(file)
+	_, err := flv.ReadHeader(reader)
+	assert.NoError(t, err)
+	for _, expected := range []flv.Tag{first, last} {
+		tag, err := flv.ReadTag(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, &expected, tag)
+	}
+	_, err = flv.ReadTag(reader)
+	assert.ErrorIs(t, err, io.EOF)
+
+	lastHeader, err := flv.ReadLastTagHeader(bytes.NewReader(file))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(23), lastHeader.Timestamp)
+	_, err = flv.ReadTag(bytes.NewReader(last.Encode()[:flv.TagHeaderSize+1]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,165 @@
+package flv
+
+import (
+	"errors"
+	"fmt"
+)
+
+const VideoPacketTypeMultitrack = uint8(6)
+
+// the layouts of the enhanced rtmp multitrack tags
+const (
+	MultitrackTypeOneTrack             = uint8(0)
+	MultitrackTypeManyTracks           = uint8(1)
+	MultitrackTypeManyTracksManyCodecs = uint8(2)
+)
+
+var ErrInvalidMultitrack = errors.New("flv: invalid multitrack tag")
+
+// Track is one track of a multitrack tag, track 0 is the default one
+type Track struct {
+	Id     uint8
+	FourCC string
+	// Data follows the FourCC like in a single track tag, it starts with the composition time of the avc1 and
+	// hvc1 coded frames
+	Data []byte
+}
+
+// Multitrack is an enhanced rtmp v2 audio or video tag carrying several tracks. The tracks of the OneTrack and
+// ManyTracks layouts share the same codec, ManyTracksManyCodecs gives one to every track.
+type Multitrack struct {
+	// TagType is TagTypeAudio or TagTypeVideo
+	TagType uint8
+	// FrameType is shared by the tracks of a video tag
+	FrameType      uint8
+	MultitrackType uint8
+	// PacketType is the audio or video packet type of every track
+	PacketType uint8
+	Tracks     []Track
+}
+
+// IsMultitrack tells whether the audio or video tag data is a multitrack tag
+func IsMultitrack(tagType uint8, data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+	switch tagType {
+	case TagTypeVideo:
+		return data[0]&0x80 != 0 && data[0]&0x0F == VideoPacketTypeMultitrack
+	case TagTypeAudio:
+		return data[0]>>4 == SoundFormatExHeader && data[0]&0x0F == AudioPacketTypeMultitrack
+	}
+	return false
+}
+
+func ParseMultitrack(tagType uint8, data []byte) (*Multitrack, error) {
+	if !IsMultitrack(tagType, data) {
+		return nil, fmt.Errorf("%w: not a multitrack tag", ErrInvalidMultitrack)
+	}
+	multitrack := &Multitrack{
+		TagType:        tagType,
+		MultitrackType: data[1] >> 4,
+		PacketType:     data[1] & 0x0F,
+	}
+	if tagType == TagTypeVideo {
+		multitrack.FrameType = data[0] >> 4 & 0x07
+	}
+	if multitrack.MultitrackType > MultitrackTypeManyTracksManyCodecs {
+		return nil, fmt.Errorf("%w: multitrack type %d", ErrInvalidMultitrack, multitrack.MultitrackType)
+	}
+	data = data[2:]
+	var fourCC string
+	if multitrack.MultitrackType != MultitrackTypeManyTracksManyCodecs {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidMultitrack)
+		}
+		fourCC, data = string(data[:4]), data[4:]
+	}
+	for len(data) > 0 {
+		track := Track{FourCC: fourCC}
+		if multitrack.MultitrackType == MultitrackTypeManyTracksManyCodecs {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("%w: truncated track", ErrInvalidMultitrack)
+			}
+			track.FourCC, data = string(data[:4]), data[4:]
+		}
+		if len(data) < 1 {
+			return nil, fmt.Errorf("%w: truncated track", ErrInvalidMultitrack)
+		}
+		track.Id, data = data[0], data[1:]
+		if multitrack.MultitrackType == MultitrackTypeOneTrack {
+			track.Data, data = data, nil
+		} else {
+			if len(data) < 3 {
+				return nil, fmt.Errorf("%w: truncated track", ErrInvalidMultitrack)
+			}
+			size := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+			if len(data) < 3+size {
+				return nil, fmt.Errorf("%w: track %d of %d bytes truncated", ErrInvalidMultitrack, track.Id, size)
+			}
+			track.Data, data = data[3:3+size], data[3+size:]
+		}
+		multitrack.Tracks = append(multitrack.Tracks, track)
+	}
+	if len(multitrack.Tracks) == 0 {
+		return nil, fmt.Errorf("%w: no track", ErrInvalidMultitrack)
+	}
+	return multitrack, nil
+}
+
+func (multitrack *Multitrack) Encode() []byte {
+	bytes := []byte{SoundFormatExHeader<<4 | AudioPacketTypeMultitrack, multitrack.MultitrackType<<4 | multitrack.PacketType&0x0F}
+	if multitrack.TagType == TagTypeVideo {
+		bytes[0] = 0x80 | multitrack.FrameType&0x07<<4 | VideoPacketTypeMultitrack
+	}
+	if multitrack.MultitrackType != MultitrackTypeManyTracksManyCodecs && len(multitrack.Tracks) > 0 {
+		bytes = append(bytes, multitrack.Tracks[0].FourCC...)
+	}
+	for _, track := range multitrack.Tracks {
+		if multitrack.MultitrackType == MultitrackTypeManyTracksManyCodecs {
+			bytes = append(bytes, track.FourCC...)
+		}
+		bytes = append(bytes, track.Id)
+		if multitrack.MultitrackType != MultitrackTypeOneTrack {
+			size := len(track.Data)
+			bytes = append(bytes, byte(size>>16), byte(size>>8), byte(size))
+		}
+		bytes = append(bytes, track.Data...)
+	}
+	return bytes
+}
+
+func (multitrack *Multitrack) IsSequenceHeader() bool {
+	if multitrack.TagType == TagTypeAudio {
+		return multitrack.PacketType == AudioPacketTypeSequenceStart
+	}
+	return multitrack.PacketType == VideoPacketTypeSequenceStart || multitrack.PacketType == VideoPacketTypeMPEG2TSSequenceStart
+}
+
+// OneTrack returns the tag carrying only the given track, with the OneTrack layout
+func (multitrack *Multitrack) OneTrack(track Track) *Multitrack {
+	return &Multitrack{
+		TagType:        multitrack.TagType,
+		FrameType:      multitrack.FrameType,
+		MultitrackType: MultitrackTypeOneTrack,
+		PacketType:     multitrack.PacketType,
+		Tracks:         []Track{track},
+	}
+}
+
+// SingleTrack returns the enhanced tag of the given track without the multitrack header, for the players not
+// supporting them, false when the tag does not carry the track
+func (multitrack *Multitrack) SingleTrack(id uint8) ([]byte, bool) {
+	for _, track := range multitrack.Tracks {
+		if track.Id != id {
+			continue
+		}
+		bytes := []byte{SoundFormatExHeader<<4 | multitrack.PacketType&0x0F}
+		if multitrack.TagType == TagTypeVideo {
+			bytes[0] = 0x80 | multitrack.FrameType&0x07<<4 | multitrack.PacketType&0x0F
+		}
+		bytes = append(bytes, track.FourCC...)
+		return append(bytes, track.Data...), true
+	}
+	return nil, false
+}
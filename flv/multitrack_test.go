@@ -0,0 +1,76 @@
+package flv_test
+
+import (
+	"rtmp/flv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMultitrack(t *testing.T) {
+	// two opus tracks of the same codec
+	data := []byte{0x95, 0x11, 'O', 'p', 'u', 's', 0, 0, 0, 2, 0xA1, 0xA2, 1, 0, 0, 1, 0xB1}
+	multitrack, err := flv.ParseMultitrack(flv.TagTypeAudio, data)
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.Multitrack{
+		TagType:        flv.TagTypeAudio,
+		MultitrackType: flv.MultitrackTypeManyTracks,
+		PacketType:     flv.AudioPacketTypeCodedFrames,
+		Tracks: []flv.Track{
+			{Id: 0, FourCC: "Opus", Data: []byte{0xA1, 0xA2}},
+			{Id: 1, FourCC: "Opus", Data: []byte{0xB1}},
+		},
+	}, multitrack)
+	assert.Equal(t, data, multitrack.Encode())
+	track, ok := multitrack.SingleTrack(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x91, 'O', 'p', 'u', 's', 0xB1}, track)
+	_, ok = multitrack.SingleTrack(2)
+	assert.False(t, ok)
+	assert.False(t, flv.IsAudioSequenceHeader(data))
+}
+
+func TestParseVideoMultitrack(t *testing.T) {
+	// an hevc and an av1 keyframe, the hevc one with its composition time
+	data := []byte{0x96, 0x21, 'h', 'v', 'c', '1', 0, 0, 0, 4, 0, 0, 0x28, 0xC1, 'a', 'v', '0', '1', 1, 0, 0, 1, 0xD1}
+	multitrack, err := flv.ParseMultitrack(flv.TagTypeVideo, data)
+	assert.NoError(t, err)
+	assert.Equal(t, flv.FrameTypeKeyframe, multitrack.FrameType)
+	assert.Equal(t, []flv.Track{
+		{Id: 0, FourCC: flv.FourCCHEVC, Data: []byte{0, 0, 0x28, 0xC1}},
+		{Id: 1, FourCC: flv.FourCCAV1, Data: []byte{0xD1}},
+	}, multitrack.Tracks)
+	assert.Equal(t, data, multitrack.Encode())
+	track, ok := multitrack.SingleTrack(0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0x28, 0xC1}, track)
+
+	header, err := flv.ParseVideoTagHeader(data)
+	assert.NoError(t, err)
+	assert.True(t, header.IsMultitrack)
+	assert.Equal(t, "", header.FourCC)
+	assert.Equal(t, 2, header.Size())
+	assert.Equal(t, data[:2], header.Encode())
+	assert.True(t, header.IsKeyframe())
+
+	// a sequence start of a single track
+	oneTrack := multitrack.OneTrack(multitrack.Tracks[1])
+	oneTrack.PacketType = flv.VideoPacketTypeSequenceStart
+	assert.Equal(t, []byte{0x96, 0x00, 'a', 'v', '0', '1', 1, 0xD1}, oneTrack.Encode())
+	assert.True(t, flv.IsVideoSequenceHeader(oneTrack.Encode()))
+	assert.True(t, oneTrack.IsSequenceHeader())
+}
+
+func TestParseInvalidMultitrack(t *testing.T) {
+	for _, invalid := range [][]byte{
+		{0x95},
+		{0xA1, 0x01},
+		{0x95, 0x11, 'O', 'p'},
+		{0x95, 0x11, 'O', 'p', 'u', 's'},
+		{0x95, 0x11, 'O', 'p', 'u', 's', 0, 0, 0, 3, 0xA1},
+		{0x95, 0x31, 'O', 'p', 'u', 's', 0, 0xA1},
+	} {
+		_, err := flv.ParseMultitrack(flv.TagTypeAudio, invalid)
+		assert.ErrorIs(t, err, flv.ErrInvalidMultitrack)
+	}
+}
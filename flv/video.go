@@ -0,0 +1,342 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	FrameTypeKeyframe             = uint8(1)
+	FrameTypeInterFrame           = uint8(2)
+	FrameTypeDisposableInterFrame = uint8(3)
+	FrameTypeGeneratedKeyframe    = uint8(4)
+	FrameTypeVideoInfo            = uint8(5)
+)
+
+const (
+	VideoCodecH263         = uint8(2)
+	VideoCodecScreenVideo  = uint8(3)
+	VideoCodecVP6          = uint8(4)
+	VideoCodecVP6Alpha     = uint8(5)
+	VideoCodecScreenVideo2 = uint8(6)
+	VideoCodecAVC          = uint8(7)
+	// VideoCodecHEVC is not in the flv specification but widely used before enhanced rtmp
+	VideoCodecHEVC = uint8(12)
+)
+
+const (
+	AVCPacketTypeSequenceHeader = uint8(0)
+	AVCPacketTypeNALU           = uint8(1)
+	AVCPacketTypeEndOfSequence  = uint8(2)
+)
+
+// the packet types of the enhanced rtmp video tags
+const (
+	VideoPacketTypeSequenceStart        = uint8(0)
+	VideoPacketTypeCodedFrames          = uint8(1)
+	VideoPacketTypeSequenceEnd          = uint8(2)
+	VideoPacketTypeCodedFramesX         = uint8(3)
+	VideoPacketTypeMetadata             = uint8(4)
+	VideoPacketTypeMPEG2TSSequenceStart = uint8(5)
+)
+
+// the video codecs of the enhanced rtmp tags
+const (
+	FourCCAVC  = "avc1"
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP9  = "vp09"
+)
+
+var (
+	ErrInvalidVideoTag             = errors.New("flv: invalid video tag")
+	ErrInvalidDecoderConfiguration = errors.New("flv: invalid decoder configuration record")
+)
+
+// VideoTagHeader is the header preceding the video data, AVCPacketType and CompositionTime are only present for
+// the AVC and HEVC codecs. The enhanced rtmp headers have the IsExHeader bit set and identify the codec with a
+// FourCC, PacketType replaces AVCPacketType and only the coded frames of avc1 and hvc1 have a CompositionTime.
+// The header of a multitrack tag stops before its tracks, FourCC is empty when every track has its own codec.
+type VideoTagHeader struct {
+	FrameType     uint8
+	CodecId       uint8
+	AVCPacketType uint8
+	// CompositionTime is the offset in milliseconds of the presentation time from the timestamp
+	CompositionTime int32
+	IsExHeader      bool
+	PacketType      uint8
+	FourCC          string
+	IsMultitrack    bool
+	MultitrackType  uint8
+}
+
+func ParseVideoTagHeader(data []byte) (*VideoTagHeader, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidVideoTag)
+	}
+	if data[0]&0x80 != 0 {
+		return parseVideoExHeader(data)
+	}
+	header := &VideoTagHeader{
+		FrameType: data[0] >> 4,
+		CodecId:   data[0] & 0x0F,
+	}
+	if !header.hasPacketType() {
+		return header, nil
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidVideoTag)
+	}
+	header.AVCPacketType = data[1]
+	header.CompositionTime = compositionTime(data[2:5])
+	return header, nil
+}
+
+func parseVideoExHeader(data []byte) (*VideoTagHeader, error) {
+	header := &VideoTagHeader{
+		FrameType:  data[0] >> 4 & 0x07,
+		IsExHeader: true,
+		PacketType: data[0] & 0x0F,
+	}
+	if header.PacketType == VideoPacketTypeMultitrack {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidVideoTag)
+		}
+		header.IsMultitrack = true
+		header.MultitrackType, header.PacketType = data[1]>>4, data[1]&0x0F
+		data = data[1:]
+	}
+	if header.MultitrackType == MultitrackTypeManyTracksManyCodecs {
+		return header, nil
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidVideoTag)
+	}
+	header.FourCC = string(data[1:5])
+	if header.hasCompositionTime() {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidVideoTag)
+		}
+		header.CompositionTime = compositionTime(data[5:8])
+	}
+	return header, nil
+}
+
+func (header *VideoTagHeader) Encode() []byte {
+	if header.IsMultitrack {
+		bytes := []byte{0x80 | header.FrameType&0x07<<4 | VideoPacketTypeMultitrack, header.MultitrackType<<4 | header.PacketType&0x0F}
+		return append(bytes, header.FourCC...)
+	}
+	if header.IsExHeader {
+		bytes := append([]byte{0x80 | header.FrameType&0x07<<4 | header.PacketType&0x0F}, header.FourCC...)
+		if header.hasCompositionTime() {
+			bytes = appendCompositionTime(bytes, header.CompositionTime)
+		}
+		return bytes
+	}
+	bytes := []byte{header.FrameType<<4 | header.CodecId&0x0F}
+	if !header.hasPacketType() {
+		return bytes
+	}
+	return appendCompositionTime(append(bytes, header.AVCPacketType), header.CompositionTime)
+}
+
+// Size is the length of the header, the video data follows it
+func (header *VideoTagHeader) Size() int {
+	switch {
+	case header.IsMultitrack:
+		return 2 + len(header.FourCC)
+	case header.IsExHeader && header.hasCompositionTime():
+		return 8
+	case header.IsExHeader, header.hasPacketType():
+		return 5
+	}
+	return 1
+}
+
+func (header *VideoTagHeader) IsSequenceHeader() bool {
+	if header.IsExHeader {
+		return header.PacketType == VideoPacketTypeSequenceStart || header.PacketType == VideoPacketTypeMPEG2TSSequenceStart
+	}
+	return header.hasPacketType() && header.AVCPacketType == AVCPacketTypeSequenceHeader
+}
+
+// IsKeyframe tells the frames a decoder can start from, the sequence headers and end of sequence are flagged as
+// keyframes but are not
+func (header *VideoTagHeader) IsKeyframe() bool {
+	if header.FrameType != FrameTypeKeyframe {
+		return false
+	}
+	if header.IsExHeader {
+		return header.PacketType == VideoPacketTypeCodedFrames || header.PacketType == VideoPacketTypeCodedFramesX
+	}
+	return !header.hasPacketType() || header.AVCPacketType == AVCPacketTypeNALU
+}
+
+func (header *VideoTagHeader) hasPacketType() bool {
+	return !header.IsExHeader && (header.CodecId == VideoCodecAVC || header.CodecId == VideoCodecHEVC)
+}
+
+// hasCompositionTime tells the enhanced headers followed by a composition time, CodedFramesX implies zero
+func (header *VideoTagHeader) hasCompositionTime() bool {
+	return !header.IsMultitrack && header.PacketType == VideoPacketTypeCodedFrames && (header.FourCC == FourCCAVC || header.FourCC == FourCCHEVC)
+}
+
+// compositionTime sign extends the 24 bits
+func compositionTime(data []byte) int32 {
+	return int32(uint32(data[0])<<24|uint32(data[1])<<16|uint32(data[2])<<8) >> 8
+}
+
+func appendCompositionTime(bytes []byte, compositionTime int32) []byte {
+	value := uint32(compositionTime)
+	return append(bytes, byte(value>>16), byte(value>>8), byte(value))
+}
+
+// IsVideoSequenceHeader tells whether the video tag data holds a decoder configuration record
+func IsVideoSequenceHeader(data []byte) bool {
+	header, err := ParseVideoTagHeader(data)
+	return err == nil && header.IsSequenceHeader()
+}
+
+// IsVideoKeyframe tells whether the video tag data holds a keyframe, the sequence headers excluded
+func IsVideoKeyframe(data []byte) bool {
+	header, err := ParseVideoTagHeader(data)
+	return err == nil && header.IsKeyframe()
+}
+
+// AVCDecoderConfigurationRecord is the payload of the AVC sequence header, defined by ISO/IEC 14496-15
+type AVCDecoderConfigurationRecord struct {
+	ConfigurationVersion uint8
+	ProfileIndication    uint8
+	ProfileCompatibility uint8
+	LevelIndication      uint8
+	// NALULengthSize is the size in bytes of the length preceding every NAL unit of the frames
+	NALULengthSize uint8
+	SPS            [][]byte
+	PPS            [][]byte
+}
+
+func ParseAVCDecoderConfigurationRecord(data []byte) (*AVCDecoderConfigurationRecord, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalidDecoderConfiguration)
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidDecoderConfiguration, data[0])
+	}
+	record := &AVCDecoderConfigurationRecord{
+		ConfigurationVersion: data[0],
+		ProfileIndication:    data[1],
+		ProfileCompatibility: data[2],
+		LevelIndication:      data[3],
+		NALULengthSize:       data[4]&0x03 + 1,
+	}
+	var err error
+	record.SPS, data, err = readParameterSets(data[6:], int(data[5]&0x1F))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 {
+		return nil, fmt.Errorf("%w: missing pps", ErrInvalidDecoderConfiguration)
+	}
+	// the chroma and bit depth extension of the high profiles is ignored
+	record.PPS, _, err = readParameterSets(data[1:], int(data[0]))
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (record *AVCDecoderConfigurationRecord) Encode() []byte {
+	bytes := []byte{
+		record.ConfigurationVersion,
+		record.ProfileIndication,
+		record.ProfileCompatibility,
+		record.LevelIndication,
+		0xFC | (record.NALULengthSize-1)&0x03,
+		0xE0 | uint8(len(record.SPS))&0x1F,
+	}
+	for _, sps := range record.SPS {
+		bytes = binary.BigEndian.AppendUint16(bytes, uint16(len(sps)))
+		bytes = append(bytes, sps...)
+	}
+	bytes = append(bytes, uint8(len(record.PPS)))
+	for _, pps := range record.PPS {
+		bytes = binary.BigEndian.AppendUint16(bytes, uint16(len(pps)))
+		bytes = append(bytes, pps...)
+	}
+	return bytes
+}
+
+// HEVCDecoderConfigurationRecord is the payload of the HEVC sequence header, defined by ISO/IEC 14496-15, only
+// the parameter sets are kept from the profile and format fields
+type HEVCDecoderConfigurationRecord struct {
+	ConfigurationVersion uint8
+	ProfileIdc           uint8
+	LevelIdc             uint8
+	NALULengthSize       uint8
+	VPS                  [][]byte
+	SPS                  [][]byte
+	PPS                  [][]byte
+}
+
+const (
+	hevcNALUTypeVPS = 32
+	hevcNALUTypeSPS = 33
+	hevcNALUTypePPS = 34
+)
+
+func ParseHEVCDecoderConfigurationRecord(data []byte) (*HEVCDecoderConfigurationRecord, error) {
+	if len(data) < 23 {
+		return nil, fmt.Errorf("%w: truncated", ErrInvalidDecoderConfiguration)
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidDecoderConfiguration, data[0])
+	}
+	record := &HEVCDecoderConfigurationRecord{
+		ConfigurationVersion: data[0],
+		ProfileIdc:           data[1] & 0x1F,
+		LevelIdc:             data[12],
+		NALULengthSize:       data[21]&0x03 + 1,
+	}
+	arrays := int(data[22])
+	data = data[23:]
+	for range arrays {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("%w: truncated nal unit array", ErrInvalidDecoderConfiguration)
+		}
+		naluType := data[0] & 0x3F
+		var sets [][]byte
+		var err error
+		sets, data, err = readParameterSets(data[3:], int(binary.BigEndian.Uint16(data[1:3])))
+		if err != nil {
+			return nil, err
+		}
+		switch naluType {
+		case hevcNALUTypeVPS:
+			record.VPS = append(record.VPS, sets...)
+		case hevcNALUTypeSPS:
+			record.SPS = append(record.SPS, sets...)
+		case hevcNALUTypePPS:
+			record.PPS = append(record.PPS, sets...)
+		}
+	}
+	return record, nil
+}
+
+// readParameterSets reads the parameter sets preceded by their 16 bits length
+func readParameterSets(data []byte, count int) ([][]byte, []byte, error) {
+	sets := make([][]byte, 0, count)
+	for range count {
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("%w: truncated parameter set", ErrInvalidDecoderConfiguration)
+		}
+		length := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+length {
+			return nil, nil, fmt.Errorf("%w: truncated parameter set", ErrInvalidDecoderConfiguration)
+		}
+		sets = append(sets, data[2:2+length])
+		data = data[2+length:]
+	}
+	return sets, data, nil
+}
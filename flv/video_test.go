@@ -0,0 +1,147 @@
+package flv_test
+
+import (
+	"rtmp/flv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVideoTagHeader(t *testing.T) {
+	header, err := flv.ParseVideoTagHeader([]byte{0x27, 0x01, 0xFF, 0xFF, 0xD8, 0x65})
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.VideoTagHeader{
+		FrameType:       flv.FrameTypeInterFrame,
+		CodecId:         flv.VideoCodecAVC,
+		AVCPacketType:   flv.AVCPacketTypeNALU,
+		CompositionTime: -40,
+	}, header)
+	assert.Equal(t, 5, header.Size())
+	assert.False(t, header.IsKeyframe())
+	assert.Equal(t, []byte{0x27, 0x01, 0xFF, 0xFF, 0xD8}, header.Encode())
+
+	header, err = flv.ParseVideoTagHeader([]byte{0x17, 0x01, 0x00, 0x00, 0x50})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(80), header.CompositionTime)
+	assert.True(t, header.IsKeyframe())
+
+	// the other codecs have a single byte header
+	header, err = flv.ParseVideoTagHeader([]byte{0x12})
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.VideoTagHeader{FrameType: flv.FrameTypeKeyframe, CodecId: flv.VideoCodecH263}, header)
+	assert.Equal(t, 1, header.Size())
+	assert.Equal(t, []byte{0x12}, header.Encode())
+
+	_, err = flv.ParseVideoTagHeader([]byte{})
+	assert.ErrorIs(t, err, flv.ErrInvalidVideoTag)
+	_, err = flv.ParseVideoTagHeader([]byte{0x17, 0x01, 0x00})
+	assert.ErrorIs(t, err, flv.ErrInvalidVideoTag)
+}
+
+func TestVideoFrameDetection(t *testing.T) {
+	sequenceHeaders := [][]byte{{0x17, 0x00, 0, 0, 0, 1}, {0x1C, 0x00, 0, 0, 0, 1}}
+	keyframes := [][]byte{{0x17, 0x01, 0, 0, 0, 0x65}, {0x1C, 0x01, 0, 0, 0, 0x26}, {0x12, 0x00}}
+	others := [][]byte{{0x27, 0x01, 0, 0, 0, 0x41}, {0x17, 0x02, 0, 0, 0}, {0x57, 0x00, 0, 0, 0}, {0x17}, {}}
+	for _, data := range sequenceHeaders {
+		assert.True(t, flv.IsVideoSequenceHeader(data), data)
+		assert.False(t, flv.IsVideoKeyframe(data), data)
+	}
+	for _, data := range keyframes {
+		assert.False(t, flv.IsVideoSequenceHeader(data), data)
+		assert.True(t, flv.IsVideoKeyframe(data), data)
+	}
+	for _, data := range others {
+		assert.False(t, flv.IsVideoKeyframe(data), data)
+	}
+	assert.True(t, flv.IsAudioSequenceHeader([]byte{0xAF, 0x00, 0x12, 0x10}))
+	assert.False(t, flv.IsAudioSequenceHeader([]byte{0xAF, 0x01, 0x21}))
+	assert.False(t, flv.IsAudioSequenceHeader([]byte{0x2F, 0x00}))
+}
+
+func TestParseAVCDecoderConfigurationRecord(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1F, 0xAC, 0xD9}
+	pps := []byte{0x68, 0xEB, 0xE3, 0xCB}
+	data := append([]byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, 0x06}, sps...)
+	data = append(data, 0x01, 0x00, 0x04)
+	data = append(data, pps...)
+	// high profile extension
+	data = append(data, 0xFD, 0xF8, 0xF8, 0x00)
+
+	record, err := flv.ParseAVCDecoderConfigurationRecord(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.AVCDecoderConfigurationRecord{
+		ConfigurationVersion: 1,
+		ProfileIndication:    0x64,
+		ProfileCompatibility: 0,
+		LevelIndication:      0x1F,
+		NALULengthSize:       4,
+		SPS:                  [][]byte{sps},
+		PPS:                  [][]byte{pps},
+	}, record)
+	assert.Equal(t, data[:len(data)-4], record.Encode())
+
+	for _, invalid := range [][]byte{data[:5], data[:10], data[:14], data[:18], append([]byte{0x02}, data[1:]...)} {
+		_, err = flv.ParseAVCDecoderConfigurationRecord(invalid)
+		assert.ErrorIs(t, err, flv.ErrInvalidDecoderConfiguration)
+	}
+}
+
+func TestParseHEVCDecoderConfigurationRecord(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0C}
+	sps := []byte{0x42, 0x01, 0x01}
+	pps := []byte{0x44, 0x01, 0xC1}
+	data := []byte{0x01, 0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 123, 0xF0, 0, 0xFC, 0xFD, 0xF8, 0xF8, 0, 0, 0x0F, 3}
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		data = append(data, 0x80|nalu[0]>>1, 0, 1, 0, byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	record, err := flv.ParseHEVCDecoderConfigurationRecord(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.HEVCDecoderConfigurationRecord{
+		ConfigurationVersion: 1,
+		ProfileIdc:           1,
+		LevelIdc:             123,
+		NALULengthSize:       4,
+		VPS:                  [][]byte{vps},
+		SPS:                  [][]byte{sps},
+		PPS:                  [][]byte{pps},
+	}, record)
+
+	for _, invalid := range [][]byte{data[:22], data[:25], data[:30]} {
+		_, err = flv.ParseHEVCDecoderConfigurationRecord(invalid)
+		assert.ErrorIs(t, err, flv.ErrInvalidDecoderConfiguration)
+	}
+}
+
+func TestParseVideoExHeader(t *testing.T) {
+	// hvc1 coded frames carry a composition time
+	data := []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x28, 0xAA}
+	header, err := flv.ParseVideoTagHeader(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.VideoTagHeader{
+		FrameType:       flv.FrameTypeKeyframe,
+		IsExHeader:      true,
+		PacketType:      flv.VideoPacketTypeCodedFrames,
+		FourCC:          flv.FourCCHEVC,
+		CompositionTime: 40,
+	}, header)
+	assert.Equal(t, 8, header.Size())
+	assert.Equal(t, data[:8], header.Encode())
+	assert.True(t, header.IsKeyframe())
+	assert.False(t, header.IsSequenceHeader())
+
+	// av01 has no composition time
+	data = []byte{0xA3, 'a', 'v', '0', '1', 0xAA}
+	header, err = flv.ParseVideoTagHeader(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, header.Size())
+	assert.Equal(t, data[:5], header.Encode())
+	assert.False(t, header.IsKeyframe())
+	assert.True(t, flv.IsVideoSequenceHeader([]byte{0x90, 'a', 'v', '0', '1', 0x81}))
+	assert.True(t, flv.IsVideoKeyframe([]byte{0x93, 'v', 'p', '0', '9', 0xAA}))
+	assert.False(t, flv.IsVideoKeyframe([]byte{0x92, 'v', 'p', '0', '9'}))
+
+	_, err = flv.ParseVideoTagHeader([]byte{0x91, 'h', 'v', 'c', '1', 0x00})
+	assert.ErrorIs(t, err, flv.ErrInvalidVideoTag)
+}
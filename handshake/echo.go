@@ -2,6 +2,7 @@ package handshake
 
 import (
 	"encoding/binary"
+	"io"
 	"net"
 )
 
@@ -13,7 +14,7 @@ type Echo struct {
 
 func ReadEcho(conn net.Conn, sentTimestampChunk Timestamp) (*Echo, error) {
 	buffer := make([]byte, 1536)
-	_, err := conn.Read(buffer)
+	_, err := io.ReadFull(conn, buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -56,3 +56,41 @@ func Accept(conn net.Conn) error {
 	logger.Get().Debug("Handshake successful")
 	return nil
 }
+
+// Request performs the handshake of a client connecting to a server
+func Request(conn net.Conn) error {
+	// sends C0 and C1
+	clientVersion := Version{Version: 3}
+	err := clientVersion.Send(conn)
+	if err != nil {
+		return err
+	}
+	clientTimestamp := GenerateTimestamp()
+	err = clientTimestamp.Send(conn)
+	if err != nil {
+		return err
+	}
+	// receives S0 and S1
+	_, err = ReadVersion(conn)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	serverTimestamp, err := ReadTimestamp(conn)
+	if err != nil {
+		return err
+	}
+	// sends C2
+	clientEcho := Echo{
+		Timestamp:  serverTimestamp.Timestamp,
+		TimeStamp2: uint32(time.Since(start).Milliseconds()),
+		Random:     serverTimestamp.Random,
+	}
+	err = clientEcho.Send(conn)
+	if err != nil {
+		return err
+	}
+	// receives S2
+	_, err = ReadEcho(conn, clientTimestamp)
+	return err
+}
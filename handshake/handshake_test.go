@@ -27,3 +27,13 @@ func TestHandshake(t *testing.T) {
 	assert.Equal(t, hs.ClientTimestamp.Timestamp, hs.ServerEcho.Timestamp)
 	assert.Equal(t, hs.ServerTimestamp.Random, hs.ClientEcho.Random)
 }
+
+func TestRequestHandshake(t *testing.T) {
+	address := testutil.AcceptTestHandshake(t)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Nil(t, handshake.Request(conn))
+}
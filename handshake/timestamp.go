@@ -2,6 +2,7 @@ package handshake
 
 import (
 	"encoding/binary"
+	"io"
 	"math/rand"
 	"net"
 )
@@ -26,7 +27,7 @@ func GenerateTimestamp() Timestamp {
 
 func ReadTimestamp(conn net.Conn) (*Timestamp, error) {
 	buffer := make([]byte, 1536)
-	_, err := conn.Read(buffer)
+	_, err := io.ReadFull(conn, buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,221 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// the track ids of the fragments
+const (
+	videoTrackId = uint32(1)
+	audioTrackId = uint32(2)
+)
+
+// the sample flags of the track runs, ISO/IEC 14496-12 8.8.3.1
+const (
+	sampleFlagsSync    = uint32(0x02000000)
+	sampleFlagsNonSync = uint32(0x01010000)
+)
+
+// fmp4Track is a track of the init segment and of the fragments
+type fmp4Track struct {
+	id        uint32
+	video     bool
+	timescale uint32
+	// sampleEntry is the avc1, hvc1 or mp4a entry of the sample description
+	sampleEntry []byte
+	// codec is the RFC 6381 codec of the playlists and manifests
+	codec  string
+	width  int
+	height int
+}
+
+type fmp4Sample struct {
+	// dts and duration are in the timescale of the track
+	dts               int64
+	duration          uint32
+	compositionOffset int32
+	keyframe          bool
+	data              []byte
+}
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, boxType...)
+	for _, payload := range payloads {
+		box = append(box, payload...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func uint16s(values ...uint16) []byte {
+	bytes := make([]byte, 0, 2*len(values))
+	for _, value := range values {
+		bytes = binary.BigEndian.AppendUint16(bytes, value)
+	}
+	return bytes
+}
+
+func uint32s(values ...uint32) []byte {
+	bytes := make([]byte, 0, 4*len(values))
+	for _, value := range values {
+		bytes = binary.BigEndian.AppendUint32(bytes, value)
+	}
+	return bytes
+}
+
+// unityMatrix is the transformation matrix of the movie and track headers
+var unityMatrix = uint32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+
+// videoSampleEntry wraps a decoder configuration record, avcC for avc1 and hvcC for hvc1
+func videoSampleEntry(entryType string, configType string, record []byte, width int, height int) []byte {
+	compressorName := make([]byte, 32)
+	return mp4Box(entryType,
+		make([]byte, 6), uint16s(1),
+		make([]byte, 16), uint16s(uint16(width), uint16(height)),
+		uint32s(0x00480000, 0x00480000, 0), uint16s(1),
+		compressorName, uint16s(0x0018, 0xFFFF),
+		mp4Box(configType, record),
+	)
+}
+
+// audioSampleEntry wraps an AudioSpecificConfig in an elementary stream descriptor
+func audioSampleEntry(config []byte, sampleRate int, channels int) []byte {
+	decoderConfig := append([]byte{0x40, 0x15, 0, 0, 0}, uint32s(0, 0)...)
+	decoderConfig = append(decoderConfig, mp4Descriptor(0x05, config)...)
+	esDescriptor := append([]byte{0, byte(audioTrackId), 0}, mp4Descriptor(0x04, decoderConfig)...)
+	// the sync layer configuration of mp4 files
+	esDescriptor = append(esDescriptor, mp4Descriptor(0x06, []byte{0x02})...)
+	return mp4Box("mp4a",
+		make([]byte, 6), uint16s(1),
+		make([]byte, 8), uint16s(uint16(channels), 16, 0, 0),
+		uint32s(uint32(min(sampleRate, 0xFFFF))<<16),
+		mp4FullBox("esds", 0, 0, mp4Descriptor(0x03, esDescriptor)),
+	)
+}
+
+func mp4Descriptor(tag byte, payload []byte) []byte {
+	size := len(payload)
+	// the size is written on 4 bytes of 7 bits
+	descriptor := []byte{tag, byte(size>>21) | 0x80, byte(size>>14) | 0x80, byte(size>>7) | 0x80, byte(size) & 0x7F}
+	return append(descriptor, payload...)
+}
+
+// initSegment returns the ftyp and moov boxes describing the tracks of the fragments
+func initSegment(tracks []*fmp4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), uint32s(0), []byte("iso6cmfcmp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		uint32s(0, 0, 1000, 0, 0x00010000), uint16s(0x0100, 0), uint32s(0, 0),
+		unityMatrix, make([]byte, 24), uint32s(audioTrackId+1),
+	)
+	moov := [][]byte{mvhd}
+	var trex [][]byte
+	for _, track := range tracks {
+		moov = append(moov, trackBox(track))
+		trex = append(trex, mp4FullBox("trex", 0, 0, uint32s(track.id, 1, 0, 0, 0)))
+	}
+	moov = append(moov, mp4Box("mvex", trex...))
+	return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func trackBox(track *fmp4Track) []byte {
+	volume := uint16(0x0100)
+	handler, handlerName := "soun", "SoundHandler"
+	mediaHeader := mp4FullBox("smhd", 0, 0, uint32s(0))
+	if track.video {
+		volume = 0
+		handler, handlerName = "vide", "VideoHandler"
+		mediaHeader = mp4FullBox("vmhd", 0, 1, uint16s(0, 0, 0, 0))
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		uint32s(0, 0, track.id, 0, 0), make([]byte, 8), uint16s(0, 0, volume, 0),
+		unityMatrix, uint32s(uint32(track.width)<<16, uint32(track.height)<<16),
+	)
+	// the language is und
+	mdhd := mp4FullBox("mdhd", 0, 0, uint32s(0, 0, track.timescale, 0), uint16s(0x55C4, 0))
+	hdlr := mp4FullBox("hdlr", 0, 0, uint32s(0), []byte(handler), make([]byte, 12), []byte(handlerName+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, uint32s(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, uint32s(1), track.sampleEntry),
+		mp4FullBox("stts", 0, 0, uint32s(0)),
+		mp4FullBox("stsc", 0, 0, uint32s(0)),
+		mp4FullBox("stsz", 0, 0, uint32s(0, 0)),
+		mp4FullBox("stco", 0, 0, uint32s(0)),
+	)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+// fragment returns the moof and mdat boxes of the samples of each track, the tracks without samples are left out
+func fragment(sequence uint32, tracks []*fmp4Track, samples [][]fmp4Sample) []byte {
+	build := func(dataOffsets []uint32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, uint32s(sequence))}
+		for index, track := range tracks {
+			if len(samples[index]) == 0 {
+				continue
+			}
+			tfhd := mp4FullBox("tfhd", 0, 0x020000, uint32s(track.id))
+			tfdt := mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, uint64(samples[index][0].dts)))
+			// data offset, sample duration, size, flags and composition time offset
+			run := uint32s(uint32(len(samples[index])), dataOffsets[index])
+			for _, sample := range samples[index] {
+				flags := sampleFlagsSync
+				if track.video && !sample.keyframe {
+					flags = sampleFlagsNonSync
+				}
+				run = append(run, uint32s(sample.duration, uint32(len(sample.data)), flags, uint32(sample.compositionOffset))...)
+			}
+			trafs = append(trafs, mp4Box("traf", tfhd, tfdt, mp4FullBox("trun", 1, 0x000F01, run)))
+		}
+		return mp4Box("moof", trafs...)
+	}
+	// the moof size does not depend on the offsets, it is built once to know where the data starts
+	offsets := make([]uint32, len(tracks))
+	offset := uint32(len(build(offsets)) + 8)
+	var data [][]byte
+	for index := range tracks {
+		offsets[index] = offset
+		for _, sample := range samples[index] {
+			data = append(data, sample.data)
+			offset += uint32(len(sample.data))
+		}
+	}
+	return append(build(offsets), mp4Box("mdat", data...)...)
+}
+
+// avcCodec is the avc1.PPCCLL codec of an AVCDecoderConfigurationRecord
+func avcCodec(record []byte) string {
+	return fmt.Sprintf("avc1.%02X%02X%02X", record[1], record[2], record[3])
+}
+
+// hevcCodec is the codec of an HEVCDecoderConfigurationRecord, ISO/IEC 14496-15 E.3
+func hevcCodec(record []byte) string {
+	profileSpace := []string{"", "A", "B", "C"}[record[1]>>6]
+	tier := "L"
+	if record[1]&0x20 != 0 {
+		tier = "H"
+	}
+	compatibility := bits.Reverse32(binary.BigEndian.Uint32(record[2:6]))
+	codec := fmt.Sprintf("hvc1.%s%d.%X.%s%d", profileSpace, record[1]&0x1F, compatibility, tier, record[12])
+	constraints := record[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	var builder strings.Builder
+	builder.WriteString(codec)
+	for _, constraint := range constraints {
+		fmt.Fprintf(&builder, ".%X", constraint)
+	}
+	return builder.String()
+}
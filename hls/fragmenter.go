@@ -0,0 +1,350 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"rtmp/codec"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/stream"
+	"sync"
+	"time"
+)
+
+var errFragmenterTooSlow = errors.New("hls fragmenter is too slow")
+
+// the timescales of the fragments, the audio uses its sampling frequency
+const videoTimescale = 90000
+
+// fragmentTrack is a track of the fragmenter and its samples waiting for the next fragment
+type fragmentTrack struct {
+	*fmp4Track
+	samples []fmp4Sample
+	// duration is the duration of the last sample, given to the last sample of a fragment
+	duration uint32
+}
+
+func (track *fragmentTrack) timestamp(timestamp uint32, offset int32) int64 {
+	return (int64(timestamp) + int64(offset)) * int64(track.timescale) / 1000
+}
+
+// push queues a sample, the duration of the previous one is known from then
+func (track *fragmentTrack) push(sample fmp4Sample) {
+	if count := len(track.samples); count > 0 && sample.dts > track.samples[count-1].dts {
+		track.duration = uint32(sample.dts - track.samples[count-1].dts)
+		track.samples[count-1].duration = track.duration
+	}
+	track.samples = append(track.samples, sample)
+}
+
+// fragmenter muxes the AVC or HEVC video and the AAC audio of a stream to fmp4 segments cut on the keyframes, the
+// segments are published in parts when low latency is enabled
+type fragmenter struct {
+	muxer     *Muxer
+	stream    *stream.Stream
+	playlist  *playlist
+	messages  chan *conn.Message
+	done      chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+	video     *fragmentTrack
+	audio     *fragmentTrack
+	// tracks are the tracks of the current init segment, changed is set when a sequence header changes them
+	tracks   []*fragmentTrack
+	changed  bool
+	started  bool
+	sequence uint32
+	// segment gathers the fragments of the current segment
+	segment       []byte
+	segmentStart  uint32
+	partStart     uint32
+	lastTimestamp uint32
+}
+
+func startFragmenter(muxer *Muxer, fragmentedStream *stream.Stream, segmentsPlaylist *playlist) *fragmenter {
+	newFragmenter := &fragmenter{
+		muxer:    muxer,
+		stream:   fragmentedStream,
+		playlist: segmentsPlaylist,
+		messages: make(chan *conn.Message, segmenterQueueSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go newFragmenter.run()
+	return newFragmenter
+}
+
+func (fragmenter *fragmenter) WriteMessage(media *conn.Message) error {
+	select {
+	case <-fragmenter.done:
+		return errFragmenterTooSlow
+	default:
+	}
+	select {
+	case fragmenter.messages <- media:
+		return nil
+	default:
+		logger.Get().Errorf("hls fragmenter of %s stopped, it is too slow", fragmenter.stream.Key())
+		return errFragmenterTooSlow
+	}
+}
+
+// Close waits for the queued messages to be muxed and the playlist to be ended
+func (fragmenter *fragmenter) Close() error {
+	fragmenter.closeOnce.Do(func() {
+		close(fragmenter.done)
+	})
+	<-fragmenter.finished
+	return nil
+}
+
+func (fragmenter *fragmenter) run() {
+	defer close(fragmenter.finished)
+	for {
+		select {
+		case media := <-fragmenter.messages:
+			fragmenter.write(media)
+		case <-fragmenter.done:
+			for len(fragmenter.messages) > 0 {
+				fragmenter.write(<-fragmenter.messages)
+			}
+			if fragmenter.started {
+				fragmenter.complete(fragmenter.lastTimestamp)
+			}
+			err := fragmenter.playlist.end()
+			if err != nil {
+				logger.Get().Errorf("error ending the hls playlist of %s: %s", fragmenter.stream.Key(), err)
+			}
+			fragmenter.muxer.ended(fragmenter.stream.Key(), fragmenter.playlist)
+			return
+		}
+	}
+}
+
+func (fragmenter *fragmenter) write(media *conn.Message) {
+	switch media.TypeId {
+	case flv.TagTypeVideo:
+		fragmenter.writeVideo(media)
+	case flv.TagTypeAudio:
+		fragmenter.writeAudio(media)
+	}
+}
+
+func (fragmenter *fragmenter) writeVideo(media *conn.Message) {
+	header, err := flv.ParseVideoTagHeader(media.Data)
+	if err != nil || header.IsMultitrack {
+		return
+	}
+	payload := media.Data[header.Size():]
+	if header.IsSequenceHeader() {
+		track, err := videoTrack(header, payload)
+		if err != nil {
+			logger.Get().Debugf("video of %s not muxed to hls: %s", fragmenter.stream.Key(), err)
+		}
+		fragmenter.video = track
+		fragmenter.changed = true
+		return
+	}
+	if fragmenter.video == nil || !isCodedFrames(header) {
+		return
+	}
+	keyframe := header.IsKeyframe()
+	if keyframe {
+		fragmenter.cut(media.Timestamp)
+	}
+	fragmenter.writeSample(fragmenter.video, media.Timestamp, fmp4Sample{
+		dts:               fragmenter.video.timestamp(media.Timestamp, 0),
+		compositionOffset: int32(fragmenter.video.timestamp(0, header.CompositionTime)),
+		keyframe:          keyframe,
+		data:              payload,
+	})
+}
+
+func (fragmenter *fragmenter) writeAudio(media *conn.Message) {
+	header, err := flv.ParseAudioTagHeader(media.Data)
+	if err != nil || header.IsMultitrack || (header.SoundFormat != flv.SoundFormatAAC && header.FourCC != flv.FourCCAAC) {
+		return
+	}
+	payload := media.Data[header.Size():]
+	if header.IsSequenceHeader() {
+		track, err := audioTrack(payload)
+		if err != nil {
+			logger.Get().Debugf("audio of %s not muxed to hls: %s", fragmenter.stream.Key(), err)
+		}
+		fragmenter.audio = track
+		fragmenter.changed = true
+		return
+	}
+	if fragmenter.audio == nil || (header.IsExHeader && header.PacketType != flv.AudioPacketTypeCodedFrames) {
+		return
+	}
+	if fragmenter.video == nil {
+		fragmenter.cut(media.Timestamp)
+	}
+	fragmenter.writeSample(fragmenter.audio, media.Timestamp, fmp4Sample{
+		dts:      fragmenter.audio.timestamp(media.Timestamp, 0),
+		keyframe: true,
+		data:     payload,
+	})
+}
+
+// writeSample queues a sample of a track of the current init segment, after publishing the current part once
+// the sample would make it longer than the part duration
+func (fragmenter *fragmenter) writeSample(track *fragmentTrack, timestamp uint32, sample fmp4Sample) {
+	if !fragmenter.started || !fragmenter.hasTrack(track) {
+		return
+	}
+	track.push(sample)
+	partDuration := fragmenter.muxer.Config.PartDuration
+	if partDuration > 0 && len(track.samples) > 1 && timestamp > fragmenter.partStart {
+		frameDuration := time.Duration(track.duration) * time.Second / time.Duration(track.timescale)
+		if time.Duration(timestamp-fragmenter.partStart)*time.Millisecond+frameDuration > partDuration {
+			// the new sample starts the next part
+			track.samples = track.samples[:len(track.samples)-1]
+			fragmenter.flush(timestamp)
+			track.samples = append(track.samples, sample)
+		}
+	}
+	fragmenter.lastTimestamp = timestamp
+}
+
+func (fragmenter *fragmenter) hasTrack(track *fragmentTrack) bool {
+	for _, candidate := range fragmenter.tracks {
+		if candidate == track {
+			return true
+		}
+	}
+	return false
+}
+
+// cut completes the current segment once it lasts the target duration, or when the tracks changed, and starts
+// the next one with a new init segment when needed
+func (fragmenter *fragmenter) cut(timestamp uint32) {
+	if fragmenter.started {
+		duration := time.Duration(timestamp-fragmenter.segmentStart) * time.Millisecond
+		if duration < fragmenter.muxer.Config.TargetDuration && !fragmenter.changed {
+			return
+		}
+		fragmenter.complete(timestamp)
+	}
+	if fragmenter.changed {
+		fragmenter.tracks = nil
+		var tracks []*fmp4Track
+		for _, track := range []*fragmentTrack{fragmenter.video, fragmenter.audio} {
+			if track != nil {
+				track.samples = nil
+				fragmenter.tracks = append(fragmenter.tracks, track)
+				tracks = append(tracks, track.fmp4Track)
+			}
+		}
+		err := fragmenter.playlist.setInit(initSegment(tracks), tracks)
+		if err != nil {
+			logger.Get().Errorf("error writing the hls init segment of %s: %s", fragmenter.stream.Key(), err)
+		}
+		fragmenter.changed = false
+	}
+	fragmenter.started = true
+	fragmenter.segmentStart = timestamp
+	fragmenter.partStart = timestamp
+	fragmenter.lastTimestamp = timestamp
+}
+
+// flush publishes the queued samples as a fragment ending at the given timestamp, a part of the segment when
+// low latency is enabled
+func (fragmenter *fragmenter) flush(timestamp uint32) {
+	var tracks []*fmp4Track
+	var samples [][]fmp4Sample
+	independent := true
+	for _, track := range fragmenter.tracks {
+		if len(track.samples) == 0 {
+			continue
+		}
+		last := &track.samples[len(track.samples)-1]
+		if end := track.timestamp(timestamp, 0); end > last.dts {
+			last.duration = uint32(end - last.dts)
+		} else {
+			last.duration = track.duration
+		}
+		if track.video {
+			independent = track.samples[0].keyframe
+		}
+		tracks = append(tracks, track.fmp4Track)
+		samples = append(samples, track.samples)
+		track.samples = nil
+	}
+	if len(tracks) == 0 {
+		return
+	}
+	fragmenter.sequence++
+	data := fragment(fragmenter.sequence, tracks, samples)
+	fragmenter.segment = append(fragmenter.segment, data...)
+	if fragmenter.muxer.Config.PartDuration > 0 {
+		duration := time.Duration(timestamp-fragmenter.partStart) * time.Millisecond
+		err := fragmenter.playlist.addPart(data, duration, independent, fragmenter.segmentStart)
+		if err != nil {
+			logger.Get().Errorf("error writing the hls part of %s: %s", fragmenter.stream.Key(), err)
+		}
+	}
+	fragmenter.partStart = timestamp
+}
+
+func (fragmenter *fragmenter) complete(timestamp uint32) {
+	fragmenter.flush(timestamp)
+	duration := time.Duration(timestamp-fragmenter.segmentStart) * time.Millisecond
+	err := fragmenter.playlist.add(fragmenter.segment, duration, fragmenter.segmentStart)
+	if err != nil {
+		logger.Get().Errorf("error writing the hls segment of %s: %s", fragmenter.stream.Key(), err)
+	}
+	fragmenter.segment = nil
+	fragmenter.started = false
+}
+
+// videoTrack reads the sequence header of an AVC or HEVC stream, legacy or enhanced
+func videoTrack(header *flv.VideoTagHeader, payload []byte) (*fragmentTrack, error) {
+	track := &fmp4Track{id: videoTrackId, video: true, timescale: videoTimescale}
+	var sps *codec.SPS
+	var entryType, configType string
+	switch {
+	case isAVC(header):
+		record, err := flv.ParseAVCDecoderConfigurationRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(record.SPS) > 0 {
+			sps, _ = codec.ParseH264SPS(record.SPS[0])
+		}
+		entryType, configType, track.codec = "avc1", "avcC", avcCodec(payload)
+	case isHEVC(header):
+		record, err := flv.ParseHEVCDecoderConfigurationRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(record.SPS) > 0 {
+			sps, _ = codec.ParseHEVCSPS(record.SPS[0])
+		}
+		entryType, configType, track.codec = "hvc1", "hvcC", hevcCodec(payload)
+	default:
+		return nil, fmt.Errorf("%w: video codec %d %q", errUnsupportedCodec, header.CodecId, header.FourCC)
+	}
+	if sps != nil {
+		track.width, track.height = sps.Width, sps.Height
+	}
+	track.sampleEntry = videoSampleEntry(entryType, configType, payload, track.width, track.height)
+	return &fragmentTrack{fmp4Track: track}, nil
+}
+
+// audioTrack reads the AudioSpecificConfig of an AAC stream, its timescale is the sampling frequency
+func audioTrack(payload []byte) (*fragmentTrack, error) {
+	config, err := codec.ParseAudioSpecificConfig(payload)
+	if err != nil {
+		return nil, err
+	}
+	track := &fmp4Track{
+		id:          audioTrackId,
+		timescale:   uint32(config.SamplingFrequency),
+		sampleEntry: audioSampleEntry(payload, config.SamplingFrequency, config.Channels()),
+		codec:       fmt.Sprintf("mp4a.40.%d", config.ObjectType),
+	}
+	return &fragmentTrack{fmp4Track: track}, nil
+}
@@ -0,0 +1,388 @@
+package hls
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"rtmp/logger"
+	"rtmp/server"
+	"rtmp/stream"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the formats of the segments
+const (
+	FormatTS   = "ts"
+	FormatFMP4 = "fmp4"
+)
+
+type Config struct {
+	// Directory stores the segments and the playlists on disk, they are kept in memory when empty
+	Directory string
+	// Apps lists the applications whose streams are muxed, every one when empty
+	Apps []string
+	// TargetDuration is the minimum duration of a segment, they are cut at the next keyframe
+	TargetDuration time.Duration
+	// PlaylistSize is the number of segments of the sliding window playlists
+	PlaylistSize int
+	// Event keeps every segment of a publication in an EVENT playlist instead of a sliding window
+	Event bool
+	// Retention is how long the playlist of an ended stream stays in memory
+	Retention time.Duration
+	// Format is FormatTS or FormatFMP4, the fmp4 segments are also listed by a dash manifest
+	Format string
+	// PartDuration enables low latency HLS, the fmp4 segments are published in parts of at most this duration
+	PartDuration time.Duration
+	// ViewerTimeout is how long a viewer stays admitted after its last request, three target durations when
+	// zero
+	ViewerTimeout time.Duration
+}
+
+// Muxer converts the published streams to HLS and serves them over http:
+//
+//	GET /{app}/{stream}/index.m3u8
+//	GET /{app}/{stream}/{sequence}.ts
+//
+// and in the fmp4 format:
+//
+//	GET /{app}/{stream}/manifest.mpd
+//	GET /{app}/{stream}/init{generation}.mp4
+//	GET /{app}/{stream}/{sequence}.m4s
+//	GET /{app}/{stream}/{sequence}.{part}.m4s
+//
+// The low latency playlists block until the segment or part of the _HLS_msn and _HLS_part parameters is
+// listed, as do the requests of the part announced by the preload hint.
+type Muxer struct {
+	server.NopHandler
+	Config  Config
+	Streams *stream.Registry
+	// Admit is called on the first request of a viewer, an error rejects it. The viewers hold no connection, a
+	// viewer is an address polling a stream and it is released once it stopped for Config.ViewerTimeout
+	Admit     func(request *http.Request, app string, name string) (release func(), err error)
+	playlists map[string]*playlist
+	viewers   map[string]*viewer
+	mutex     sync.Mutex
+	mux       *http.ServeMux
+}
+
+// viewer is an admitted address polling a stream
+type viewer struct {
+	release func()
+	seenAt  time.Time
+	timer   *time.Timer
+}
+
+func NewMuxer(config Config, streams *stream.Registry) *Muxer {
+	if config.TargetDuration == 0 {
+		config.TargetDuration = 4 * time.Second
+	}
+	if config.PlaylistSize == 0 {
+		config.PlaylistSize = 5
+	}
+	if config.Retention == 0 {
+		config.Retention = time.Minute
+	}
+	if config.Format == "" {
+		config.Format = FormatTS
+	}
+	if config.ViewerTimeout == 0 {
+		config.ViewerTimeout = 3 * config.TargetDuration
+	}
+	muxer := &Muxer{
+		Config:    config,
+		Streams:   streams,
+		playlists: make(map[string]*playlist),
+		viewers:   make(map[string]*viewer),
+		mux:       http.NewServeMux(),
+	}
+	muxer.mux.HandleFunc("GET /{app}/{stream}/"+playlistName, muxer.servePlaylist)
+	muxer.mux.HandleFunc("GET /{app}/{stream}/"+manifestName, muxer.serveManifest)
+	muxer.mux.HandleFunc("GET /{app}/{stream}/{segment}", muxer.serveSegment)
+	return muxer
+}
+
+func (muxer *Muxer) OnPublish(_ *server.Session, request *server.PublishRequest) error {
+	if len(muxer.Config.Apps) > 0 && !slices.Contains(muxer.Config.Apps, request.App) {
+		return nil
+	}
+	publishedStream, ok := muxer.Streams.Get(request.App, request.Name)
+	if !ok {
+		return nil
+	}
+	streamPlaylist, err := muxer.openPlaylist(publishedStream)
+	if err != nil {
+		logger.Get().Errorf("error starting the hls playlist of %s: %s", publishedStream.Key(), err)
+		return nil
+	}
+	var subscriber stream.Subscriber
+	if muxer.Config.Format == FormatFMP4 {
+		subscriber = startFragmenter(muxer, publishedStream, streamPlaylist)
+	} else {
+		subscriber = startSegmenter(muxer, publishedStream, streamPlaylist)
+	}
+	err = publishedStream.Subscribe(subscriber)
+	if err != nil {
+		_ = subscriber.Close()
+	}
+	return nil
+}
+
+// openPlaylist continues the playlist of a stream published again while it is still retained
+func (muxer *Muxer) openPlaylist(publishedStream *stream.Stream) (*playlist, error) {
+	muxer.mutex.Lock()
+	defer muxer.mutex.Unlock()
+	if existing, ok := muxer.playlists[publishedStream.Key()]; ok {
+		existing.restart()
+		return existing, nil
+	}
+	directory := ""
+	if muxer.Config.Directory != "" {
+		directory = filepath.Join(muxer.Config.Directory, sanitize(publishedStream.App), sanitize(publishedStream.Name))
+	}
+	newPlaylist, err := newPlaylist(muxer.Config, directory)
+	if err != nil {
+		return nil, err
+	}
+	muxer.playlists[publishedStream.Key()] = newPlaylist
+	return newPlaylist, nil
+}
+
+// ended forgets the playlist of an ended stream after the retention, unless the stream is published again
+func (muxer *Muxer) ended(key string, endedPlaylist *playlist) {
+	time.AfterFunc(muxer.Config.Retention, func() {
+		muxer.mutex.Lock()
+		defer muxer.mutex.Unlock()
+		if muxer.playlists[key] == endedPlaylist && endedPlaylist.expired() {
+			delete(muxer.playlists, key)
+		}
+	})
+}
+
+// admit writes the rejection of the viewers Admit refuses, the requests of the viewers admitted only keep them
+// admitted
+func (muxer *Muxer) admit(writer http.ResponseWriter, request *http.Request) bool {
+	if muxer.Admit == nil {
+		return true
+	}
+	app, name := request.PathValue("app"), request.PathValue("stream")
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	key := host + " " + stream.Key(app, name)
+	if muxer.seen(key) {
+		return true
+	}
+	release, err := muxer.Admit(request, app, name)
+	if err != nil {
+		logger.Get().Debugf("hls viewer of %s rejected: %s", stream.Key(app, name), err)
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	muxer.mutex.Lock()
+	defer muxer.mutex.Unlock()
+	if _, ok := muxer.viewers[key]; ok {
+		// admitted by a concurrent request
+		release()
+		return true
+	}
+	admitted := &viewer{release: release, seenAt: time.Now()}
+	admitted.timer = time.AfterFunc(muxer.Config.ViewerTimeout, func() {
+		muxer.expire(key, admitted)
+	})
+	muxer.viewers[key] = admitted
+	return true
+}
+
+// seen tells whether a viewer is admitted and keeps it admitted
+func (muxer *Muxer) seen(key string) bool {
+	muxer.mutex.Lock()
+	defer muxer.mutex.Unlock()
+	existing, ok := muxer.viewers[key]
+	if ok {
+		existing.seenAt = time.Now()
+	}
+	return ok
+}
+
+// expire releases a viewer once it stopped polling for the viewer timeout
+func (muxer *Muxer) expire(key string, admitted *viewer) {
+	muxer.mutex.Lock()
+	if idle := time.Since(admitted.seenAt); idle < muxer.Config.ViewerTimeout {
+		admitted.timer.Reset(muxer.Config.ViewerTimeout - idle)
+		muxer.mutex.Unlock()
+		return
+	}
+	delete(muxer.viewers, key)
+	muxer.mutex.Unlock()
+	admitted.release()
+}
+
+func (muxer *Muxer) playlist(request *http.Request) (*playlist, bool) {
+	muxer.mutex.Lock()
+	defer muxer.mutex.Unlock()
+	streamPlaylist, ok := muxer.playlists[stream.Key(request.PathValue("app"), request.PathValue("stream"))]
+	return streamPlaylist, ok
+}
+
+func (muxer *Muxer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// the players of the browsers load the playlists from other origins
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	muxer.mux.ServeHTTP(writer, request)
+}
+
+func (muxer *Muxer) servePlaylist(writer http.ResponseWriter, request *http.Request) {
+	if !muxer.admit(writer, request) {
+		return
+	}
+	streamPlaylist, ok := muxer.playlist(request)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	if streamPlaylist.lowLatency() && !muxer.block(writer, request, streamPlaylist) {
+		return
+	}
+	data, ok := streamPlaylist.encode()
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	writer.Header().Set("Cache-Control", "no-cache")
+	_, _ = writer.Write(data)
+}
+
+// block waits for the segment or part requested by a blocking playlist reload, false when the response was
+// already written
+func (muxer *Muxer) block(writer http.ResponseWriter, request *http.Request, streamPlaylist *playlist) bool {
+	query := request.URL.Query()
+	if !query.Has("_HLS_msn") {
+		if query.Has("_HLS_part") {
+			http.Error(writer, "_HLS_part without _HLS_msn", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	sequence, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+	index := -1
+	if err == nil && query.Has("_HLS_part") {
+		index, err = strconv.Atoi(query.Get("_HLS_part"))
+	}
+	// the players may only ask for the next two segments
+	if err != nil || index < -1 || sequence > streamPlaylist.sequence()+1 {
+		http.Error(writer, "invalid _HLS_msn or _HLS_part", http.StatusBadRequest)
+		return false
+	}
+	if !muxer.wait(request, streamPlaylist, sequence, index) {
+		http.Error(writer, "the segment is not available yet", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// wait blocks for three target durations at most
+func (muxer *Muxer) wait(request *http.Request, streamPlaylist *playlist, sequence uint64, index int) bool {
+	ctx, cancel := context.WithTimeout(request.Context(), 3*muxer.Config.TargetDuration)
+	defer cancel()
+	return streamPlaylist.wait(ctx, sequence, index)
+}
+
+func (muxer *Muxer) serveManifest(writer http.ResponseWriter, request *http.Request) {
+	if !muxer.admit(writer, request) {
+		return
+	}
+	streamPlaylist, ok := muxer.playlist(request)
+	if !ok || !streamPlaylist.fmp4() {
+		http.NotFound(writer, request)
+		return
+	}
+	data, ok := streamPlaylist.encodeManifest()
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/dash+xml")
+	writer.Header().Set("Cache-Control", "no-cache")
+	_, _ = writer.Write(data)
+}
+
+func (muxer *Muxer) serveSegment(writer http.ResponseWriter, request *http.Request) {
+	if !muxer.admit(writer, request) {
+		return
+	}
+	streamPlaylist, ok := muxer.playlist(request)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	name := request.PathValue("segment")
+	extension := filepath.Ext(name)
+	var data []byte
+	var path string
+	switch {
+	case extension == ".ts" && !streamPlaylist.fmp4():
+		writer.Header().Set("Content-Type", "video/mp2t")
+		data, path, ok = muxer.segment(streamPlaylist, strings.TrimSuffix(name, extension), extension)
+	case extension == ".mp4" && streamPlaylist.fmp4():
+		writer.Header().Set("Content-Type", "video/mp4")
+		data, path, ok = streamPlaylist.init(name)
+	case extension == ".m4s" && streamPlaylist.fmp4():
+		writer.Header().Set("Content-Type", "video/iso.segment")
+		if sequence, index, isPart := strings.Cut(strings.TrimSuffix(name, extension), "."); isPart {
+			data, ok = muxer.part(request, streamPlaylist, sequence, index)
+		} else {
+			data, path, ok = muxer.segment(streamPlaylist, sequence, extension)
+		}
+	default:
+		ok = false
+	}
+	if !ok {
+		writer.Header().Del("Content-Type")
+		http.NotFound(writer, request)
+		return
+	}
+	if path != "" {
+		http.ServeFile(writer, request, path)
+		return
+	}
+	_, _ = writer.Write(data)
+}
+
+func (muxer *Muxer) segment(streamPlaylist *playlist, name string, extension string) ([]byte, string, bool) {
+	sequence, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return nil, "", false
+	}
+	return streamPlaylist.segment(sequence, extension)
+}
+
+// part returns a part of a low latency segment, the requests of the next parts wait for them
+func (muxer *Muxer) part(request *http.Request, streamPlaylist *playlist, sequenceName string, indexName string) ([]byte, bool) {
+	sequence, err := strconv.ParseUint(sequenceName, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	index, err := strconv.Atoi(indexName)
+	if err != nil || index < 0 {
+		return nil, false
+	}
+	if sequence <= streamPlaylist.sequence() {
+		muxer.wait(request, streamPlaylist, sequence, index)
+	}
+	return streamPlaylist.part(sequence, index)
+}
+
+// sanitize keeps the names sent by the peers from escaping the segments directory
+func sanitize(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
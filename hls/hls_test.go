@@ -0,0 +1,374 @@
+package hls_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rtmp/conn"
+	"rtmp/hls"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0x00, 0x0A, 0xF8, 0x41, 0xA2}
+	testPPS = []byte{0x68, 0xCE, 0x38, 0x80}
+)
+
+func startTestingMuxer(t *testing.T, config hls.Config) (*server.Server, *httptest.Server) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	if config.TargetDuration == 0 {
+		config.TargetDuration = time.Second
+	}
+	muxer := hls.NewMuxer(config, testServer.Streams)
+	testServer.Handler = muxer
+	httpServer := httptest.NewServer(muxer)
+	t.Cleanup(httpServer.Close)
+	return testServer, httpServer
+}
+
+// publishTestStream sends the sequence headers and a keyframe, an inter frame and an audio frame every second
+func publishTestStream(t *testing.T, clientConn *conn.Conn, seconds int) {
+	t.Helper()
+	streamId := publishTestHeaders(t, clientConn)
+	for second := range seconds {
+		sendTestSecond(t, clientConn, streamId, second)
+	}
+}
+
+func publishTestHeaders(t *testing.T, clientConn *conn.Conn) uint32 {
+	t.Helper()
+	streamId := testutil.PublishTestStream(t, clientConn, "testStream")
+	sequenceHeader := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0x00, 0x0A, 0xFF, 0xE1, 0x00, byte(len(testSPS))}
+	sequenceHeader = append(sequenceHeader, testSPS...)
+	sequenceHeader = append(append(sequenceHeader, 0x01, 0x00, byte(len(testPPS))), testPPS...)
+	testutil.SendTestHeaders(t, clientConn, streamId, 0, sequenceHeader)
+	return streamId
+}
+
+func sendTestSecond(t *testing.T, clientConn *conn.Conn, streamId uint32, second int) {
+	t.Helper()
+	timestamp := uint32(second * 1000)
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeVideo, timestamp, []byte{0x17, 0x01, 0, 0, 40, 0, 0, 0, 3, 0x65, 0x88, 0x84})
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeAudio, timestamp, []byte{0xAF, 0x01, 0x21, 0x10})
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeVideo, timestamp+500, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9A})
+}
+
+func getTest(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return response.StatusCode, body
+}
+
+// waitTestPlaylist waits for the playlist to end
+func waitTestPlaylist(t *testing.T, url string) string {
+	t.Helper()
+	var playlist []byte
+	assert.Eventually(t, func() bool {
+		var status int
+		status, playlist = getTest(t, url)
+		return status == http.StatusOK && bytes.Contains(playlist, []byte("#EXT-X-ENDLIST"))
+	}, 3*time.Second, 10*time.Millisecond)
+	return string(playlist)
+}
+
+// demuxTestSegment checks the packets of a segment and returns the payloads of each pid
+func demuxTestSegment(t *testing.T, segment []byte) map[uint16][]byte {
+	t.Helper()
+	assert.Zero(t, len(segment)%188)
+	payloads := make(map[uint16][]byte)
+	continuity := make(map[uint16]byte)
+	for offset := 0; offset+188 <= len(segment); offset += 188 {
+		packet := segment[offset : offset+188]
+		assert.Equal(t, byte(0x47), packet[0])
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		if expected, ok := continuity[pid]; ok {
+			assert.Equal(t, expected, packet[3]&0x0F)
+		}
+		continuity[pid] = (packet[3] + 1) & 0x0F
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		payloads[pid] = append(payloads[pid], payload...)
+	}
+	return payloads
+}
+
+func TestMuxStream(t *testing.T) {
+	testServer, httpServer := startTestingMuxer(t, hls.Config{})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	publishTestStream(t, clientConn, 3)
+	_ = clientConn.Close()
+
+	playlist := waitTestPlaylist(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+		"#EXTINF:1.000,\n0.ts\n#EXTINF:1.000,\n1.ts\n#EXTINF:0.500,\n2.ts\n#EXT-X-ENDLIST\n", playlist)
+
+	status, segment := getTest(t, httpServer.URL+"/testApp/testStream/1.ts")
+	assert.Equal(t, http.StatusOK, status)
+	payloads := demuxTestSegment(t, segment)
+	// the program association table points to the program map table, which lists H.264 and AAC
+	assert.Equal(t, []byte{0x00, 0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0x2A, 0xB1, 0x04, 0xB2}, payloads[0x0000][:17])
+	assert.Equal(t, []byte{0x1B, 0xE1, 0x00, 0xF0, 0x00, 0x0F, 0xE1, 0x01, 0xF0, 0x00}, payloads[0x1000][13:23])
+	// the keyframe has its access unit delimiter and parameter sets in Annex B, with its presentation time
+	video := payloads[0x0100]
+	assert.Equal(t, []byte{0x00, 0x00, 0x01, 0xE0}, video[:4])
+	assert.Equal(t, byte(0xC0), video[7])
+	keyframe := []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 0, 1}
+	keyframe = append(append(keyframe, testSPS...), 0, 0, 0, 1)
+	keyframe = append(append(keyframe, testPPS...), 0, 0, 0, 1, 0x65, 0x88, 0x84)
+	assert.Equal(t, keyframe, video[19:19+len(keyframe)])
+	// 1040 ms then 1000 ms at 90 kHz
+	assert.Equal(t, []byte{0x31, 0x00, 0x05, 0xDB, 0x41}, video[9:14])
+	assert.Equal(t, []byte{0x11, 0x00, 0x05, 0xBF, 0x21}, video[14:19])
+	// the audio frame has its adts header
+	audio := payloads[0x0101]
+	assert.Equal(t, []byte{0x00, 0x00, 0x01, 0xC0, 0x00, 0x11}, audio[:6])
+	assert.Equal(t, []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x3F, 0xFC, 0x21, 0x10}, audio[14:23])
+
+	status, _ = getTest(t, httpServer.URL+"/testApp/testStream/3.ts")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = getTest(t, httpServer.URL+"/testApp/unknown/index.m3u8")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMuxSlidingWindow(t *testing.T) {
+	testServer, httpServer := startTestingMuxer(t, hls.Config{PlaylistSize: 2})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	publishTestStream(t, clientConn, 8)
+	_ = clientConn.Close()
+
+	playlist := waitTestPlaylist(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:6\n")
+	assert.Equal(t, 2, strings.Count(playlist, "#EXTINF"))
+	// the segments which left the window are kept for another window
+	status, _ := getTest(t, httpServer.URL+"/testApp/testStream/4.ts")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = getTest(t, httpServer.URL+"/testApp/testStream/3.ts")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMuxEventPlaylistToDisk(t *testing.T) {
+	directory := t.TempDir()
+	testServer, httpServer := startTestingMuxer(t, hls.Config{PlaylistSize: 2, Event: true, Directory: directory})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	publishTestStream(t, clientConn, 4)
+	_ = clientConn.Close()
+
+	playlist := waitTestPlaylist(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+	assert.Contains(t, playlist, "#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	assert.Equal(t, 4, strings.Count(playlist, "#EXTINF"))
+	written, err := os.ReadFile(filepath.Join(directory, "testApp", "testStream", "index.m3u8"))
+	assert.NoError(t, err)
+	assert.Equal(t, playlist, string(written))
+	segment, err := os.ReadFile(filepath.Join(directory, "testApp", "testStream", "0.ts"))
+	assert.NoError(t, err)
+	status, served := getTest(t, httpServer.URL+"/testApp/testStream/0.ts")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, segment, served)
+}
+
+func TestMuxRepublishedStream(t *testing.T) {
+	testServer, httpServer := startTestingMuxer(t, hls.Config{})
+	for range 2 {
+		clientConn := testutil.DialTestingServer(t, testServer)
+		publishTestStream(t, clientConn, 2)
+		_ = clientConn.Close()
+		waitTestPlaylist(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+		assert.Eventually(t, func() bool {
+			_, ok := testServer.Streams.Get("testApp", "testStream")
+			return !ok
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+	// the second publication continues the playlist after a discontinuity
+	_, playlist := getTest(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+	assert.Contains(t, string(playlist), "1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:1.000,\n2.ts\n")
+}
+
+type testBox struct {
+	boxType string
+	payload []byte
+}
+
+// readTestBoxes splits the boxes of an mp4 file or of the payload of a container box
+func readTestBoxes(t *testing.T, data []byte) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if !assert.True(t, size >= 8 && size <= len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, testBox{boxType: string(data[4:8]), payload: data[8:size]})
+		data = data[size:]
+	}
+	assert.Empty(t, data)
+	return boxes
+}
+
+func TestMuxFMP4Stream(t *testing.T) {
+	testServer, httpServer := startTestingMuxer(t, hls.Config{Format: hls.FormatFMP4})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	publishTestStream(t, clientConn, 3)
+	_ = clientConn.Close()
+
+	playlist := waitTestPlaylist(t, httpServer.URL+"/testApp/testStream/index.m3u8")
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-MAP:URI=\"init0.mp4\"\n"+
+		"#EXTINF:1.000,\n0.m4s\n#EXTINF:1.000,\n1.m4s\n#EXTINF:0.500,\n2.m4s\n#EXT-X-ENDLIST\n", playlist)
+
+	// the init segment carries the decoder configurations
+	status, init := getTest(t, httpServer.URL+"/testApp/testStream/init0.mp4")
+	assert.Equal(t, http.StatusOK, status)
+	boxes := readTestBoxes(t, init)
+	assert.Equal(t, "ftyp", boxes[0].boxType)
+	assert.Equal(t, "moov", boxes[1].boxType)
+	record := append([]byte{0x01, 0x42, 0x00, 0x0A, 0xFF, 0xE1, 0x00, byte(len(testSPS))}, testSPS...)
+	assert.True(t, bytes.Contains(init, append([]byte("avcC"), record...)))
+	assert.True(t, bytes.Contains(init, []byte{0x05, 0x80, 0x80, 0x80, 0x02, 0x12, 0x10}))
+
+	status, segment := getTest(t, httpServer.URL+"/testApp/testStream/1.m4s")
+	assert.Equal(t, http.StatusOK, status)
+	boxes = readTestBoxes(t, segment)
+	if !assert.Len(t, boxes, 2) {
+		return
+	}
+	assert.Equal(t, "moof", boxes[0].boxType)
+	assert.Equal(t, "mdat", boxes[1].boxType)
+	assert.Equal(t, []byte{0, 0, 0, 3, 0x65, 0x88, 0x84, 0, 0, 0, 2, 0x41, 0x9A, 0x21, 0x10}, boxes[1].payload)
+	trafs := readTestBoxes(t, boxes[0].payload)[1:]
+	if !assert.Len(t, trafs, 2) {
+		return
+	}
+	// the video starts at 1000 ms at 90 kHz with its samples of 500 ms, the keyframe is displayed 40 ms later
+	video := readTestBoxes(t, trafs[0].payload)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0x01, 0x5F, 0x90}, video[1].payload[3:])
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, byte(len(boxes[0].payload) + 16)}, video[2].payload[4:12])
+	assert.Equal(t, []byte{0, 0, 0xAF, 0xC8, 0, 0, 0, 7, 0x02, 0, 0, 0, 0, 0, 0x0E, 0x10}, video[2].payload[12:28])
+	assert.Equal(t, []byte{0, 0, 0xAF, 0xC8, 0, 0, 0, 6, 0x01, 0x01, 0, 0, 0, 0, 0, 0}, video[2].payload[28:44])
+	// the audio starts at 1000 ms at 44.1 kHz
+	audio := readTestBoxes(t, trafs[1].payload)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0xAC, 0x44}, audio[1].payload[4:])
+
+	status, manifest := getTest(t, httpServer.URL+"/testApp/testStream/manifest.mpd")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, string(manifest), `type="static" mediaPresentationDuration="PT2.500S"`)
+	assert.Contains(t, string(manifest), `codecs="avc1.42000A,mp4a.40.2"`)
+	assert.Contains(t, string(manifest), `initialization="init0.mp4" media="$Number$.m4s" startNumber="0"`)
+	assert.Contains(t, string(manifest), `<S t="1000" d="1000"/>`)
+
+	status, _ = getTest(t, httpServer.URL+"/testApp/testStream/1.ts")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMuxLowLatency(t *testing.T) {
+	testServer, httpServer := startTestingMuxer(t, hls.Config{Format: hls.FormatFMP4, PartDuration: 500 * time.Millisecond})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := publishTestHeaders(t, clientConn)
+	sendTestSecond(t, clientConn, streamId, 0)
+
+	url := httpServer.URL + "/testApp/testStream/index.m3u8"
+	var playlist []byte
+	assert.Eventually(t, func() bool {
+		_, playlist = getTest(t, url)
+		return bytes.Contains(playlist, []byte("0.0.m4s"))
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n"+
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500\n#EXT-X-PART-INF:PART-TARGET=0.500\n"+
+		"#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-MAP:URI=\"init0.mp4\"\n"+
+		"#EXT-X-PART:DURATION=0.500,URI=\"0.0.m4s\",INDEPENDENT=YES\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"0.1.m4s\"\n", string(playlist))
+
+	// the blocking reload and the preload hint wait for the next part
+	blocked := make(chan []byte)
+	go func() {
+		_, body := getTest(t, url+"?_HLS_msn=1&_HLS_part=0")
+		blocked <- body
+	}()
+	hinted := make(chan []byte)
+	go func() {
+		_, body := getTest(t, httpServer.URL+"/testApp/testStream/0.1.m4s")
+		hinted <- body
+	}()
+	status, _ := getTest(t, url+"?_HLS_msn=3")
+	assert.Equal(t, http.StatusBadRequest, status)
+	sendTestSecond(t, clientConn, streamId, 1)
+	select {
+	case body := <-blocked:
+		assert.Contains(t, string(body), "#EXT-X-PART:DURATION=0.500,URI=\"0.1.m4s\"\n#EXTINF:1.000,\n0.m4s\n"+
+			"#EXT-X-PART:DURATION=0.500,URI=\"1.0.m4s\",INDEPENDENT=YES\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"1.1.m4s\"\n")
+	case <-time.After(3 * time.Second):
+		t.Fatal("the blocking reload did not return")
+	}
+	select {
+	case body := <-hinted:
+		assert.Equal(t, "moof", readTestBoxes(t, body)[0].boxType)
+	case <-time.After(3 * time.Second):
+		t.Fatal("the preload hint did not return")
+	}
+
+	// a segment is the concatenation of its parts
+	_, first := getTest(t, httpServer.URL+"/testApp/testStream/0.0.m4s")
+	_, second := getTest(t, httpServer.URL+"/testApp/testStream/0.1.m4s")
+	_, segment := getTest(t, httpServer.URL+"/testApp/testStream/0.m4s")
+	assert.Equal(t, append(first, second...), segment)
+	_ = clientConn.Close()
+}
+
+func TestMuxAdmitsViewers(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxPlayersPerStream: 1})
+	muxer := hls.NewMuxer(hls.Config{TargetDuration: time.Second, ViewerTimeout: 200 * time.Millisecond}, testServer.Streams)
+	muxer.Admit = func(_ *http.Request, app string, name string) (func(), error) {
+		if name != "testStream" {
+			return nil, errors.New("not allowed")
+		}
+		err := testServer.AdmitPlayer(app, name)
+		if err != nil {
+			return nil, err
+		}
+		return func() { testServer.ReleasePlayer(app, name) }, nil
+	}
+	testServer.Handler = muxer
+	clientConn := testutil.DialTestingServer(t, testServer)
+	publishTestStream(t, clientConn, 2)
+	_ = clientConn.Close()
+	serveTest := func(remoteAddr string, path string) int {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		muxer.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Eventually(t, func() bool {
+		return serveTest("192.0.2.1:1000", "/testApp/testStream/index.m3u8") == http.StatusOK
+	}, 3*time.Second, 10*time.Millisecond)
+	// the viewer polling from another port is the same one, the other addresses are beyond the limit
+	assert.Equal(t, http.StatusOK, serveTest("192.0.2.1:1001", "/testApp/testStream/0.ts"))
+	assert.Equal(t, http.StatusForbidden, serveTest("192.0.2.2:1000", "/testApp/testStream/index.m3u8"))
+	assert.Equal(t, http.StatusForbidden, serveTest("192.0.2.1:1000", "/testApp/denied/index.m3u8"))
+	assert.Equal(t, http.StatusForbidden, serveTest("192.0.2.1:1000", "/testApp/denied/0.ts"))
+
+	// the slot is released once the viewer stops polling
+	assert.Eventually(t, func() bool {
+		return serveTest("192.0.2.2:1000", "/testApp/testStream/index.m3u8") == http.StatusOK
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,501 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	playlistName = "index.m3u8"
+	manifestName = "manifest.mpd"
+)
+
+// partHoldBack is the number of part durations the low latency players stay behind the live edge
+const partHoldBack = 3
+
+type segment struct {
+	sequence      uint64
+	duration      time.Duration
+	discontinuity bool
+	extension     string
+	// start is the timestamp of the first frame in milliseconds
+	start uint32
+	// initName is the init segment of the fmp4 segments
+	initName string
+	// parts are the parts of a low latency segment, dropped once they leave the end of the playlist
+	parts []*part
+	// data is nil when the segment is stored on disk
+	data []byte
+}
+
+type part struct {
+	duration    time.Duration
+	independent bool
+	data        []byte
+}
+
+func (segment *segment) name() string {
+	return strconv.FormatUint(segment.sequence, 10) + segment.extension
+}
+
+func partName(sequence uint64, index int) string {
+	return fmt.Sprintf("%d.%d.m4s", sequence, index)
+}
+
+// playlist is the window of segments of a stream, written by its segmenter and read by the http handler. The
+// segments leaving a sliding window are kept for another window since the players may still load them.
+type playlist struct {
+	config Config
+	// directory stores the segments and the playlist, empty when they are kept in memory
+	directory     string
+	mutex         sync.RWMutex
+	segments      []*segment
+	nextSequence  uint64
+	discontinuity bool
+	ended         bool
+	endedAt       time.Time
+	// current is the low latency segment whose parts are published, nil between segments
+	current *segment
+	// updated is closed and replaced on every change, for the blocking playlist reloads
+	updated chan struct{}
+	// inits are the init segments of the fmp4 segments by name, nil when they are stored on disk
+	inits      map[string][]byte
+	initName   string
+	generation int
+	codecs     string
+	width      int
+	height     int
+	// availabilityStart is the wall clock time of the timestamp zero of the current init segment
+	availabilityStart time.Time
+}
+
+func newPlaylist(config Config, directory string) (*playlist, error) {
+	if directory != "" {
+		err := os.MkdirAll(directory, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &playlist{config: config, directory: directory, updated: make(chan struct{}), inits: make(map[string][]byte)}, nil
+}
+
+func (playlist *playlist) fmp4() bool {
+	return playlist.config.Format == FormatFMP4
+}
+
+func (playlist *playlist) lowLatency() bool {
+	return playlist.fmp4() && playlist.config.PartDuration > 0
+}
+
+// notify wakes up the blocked playlist reloads
+func (playlist *playlist) notify() {
+	close(playlist.updated)
+	playlist.updated = make(chan struct{})
+}
+
+// restart continues the playlist of a stream published again, after a discontinuity
+func (playlist *playlist) restart() {
+	playlist.mutex.Lock()
+	defer playlist.mutex.Unlock()
+	playlist.ended = false
+	playlist.discontinuity = len(playlist.segments) > 0
+}
+
+// setInit starts the fmp4 segments with a new init segment, the segments before it keep theirs
+func (playlist *playlist) setInit(data []byte, tracks []*fmp4Track) error {
+	playlist.mutex.Lock()
+	defer playlist.mutex.Unlock()
+	name := fmt.Sprintf("init%d.mp4", playlist.generation)
+	playlist.generation++
+	if playlist.directory != "" {
+		err := os.WriteFile(filepath.Join(playlist.directory, name), data, 0644)
+		if err != nil {
+			return err
+		}
+		data = nil
+	}
+	playlist.inits[name] = data
+	playlist.initName = name
+	playlist.availabilityStart = time.Time{}
+	// the tracks or their encoding changed
+	playlist.discontinuity = playlist.discontinuity || len(playlist.segments) > 0
+	var codecs []string
+	playlist.width, playlist.height = 0, 0
+	for _, track := range tracks {
+		codecs = append(codecs, track.codec)
+		if track.video {
+			playlist.width, playlist.height = track.width, track.height
+		}
+	}
+	playlist.codecs = strings.Join(codecs, ",")
+	return nil
+}
+
+// currentSegment returns the segment being built, started at the given timestamp
+func (playlist *playlist) currentSegment(start uint32) *segment {
+	if playlist.current == nil {
+		extension := ".ts"
+		if playlist.fmp4() {
+			extension = ".m4s"
+		}
+		playlist.current = &segment{
+			sequence:      playlist.nextSequence,
+			discontinuity: playlist.discontinuity,
+			extension:     extension,
+			start:         start,
+			initName:      playlist.initName,
+		}
+		playlist.nextSequence++
+		playlist.discontinuity = false
+		if playlist.availabilityStart.IsZero() {
+			playlist.availabilityStart = time.Now().Add(-time.Duration(start) * time.Millisecond)
+		}
+	}
+	return playlist.current
+}
+
+// addPart publishes a part of the low latency segment started at the given timestamp
+func (playlist *playlist) addPart(data []byte, duration time.Duration, independent bool, start uint32) error {
+	playlist.mutex.Lock()
+	defer playlist.mutex.Unlock()
+	current := playlist.currentSegment(start)
+	current.parts = append(current.parts, &part{duration: duration, independent: independent, data: data})
+	playlist.notify()
+	return playlist.write()
+}
+
+// add completes the segment started at the given timestamp
+func (playlist *playlist) add(data []byte, duration time.Duration, start uint32) error {
+	playlist.mutex.Lock()
+	defer playlist.mutex.Unlock()
+	newSegment := playlist.currentSegment(start)
+	playlist.current = nil
+	newSegment.duration = duration
+	newSegment.data = data
+	defer playlist.notify()
+	if playlist.directory != "" {
+		err := os.WriteFile(filepath.Join(playlist.directory, newSegment.name()), data, 0644)
+		if err != nil {
+			return err
+		}
+		newSegment.data = nil
+	}
+	playlist.segments = append(playlist.segments, newSegment)
+	if !playlist.config.Event && len(playlist.segments) > 2*playlist.config.PlaylistSize {
+		removed := len(playlist.segments) - 2*playlist.config.PlaylistSize
+		for _, removedSegment := range playlist.segments[:removed] {
+			if playlist.directory != "" {
+				_ = os.Remove(filepath.Join(playlist.directory, removedSegment.name()))
+			}
+		}
+		playlist.segments = append([]*segment{}, playlist.segments[removed:]...)
+		playlist.removeInits()
+	}
+	// the parts are listed for the last three target durations only
+	var listedDuration time.Duration
+	for index := len(playlist.segments) - 1; index >= 0; index-- {
+		if listedDuration >= 3*playlist.config.TargetDuration {
+			playlist.segments[index].parts = nil
+		}
+		listedDuration += playlist.segments[index].duration
+	}
+	return playlist.write()
+}
+
+// removeInits removes the init segments no segment refers to anymore
+func (playlist *playlist) removeInits() {
+	for name := range playlist.inits {
+		used := name == playlist.initName
+		for _, remaining := range playlist.segments {
+			used = used || remaining.initName == name
+		}
+		if used {
+			continue
+		}
+		delete(playlist.inits, name)
+		if playlist.directory != "" {
+			_ = os.Remove(filepath.Join(playlist.directory, name))
+		}
+	}
+}
+
+func (playlist *playlist) end() error {
+	playlist.mutex.Lock()
+	defer playlist.mutex.Unlock()
+	playlist.ended = true
+	playlist.endedAt = time.Now()
+	playlist.current = nil
+	playlist.notify()
+	return playlist.write()
+}
+
+// write stores the playlist next to the segments, replaced at once so it is never read partially written
+func (playlist *playlist) write() error {
+	if playlist.directory == "" || !playlist.listable() {
+		return nil
+	}
+	err := writeFile(filepath.Join(playlist.directory, playlistName), playlist.encodeLocked())
+	if err != nil || !playlist.fmp4() {
+		return err
+	}
+	manifest, ok := playlist.encodeManifestLocked()
+	if !ok {
+		return nil
+	}
+	return writeFile(filepath.Join(playlist.directory, manifestName), manifest)
+}
+
+func writeFile(path string, data []byte) error {
+	err := os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// listable tells whether the playlist has a complete segment or a part
+func (playlist *playlist) listable() bool {
+	return len(playlist.segments) > 0 || (playlist.current != nil && len(playlist.current.parts) > 0)
+}
+
+// encode returns the media playlist, false until the first segment or part is complete
+func (playlist *playlist) encode() ([]byte, bool) {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	if !playlist.listable() {
+		return nil, false
+	}
+	return playlist.encodeLocked(), true
+}
+
+func (playlist *playlist) encodeLocked() []byte {
+	listed := playlist.segments
+	if !playlist.config.Event && len(listed) > playlist.config.PlaylistSize {
+		listed = listed[len(listed)-playlist.config.PlaylistSize:]
+	}
+	targetDuration := math.Ceil(playlist.config.TargetDuration.Seconds())
+	for _, listedSegment := range listed {
+		targetDuration = max(targetDuration, math.Round(listedSegment.duration.Seconds()))
+	}
+	mediaSequence := playlist.nextSequence
+	if len(listed) > 0 {
+		mediaSequence = listed[0].sequence
+	} else if playlist.current != nil {
+		mediaSequence = playlist.current.sequence
+	}
+	var buffer bytes.Buffer
+	version := 3
+	if playlist.fmp4() {
+		version = 6
+	}
+	fmt.Fprintf(&buffer, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&buffer, "#EXT-X-TARGETDURATION:%d\n", int(targetDuration))
+	if playlist.lowLatency() {
+		partTarget := playlist.config.PartDuration.Seconds()
+		fmt.Fprintf(&buffer, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", partHoldBack*partTarget)
+		fmt.Fprintf(&buffer, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	}
+	fmt.Fprintf(&buffer, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	if playlist.config.Event {
+		buffer.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	initName := ""
+	writeHeader := func(listedSegment *segment) {
+		if listedSegment.discontinuity {
+			buffer.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if listedSegment.initName != initName {
+			initName = listedSegment.initName
+			fmt.Fprintf(&buffer, "#EXT-X-MAP:URI=\"%s\"\n", initName)
+		}
+	}
+	for _, listedSegment := range listed {
+		writeHeader(listedSegment)
+		writeParts(&buffer, listedSegment)
+		fmt.Fprintf(&buffer, "#EXTINF:%.3f,\n%s\n", listedSegment.duration.Seconds(), listedSegment.name())
+	}
+	if playlist.current != nil {
+		writeHeader(playlist.current)
+		writeParts(&buffer, playlist.current)
+	}
+	if playlist.ended {
+		buffer.WriteString("#EXT-X-ENDLIST\n")
+	} else if playlist.lowLatency() {
+		sequence, index := playlist.nextSequence, 0
+		if playlist.current != nil {
+			sequence, index = playlist.current.sequence, len(playlist.current.parts)
+		}
+		fmt.Fprintf(&buffer, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", partName(sequence, index))
+	}
+	return buffer.Bytes()
+}
+
+func writeParts(buffer *bytes.Buffer, partsSegment *segment) {
+	for index, listedPart := range partsSegment.parts {
+		fmt.Fprintf(buffer, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", listedPart.duration.Seconds(), partName(partsSegment.sequence, index))
+		if listedPart.independent {
+			buffer.WriteString(",INDEPENDENT=YES")
+		}
+		buffer.WriteString("\n")
+	}
+}
+
+// encodeManifest returns the dash manifest of the segments of the current init segment, false until the first
+// segment is complete
+func (playlist *playlist) encodeManifest() ([]byte, bool) {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	return playlist.encodeManifestLocked()
+}
+
+func (playlist *playlist) encodeManifestLocked() ([]byte, bool) {
+	var listed []*segment
+	start := max(0, len(playlist.segments)-playlist.config.PlaylistSize)
+	if playlist.config.Event {
+		start = 0
+	}
+	for _, listedSegment := range playlist.segments[start:] {
+		if listedSegment.initName == playlist.initName {
+			listed = append(listed, listedSegment)
+		}
+	}
+	if len(listed) == 0 {
+		return nil, false
+	}
+	var duration time.Duration
+	var size int
+	for _, listedSegment := range listed {
+		duration += listedSegment.duration
+		size += len(listedSegment.data)
+	}
+	bandwidth := 0
+	if duration > 0 {
+		bandwidth = int(float64(size*8) / duration.Seconds())
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	buffer.WriteString("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\"")
+	if playlist.ended {
+		fmt.Fprintf(&buffer, " type=\"static\" mediaPresentationDuration=\"%s\"", mpdDuration(duration))
+	} else {
+		fmt.Fprintf(&buffer, " type=\"dynamic\" availabilityStartTime=\"%s\" publishTime=\"%s\"",
+			playlist.availabilityStart.UTC().Format(time.RFC3339Nano), time.Now().UTC().Format(time.RFC3339Nano))
+		fmt.Fprintf(&buffer, " minimumUpdatePeriod=\"%s\" timeShiftBufferDepth=\"%s\"", mpdDuration(playlist.config.TargetDuration), mpdDuration(duration))
+	}
+	fmt.Fprintf(&buffer, " minBufferTime=\"%s\">\n", mpdDuration(playlist.config.TargetDuration))
+	buffer.WriteString("  <Period id=\"0\" start=\"PT0S\">\n    <AdaptationSet segmentAlignment=\"true\">\n")
+	fmt.Fprintf(&buffer, "      <Representation id=\"0\" mimeType=\"video/mp4\" codecs=\"%s\" bandwidth=\"%d\"", playlist.codecs, bandwidth)
+	if playlist.width > 0 {
+		fmt.Fprintf(&buffer, " width=\"%d\" height=\"%d\"", playlist.width, playlist.height)
+	}
+	buffer.WriteString(">\n")
+	fmt.Fprintf(&buffer, "        <SegmentTemplate timescale=\"1000\" initialization=\"%s\" media=\"$Number$.m4s\" startNumber=\"%d\">\n",
+		playlist.initName, listed[0].sequence)
+	buffer.WriteString("          <SegmentTimeline>\n")
+	for _, listedSegment := range listed {
+		fmt.Fprintf(&buffer, "            <S t=\"%d\" d=\"%d\"/>\n", listedSegment.start, listedSegment.duration.Milliseconds())
+	}
+	buffer.WriteString("          </SegmentTimeline>\n        </SegmentTemplate>\n      </Representation>\n")
+	buffer.WriteString("    </AdaptationSet>\n  </Period>\n</MPD>\n")
+	return buffer.Bytes(), true
+}
+
+// mpdDuration formats an xml schema duration
+func mpdDuration(duration time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", duration.Seconds())
+}
+
+// wait blocks until the playlist lists the segment of the given sequence, or its part when the index is not
+// negative, the playlist ends or the context is done
+func (playlist *playlist) wait(ctx context.Context, sequence uint64, index int) bool {
+	for {
+		playlist.mutex.RLock()
+		available := playlist.ended || playlist.available(sequence, index)
+		updated := playlist.updated
+		playlist.mutex.RUnlock()
+		if available {
+			return true
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (playlist *playlist) available(sequence uint64, index int) bool {
+	if len(playlist.segments) > 0 && playlist.segments[len(playlist.segments)-1].sequence >= sequence {
+		return true
+	}
+	current := playlist.current
+	return index >= 0 && current != nil && current.sequence == sequence && len(current.parts) > index
+}
+
+// sequence is the sequence of the segment after the last one listed, complete or not
+func (playlist *playlist) sequence() uint64 {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	return playlist.nextSequence
+}
+
+// segment returns the data of a segment in memory or the path of a segment on disk
+func (playlist *playlist) segment(sequence uint64, extension string) ([]byte, string, bool) {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	for _, candidate := range playlist.segments {
+		if candidate.sequence != sequence || candidate.extension != extension {
+			continue
+		}
+		if candidate.data == nil {
+			return nil, filepath.Join(playlist.directory, candidate.name()), true
+		}
+		return candidate.data, "", true
+	}
+	return nil, "", false
+}
+
+// part returns the data of a part of a low latency segment
+func (playlist *playlist) part(sequence uint64, index int) ([]byte, bool) {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	candidates := playlist.segments
+	if playlist.current != nil {
+		candidates = append(candidates[:len(candidates):len(candidates)], playlist.current)
+	}
+	for _, candidate := range candidates {
+		if candidate.sequence == sequence && index < len(candidate.parts) {
+			return candidate.parts[index].data, true
+		}
+	}
+	return nil, false
+}
+
+// init returns the data of an init segment in memory or its path on disk
+func (playlist *playlist) init(name string) ([]byte, string, bool) {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	data, ok := playlist.inits[name]
+	if !ok {
+		return nil, "", false
+	}
+	if data == nil {
+		return nil, filepath.Join(playlist.directory, name), true
+	}
+	return data, "", true
+}
+
+// expired tells whether the playlist ended longer than the retention ago
+func (playlist *playlist) expired() bool {
+	playlist.mutex.RLock()
+	defer playlist.mutex.RUnlock()
+	return playlist.ended && time.Since(playlist.endedAt) >= playlist.config.Retention
+}
@@ -0,0 +1,226 @@
+package hls
+
+import (
+	"errors"
+	"rtmp/codec"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/stream"
+	"sync"
+	"time"
+)
+
+// segmenterQueueSize is the number of messages the segmenter may lag behind the publisher before being dropped
+const segmenterQueueSize = 4096
+
+// timestampMask keeps the 33 bits of the mpeg-ts timestamps
+const timestampMask = 1<<33 - 1
+
+var errSegmenterTooSlow = errors.New("hls segmenter is too slow")
+
+// segmenter muxes the AVC or HEVC video and the AAC audio of a stream to mpeg-ts segments cut on the keyframes,
+// the segments of the streams without video are cut on any audio frame
+type segmenter struct {
+	muxer     *Muxer
+	stream    *stream.Stream
+	playlist  *playlist
+	messages  chan *conn.Message
+	done      chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+	video     *videoConfig
+	audio     *codec.AudioSpecificConfig
+	// writer is the current segment, nil before the first keyframe
+	writer        *tsWriter
+	segmentStart  uint32
+	lastTimestamp uint32
+}
+
+func startSegmenter(muxer *Muxer, segmentedStream *stream.Stream, segmentsPlaylist *playlist) *segmenter {
+	newSegmenter := &segmenter{
+		muxer:    muxer,
+		stream:   segmentedStream,
+		playlist: segmentsPlaylist,
+		messages: make(chan *conn.Message, segmenterQueueSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go newSegmenter.run()
+	return newSegmenter
+}
+
+func (segmenter *segmenter) WriteMessage(media *conn.Message) error {
+	select {
+	case <-segmenter.done:
+		return errSegmenterTooSlow
+	default:
+	}
+	select {
+	case segmenter.messages <- media:
+		return nil
+	default:
+		logger.Get().Errorf("hls segmenter of %s stopped, it is too slow", segmenter.stream.Key())
+		return errSegmenterTooSlow
+	}
+}
+
+// Close waits for the queued messages to be muxed and the playlist to be ended
+func (segmenter *segmenter) Close() error {
+	segmenter.closeOnce.Do(func() {
+		close(segmenter.done)
+	})
+	<-segmenter.finished
+	return nil
+}
+
+func (segmenter *segmenter) run() {
+	defer close(segmenter.finished)
+	for {
+		select {
+		case media := <-segmenter.messages:
+			segmenter.write(media)
+		case <-segmenter.done:
+			for len(segmenter.messages) > 0 {
+				segmenter.write(<-segmenter.messages)
+			}
+			if segmenter.writer != nil {
+				segmenter.complete(time.Duration(segmenter.lastTimestamp-segmenter.segmentStart) * time.Millisecond)
+			}
+			err := segmenter.playlist.end()
+			if err != nil {
+				logger.Get().Errorf("error ending the hls playlist of %s: %s", segmenter.stream.Key(), err)
+			}
+			segmenter.muxer.ended(segmenter.stream.Key(), segmenter.playlist)
+			return
+		}
+	}
+}
+
+func (segmenter *segmenter) write(media *conn.Message) {
+	switch media.TypeId {
+	case flv.TagTypeVideo:
+		segmenter.writeVideo(media)
+	case flv.TagTypeAudio:
+		segmenter.writeAudio(media)
+	}
+}
+
+func (segmenter *segmenter) writeVideo(media *conn.Message) {
+	header, err := flv.ParseVideoTagHeader(media.Data)
+	if err != nil || header.IsMultitrack {
+		return
+	}
+	payload := media.Data[header.Size():]
+	if header.IsSequenceHeader() {
+		segmenter.video, err = parseVideoConfig(header, payload)
+		if err != nil {
+			logger.Get().Debugf("video of %s not muxed to hls: %s", segmenter.stream.Key(), err)
+		}
+		return
+	}
+	if segmenter.video == nil || !isCodedFrames(header) {
+		return
+	}
+	keyframe := header.IsKeyframe()
+	if keyframe {
+		segmenter.cut(media.Timestamp)
+	}
+	if segmenter.writer == nil || segmenter.writer.videoStreamType == 0 {
+		return
+	}
+	frame, err := segmenter.video.annexB(payload, keyframe)
+	if err != nil {
+		logger.Get().Debugf("invalid video frame of %s: %s", segmenter.stream.Key(), err)
+		return
+	}
+	dts := tsTimestamp(media.Timestamp, 0)
+	segmenter.writer.writePES(videoPid, pesStreamIdVideo, tsTimestamp(media.Timestamp, header.CompositionTime), dts, dts, keyframe, frame)
+	segmenter.lastTimestamp = media.Timestamp
+}
+
+func (segmenter *segmenter) writeAudio(media *conn.Message) {
+	header, err := flv.ParseAudioTagHeader(media.Data)
+	if err != nil || header.IsMultitrack || (header.SoundFormat != flv.SoundFormatAAC && header.FourCC != flv.FourCCAAC) {
+		return
+	}
+	payload := media.Data[header.Size():]
+	if header.IsSequenceHeader() {
+		segmenter.audio = nil
+		config, err := codec.ParseAudioSpecificConfig(payload)
+		if err == nil {
+			_, err = config.ADTSHeader(0)
+		}
+		if err != nil {
+			logger.Get().Debugf("audio of %s not muxed to hls: %s", segmenter.stream.Key(), err)
+			return
+		}
+		segmenter.audio = config
+		return
+	}
+	if segmenter.audio == nil || (header.IsExHeader && header.PacketType != flv.AudioPacketTypeCodedFrames) {
+		return
+	}
+	if segmenter.video == nil {
+		segmenter.cut(media.Timestamp)
+	}
+	if segmenter.writer == nil || segmenter.writer.audioStreamType == 0 {
+		return
+	}
+	adtsHeader, err := segmenter.audio.ADTSHeader(len(payload))
+	if err != nil {
+		return
+	}
+	pts := tsTimestamp(media.Timestamp, 0)
+	pcr := int64(-1)
+	if segmenter.writer.videoStreamType == 0 {
+		pcr = pts
+	}
+	segmenter.writer.writePES(audioPid, pesStreamIdAudio, pts, pts, pcr, false, append(adtsHeader, payload...))
+	segmenter.lastTimestamp = media.Timestamp
+}
+
+// cut completes the current segment once it lasts the target duration, or when a stream it is missing started,
+// and starts the next one
+func (segmenter *segmenter) cut(timestamp uint32) {
+	var videoStreamType, audioStreamType uint8
+	if segmenter.video != nil {
+		videoStreamType = segmenter.video.streamType()
+	}
+	if segmenter.audio != nil {
+		audioStreamType = streamTypeAAC
+	}
+	if segmenter.writer != nil {
+		duration := time.Duration(timestamp-segmenter.segmentStart) * time.Millisecond
+		missingStream := segmenter.writer.videoStreamType != videoStreamType || segmenter.writer.audioStreamType != audioStreamType
+		if duration < segmenter.muxer.Config.TargetDuration && !missingStream {
+			return
+		}
+		segmenter.complete(duration)
+	}
+	segmenter.writer = newTSWriter(videoStreamType, audioStreamType)
+	segmenter.writer.writeTables()
+	segmenter.segmentStart = timestamp
+	segmenter.lastTimestamp = timestamp
+}
+
+func (segmenter *segmenter) complete(duration time.Duration) {
+	err := segmenter.playlist.add(segmenter.writer.buffer.Bytes(), duration, segmenter.segmentStart)
+	if err != nil {
+		logger.Get().Errorf("error writing the hls segment of %s: %s", segmenter.stream.Key(), err)
+	}
+	segmenter.writer = nil
+}
+
+// isCodedFrames tells the video tags carrying frames, the sequence end and metadata excluded
+func isCodedFrames(header *flv.VideoTagHeader) bool {
+	if header.IsExHeader {
+		return header.PacketType == flv.VideoPacketTypeCodedFrames || header.PacketType == flv.VideoPacketTypeCodedFramesX
+	}
+	return header.AVCPacketType == flv.AVCPacketTypeNALU
+}
+
+// tsTimestamp converts a timestamp in milliseconds to the 90 kHz clock
+func tsTimestamp(timestamp uint32, compositionTime int32) int64 {
+	return (int64(timestamp) + int64(compositionTime)) * 90 & timestampMask
+}
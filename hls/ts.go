@@ -0,0 +1,195 @@
+package hls
+
+import (
+	"bytes"
+)
+
+const (
+	tsPacketSize  = 188
+	tsPayloadSize = tsPacketSize - 4
+	tsSyncByte    = 0x47
+)
+
+// the program of the segments, a video and an audio elementary stream
+const (
+	patPid   = uint16(0)
+	pmtPid   = uint16(0x1000)
+	videoPid = uint16(0x100)
+	audioPid = uint16(0x101)
+)
+
+const (
+	streamTypeAAC  = uint8(0x0F)
+	streamTypeH264 = uint8(0x1B)
+	streamTypeHEVC = uint8(0x24)
+)
+
+const (
+	pesStreamIdVideo = byte(0xE0)
+	pesStreamIdAudio = byte(0xC0)
+)
+
+// tsWriter packetizes the tables and the PES packets of a segment, ISO/IEC 13818-1
+type tsWriter struct {
+	buffer     bytes.Buffer
+	continuity map[uint16]uint8
+	// videoStreamType and audioStreamType are zero when the segment has no such stream
+	videoStreamType uint8
+	audioStreamType uint8
+}
+
+func newTSWriter(videoStreamType uint8, audioStreamType uint8) *tsWriter {
+	return &tsWriter{
+		continuity:      make(map[uint16]uint8),
+		videoStreamType: videoStreamType,
+		audioStreamType: audioStreamType,
+	}
+}
+
+// writeTables writes the program association and program map tables the segments start with
+func (writer *tsWriter) writeTables() {
+	pat := []byte{
+		0x00, 0xB0, 0x00, 0x00, 0x01, 0xC1, 0x00, 0x00,
+		// program 1 mapped to the pmt
+		0x00, 0x01, 0xE0 | byte(pmtPid>>8), byte(pmtPid & 0xFF),
+	}
+	writer.writeSection(patPid, pat)
+	pcrPid := videoPid
+	if writer.videoStreamType == 0 {
+		pcrPid = audioPid
+	}
+	pmt := []byte{0x02, 0xB0, 0x00, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE0 | byte(pcrPid>>8), byte(pcrPid), 0xF0, 0x00}
+	if writer.videoStreamType != 0 {
+		pmt = append(pmt, writer.videoStreamType, 0xE0|byte(videoPid>>8), byte(videoPid&0xFF), 0xF0, 0x00)
+	}
+	if writer.audioStreamType != 0 {
+		pmt = append(pmt, writer.audioStreamType, 0xE0|byte(audioPid>>8), byte(audioPid&0xFF), 0xF0, 0x00)
+	}
+	writer.writeSection(pmtPid, pmt)
+}
+
+// writeSection completes the length and the crc of a table section and writes it in a single packet
+func (writer *tsWriter) writeSection(pid uint16, section []byte) {
+	sectionLength := len(section) - 3 + 4
+	section[1] |= byte(sectionLength >> 8)
+	section[2] = byte(sectionLength)
+	crc := crc32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	packet := make([]byte, 0, tsPacketSize)
+	packet = append(packet, tsSyncByte, 0x40|byte(pid>>8), byte(pid), 0x10|writer.nextContinuity(pid))
+	// pointer field
+	packet = append(packet, 0x00)
+	packet = append(packet, section...)
+	packet = append(packet, bytes.Repeat([]byte{0xFF}, tsPacketSize-len(packet))...)
+	writer.buffer.Write(packet)
+}
+
+// writePES writes an access unit, the timestamps are in 90 kHz units and pcr is negative when not sent
+func (writer *tsWriter) writePES(pid uint16, streamId byte, pts int64, dts int64, pcr int64, randomAccess bool, data []byte) {
+	header := []byte{0x00, 0x00, 0x01, streamId, 0x00, 0x00, 0x80, 0x80, 5}
+	if pts != dts {
+		header[7], header[8] = 0xC0, 10
+		header = appendTimestamp(header, 0x3, pts)
+		header = appendTimestamp(header, 0x1, dts)
+	} else {
+		header = appendTimestamp(header, 0x2, pts)
+	}
+	// the length of the video packets may overflow and is left unbounded
+	if length := len(header) - 6 + len(data); length <= 0xFFFF && streamId != pesStreamIdVideo {
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	writer.writePayload(pid, append(header, data...), pcr, randomAccess)
+}
+
+func (writer *tsWriter) writePayload(pid uint16, data []byte, pcr int64, randomAccess bool) {
+	first := true
+	for first || len(data) > 0 {
+		// fields is the adaptation field after its length byte, nil when there is none
+		var fields []byte
+		if first && (pcr >= 0 || randomAccess) {
+			fields = []byte{0x00}
+			if randomAccess {
+				fields[0] |= 0x40
+			}
+			if pcr >= 0 {
+				fields[0] |= 0x10
+				fields = append(fields, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7E, 0x00)
+			}
+		}
+		adaptationSize := 0
+		if fields != nil {
+			adaptationSize = 1 + len(fields)
+		}
+		payloadSize := min(len(data), tsPayloadSize-adaptationSize)
+		if stuffing := tsPayloadSize - adaptationSize - payloadSize; stuffing > 0 {
+			if fields == nil {
+				// the length byte alone stuffs one byte, the flags a second one
+				fields = []byte{}
+				stuffing--
+				if stuffing > 0 {
+					fields = append(fields, 0x00)
+					stuffing--
+				}
+			}
+			fields = append(fields, bytes.Repeat([]byte{0xFF}, stuffing)...)
+		}
+		control := byte(0x10)
+		if fields != nil {
+			control = 0x30
+		}
+		start := byte(0)
+		if first {
+			start = 0x40
+		}
+		writer.buffer.Write([]byte{tsSyncByte, start | byte(pid>>8), byte(pid), control | writer.nextContinuity(pid)})
+		if fields != nil {
+			writer.buffer.WriteByte(byte(len(fields)))
+			writer.buffer.Write(fields)
+		}
+		writer.buffer.Write(data[:payloadSize])
+		data = data[payloadSize:]
+		first = false
+	}
+}
+
+func (writer *tsWriter) nextContinuity(pid uint16) uint8 {
+	continuity := writer.continuity[pid]
+	writer.continuity[pid] = (continuity + 1) & 0x0F
+	return continuity
+}
+
+// appendTimestamp writes a 33 bits timestamp with its 4 bits prefix and marker bits
+func appendTimestamp(bytes []byte, prefix byte, timestamp int64) []byte {
+	return append(bytes,
+		prefix<<4|byte(timestamp>>29)&0x0E|1,
+		byte(timestamp>>22),
+		byte(timestamp>>14)&0xFE|1,
+		byte(timestamp>>7),
+		byte(timestamp<<1)|1,
+	)
+}
+
+var crc32Table = func() [256]uint32 {
+	var table [256]uint32
+	for index := range table {
+		crc := uint32(index) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[index] = crc
+	}
+	return table
+}()
+
+// crc32MPEG2 is the crc of the table sections, not reflected and without final xor
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, value := range data {
+		crc = crc<<8 ^ crc32Table[byte(crc>>24)^value]
+	}
+	return crc
+}
@@ -0,0 +1,109 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"rtmp/flv"
+)
+
+var errUnsupportedCodec = errors.New("hls: unsupported codec")
+
+var startCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// the access unit delimiters starting every access unit, any slice type
+var (
+	h264AccessUnitDelimiter = []byte{0x09, 0xF0}
+	hevcAccessUnitDelimiter = []byte{0x46, 0x01, 0x50}
+)
+
+const (
+	h264NALUTypeAUD = 9
+	hevcNALUTypeAUD = 35
+)
+
+// videoConfig converts the frames of a decoder configuration record to Annex B, the parameter sets are sent
+// again before every keyframe so the players can join at any segment
+type videoConfig struct {
+	hevc           bool
+	naluLengthSize int
+	parameterSets  [][]byte
+}
+
+// parseVideoConfig reads the sequence header of an AVC or HEVC stream, legacy or enhanced
+func parseVideoConfig(header *flv.VideoTagHeader, payload []byte) (*videoConfig, error) {
+	switch {
+	case isAVC(header):
+		record, err := flv.ParseAVCDecoderConfigurationRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		parameterSets := append(append([][]byte{}, record.SPS...), record.PPS...)
+		return &videoConfig{naluLengthSize: int(record.NALULengthSize), parameterSets: parameterSets}, nil
+	case isHEVC(header):
+		record, err := flv.ParseHEVCDecoderConfigurationRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		parameterSets := append(append(append([][]byte{}, record.VPS...), record.SPS...), record.PPS...)
+		return &videoConfig{hevc: true, naluLengthSize: int(record.NALULengthSize), parameterSets: parameterSets}, nil
+	}
+	return nil, fmt.Errorf("%w: video codec %d %q", errUnsupportedCodec, header.CodecId, header.FourCC)
+}
+
+func isAVC(header *flv.VideoTagHeader) bool {
+	return (!header.IsExHeader && header.CodecId == flv.VideoCodecAVC) || header.FourCC == flv.FourCCAVC
+}
+
+func isHEVC(header *flv.VideoTagHeader) bool {
+	return (!header.IsExHeader && header.CodecId == flv.VideoCodecHEVC) || header.FourCC == flv.FourCCHEVC
+}
+
+func (config *videoConfig) streamType() uint8 {
+	if config.hevc {
+		return streamTypeHEVC
+	}
+	return streamTypeH264
+}
+
+// annexB converts the length prefixed NAL units of a frame to start code prefixed ones, after an access unit
+// delimiter and the parameter sets of a keyframe
+func (config *videoConfig) annexB(frame []byte, keyframe bool) ([]byte, error) {
+	delimiter := h264AccessUnitDelimiter
+	if config.hevc {
+		delimiter = hevcAccessUnitDelimiter
+	}
+	converted := make([]byte, 0, len(frame)+64)
+	converted = append(append(converted, startCode...), delimiter...)
+	if keyframe {
+		for _, parameterSet := range config.parameterSets {
+			converted = append(append(converted, startCode...), parameterSet...)
+		}
+	}
+	for len(frame) > 0 {
+		if len(frame) < config.naluLengthSize {
+			return nil, fmt.Errorf("%w: truncated nal unit length", flv.ErrInvalidVideoTag)
+		}
+		size := 0
+		for _, value := range frame[:config.naluLengthSize] {
+			size = size<<8 | int(value)
+		}
+		frame = frame[config.naluLengthSize:]
+		if size > len(frame) {
+			return nil, fmt.Errorf("%w: nal unit of %d bytes truncated", flv.ErrInvalidVideoTag, size)
+		}
+		nalu := frame[:size]
+		frame = frame[size:]
+		if len(nalu) == 0 || config.isAccessUnitDelimiter(nalu) {
+			continue
+		}
+		converted = append(append(converted, startCode...), nalu...)
+	}
+	return converted, nil
+}
+
+func (config *videoConfig) isAccessUnitDelimiter(nalu []byte) bool {
+	if config.hevc {
+		return nalu[0]>>1&0x3F == hevcNALUTypeAUD
+	}
+	return nalu[0]&0x1F == h264NALUTypeAUD
+}
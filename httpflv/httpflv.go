@@ -0,0 +1,193 @@
+package httpflv
+
+import (
+	"errors"
+	"net/http"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/stream"
+	"strings"
+	"sync"
+	"time"
+)
+
+// viewerQueueSize is the number of messages a viewer may lag behind the publisher before being dropped
+const viewerQueueSize = 2048
+
+var errViewerTooSlow = errors.New("http-flv viewer is too slow to receive the stream")
+
+// Handler serves the live streams as flv files of unknown length, the same way they are played over rtmp:
+//
+//	GET /{app}/{stream}.flv
+//
+// The viewers receive the flv header, then the metadata, sequence headers and last group of pictures of the
+// stream followed by the live tags, until the stream ends or they disconnect. The requests upgrading to a
+// websocket receive the same bytes in binary messages.
+type Handler struct {
+	Streams *stream.Registry
+	// Admit is called before serving a viewer, an error rejects it and release is called once it stops
+	Admit func(request *http.Request, app string, name string) (release func(), err error)
+	// WriteTimeout bounds every write to a viewer, the viewers stalled longer are dropped
+	WriteTimeout time.Duration
+	mux          *http.ServeMux
+}
+
+func NewHandler(streams *stream.Registry) *Handler {
+	handler := &Handler{
+		Streams:      streams,
+		WriteTimeout: 10 * time.Second,
+		mux:          http.NewServeMux(),
+	}
+	handler.mux.HandleFunc("GET /{app}/{stream}", handler.serveStream)
+	return handler
+}
+
+func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// the players of the browsers load the streams from other origins
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	handler.mux.ServeHTTP(writer, request)
+}
+
+func (handler *Handler) serveStream(writer http.ResponseWriter, request *http.Request) {
+	name, ok := strings.CutSuffix(request.PathValue("stream"), ".flv")
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	app := request.PathValue("app")
+	if handler.Admit != nil {
+		release, err := handler.Admit(request, app, name)
+		if err != nil {
+			logger.Get().Debugf("http-flv viewer of %s rejected: %s", stream.Key(app, name), err)
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		defer release()
+	}
+	newViewer := newViewer()
+	viewedStream, err := handler.Streams.Subscribe(app, name, newViewer)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	defer viewedStream.Unsubscribe(newViewer)
+	if isWebsocket(request) {
+		handler.serveWebsocket(writer, request, viewedStream, newViewer)
+		return
+	}
+	writer.Header().Set("Content-Type", "video/x-flv")
+	writer.Header().Set("Cache-Control", "no-cache")
+	controller := http.NewResponseController(writer)
+	err = newViewer.serve(request.Context().Done(), hasTracks(viewedStream), func(data []byte) error {
+		// the request context is not cancelled while a stalled viewer stays connected
+		err := controller.SetWriteDeadline(time.Now().Add(handler.WriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			return err
+		}
+		return controller.Flush()
+	})
+	if err != nil {
+		logger.Get().Debugf("http-flv viewer of %s stopped: %s", viewedStream.Key(), err)
+	}
+}
+
+// serveWebsocket sends every flv header and tag in its own binary message
+func (handler *Handler) serveWebsocket(writer http.ResponseWriter, request *http.Request, viewedStream *stream.Stream, newViewer *viewer) {
+	websocket, err := upgradeWebsocket(writer, request, handler.WriteTimeout)
+	if err != nil {
+		logger.Get().Debugf("websocket-flv viewer of %s rejected: %s", viewedStream.Key(), err)
+		return
+	}
+	defer websocket.close(closeNormal)
+	disconnected := make(chan struct{})
+	go websocket.readControlFrames(disconnected)
+	err = newViewer.serve(disconnected, hasTracks(viewedStream), func(data []byte) error {
+		return websocket.writeFrame(opcodeBinary, data)
+	})
+	if err != nil {
+		logger.Get().Debugf("websocket-flv viewer of %s stopped: %s", viewedStream.Key(), err)
+	}
+}
+
+// hasTracks tells the tracks of the flv header, both when the stream did not send its media yet
+func hasTracks(viewedStream *stream.Stream) flv.Header {
+	info := viewedStream.Info()
+	if info.VideoCodec == "" && info.AudioCodec == "" {
+		return flv.Header{HasAudio: true, HasVideo: true}
+	}
+	return flv.Header{HasAudio: info.AudioCodec != "", HasVideo: info.VideoCodec != ""}
+}
+
+// viewer queues the messages of a stream so the publisher never waits for the network
+type viewer struct {
+	messages  chan *conn.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newViewer() *viewer {
+	return &viewer{
+		messages: make(chan *conn.Message, viewerQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func (viewer *viewer) WriteMessage(media *conn.Message) error {
+	select {
+	case <-viewer.done:
+		return errViewerTooSlow
+	default:
+	}
+	select {
+	case viewer.messages <- media:
+		return nil
+	default:
+		return errViewerTooSlow
+	}
+}
+
+// Close is called by the stream once the viewer stops receiving messages, the queued ones are still sent
+func (viewer *viewer) Close() error {
+	viewer.closeOnce.Do(func() {
+		close(viewer.done)
+	})
+	return nil
+}
+
+// serve writes the flv header and the tags of the queued messages until the stream drops the viewer or the
+// disconnected channel is closed
+func (viewer *viewer) serve(disconnected <-chan struct{}, header flv.Header, write func([]byte) error) error {
+	err := write(header.Encode())
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case media := <-viewer.messages:
+			err = viewer.send(media, write)
+		case <-viewer.done:
+			for len(viewer.messages) > 0 && err == nil {
+				err = viewer.send(<-viewer.messages, write)
+			}
+			return err
+		case <-disconnected:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (viewer *viewer) send(media *conn.Message, write func([]byte) error) error {
+	switch media.TypeId {
+	case flv.TagTypeAudio, flv.TagTypeVideo, flv.TagTypeScriptData:
+		return write(flv.Tag{Type: media.TypeId, Timestamp: media.Timestamp, Data: media.Data}.Encode())
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package httpflv_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/amf"
+	"rtmp/flv"
+	"rtmp/httpflv"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestingHandler(t *testing.T) (*server.Server, *httptest.Server) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	httpServer := httptest.NewServer(httpflv.NewHandler(testServer.Streams))
+	t.Cleanup(httpServer.Close)
+	return testServer, httpServer
+}
+
+func readTestTag(t *testing.T, reader io.Reader) *flv.Tag {
+	t.Helper()
+	tag, err := flv.ReadTag(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
+
+func TestServeStream(t *testing.T) {
+	testServer, httpServer := startTestingHandler(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	metadata := amf.NewCommand(amf.NewString("@setDataFrame"), amf.NewString("onMetaData"), amf.NewEcmaArray(
+		amf.ObjectProperty{Name: "width", Value: amf.NewNumber(1280)},
+	))
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeDataMessageAmf0, 0, metadata.Encode())
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 40, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02})
+	assert.Eventually(t, func() bool {
+		publishedStream, ok := testServer.Streams.Get("testApp", "testStream")
+		return ok && publishedStream.Info().VideoCodec != ""
+	}, 3*time.Second, 10*time.Millisecond)
+
+	response, err := http.Get(httpServer.URL + "/testApp/testStream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "video/x-flv", response.Header.Get("Content-Type"))
+	header, err := flv.ReadHeader(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, &flv.Header{HasVideo: true}, header)
+	// the cached metadata, sequence header and keyframe come first
+	tag := readTestTag(t, response.Body)
+	assert.Equal(t, flv.TagTypeScriptData, tag.Type)
+	decodedMetadata, err := amf.DecodeCommand(tag.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, amf.NewString("onMetaData"), decodedMetadata.Parts[0])
+	assert.Equal(t, &flv.Tag{Type: flv.TagTypeVideo, Timestamp: 0, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}}, readTestTag(t, response.Body))
+	assert.Equal(t, &flv.Tag{Type: flv.TagTypeVideo, Timestamp: 40, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}}, readTestTag(t, response.Body))
+	// then the live tags
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 80, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03})
+	assert.Equal(t, &flv.Tag{Type: flv.TagTypeVideo, Timestamp: 80, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}}, readTestTag(t, response.Body))
+
+	// the response ends with the stream
+	_ = publisherConn.Close()
+	_, err = flv.ReadTag(response.Body)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeStreamUnsubscribesDisconnectedViewer(t *testing.T) {
+	testServer, httpServer := startTestingHandler(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	publishedStream, _ := testServer.Streams.Get("testApp", "testStream")
+
+	response, err := http.Get(httpServer.URL + "/testApp/testStream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = flv.ReadHeader(response.Body)
+	assert.NoError(t, err)
+	assert.Len(t, publishedStream.Subscribers(), 1)
+	_ = response.Body.Close()
+	assert.Eventually(t, func() bool {
+		return len(publishedStream.Subscribers()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestServeUnknownStream(t *testing.T) {
+	_, httpServer := startTestingHandler(t)
+	for _, path := range []string{"/testApp/unknown.flv", "/testApp/testStream"} {
+		response, err := http.Get(httpServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestServeStreamAdmitsViewers(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxPlayersPerStream: 1})
+	handler := httpflv.NewHandler(testServer.Streams)
+	handler.Admit = func(_ *http.Request, app string, name string) (func(), error) {
+		err := testServer.AdmitPlayer(app, name)
+		if err != nil {
+			return nil, err
+		}
+		return func() { testServer.ReleasePlayer(app, name) }, nil
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "testStream")
+
+	viewer, err := http.Get(httpServer.URL + "/testApp/testStream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, viewer.StatusCode)
+	_, err = flv.ReadHeader(viewer.Body)
+	assert.NoError(t, err)
+	rejected, err := http.Get(httpServer.URL + "/testApp/testStream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rejected.Body.Close()
+	assert.Equal(t, http.StatusForbidden, rejected.StatusCode)
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitPlayersPerStream])
+
+	// the slot is released once the viewer disconnects
+	_ = viewer.Body.Close()
+	assert.Eventually(t, func() bool {
+		err := testServer.AdmitPlayer("testApp", "testStream")
+		if err == nil {
+			testServer.ReleasePlayer("testApp", "testStream")
+		}
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// stallTestViewer publishes a stream to a viewer that never reads, it tells once the viewer was released
+func stallTestViewer(t *testing.T, dialViewer func(url string)) (released func() bool) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	handler := httpflv.NewHandler(testServer.Streams)
+	handler.WriteTimeout = 100 * time.Millisecond
+	var viewerReleased atomic.Bool
+	handler.Admit = func(*http.Request, string, string) (func(), error) {
+		return func() { viewerReleased.Store(true) }, nil
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	publishedStream, _ := testServer.Streams.Get("testApp", "testStream")
+
+	dialViewer(httpServer.URL)
+	assert.Eventually(t, func() bool {
+		return len(publishedStream.Subscribers()) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	// more than the socket buffers hold, fewer messages than the queue of the viewer
+	frame := bytes.Repeat([]byte{0x27, 0x01, 0x00, 0x00, 0x00}, 20000)
+	for index := range 200 {
+		testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, uint32(index*40), frame)
+	}
+	return viewerReleased.Load
+}
+
+func TestServeStreamDropsStalledViewer(t *testing.T) {
+	released := stallTestViewer(t, func(url string) {
+		netConn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = netConn.Close() })
+		_, err = fmt.Fprintf(netConn, "GET /testApp/testStream.flv HTTP/1.1\r\nHost: test\r\n\r\n")
+		assert.NoError(t, err)
+	})
+	assert.Eventually(t, released, 3*time.Second, 10*time.Millisecond)
+}
+
+// dialTestWebsocket opens a websocket and checks the opening handshake
+func dialTestWebsocket(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	netConn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = netConn.Close() })
+	_ = netConn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = fmt.Fprintf(netConn, "GET /testApp/testStream.flv HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	assert.NoError(t, err)
+	reader := bufio.NewReader(netConn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	// the accept key of the example of RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", response.Header.Get("Sec-WebSocket-Accept"))
+	return netConn, reader
+}
+
+// readTestFrame reads an unmasked frame of the server
+func readTestFrame(t *testing.T, reader io.Reader) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x80), header[0]&0xF0)
+	assert.Zero(t, header[1]&0x80)
+	size := uint64(header[1])
+	switch size {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(reader, extended)
+		size = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(reader, extended)
+		size = binary.BigEndian.Uint64(extended)
+	}
+	assert.NoError(t, err)
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	assert.NoError(t, err)
+	return header[0] & 0x0F, payload
+}
+
+// writeTestFrame writes a masked frame of the client
+func writeTestFrame(t *testing.T, writer io.Writer, opcode byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for index, value := range payload {
+		frame = append(frame, value^mask[index%4])
+	}
+	_, err := writer.Write(frame)
+	assert.NoError(t, err)
+}
+
+func TestServeWebsocket(t *testing.T) {
+	testServer, httpServer := startTestingHandler(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+	assert.Eventually(t, func() bool {
+		publishedStream, ok := testServer.Streams.Get("testApp", "testStream")
+		return ok && publishedStream.Info().VideoCodec != ""
+	}, 3*time.Second, 10*time.Millisecond)
+
+	netConn, reader := dialTestWebsocket(t, httpServer.URL)
+	// the flv header and every tag are binary messages
+	opcode, payload := readTestFrame(t, reader)
+	assert.Equal(t, byte(0x2), opcode)
+	assert.Equal(t, flv.Header{HasVideo: true}.Encode(), payload)
+	_, payload = readTestFrame(t, reader)
+	assert.Equal(t, flv.Tag{Type: flv.TagTypeVideo, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}}.Encode(), payload)
+	frame := bytes.Repeat([]byte{0x27, 0x01, 0x00, 0x00, 0x00}, 100)
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 40, frame)
+	_, payload = readTestFrame(t, reader)
+	assert.Equal(t, flv.Tag{Type: flv.TagTypeVideo, Timestamp: 40, Data: frame}.Encode(), payload)
+
+	// the pings are answered
+	writeTestFrame(t, netConn, 0x9, []byte("ping"))
+	opcode, payload = readTestFrame(t, reader)
+	assert.Equal(t, byte(0xA), opcode)
+	assert.Equal(t, []byte("ping"), payload)
+
+	// the websocket is closed once the stream ends
+	_ = publisherConn.Close()
+	opcode, payload = readTestFrame(t, reader)
+	assert.Equal(t, byte(0x8), opcode)
+	assert.Equal(t, []byte{0x03, 0xE8}, payload)
+}
+
+func TestServeWebsocketClosedByViewer(t *testing.T) {
+	testServer, httpServer := startTestingHandler(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	publishedStream, _ := testServer.Streams.Get("testApp", "testStream")
+
+	netConn, reader := dialTestWebsocket(t, httpServer.URL)
+	readTestFrame(t, reader)
+	writeTestFrame(t, netConn, 0x8, []byte{0x03, 0xE9})
+	opcode, payload := readTestFrame(t, reader)
+	assert.Equal(t, byte(0x8), opcode)
+	assert.Equal(t, []byte{0x03, 0xE9}, payload)
+	assert.Eventually(t, func() bool {
+		return len(publishedStream.Subscribers()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	// the server closes the connection after the close frame
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeWebsocketDropsStalledViewer(t *testing.T) {
+	released := stallTestViewer(t, func(url string) {
+		dialTestWebsocket(t, url)
+	})
+	assert.Eventually(t, released, 3*time.Second, 10*time.Millisecond)
+}
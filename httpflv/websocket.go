@@ -0,0 +1,185 @@
+package httpflv
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of the opening handshake, RFC 6455 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opcodeBinary = 0x2
+	opcodeClose  = 0x8
+	opcodePing   = 0x9
+	opcodePong   = 0xA
+)
+
+// websocketMaxFrameSize bounds the frames of the viewers, they only send control frames
+const websocketMaxFrameSize = 64 * 1024
+
+// closeNormal is the status of the close frame sent once the stream ended
+const closeNormal = 1000
+
+var errInvalidFrame = errors.New("invalid websocket frame")
+
+// isWebsocket tells the requests opening a websocket
+func isWebsocket(request *http.Request) bool {
+	return headerContains(request.Header, "Connection", "upgrade") && headerContains(request.Header, "Upgrade", "websocket")
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketConn is the server side of a websocket, the frames are written from several goroutines
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// writeTimeout bounds the write of every frame, the reads wait for the client as long as it stays connected
+	writeTimeout time.Duration
+	mutex        sync.Mutex
+	// closeSent is set once the close frame is sent, no frame may follow it
+	closeSent bool
+}
+
+// upgradeWebsocket completes the opening handshake, the response is written when it fails
+func upgradeWebsocket(writer http.ResponseWriter, request *http.Request, writeTimeout time.Duration) (*websocketConn, error) {
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if request.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		writer.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(writer, "unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: version %q", errInvalidFrame, request.Header.Get("Sec-WebSocket-Version"))
+	}
+	netConn, readWriter, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		http.Error(writer, "websocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// the deadlines of the http server no longer apply
+	_ = netConn.SetDeadline(time.Time{})
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	_, err = fmt.Fprintf(readWriter, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err == nil {
+		err = readWriter.Flush()
+	}
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: netConn, reader: readWriter.Reader, writeTimeout: writeTimeout}, nil
+}
+
+// writeFrame writes a final unmasked frame, the server never masks its frames
+func (websocket *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	websocket.mutex.Lock()
+	defer websocket.mutex.Unlock()
+	if websocket.closeSent {
+		return net.ErrClosed
+	}
+	websocket.closeSent = opcode == opcodeClose
+	header := []byte{0x80 | opcode}
+	switch size := len(payload); {
+	case size < 126:
+		header = append(header, byte(size))
+	case size <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(size))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(size))
+	}
+	err := websocket.conn.SetWriteDeadline(time.Now().Add(websocket.writeTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = (&net.Buffers{header, payload}).WriteTo(websocket.conn)
+	return err
+}
+
+// readFrame reads a frame of the client, which are always masked
+func (websocket *websocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(websocket.reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: unmasked client frame", errInvalidFrame)
+	}
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(websocket.reader, extended)
+		size = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(websocket.reader, extended)
+		size = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > websocketMaxFrameSize {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", errInvalidFrame, size)
+	}
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(websocket.reader, mask)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(websocket.reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for index := range payload {
+		payload[index] ^= mask[index%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// readControlFrames answers the pings and the close frame of the client, disconnected is closed once it closed
+// the websocket or the connection failed
+func (websocket *websocketConn) readControlFrames(disconnected chan<- struct{}) {
+	defer close(disconnected)
+	for {
+		opcode, payload, err := websocket.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opcodePing:
+			_ = websocket.writeFrame(opcodePong, payload)
+		case opcodeClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			_ = websocket.writeFrame(opcodeClose, payload)
+			return
+		}
+	}
+}
+
+// close sends the close frame of the server and closes the connection
+func (websocket *websocketConn) close(status uint16) error {
+	_ = websocket.writeFrame(opcodeClose, binary.BigEndian.AppendUint16(nil, status))
+	return websocket.conn.Close()
+}
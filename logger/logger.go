@@ -1,20 +1,77 @@
 package logger
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// the formats of the logs
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+var ErrInvalidFormat = errors.New("invalid log format")
+
 var once sync.Once
 
-var sugar *zap.SugaredLogger
+var sugar atomic.Pointer[zap.SugaredLogger]
+
+// level is shared by every logger built so SetLevel applies without replacing the logger
+var level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
 
 func Get() *zap.SugaredLogger {
 	once.Do(func() {
-		logger, _ := zap.NewDevelopment()
+		// a logger set by Configure is kept
+		config := zap.NewDevelopmentConfig()
+		config.Level = level
+		logger, _ := config.Build()
 		defer logger.Sync()
-		sugar = logger.Sugar()
+		sugar.CompareAndSwap(nil, logger.Sugar())
 	})
-	return sugar
+	return sugar.Load()
+}
+
+// Configure replaces the logger with one logging from a level, debug, info, warn or error, in the console or
+// json format
+func Configure(levelName string, format string) error {
+	err := SetLevel(levelName)
+	if err != nil {
+		return err
+	}
+	var config zap.Config
+	switch format {
+	case "", FormatConsole:
+		config = zap.NewDevelopmentConfig()
+	case FormatJSON:
+		config = zap.NewProductionConfig()
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidFormat, format)
+	}
+	config.Level = level
+	logger, err := config.Build()
+	if err != nil {
+		return err
+	}
+	sugar.Store(logger.Sugar())
+	return nil
+}
+
+// SetLevel changes the level of the logger, info when empty
+func SetLevel(levelName string) error {
+	parsed := zapcore.InfoLevel
+	if levelName != "" {
+		var err error
+		parsed, err = zapcore.ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+	}
+	level.SetLevel(parsed)
+	return nil
 }
@@ -1,9 +1,61 @@
 package main
 
 import (
-	"rtmp/server"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
 )
 
+// version is set when building a release, go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const usage = `usage: rtmp <command> [flags]
+
+commands:
+  serve     runs the server, the command run when none is given
+  probe     plays a stream and prints its metadata and codecs
+  version   prints the version
+
+rtmp <command> -h lists the flags of a command
+`
+
 func main() {
-	server.NewServer("127.0.0.1:9999").Accept()
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "probe":
+		err = probe(args)
+	case "version":
+		fmt.Println(versionString())
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rtmp %s: %s\n", command, err)
+		os.Exit(1)
+	}
+}
+
+// versionString is the version followed by the commit it was built from when known
+func versionString() string {
+	description := "rtmp " + version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				description += " (" + setting.Value[:12] + ")"
+			}
+		}
+	}
+	return fmt.Sprintf("%s %s %s/%s", description, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 }
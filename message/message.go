@@ -8,6 +8,7 @@ import (
 	"rtmp/chunk"
 	"rtmp/conn"
 	"rtmp/logger"
+	"time"
 )
 
 const (
@@ -17,7 +18,9 @@ const (
 	TypeUserControl               = uint8(4)
 	TypeWindowAcknowledgementSize = uint8(5)
 	TypeSetPeerBandwidth          = uint8(6)
+	TypeAudio                     = uint8(8)
 	TypeVideo                     = uint8(9)
+	TypeDataMessageAmf0           = uint8(18)
 	TypeCommandMessageAmf0        = uint8(20)
 )
 
@@ -25,10 +28,18 @@ const (
 	SetPeerBandwidthLimitTypeHard = uint8(0)
 )
 
+const (
+	UserControlStreamBegin  = uint16(0)
+	UserControlStreamEOF    = uint16(1)
+	UserControlPingRequest  = uint16(6)
+	UserControlPingResponse = uint16(7)
+)
+
 type Message struct {
 	MessageTypeId   uint8
 	MessageStreamId uint32
 	ChunkStreamId   uint32
+	Timestamp       uint32
 	Data            []byte
 }
 
@@ -68,25 +79,63 @@ func NewAcknowledgementMessage(acknowledgementSize int) *Message {
 }
 
 func NewStreamBeginMessage(messageStreamId uint32) *Message {
+	return newUserControlMessage(UserControlStreamBegin, messageStreamId)
+}
+
+func NewStreamEOFMessage(messageStreamId uint32) *Message {
+	return newUserControlMessage(UserControlStreamEOF, messageStreamId)
+}
+
+func NewPingRequestMessage(timestamp uint32) *Message {
+	return newUserControlMessage(UserControlPingRequest, timestamp)
+}
+
+func NewPingResponseMessage(timestamp uint32) *Message {
+	return newUserControlMessage(UserControlPingResponse, timestamp)
+}
+
+func newUserControlMessage(eventType uint16, eventData uint32) *Message {
 	contents := make([]byte, 6)
-	binary.BigEndian.PutUint16(contents[0:2], 0)
-	binary.BigEndian.PutUint32(contents[2:6], messageStreamId)
+	binary.BigEndian.PutUint16(contents[0:2], eventType)
+	binary.BigEndian.PutUint32(contents[2:6], eventData)
 	return NewMessage(TypeUserControl, 0, contents)
 }
 
+func NewCommandMessage(messageStreamId uint32, command amf.Command) *Message {
+	commandMessage := NewMessage(TypeCommandMessageAmf0, messageStreamId, command.Encode())
+	commandMessage.ChunkStreamId = uint32(3)
+	return commandMessage
+}
+
+func NewStatusMessage(messageStreamId uint32, level string, code string, description string) *Message {
+	infoProps := amf.NewObject(
+		amf.ObjectProperty{Name: "level", Value: amf.NewString(level)},
+		amf.ObjectProperty{Name: "code", Value: amf.NewString(code)},
+		amf.ObjectProperty{Name: "description", Value: amf.NewString(description)},
+	)
+	statusCommand := amf.NewCommand(amf.NewString("onStatus"), amf.NewNumber(0), amf.NewNull(), infoProps)
+	return NewCommandMessage(messageStreamId, statusCommand)
+}
+
+// NewPlayStatusMessage builds the onPlayStatus data message telling a player a recorded stream ended
+func NewPlayStatusMessage(messageStreamId uint32, code string, duration float64, bytes uint64) *Message {
+	infoProps := amf.NewObject(
+		amf.ObjectProperty{Name: "level", Value: amf.NewString("status")},
+		amf.ObjectProperty{Name: "code", Value: amf.NewString(code)},
+		amf.ObjectProperty{Name: "duration", Value: amf.NewNumber(duration)},
+		amf.ObjectProperty{Name: "bytes", Value: amf.NewNumber(float64(bytes))},
+	)
+	playStatus := amf.NewCommand(amf.NewString("onPlayStatus"), infoProps)
+	return NewMessage(TypeDataMessageAmf0, messageStreamId, playStatus.Encode())
+}
+
 func (message *Message) Send(conn *conn.Conn) (int, error) {
+	// a message is written as a whole so messages sent from different goroutines never interleave
+	conn.SendMutex.Lock()
+	defer conn.SendMutex.Unlock()
+	conn.Stats.MessagesSent[message.MessageTypeId].Add(1)
 	bytesSent := 0
 	for _, nChunk := range message.BuildChunks(int(conn.MaxChunkSize)) {
-
-		if conn.UnacknowledgedBytesSent > 0 && conn.PeerWindowAcknowledgementSize > 0 && conn.UnacknowledgedBytesSent >= conn.PeerWindowAcknowledgementSize {
-			ackChunk, err := Accept(conn)
-			if err != nil {
-				return 0, errors.New("bandwith exceeded")
-			}
-			if ackChunk.Header.MessageHeader.MessageTypeId == TypeAcknowledgement {
-				conn.UnacknowledgedBytesSent = 0
-			}
-		}
 		if nChunk.Header.BasicHeader.Fmt == 0 && nChunk.Header.MessageHeader.MessageTypeId == TypeSetChunkSize {
 			conn.PeerMaxChunkSize = binary.BigEndian.Uint32(nChunk.Data[0:4]) & 0x7FFFFFFF
 		}
@@ -114,11 +163,16 @@ func (message *Message) BuildChunks(chunkSize int) []chunk.Chunk {
 		var messageHeader chunk.MessageHeader
 		if i == 0 {
 			basicHeader = *chunk.NewBasicHeader(uint8(0), message.ChunkStreamId)
-			messageHeader = *chunk.NewMessageHeader(uint32(0), uint32(len(message.Data)), message.MessageTypeId, message.MessageStreamId)
+			messageHeader = *chunk.NewMessageHeader(message.Timestamp, uint32(len(message.Data)), message.MessageTypeId, message.MessageStreamId)
 		} else {
 			basicHeader = *chunk.NewBasicHeader(uint8(3), message.ChunkStreamId)
 		}
-		header := chunk.NewHeader(basicHeader, messageHeader, uint32(0))
+		// the type 3 chunks of the message repeat its extended timestamp
+		var extendedTimestamp uint32
+		if message.Timestamp >= 0xFFFFFF {
+			extendedTimestamp = message.Timestamp
+		}
+		header := chunk.NewHeader(basicHeader, messageHeader, extendedTimestamp)
 		chunks = append(
 			chunks,
 			*chunk.NewChunk(*header, message.Data[i:end]),
@@ -137,81 +191,137 @@ func isProtocolControlMessage(messageTypeId uint8) bool {
 }
 
 func Accept(connection *conn.Conn) (*chunk.Chunk, error) {
-	header, err := chunk.ReadChunkHeader(connection)
-	if err != nil {
-		return nil, err
+	receivedChunk, _, err := accept(connection)
+	return receivedChunk, err
+}
+
+// AcceptMessage reads chunks until a message is completed, protocol control messages are handled
+// before being returned
+func AcceptMessage(connection *conn.Conn) (*conn.Message, error) {
+	for {
+		_, completedMessage, err := accept(connection)
+		if err != nil {
+			return nil, err
+		}
+		if completedMessage != nil {
+			return completedMessage, nil
+		}
 	}
-	dataSize, err := getNextChunkDataSize(connection, header)
-	if err != nil {
-		return nil, err
+}
+
+func accept(connection *conn.Conn) (*chunk.Chunk, *conn.Message, error) {
+	var header *chunk.Header
+	var dataSize uint32
+	var err error
+	continuation := connection.PendingChunkDataSize > 0
+	if continuation {
+		// the data of the previous chunk arrived split across reads, the rest is read as a type 3 chunk
+		header = chunk.NewHeader(*chunk.NewBasicHeader(uint8(3), connection.PendingChunkStreamId), chunk.MessageHeader{}, uint32(0))
+		dataSize = connection.PendingChunkDataSize
+	} else {
+		header, err = chunk.ReadChunkHeader(connection)
+		if err != nil {
+			return nil, nil, err
+		}
+		dataSize, err = getNextChunkDataSize(connection, header)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	data := make(
 		[]byte,
 		dataSize,
 	)
-	_, err = connection.Read(data)
+	n, err := connection.Read(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	connection.PendingChunkDataSize = dataSize - uint32(n)
+	connection.PendingChunkStreamId = header.BasicHeader.ChunkStreamId
+	receivedChunk := chunk.NewChunk(*header, data[:n])
+	if continuation {
+		connection.UnacknowledgedBytesReceived += uint32(n)
+	} else {
+		connection.UnacknowledgedBytesReceived += uint32(len(receivedChunk.Encode()))
 	}
-	receivedChunk := chunk.NewChunk(*header, data)
-	connection.UnacknowledgedBytesReceived += uint32(len(receivedChunk.Encode()))
 	if connection.WindowAcknowledgementSize > 0 && connection.UnacknowledgedBytesReceived >= connection.WindowAcknowledgementSize {
 		acknowledgementMessage := NewAcknowledgementMessage(int(connection.UnacknowledgedBytesReceived))
 		_, err = acknowledgementMessage.Send(connection)
 		connection.UnacknowledgedBytesReceived = 0
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	handleReceivedChunk(connection, receivedChunk)
-	connection.CurrentMessage.Data = append(connection.CurrentMessage.Data, receivedChunk.Data...)
-	if connection.CurrentMessage.Length == connection.CurrentMessage.DataSize() && connection.CurrentMessage.Length > 0 {
-		err = handleCompletedMessage(connection, connection.CurrentMessage)
+	chunkStream := connection.ChunkStream(header.BasicHeader.ChunkStreamId)
+	handleReceivedChunk(chunkStream.Message, receivedChunk)
+	chunkStream.Message.Data = append(chunkStream.Message.Data, receivedChunk.Data...)
+	var completedMessage *conn.Message
+	if chunkStream.Message.Length == chunkStream.Message.DataSize() && chunkStream.Message.Length > 0 {
+		completedMessage = chunkStream.Message
+		err = handleCompletedMessage(connection, chunkStream, completedMessage)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	return receivedChunk, nil
+	return receivedChunk, completedMessage, nil
 }
 
 func getNextChunkDataSize(connection *conn.Conn, header *chunk.Header) (uint32, error) {
-	messageLength := connection.CurrentMessage.Length
+	currentMessage := connection.ChunkStream(header.BasicHeader.ChunkStreamId).Message
+	messageLength := currentMessage.Length
 	if header.BasicHeader.Fmt == 0 || header.BasicHeader.Fmt == 1 {
 		messageLength = header.MessageHeader.MessageLength
 	}
-	remainingBytes := messageLength - connection.CurrentMessage.DataSize()
+	remainingBytes := messageLength - currentMessage.DataSize()
 	if remainingBytes <= 0 {
 		return 0, errors.New("no data to read")
 	}
 	return min(remainingBytes, connection.PeerMaxChunkSize), nil
 }
 
-func handleReceivedChunk(connection *conn.Conn, receivedChunk *chunk.Chunk) {
+// handleReceivedChunk applies the header of a chunk to the message read on its chunk stream
+func handleReceivedChunk(currentMessage *conn.Message, receivedChunk *chunk.Chunk) {
 	logger.Get().Debugf("received chunk %v", receivedChunk)
+	timestamp := receivedChunk.Header.MessageHeader.Timestamp
+	if timestamp >= 0xFFFFFF {
+		timestamp = receivedChunk.Header.ExtendedTimestamp
+	}
 	if receivedChunk.Header.BasicHeader.Fmt <= 1 {
-		connection.CurrentMessage.Length = receivedChunk.Header.MessageHeader.MessageLength
-		connection.CurrentMessage.TypeId = receivedChunk.Header.MessageHeader.MessageTypeId
+		currentMessage.Length = receivedChunk.Header.MessageHeader.MessageLength
+		currentMessage.TypeId = receivedChunk.Header.MessageHeader.MessageTypeId
 	}
 	if receivedChunk.Header.BasicHeader.Fmt == 0 {
-		connection.CurrentMessage.StreamId = receivedChunk.Header.MessageHeader.MessageStreamId
+		currentMessage.StreamId = receivedChunk.Header.MessageHeader.MessageStreamId
+		currentMessage.Timestamp = timestamp
+		currentMessage.TimestampDelta = 0
+	} else if receivedChunk.Header.BasicHeader.Fmt <= 2 {
+		// type 1 and 2 chunks carry the delta from the previous message
+		currentMessage.TimestampDelta = timestamp
+		currentMessage.Timestamp += timestamp
+	} else if currentMessage.DataSize() == 0 {
+		// a type 3 chunk starting a message repeats the previous delta
+		currentMessage.Timestamp += currentMessage.TimestampDelta
 	}
 }
 
-func handleCompletedMessage(connection *conn.Conn, completedMessage *conn.Message) error {
+func handleCompletedMessage(connection *conn.Conn, chunkStream *conn.ChunkStream, completedMessage *conn.Message) error {
 	logger.Get().Debugf("received completed message %v", completedMessage)
+	connection.Stats.MessagesReceived[completedMessage.TypeId].Add(1)
 	if completedMessage.TypeId == TypeSetChunkSize {
+		connection.SendMutex.Lock()
 		connection.MaxChunkSize = binary.BigEndian.Uint32(completedMessage.Data[0:4]) & 0x7FFFFFFF
+		connection.SendMutex.Unlock()
 		peerMaxChunkSizeMessage := NewMessage(TypeSetChunkSize, 0, binary.BigEndian.AppendUint32(make([]byte, 0), connection.MaxChunkSize))
 		_, err := peerMaxChunkSizeMessage.Send(connection)
 		if err != nil {
 			return err
 		}
 	} else if completedMessage.TypeId == TypeAbortMessage {
-		connection.CurrentMessage = nil
+		abortMessage(connection, completedMessage)
 	} else if completedMessage.TypeId == TypeWindowAcknowledgementSize {
 		connection.WindowAcknowledgementSize = binary.BigEndian.Uint32(completedMessage.Data[0:4])
 	} else if completedMessage.TypeId == TypeSetPeerBandwidth {
-		connection.PeerWindowAcknowledgementSize = binary.BigEndian.Uint32(connection.CurrentMessage.Data[0:4])
+		connection.PeerWindowAcknowledgementSize = binary.BigEndian.Uint32(completedMessage.Data[0:4])
 		windowAcknowledgementSizeMessage := NewWindowAcknowledgementSizeMessage(int(connection.PeerWindowAcknowledgementSize))
 		_, err := windowAcknowledgementSizeMessage.Send(connection)
 		if err != nil {
@@ -219,119 +329,48 @@ func handleCompletedMessage(connection *conn.Conn, completedMessage *conn.Messag
 		}
 	} else if completedMessage.TypeId == TypeAcknowledgement {
 		connection.UnacknowledgedBytesSent = 0
-	} else if completedMessage.TypeId == TypeCommandMessageAmf0 {
-		command, err := amf.DecodeCommand(completedMessage.Data)
-		if err != nil {
-			return err
-		}
-		logger.Get().Debugf("Command received: %s\n", command)
-		if len(command.Parts) > 0 && command.Parts[0] == amf.NewString("connect") {
-			err = doConnectMessageFlow(connection, rand.Uint32())
-
-		} else if len(command.Parts) > 0 && command.Parts[0] == amf.NewString("createStream") {
-			err = doCreateStreamFlow(connection, rand.Uint32(), *command)
-		} else if len(command.Parts) > 0 && command.Parts[0] == amf.NewString("publish") {
-			err = doPublishFlow(connection, rand.Uint32(), *command)
-		}
+	} else if completedMessage.TypeId == TypeUserControl && len(completedMessage.Data) >= 6 {
+		err := handleUserControlMessage(connection, completedMessage)
 		if err != nil {
 			return err
 		}
 	}
 	select {
-	case connection.Messages <- connection.CurrentMessage:
+	case connection.Messages <- completedMessage:
 	default:
 	}
-	connection.CurrentMessage = new(conn.Message)
-	// preserves the data of the last message
-	connection.CurrentMessage.Length = completedMessage.Length
-	connection.CurrentMessage.TypeId = completedMessage.TypeId
-	connection.CurrentMessage.StreamId = completedMessage.StreamId
-	return nil
-}
-
-func doConnectMessageFlow(connection *conn.Conn, messageStreamId uint32) error {
-	// server sends window acknowledgement size
-	windowAcknowledgementSizeMessage := NewWindowAcknowledgementSizeMessage(int(connection.PeerWindowAcknowledgementSize))
-	_, err := windowAcknowledgementSizeMessage.Send(connection)
-	if err != nil {
-		return err
-	}
-	// server sends set peer bandwidth
-	setPeerBandwidthMessage := NewSetPeerBandwidthMessage(int(connection.PeerWindowAcknowledgementSize), SetPeerBandwidthLimitTypeHard)
-	_, err = setPeerBandwidthMessage.Send(connection)
-	connection.WindowAcknowledgementSize = connection.PeerWindowAcknowledgementSize
-	if err != nil {
-		return err
-	}
-	// server sends stream begin message
-	streamBeginMessage := NewStreamBeginMessage(messageStreamId)
-	_, err = streamBeginMessage.Send(connection)
-	if err != nil {
-		return err
-	}
-	// server sends result command
-	serverProps := amf.NewObject(
-		amf.ObjectProperty{Name: "fmsVer", Value: amf.NewString("FMS/3,0,1,123")},
-		amf.ObjectProperty{Name: "capabilities", Value: amf.NewNumber(31)},
-	)
-	infoProps := amf.NewObject(
-		amf.ObjectProperty{Name: "level", Value: amf.NewString("status")},
-		amf.ObjectProperty{Name: "code", Value: amf.NewString("NetConnection.Connect.Success")},
-		amf.ObjectProperty{Name: "description", Value: amf.NewString("Connection succeeded.")},
-		amf.ObjectProperty{Name: "objectEncoding", Value: amf.NewNumber(0)},
-	)
-
-	resultCommand := amf.NewCommand(amf.NewString("_result"), amf.NewNumber(1), serverProps, infoProps)
-	resultCommandMessage := NewMessage(TypeCommandMessageAmf0, uint32(0), resultCommand.Encode())
-	resultCommandMessage.ChunkStreamId = uint32(3)
-	_, err = resultCommandMessage.Send(connection)
-	if err != nil {
-		return err
+	// the next message of the chunk stream starts from the header of this one
+	chunkStream.Message = &conn.Message{
+		Length:         completedMessage.Length,
+		TypeId:         completedMessage.TypeId,
+		StreamId:       completedMessage.StreamId,
+		Timestamp:      completedMessage.Timestamp,
+		TimestampDelta: completedMessage.TimestampDelta,
 	}
 	return nil
 }
 
-func doCreateStreamFlow(connection *conn.Conn, messageStreamId uint32, command amf.Command) error {
-	// sends result command
-	transactionId := command.Parts[1]
-	resultCommand := amf.NewCommand(amf.NewString("_result"), transactionId, amf.NewNull(), amf.NewNumber(float64(messageStreamId)))
-	resultCommandMessage := NewMessage(TypeCommandMessageAmf0, uint32(0), resultCommand.Encode())
-	resultCommandMessage.ChunkStreamId = uint32(3)
-	_, err := resultCommandMessage.Send(connection)
-	if err != nil {
-		return err
+// abortMessage drops the chunks received of the message read on the chunk stream named by an abort message
+func abortMessage(connection *conn.Conn, completedMessage *conn.Message) {
+	if len(completedMessage.Data) < 4 {
+		return
+	}
+	abortedStream, ok := connection.ChunkStreams[binary.BigEndian.Uint32(completedMessage.Data[0:4])]
+	if ok {
+		abortedStream.Message.Data = nil
 	}
-	return nil
 }
 
-func doPublishFlow(connection *conn.Conn, messageStreamId uint32, command amf.Command) error {
-	infoProps := amf.NewObject(
-		amf.ObjectProperty{Name: "level", Value: amf.NewString("status")},
-		amf.ObjectProperty{Name: "code", Value: amf.NewString("NetConnection.Publish.Start")},
-		amf.ObjectProperty{Name: "description", Value: amf.NewString("Publish flow started.")},
-	)
-
-	statusCommand := amf.NewCommand(amf.NewString("onStatus"), amf.NewNumber(0), amf.NewNull(), infoProps)
-	statusCommandMessage := NewMessage(TypeCommandMessageAmf0, uint32(0), statusCommand.Encode())
-	statusCommandMessage.ChunkStreamId = uint32(3)
-	_, err := statusCommandMessage.Send(connection)
-	// server sends stream begin message
-	streamBeginMessage := NewStreamBeginMessage(messageStreamId)
-	_, err = streamBeginMessage.Send(connection)
-	if err != nil {
-		return err
-	}
-	// sends result command
-	transactionId := command.Parts[1]
-	resultCommand := amf.NewCommand(amf.NewString("_result"), transactionId, amf.NewNull(), amf.NewNumber(float64(messageStreamId)))
-	resultCommandMessage := NewMessage(TypeCommandMessageAmf0, uint32(0), resultCommand.Encode())
-	resultCommandMessage.ChunkStreamId = uint32(3)
-	_, err = resultCommandMessage.Send(connection)
-	if err != nil {
+func handleUserControlMessage(connection *conn.Conn, completedMessage *conn.Message) error {
+	eventType := binary.BigEndian.Uint16(completedMessage.Data[0:2])
+	eventData := binary.BigEndian.Uint32(completedMessage.Data[2:6])
+	if eventType == UserControlPingRequest {
+		_, err := NewPingResponseMessage(eventData).Send(connection)
 		return err
+	} else if eventType == UserControlPingResponse {
+		// the ping request timestamp is the uptime of the connection when it was sent
+		sentAt := time.Duration(eventData) * time.Millisecond
+		connection.SetRoundTripTime(connection.Uptime() - sentAt)
 	}
-	//sets message data
-	connection.CurrentMessage.StreamId = messageStreamId
-	connection.CurrentMessage.TypeId = TypeVideo
 	return nil
 }
@@ -4,9 +4,11 @@ import (
 	"encoding/binary"
 	"math/rand"
 	"rtmp/amf"
+	"rtmp/chunk"
 	"rtmp/message"
 	"rtmp/testutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -47,6 +49,78 @@ func TestSetChunkSizeAndMultiChunkRandomMessageReceived(t *testing.T) {
 	}
 }
 
+func TestMultiChunkMessageWithExtendedTimestamp(t *testing.T) {
+	rtmpServer, clientConn := testutil.StartTestingServerWithHandshake(t)
+	timestamp := uint32(0x1000000)
+	testMessage := testutil.GenerateTestRandomMessage(300)
+	testMessage.Timestamp = timestamp
+	chunks := testMessage.BuildChunks(int(clientConn.MaxChunkSize))
+	assert.Len(t, chunks, 3)
+	for _, builtChunk := range chunks {
+		assert.Equal(t, timestamp, builtChunk.Header.ExtendedTimestamp)
+	}
+	// the type 3 chunks carry the extended timestamp after the basic header
+	withoutTimestamp := chunks[1]
+	withoutTimestamp.Header.ExtendedTimestamp = 0
+	assert.Len(t, chunks[1].Encode(), len(withoutTimestamp.Encode())+4)
+	nextMessage := testutil.GenerateTestRandomMessage(300)
+	nextMessage.Timestamp = timestamp + 40
+	serverConn := <-rtmpServer.Connections
+	// the chunks of the second message are read in place only when the first ones were framed right
+	for _, sentMessage := range []message.Message{testMessage, nextMessage} {
+		_, err := sentMessage.Send(clientConn)
+		assert.Nil(t, err)
+		select {
+		case messageReceived := <-serverConn.Messages:
+			assert.Equal(t, sentMessage.Timestamp, messageReceived.Timestamp)
+			assert.Equal(t, sentMessage.Data, messageReceived.Data)
+		case <-serverConn.Errors:
+			t.FailNow()
+		}
+	}
+}
+
+func TestInterleavedChunkStreamsKeepTheirTimestamps(t *testing.T) {
+	rtmpServer, clientConn := testutil.StartTestingServerWithHandshake(t)
+	serverConn := <-rtmpServer.Connections
+	// the audio on chunk stream 4 and the video on 6, the type 1, 2 and 3 headers are relative to their own stream
+	sentChunks := []struct {
+		fmt           uint8
+		chunkStreamId uint32
+		timestamp     uint32
+		length        uint32
+		typeId        uint8
+		expected      uint32
+	}{
+		{0, 4, 0, 2, message.TypeAudio, 0},
+		{0, 6, 0, 2, message.TypeVideo, 0},
+		{2, 4, 23, 0, 0, 23},
+		{1, 6, 33, 3, message.TypeVideo, 33},
+		{3, 4, 0, 0, 0, 46},
+		{3, 6, 0, 0, 0, 66},
+	}
+	lengths := map[uint32]uint32{}
+	for _, sentChunk := range sentChunks {
+		if sentChunk.fmt <= 1 {
+			lengths[sentChunk.chunkStreamId] = sentChunk.length
+		}
+		header := chunk.NewHeader(
+			*chunk.NewBasicHeader(sentChunk.fmt, sentChunk.chunkStreamId),
+			*chunk.NewMessageHeader(sentChunk.timestamp, sentChunk.length, sentChunk.typeId, 1),
+			0,
+		)
+		_, err := clientConn.Conn.Write(chunk.NewChunk(*header, make([]byte, lengths[sentChunk.chunkStreamId])).Encode())
+		assert.Nil(t, err)
+		select {
+		case messageReceived := <-serverConn.Messages:
+			assert.Equal(t, sentChunk.expected, messageReceived.Timestamp)
+			assert.Equal(t, lengths[sentChunk.chunkStreamId], messageReceived.Length)
+		case <-serverConn.Errors:
+			t.FailNow()
+		}
+	}
+}
+
 func TestSetChunkSizeMessageReceived(t *testing.T) {
 	rtmpServer, clientConn := testutil.StartTestingServerWithHandshake(t)
 	newSize := uint32(1024)
@@ -130,6 +204,17 @@ func TestSetPeerBandwidthMessageTypeHardDifferentFromPreviousSizeReceived(t *tes
 	}
 }
 
+func TestPingRequestAnswered(t *testing.T) {
+	_, clientConn := testutil.StartTestingServerWithHandshake(t)
+	timestamp := uint32(clientConn.Uptime().Milliseconds())
+	_, err := message.NewPingRequestMessage(timestamp).Send(clientConn)
+	assert.Nil(t, err)
+	assert.Equal(t, timestamp, testutil.WaitTestUserControl(t, clientConn, message.UserControlPingResponse))
+	assert.Eventually(t, func() bool {
+		return clientConn.RoundTripTime() > 0
+	}, time.Second, time.Millisecond)
+}
+
 func TestConnectMessageFlow(t *testing.T) {
 	rtmpServer, clientConn := testutil.StartTestingServerWithHandshake(t)
 	testMessage := testutil.GenerateTestConnectCommand()
@@ -283,7 +368,7 @@ func TestPublishMessageFlow(t *testing.T) {
 						}
 					}
 					assert.Equal(t, amf.NewString("status"), level)
-					assert.Equal(t, amf.NewString("NetConnection.Publish.Start"), code)
+					assert.Equal(t, amf.NewString("NetStream.Publish.Start"), code)
 				} else if commandName == amf.NewString("_result") {
 					receivedResult = true
 					assert.Equal(t, amf.NewNumber(transactionId), decodedCommand.Parts[1])
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"rtmp/logger"
+	"rtmp/server"
+	"strings"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var messageTypeNames = map[int]string{
+	1:  "set_chunk_size",
+	2:  "abort",
+	3:  "acknowledgement",
+	4:  "user_control",
+	5:  "window_acknowledgement_size",
+	6:  "set_peer_bandwidth",
+	8:  "audio",
+	9:  "video",
+	15: "data_amf3",
+	16: "shared_object_amf3",
+	17: "command_amf3",
+	18: "data",
+	19: "shared_object",
+	20: "command",
+	22: "aggregate",
+}
+
+// Handler serves the metrics of the server in the prometheus text exposition format
+func Handler(rtmpServer *server.Server) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", contentType)
+		err := Write(writer, rtmpServer)
+		if err != nil {
+			logger.Get().Debugf("error writing metrics: %s", err)
+		}
+	})
+}
+
+func Write(writer io.Writer, rtmpServer *server.Server) error {
+	stats := rtmpServer.Stats()
+	traffic := stats.Traffic
+	metricsWriter := &metricsWriter{writer: bufio.NewWriter(writer)}
+
+	metricsWriter.family("rtmp_handshakes_total", "counter", "Handshakes by result.")
+	metricsWriter.sample("rtmp_handshakes_total", labels("result", "accepted"), float64(stats.HandshakesAccepted))
+	metricsWriter.sample("rtmp_handshakes_total", labels("result", "failed"), float64(stats.HandshakesFailed))
+
+	metricsWriter.family("rtmp_connections_active", "gauge", "Open connections.")
+	metricsWriter.sample("rtmp_connections_active", "", float64(stats.ActiveConnections))
+	metricsWriter.family("rtmp_publishers_active", "gauge", "Streams being published.")
+	metricsWriter.sample("rtmp_publishers_active", "", float64(stats.ActivePublishers))
+	metricsWriter.family("rtmp_players_active", "gauge", "Streams being played.")
+	metricsWriter.sample("rtmp_players_active", "", float64(stats.ActivePlayers))
+
+	metricsWriter.family("rtmp_bytes_total", "counter", "Bytes received and sent.")
+	metricsWriter.sample("rtmp_bytes_total", labels("direction", "in"), float64(traffic.BytesReceived))
+	metricsWriter.sample("rtmp_bytes_total", labels("direction", "out"), float64(traffic.BytesSent))
+
+	metricsWriter.family("rtmp_messages_total", "counter", "Messages received and sent by type.")
+	for _, direction := range []struct {
+		name   string
+		counts [256]uint64
+	}{{"in", traffic.MessagesReceived}, {"out", traffic.MessagesSent}} {
+		for typeId, count := range direction.counts {
+			if count > 0 {
+				metricsWriter.sample("rtmp_messages_total", labels("direction", direction.name, "type", messageTypeName(typeId)), float64(count))
+			}
+		}
+	}
+
+	metricsWriter.family("rtmp_acknowledgements_total", "counter", "Acknowledgements received and sent.")
+	metricsWriter.sample("rtmp_acknowledgements_total", labels("direction", "in"), float64(traffic.MessagesReceived[3]))
+	metricsWriter.sample("rtmp_acknowledgements_total", labels("direction", "out"), float64(traffic.MessagesSent[3]))
+
+	metricsWriter.family("rtmp_chunk_size_changes_total", "counter", "Chunk size renegotiations received and sent.")
+	metricsWriter.sample("rtmp_chunk_size_changes_total", labels("direction", "in"), float64(traffic.MessagesReceived[1]))
+	metricsWriter.sample("rtmp_chunk_size_changes_total", labels("direction", "out"), float64(traffic.MessagesSent[1]))
+
+	metricsWriter.family("rtmp_round_trip_seconds", "summary", "Round trip times measured with ping requests.")
+	metricsWriter.sample("rtmp_round_trip_seconds_sum", "", traffic.RoundTripsTime.Seconds())
+	metricsWriter.sample("rtmp_round_trip_seconds_count", "", float64(traffic.RoundTrips))
+
+	metricsWriter.family("rtmp_decode_errors_total", "counter", "Connections closed because of undecodable data by kind.")
+	for _, kind := range []string{server.DecodeErrorChunk, server.DecodeErrorAmf, server.DecodeErrorProxy} {
+		metricsWriter.sample("rtmp_decode_errors_total", labels("kind", kind), float64(stats.DecodeErrors[kind]))
+	}
+
+	metricsWriter.family("rtmp_rejections_total", "counter", "Connections and streams refused by the limits by limit.")
+	for _, limit := range []string{server.LimitConnections, server.LimitConnectionsPerIP, server.LimitPublishersPerApp, server.LimitPlayersPerApp, server.LimitPlayersPerStream} {
+		metricsWriter.sample("rtmp_rejections_total", labels("limit", limit), float64(stats.Rejections[limit]))
+	}
+
+	metricsWriter.family("rtmp_stream_bitrate_bits_per_second", "gauge", "Bitrate received from the publisher of each stream.")
+	for _, publishedStream := range rtmpServer.Streams.Streams() {
+		streamLabels := labels("app", publishedStream.App, "stream", publishedStream.Name)
+		metricsWriter.sample("rtmp_stream_bitrate_bits_per_second", streamLabels, publishedStream.Stats().Bitrate)
+	}
+	metricsWriter.family("rtmp_stream_subscribers", "gauge", "Subscribers of each stream.")
+	for _, publishedStream := range rtmpServer.Streams.Streams() {
+		streamLabels := labels("app", publishedStream.App, "stream", publishedStream.Name)
+		metricsWriter.sample("rtmp_stream_subscribers", streamLabels, float64(len(publishedStream.Subscribers())))
+	}
+	return metricsWriter.flush()
+}
+
+// metricsWriter keeps the first error so the metrics are written without checking every line
+type metricsWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+func (metricsWriter *metricsWriter) family(name string, metricType string, help string) {
+	metricsWriter.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (metricsWriter *metricsWriter) sample(name string, labels string, value float64) {
+	metricsWriter.printf("%s%s %v\n", name, labels, value)
+}
+
+func (metricsWriter *metricsWriter) printf(format string, args ...any) {
+	if metricsWriter.err != nil {
+		return
+	}
+	_, metricsWriter.err = fmt.Fprintf(metricsWriter.writer, format, args...)
+}
+
+func (metricsWriter *metricsWriter) flush() error {
+	if metricsWriter.err != nil {
+		return metricsWriter.err
+	}
+	return metricsWriter.writer.Flush()
+}
+
+// labels formats name and value pairs, the values are escaped as the exposition format requires
+func labels(pairs ...string) string {
+	formatted := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted, pairs[i]+`="`+escaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(formatted, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func messageTypeName(typeId int) string {
+	if name, ok := messageTypeNames[typeId]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", typeId)
+}
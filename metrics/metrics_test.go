@@ -0,0 +1,62 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rtmp/message"
+	"rtmp/metrics"
+	"rtmp/testutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeTestMetrics(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	return recorder.Body.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := metrics.Handler(testServer)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "test\"Stream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x01, 0, 0, 0, 1, 2, 3})
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "test\"Stream")
+	testutil.WaitTestMedia(t, playerConn, message.TypeVideo)
+
+	exposition := scrapeTestMetrics(t, handler)
+	assert.Contains(t, exposition, "# TYPE rtmp_handshakes_total counter\n")
+	assert.Contains(t, exposition, "rtmp_handshakes_total{result=\"accepted\"} 2\n")
+	assert.Contains(t, exposition, "rtmp_connections_active 2\n")
+	assert.Contains(t, exposition, "rtmp_publishers_active 1\n")
+	assert.Contains(t, exposition, "rtmp_players_active 1\n")
+	assert.Contains(t, exposition, "rtmp_messages_total{direction=\"in\",type=\"video\"} 1\n")
+	assert.Contains(t, exposition, "rtmp_messages_total{direction=\"out\",type=\"video\"} 1\n")
+	assert.Contains(t, exposition, "rtmp_messages_total{direction=\"in\",type=\"command\"} 6\n")
+	assert.Contains(t, exposition, "rtmp_stream_bitrate_bits_per_second{app=\"testApp\",stream=\"test\\\"Stream\"}")
+	assert.Contains(t, exposition, "rtmp_stream_subscribers{app=\"testApp\",stream=\"test\\\"Stream\"} 1\n")
+	assert.Contains(t, exposition, "rtmp_decode_errors_total{kind=\"amf\"} 0\n")
+	assert.Contains(t, exposition, "rtmp_rejections_total{limit=\"connections\"} 0\n")
+}
+
+func TestMetricsCountClosedConnections(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := metrics.Handler(testServer)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	// a command message holding an unknown amf marker
+	testutil.SendTestMedia(t, clientConn, 0, message.TypeCommandMessageAmf0, 0, []byte{0x42, 0x00})
+	assert.Eventually(t, func() bool {
+		exposition := scrapeTestMetrics(t, handler)
+		return strings.Contains(exposition, "rtmp_decode_errors_total{kind=\"amf\"} 1\n") &&
+			strings.Contains(exposition, "rtmp_connections_active 0\n") &&
+			strings.Contains(exposition, "rtmp_messages_total{direction=\"in\",type=\"command\"} 1\n")
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"rtmp/client"
+	"rtmp/logger"
+	"rtmp/stream"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func probe(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "bound of the connection and of every read")
+	duration := flags.Duration("duration", 3*time.Second, "time the stream is read for, less when it ends before")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: rtmp probe [flags] rtmp://host[:port]/app/stream")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// the protocol messages logged by the packages would bury the result
+	_ = logger.SetLevel("error")
+	rawURL := flags.Arg(0)
+	streamURL, err := client.ParseURL(rawURL)
+	if err != nil {
+		return err
+	}
+	if streamURL.Stream == "" {
+		return fmt.Errorf("%w: %s names no stream", client.ErrInvalidURL, rawURL)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	rtmpClient, err := client.Dial(ctx, rawURL, *timeout)
+	if err != nil {
+		return err
+	}
+	defer rtmpClient.Close()
+	err = rtmpClient.Play(streamURL.Stream)
+	if err != nil {
+		return err
+	}
+	// the stream describes the media it receives like a published one
+	probed, err := stream.NewRegistry().Publish(streamURL.App, streamURL.Stream)
+	if err != nil {
+		return err
+	}
+	// the media is read for the whole duration to measure its bitrate
+	readCtx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+	stopReading := context.AfterFunc(readCtx, func() {
+		_ = rtmpClient.Close()
+	})
+	defer stopReading()
+	startedAt := time.Now()
+	for {
+		media, err := rtmpClient.ReadMessage()
+		if err != nil {
+			if readCtx.Err() != nil || (errors.Is(err, io.EOF) && probed.Stats().MessagesReceived > 0) {
+				break
+			}
+			return err
+		}
+		probed.WriteMessage(media)
+	}
+	printProbe(os.Stdout, rawURL, probed, time.Since(startedAt))
+	return nil
+}
+
+func printProbe(output io.Writer, rawURL string, probed *stream.Stream, elapsed time.Duration) {
+	info := probed.Info()
+	stats := probed.Stats()
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	defer writer.Flush()
+	fmt.Fprintf(writer, "url\t%s\n", rawURL)
+	if stats.MessagesReceived == 0 {
+		fmt.Fprintf(writer, "media\tnone received in %s\n", elapsed.Round(time.Millisecond))
+		return
+	}
+	if info.VideoCodec != "" {
+		video := []string{joinNonEmpty(" ", info.VideoCodec, info.VideoProfile, info.VideoLevel)}
+		if info.Width > 0 && info.Height > 0 {
+			video = append(video, fmt.Sprintf("%dx%d", info.Width, info.Height))
+		}
+		if info.FrameRate > 0 {
+			video = append(video, fmt.Sprintf("%.3g fps", info.FrameRate))
+		}
+		if info.ChromaFormat != "" {
+			video = append(video, info.ChromaFormat)
+		}
+		if info.SARWidth > 0 && info.SARWidth != info.SARHeight {
+			video = append(video, fmt.Sprintf("sar %d:%d", info.SARWidth, info.SARHeight))
+		}
+		fmt.Fprintf(writer, "video\t%s\n", strings.Join(video, ", "))
+	}
+	if info.AudioCodec != "" {
+		audio := []string{joinNonEmpty(" ", info.AudioCodec, info.AudioProfile)}
+		if info.AudioSampleRate > 0 {
+			audio = append(audio, fmt.Sprintf("%d Hz", info.AudioSampleRate))
+		}
+		if info.AudioChannels > 0 {
+			audio = append(audio, fmt.Sprintf("%d channels", info.AudioChannels))
+		}
+		fmt.Fprintf(writer, "audio\t%s\n", strings.Join(audio, ", "))
+	}
+	for _, track := range info.Tracks {
+		fmt.Fprintf(writer, "track\t%s %d %s\n", track.Type, track.Id, track.Codec)
+	}
+	fmt.Fprintf(writer, "received\t%d messages, %d bytes in %s\n", stats.MessagesReceived, stats.BytesReceived,
+		elapsed.Round(time.Millisecond))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Fprintf(writer, "bitrate\t%.0f kbps\n", float64(stats.BytesReceived*8)/seconds/1000)
+	}
+}
+
+func joinNonEmpty(separator string, parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, separator)
+}
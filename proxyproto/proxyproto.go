@@ -0,0 +1,253 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// the types of the tlvs of a version 2 header
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+)
+
+// v1MaxLength is the longest version 1 header, crlf included
+const v1MaxLength = 107
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	ErrInvalidHeader = errors.New("invalid proxy protocol header")
+	ErrChecksum      = errors.New("proxy protocol header checksum mismatch")
+)
+
+// Header is the PROXY protocol header a proxy sends before relaying a connection
+type Header struct {
+	// Version is 1 for the text headers and 2 for the binary ones
+	Version int
+	// Source and Destination are the addresses of the client and of the address it connected to, nil for the
+	// health checks of the proxy and the unknown protocols, the addresses of the connection apply then
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV is an additional information of a version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first tlv with the given type
+func (header *Header) TLV(tlvType byte) ([]byte, bool) {
+	for _, tlv := range header.TLVs {
+		if tlv.Type == tlvType {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Read reads a version 1 or 2 header, it never reads past the header so the reader can be used afterwards
+func Read(reader io.Reader) (*Header, error) {
+	first := make([]byte, 1)
+	_, err := io.ReadFull(reader, first)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readV1(reader)
+	case v2Signature[0]:
+		return readV2(reader)
+	default:
+		return nil, fmt.Errorf("%w: unexpected first byte %#x", ErrInvalidHeader, first[0])
+	}
+}
+
+// readV1 reads "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n" after its first byte
+func readV1(reader io.Reader) (*Header, error) {
+	line := []byte{'P'}
+	character := make([]byte, 1)
+	// reads byte by byte to leave the data following the header unread
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("%w: line too long", ErrInvalidHeader)
+		}
+		_, err := io.ReadFull(reader, character)
+		if err != nil {
+			return nil, truncated(err)
+		}
+		line = append(line, character[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	header := &Header{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	source, err := parseV1Address(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Address(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+	header.Source = source
+	header.Destination = destination
+	return header, nil
+}
+
+func parseV1Address(rawAddress string, rawPort string, ipv6 bool) (net.Addr, error) {
+	address, err := netip.ParseAddr(rawAddress)
+	if err != nil || address.Is6() != ipv6 {
+		return nil, fmt.Errorf("%w: address %q", ErrInvalidHeader, rawAddress)
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil || (len(rawPort) > 1 && rawPort[0] == '0') {
+		return nil, fmt.Errorf("%w: port %q", ErrInvalidHeader, rawPort)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(address, uint16(port))), nil
+}
+
+// readV2 reads a binary header after the first byte of its signature
+func readV2(reader io.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	fixed[0] = v2Signature[0]
+	_, err := io.ReadFull(reader, fixed[1:])
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if !bytes.Equal(fixed[:12], v2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidHeader)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0F
+	if command > 1 {
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, command)
+	}
+	family := fixed[13] >> 4
+	protocol := fixed[13] & 0x0F
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	header := &Header{Version: 2}
+	var addressesLength int
+	switch family {
+	case 0x1:
+		addressesLength = 12
+	case 0x2:
+		addressesLength = 36
+	case 0x3:
+		addressesLength = 216
+	}
+	if len(payload) < addressesLength {
+		return nil, fmt.Errorf("%w: addresses truncated", ErrInvalidHeader)
+	}
+	header.TLVs, err = parseTLVs(payload[addressesLength:])
+	if err != nil {
+		return nil, err
+	}
+	if checksum, ok := header.TLV(TypeCRC32C); ok {
+		err = verifyChecksum(fixed, payload, checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the local connections are the health checks of the proxy, the unspecified ones are relayed as is
+	if command == 0 || family == 0 || protocol == 0 {
+		return header, nil
+	}
+	addresses := payload[:addressesLength]
+	switch family {
+	case 0x1, 0x2:
+		ipLength := (addressesLength - 4) / 2
+		source, _ := netip.AddrFromSlice(addresses[:ipLength])
+		destination, _ := netip.AddrFromSlice(addresses[ipLength : 2*ipLength])
+		sourcePort := binary.BigEndian.Uint16(addresses[2*ipLength:])
+		destinationPort := binary.BigEndian.Uint16(addresses[2*ipLength+2:])
+		if protocol == 0x2 {
+			header.Source = net.UDPAddrFromAddrPort(netip.AddrPortFrom(source, sourcePort))
+			header.Destination = net.UDPAddrFromAddrPort(netip.AddrPortFrom(destination, destinationPort))
+		} else {
+			header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, sourcePort))
+			header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(destination, destinationPort))
+		}
+	case 0x3:
+		network := "unix"
+		if protocol == 0x2 {
+			network = "unixgram"
+		}
+		header.Source = &net.UnixAddr{Name: unixPath(addresses[:108]), Net: network}
+		header.Destination = &net.UnixAddr{Name: unixPath(addresses[108:]), Net: network}
+	}
+	return header, nil
+}
+
+func parseTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("%w: tlv truncated", ErrInvalidHeader)
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("%w: tlv truncated", ErrInvalidHeader)
+		}
+		tlvs = append(tlvs, TLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// verifyChecksum checks the crc32c of the whole header computed with the checksum zeroed
+func verifyChecksum(fixed []byte, payload []byte, checksum []byte) error {
+	if len(checksum) != 4 {
+		return fmt.Errorf("%w: checksum length %d", ErrInvalidHeader, len(checksum))
+	}
+	expected := binary.BigEndian.Uint32(checksum)
+	clear(checksum)
+	table := crc32.MakeTable(crc32.Castagnoli)
+	actual := crc32.Update(crc32.Checksum(fixed, table), table, payload)
+	binary.BigEndian.PutUint32(checksum, expected)
+	if actual != expected {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// truncated tells a header cut short apart from a connection closed before sending anything
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func unixPath(raw []byte) string {
+	path, _, _ := bytes.Cut(raw, []byte{0})
+	return string(path)
+}
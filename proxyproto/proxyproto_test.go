@@ -0,0 +1,123 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"rtmp/proxyproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+func v2Header(command byte, family byte, addresses []byte, tlvs ...proxyproto.TLV) []byte {
+	payload := append([]byte{}, addresses...)
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	header := append(append([]byte{}, signature...), 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadV1(t *testing.T) {
+	reader := bytes.NewReader([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 1935\r\n\x03rest"))
+	header, err := proxyproto.Read(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, header.Version)
+	assert.Equal(t, "203.0.113.7:56324", header.Source.String())
+	assert.Equal(t, "192.0.2.1:1935", header.Destination.String())
+	rest, _ := io.ReadAll(reader)
+	assert.Equal(t, []byte("\x03rest"), rest)
+
+	header, err = proxyproto.Read(bytes.NewReader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1935\r\n")))
+	assert.Nil(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", header.Source.String())
+
+	header, err = proxyproto.Read(bytes.NewReader([]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")))
+	assert.Nil(t, err)
+	assert.Nil(t, header.Source)
+}
+
+func TestReadInvalidV1(t *testing.T) {
+	for _, rawHeader := range []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 56324 1935\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 056324 1935\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 56324 1935\r\n",
+		"PROXI TCP4 203.0.113.7 192.0.2.1 56324 1935\r\n",
+		"PROXY TCP4 " + string(bytes.Repeat([]byte{'1'}, 120)) + "\r\n",
+		"\x03 not a proxy header",
+	} {
+		_, err := proxyproto.Read(bytes.NewReader([]byte(rawHeader)))
+		assert.ErrorIs(t, err, proxyproto.ErrInvalidHeader, rawHeader)
+	}
+	_, err := proxyproto.Read(bytes.NewReader([]byte("PROXY TCP4 203.0.113.7")))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadV2(t *testing.T) {
+	addresses := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xDC, 0x04, 0x07, 0x8F}
+	rawHeader := v2Header(0x1, 0x11, addresses,
+		proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte("live.example.com")},
+		proxyproto.TLV{Type: proxyproto.TypeUniqueID, Value: []byte{1, 2, 3}},
+	)
+	reader := bytes.NewReader(append(rawHeader, 0x03))
+	header, err := proxyproto.Read(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 56324}, header.Source)
+	assert.Equal(t, "192.0.2.1:1935", header.Destination.String())
+	authority, ok := header.TLV(proxyproto.TypeAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("live.example.com"), authority)
+	_, ok = header.TLV(proxyproto.TypeALPN)
+	assert.False(t, ok)
+	rest, _ := io.ReadAll(reader)
+	assert.Equal(t, []byte{0x03}, rest)
+
+	ipv6Addresses := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x0F, 0xA0, 0x07, 0x8F)
+	header, err = proxyproto.Read(bytes.NewReader(v2Header(0x1, 0x21, ipv6Addresses)))
+	assert.Nil(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", header.Source.String())
+
+	// the health checks of the proxy keep the addresses of the connection
+	header, err = proxyproto.Read(bytes.NewReader(v2Header(0x0, 0x11, addresses)))
+	assert.Nil(t, err)
+	assert.Nil(t, header.Source)
+	assert.Nil(t, header.Destination)
+}
+
+func TestReadV2Checksum(t *testing.T) {
+	addresses := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xDC, 0x04, 0x07, 0x8F}
+	rawHeader := v2Header(0x1, 0x11, addresses, proxyproto.TLV{Type: proxyproto.TypeCRC32C, Value: make([]byte, 4)})
+	checksum := crc32.Checksum(rawHeader, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(rawHeader[len(rawHeader)-4:], checksum)
+	header, err := proxyproto.Read(bytes.NewReader(rawHeader))
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7:56324", header.Source.String())
+
+	rawHeader[len(rawHeader)-1]++
+	_, err = proxyproto.Read(bytes.NewReader(rawHeader))
+	assert.ErrorIs(t, err, proxyproto.ErrChecksum)
+}
+
+func TestReadInvalidV2(t *testing.T) {
+	addresses := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xDC, 0x04, 0x07, 0x8F}
+	badVersion := v2Header(0x1, 0x11, addresses)
+	badVersion[12] = 0x11
+	badCommand := v2Header(0x2, 0x11, addresses)
+	truncatedAddresses := v2Header(0x1, 0x21, addresses)
+	truncatedTLV := append(v2Header(0x1, 0x11, addresses), proxyproto.TypeNoop, 0x00)
+	binary.BigEndian.PutUint16(truncatedTLV[14:16], uint16(len(addresses)+2))
+	for _, rawHeader := range [][]byte{badVersion, badCommand, truncatedAddresses, truncatedTLV} {
+		_, err := proxyproto.Read(bytes.NewReader(rawHeader))
+		assert.ErrorIs(t, err, proxyproto.ErrInvalidHeader)
+	}
+}
@@ -0,0 +1,275 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"rtmp/amf"
+	"rtmp/flv"
+	"slices"
+)
+
+// paddingOverhead is the size of the padding property without its value, the name and the string marker and length
+const paddingOverhead = 2 + len(paddingProperty) + 3
+
+// maxMetadataSize keeps the padding within a short string
+const maxMetadataSize = 65000
+
+const paddingProperty = "_padding"
+
+// generatedProperties are the metadata properties computed by the recorder rather than sent by the publisher
+var generatedProperties = []string{"duration", "filesize", "lasttimestamp", "keyframes", paddingProperty}
+
+type keyframe struct {
+	time     float64
+	position int64
+}
+
+// file is a recording on disk, the onMetaData tag at its start has a fixed size so the duration, the file
+// size and the keyframe index are patched in place once the file is complete
+type file struct {
+	path      string
+	file      *os.File
+	size      int64
+	appended  bool
+	wroteTags bool
+	// metadataSize is the size of the onMetaData tag data, zero when an appended file lacks the reserved tag
+	metadataSize   int
+	properties     []amf.ObjectProperty
+	keyframes      []keyframe
+	indexSize      int
+	keyframeCount  int
+	keyframeStride int
+	// timestampOffset continues the timeline of an appended file
+	timestampOffset uint32
+	lastTimestamp   uint32
+}
+
+func createFile(path string, indexSize int) (*file, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	osFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	newFile := &file{
+		path:           path,
+		file:           osFile,
+		indexSize:      indexSize,
+		keyframeStride: 1,
+		metadataSize:   min(4096+18*indexSize, maxMetadataSize),
+	}
+	header := flv.Header{HasAudio: true, HasVideo: true}.Encode()
+	metadataTag := flv.Tag{Type: flv.TagTypeScriptData, Data: newFile.encodeMetadata()}
+	_, err = osFile.Write(append(header, metadataTag.Encode()...))
+	if err != nil {
+		_ = osFile.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	newFile.size = int64(len(header) + metadataTag.Size())
+	return newFile, nil
+}
+
+// openFile appends to an existing recording, a missing one is created
+func openFile(path string, indexSize int) (*file, error) {
+	osFile, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return createFile(path, indexSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	newFile := &file{
+		path:           path,
+		file:           osFile,
+		appended:       true,
+		indexSize:      indexSize,
+		keyframeStride: 1,
+	}
+	err = newFile.readExisting()
+	if err != nil {
+		_ = osFile.Close()
+		return nil, err
+	}
+	return newFile, nil
+}
+
+// readExisting restores the state of a recording appended to, its metadata is only patched when it
+// has the fixed size tag this recorder writes
+func (recordingFile *file) readExisting() error {
+	_, err := flv.ReadHeader(recordingFile.file)
+	if err != nil {
+		return err
+	}
+	firstTag, err := flv.ReadTag(recordingFile.file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if firstTag != nil && firstTag.Type == flv.TagTypeScriptData {
+		properties, ok := metadataProperties(firstTag.Data)
+		if ok && slices.ContainsFunc(properties, isProperty(paddingProperty)) {
+			recordingFile.metadataSize = len(firstTag.Data)
+			recordingFile.keyframes = keyframeIndex(properties)
+			recordingFile.properties = slices.DeleteFunc(properties, isGeneratedProperty)
+		}
+	}
+	lastTag, err := flv.ReadLastTagHeader(recordingFile.file)
+	if err == nil && (lastTag.Type == flv.TagTypeAudio || lastTag.Type == flv.TagTypeVideo) {
+		// the appended tags follow the last one as if the publisher never stopped
+		recordingFile.timestampOffset = lastTag.Timestamp + 1
+		recordingFile.lastTimestamp = lastTag.Timestamp
+	}
+	recordingFile.size, err = recordingFile.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (recordingFile *file) writeTag(tag flv.Tag, keyframe bool) error {
+	tag.Timestamp += recordingFile.timestampOffset
+	if keyframe {
+		recordingFile.indexKeyframe(float64(tag.Timestamp)/1000, recordingFile.size)
+	}
+	n, err := recordingFile.file.Write(tag.Encode())
+	recordingFile.size += int64(n)
+	if err != nil {
+		return err
+	}
+	recordingFile.wroteTags = true
+	recordingFile.lastTimestamp = max(recordingFile.lastTimestamp, tag.Timestamp)
+	return nil
+}
+
+// indexKeyframe thins the index once full, keeping every other keyframe
+func (recordingFile *file) indexKeyframe(time float64, position int64) {
+	recordingFile.keyframeCount++
+	if (recordingFile.keyframeCount-1)%recordingFile.keyframeStride != 0 {
+		return
+	}
+	recordingFile.keyframes = append(recordingFile.keyframes, keyframe{time, position})
+	if len(recordingFile.keyframes) >= recordingFile.indexSize {
+		recordingFile.keyframes = thin(recordingFile.keyframes)
+		recordingFile.keyframeStride *= 2
+	}
+}
+
+// close patches the metadata and closes the file, a new file without media is removed and its path is empty
+func (recordingFile *file) close() (string, error) {
+	if !recordingFile.wroteTags && !recordingFile.appended {
+		_ = recordingFile.file.Close()
+		return "", os.Remove(recordingFile.path)
+	}
+	var err error
+	if recordingFile.metadataSize > 0 {
+		if metadata := recordingFile.encodeMetadata(); metadata != nil {
+			_, err = recordingFile.file.WriteAt(metadata, flv.HeaderSize+flv.TagHeaderSize)
+		}
+	}
+	closeErr := recordingFile.file.Close()
+	return recordingFile.path, errors.Join(err, closeErr)
+}
+
+// encodeMetadata returns metadataSize bytes, the keyframe index is thinned until it fits or nil if nothing fits
+func (recordingFile *file) encodeMetadata() []byte {
+	keyframes := recordingFile.keyframes
+	for {
+		properties := slices.Clone(recordingFile.properties)
+		properties = append(properties,
+			amf.ObjectProperty{Name: "duration", Value: amf.NewNumber(float64(recordingFile.lastTimestamp) / 1000)},
+			amf.ObjectProperty{Name: "filesize", Value: amf.NewNumber(float64(recordingFile.size))},
+			amf.ObjectProperty{Name: "lasttimestamp", Value: amf.NewNumber(float64(recordingFile.lastTimestamp) / 1000)},
+			amf.ObjectProperty{Name: "keyframes", Value: encodeKeyframes(keyframes)},
+		)
+		encoded := amf.NewCommand(amf.NewString("onMetaData"), amf.NewEcmaArray(properties...)).Encode()
+		padding := recordingFile.metadataSize - len(encoded) - paddingOverhead
+		if padding >= 0 {
+			properties = append(properties, amf.ObjectProperty{Name: paddingProperty, Value: amf.NewString(string(make([]byte, padding)))})
+			return amf.NewCommand(amf.NewString("onMetaData"), amf.NewEcmaArray(properties...)).Encode()
+		}
+		if len(keyframes) == 0 {
+			if len(recordingFile.properties) == 0 {
+				return nil
+			}
+			// the publisher metadata alone is too large, only the generated properties are kept
+			recordingFile.properties = nil
+			continue
+		}
+		keyframes = thin(keyframes)
+	}
+}
+
+func encodeKeyframes(keyframes []keyframe) amf.Object {
+	times := make(amf.StrictArray, 0, len(keyframes))
+	positions := make(amf.StrictArray, 0, len(keyframes))
+	for _, indexed := range keyframes {
+		times = append(times, amf.NewNumber(indexed.time))
+		positions = append(positions, amf.NewNumber(float64(indexed.position)))
+	}
+	return amf.NewObject(
+		amf.ObjectProperty{Name: "times", Value: times},
+		amf.ObjectProperty{Name: "filepositions", Value: positions},
+	)
+}
+
+func keyframeIndex(properties []amf.ObjectProperty) []keyframe {
+	index := slices.IndexFunc(properties, isProperty("keyframes"))
+	if index < 0 {
+		return nil
+	}
+	keyframesObject, ok := properties[index].Value.(amf.Object)
+	if !ok {
+		return nil
+	}
+	var times, positions amf.StrictArray
+	for _, property := range keyframesObject {
+		if array, ok := property.Value.(amf.StrictArray); ok && property.Name == "times" {
+			times = array
+		} else if ok && property.Name == "filepositions" {
+			positions = array
+		}
+	}
+	keyframes := make([]keyframe, 0, len(times))
+	for i := 0; i < len(times) && i < len(positions); i++ {
+		time, timeOk := times[i].(amf.Number)
+		position, positionOk := positions[i].(amf.Number)
+		if timeOk && positionOk {
+			keyframes = append(keyframes, keyframe{float64(time), int64(position)})
+		}
+	}
+	return keyframes
+}
+
+// metadataProperties decodes an onMetaData data message
+func metadataProperties(data []byte) ([]amf.ObjectProperty, bool) {
+	command, err := amf.DecodeCommand(data)
+	if err != nil || len(command.Parts) < 2 || command.Parts[0] != amf.NewString("onMetaData") {
+		return nil, false
+	}
+	switch properties := command.Parts[1].(type) {
+	case amf.EcmaArray:
+		return properties, true
+	case amf.Object:
+		return properties, true
+	}
+	return nil, false
+}
+
+func thin(keyframes []keyframe) []keyframe {
+	thinned := make([]keyframe, 0, len(keyframes)/2+1)
+	for i := 0; i < len(keyframes); i += 2 {
+		thinned = append(thinned, keyframes[i])
+	}
+	return thinned
+}
+
+func isProperty(name string) func(amf.ObjectProperty) bool {
+	return func(property amf.ObjectProperty) bool {
+		return property.Name == name
+	}
+}
+
+func isGeneratedProperty(property amf.ObjectProperty) bool {
+	return slices.Contains(generatedProperties, property.Name)
+}
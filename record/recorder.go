@@ -0,0 +1,144 @@
+package record
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"rtmp/logger"
+	"rtmp/server"
+	"rtmp/stream"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PublishTypeLive   = "live"
+	PublishTypeRecord = "record"
+	PublishTypeAppend = "append"
+)
+
+type Config struct {
+	Directory string
+	// Apps lists the applications whose streams are recorded whatever the publish type
+	Apps []string
+	// Append makes the recordings of Apps append to the file named by AppendTemplate
+	Append bool
+	// Template names the recordings relative to Directory, {app}, {stream}, {date}, {time}, {unix} and {index}
+	// are replaced by the application, the stream name, the start date and time and the rotation index
+	Template string
+	// AppendTemplate names the recordings appended to, it should not depend on the time
+	AppendTemplate string
+	// MaxDuration and MaxSize rotate the recordings at the next keyframe, zero disables them
+	MaxDuration time.Duration
+	MaxSize     int64
+	// KeyframeIndexSize is the number of keyframes indexed in the metadata of a file before the index is thinned
+	KeyframeIndexSize int
+}
+
+// Recorder writes the published streams to flv files, the streams of Config.Apps and the ones published with
+// the record or append type are recorded
+type Recorder struct {
+	server.NopHandler
+	Config  Config
+	Streams *stream.Registry
+	// OnRecordDone is called once a file is complete, the webhook notifier OnRecordDone method fits it
+	OnRecordDone func(app string, stream string, path string, startedAt time.Time)
+}
+
+func NewRecorder(config Config, streams *stream.Registry) *Recorder {
+	if config.Directory == "" {
+		config.Directory = "recordings"
+	}
+	if config.Template == "" {
+		config.Template = "{app}/{stream}-{time}.flv"
+	}
+	if config.AppendTemplate == "" {
+		config.AppendTemplate = "{app}/{stream}.flv"
+	}
+	if config.KeyframeIndexSize == 0 {
+		config.KeyframeIndexSize = 2048
+	}
+	return &Recorder{
+		Config:  config,
+		Streams: streams,
+	}
+}
+
+func (recorder *Recorder) OnPublish(_ *server.Session, request *server.PublishRequest) error {
+	record, appendMode := recorder.mode(request)
+	if !record {
+		return nil
+	}
+	publishedStream, ok := recorder.Streams.Get(request.App, request.Name)
+	if !ok {
+		return nil
+	}
+	newRecording, err := startRecording(recorder, publishedStream, appendMode)
+	if err != nil {
+		logger.Get().Errorf("error starting the recording of %s: %s", publishedStream.Key(), err)
+		return &server.StatusError{Code: "NetStream.Record.NoAccess", Description: "The stream can't be recorded."}
+	}
+	err = publishedStream.Subscribe(newRecording)
+	if err != nil {
+		_ = newRecording.Close()
+	}
+	return nil
+}
+
+func (recorder *Recorder) mode(request *server.PublishRequest) (record bool, appendMode bool) {
+	switch request.Type {
+	case PublishTypeRecord:
+		return true, false
+	case PublishTypeAppend:
+		return true, true
+	}
+	if slices.Contains(recorder.Config.Apps, request.App) {
+		return true, recorder.Config.Append
+	}
+	return false, false
+}
+
+// path expands a template, a new file never overwrites an existing one
+func (recorder *Recorder) path(template string, recordedStream *stream.Stream, index int, startedAt time.Time, appendMode bool) string {
+	expanded := strings.NewReplacer(
+		"{app}", sanitize(recordedStream.App),
+		"{stream}", sanitize(recordedStream.Name),
+		"{date}", startedAt.Format("20060102"),
+		"{time}", startedAt.Format("20060102-150405"),
+		"{unix}", strconv.FormatInt(startedAt.Unix(), 10),
+		"{index}", strconv.Itoa(index),
+	).Replace(template)
+	path := filepath.Join(recorder.Config.Directory, expanded)
+	if appendMode {
+		return path
+	}
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+	for suffix := 1; fileExists(path); suffix++ {
+		path = fmt.Sprintf("%s-%d%s", base, suffix, extension)
+	}
+	return path
+}
+
+func (recorder *Recorder) recordDone(recordedStream *stream.Stream, path string, startedAt time.Time) {
+	logger.Get().Infof("recording of %s written to %s", recordedStream.Key(), path)
+	if recorder.OnRecordDone != nil {
+		recorder.OnRecordDone(recordedStream.App, recordedStream.Name, path, startedAt)
+	}
+}
+
+// sanitize keeps the names sent by the peers from escaping the recordings directory
+func sanitize(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
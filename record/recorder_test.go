@@ -0,0 +1,239 @@
+package record_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/message"
+	"rtmp/record"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordedFile struct {
+	path      string
+	startedAt time.Time
+}
+
+func startTestingRecorder(t *testing.T, config record.Config) (*server.Server, chan recordedFile) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	config.Directory = t.TempDir()
+	recorder := record.NewRecorder(config, testServer.Streams)
+	recordedFiles := make(chan recordedFile, 10)
+	recorder.OnRecordDone = func(app string, stream string, path string, startedAt time.Time) {
+		recordedFiles <- recordedFile{path, startedAt}
+	}
+	testServer.Handler = recorder
+	return testServer, recordedFiles
+}
+
+func waitTestRecording(t *testing.T, recordedFiles chan recordedFile) string {
+	t.Helper()
+	select {
+	case recorded := <-recordedFiles:
+		return recorded.path
+	case <-time.After(3 * time.Second):
+		t.Fatal("recording not completed")
+	}
+	return ""
+}
+
+func publishTestGop(t *testing.T, clientConn *conn.Conn, streamId uint32, timestamp uint32) {
+	t.Helper()
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeVideo, timestamp, []byte{0x17, 0x01, 0, 0, 0, 0x65, 1, 2, 3})
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeAudio, timestamp, []byte{0xAF, 0x01, 4, 5})
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeVideo, timestamp+40, []byte{0x27, 0x01, 0, 0, 0, 0x41, 6, 7})
+}
+
+// testSequenceHeader is an avc sequence header of the high profile
+var testSequenceHeader = []byte{0x17, 0x00, 0, 0, 0, 1, 0x64, 0, 0x1F}
+
+// readTestRecording checks the structure of a recording and returns its metadata and tags
+func readTestRecording(t *testing.T, path string) (map[string]amf.ValueType, []*flv.Tag) {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	_, err = flv.ReadHeader(file)
+	assert.NoError(t, err)
+	position := flv.HeaderSize
+	tags := make([]*flv.Tag, 0)
+	for {
+		tag, err := flv.ReadTag(file)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(t, err)
+		position += tag.Size()
+		backPointer := binary.BigEndian.Uint32(contents[position-flv.TagTrailerSize : position])
+		assert.Equal(t, uint32(flv.TagHeaderSize+len(tag.Data)), backPointer)
+		tags = append(tags, tag)
+	}
+	assert.Equal(t, flv.TagTypeScriptData, tags[0].Type)
+	command, err := amf.DecodeCommand(tags[0].Data)
+	assert.NoError(t, err)
+	assert.Equal(t, amf.NewString("onMetaData"), command.Parts[0])
+	metadata := make(map[string]amf.ValueType)
+	for _, property := range command.Parts[1].(amf.EcmaArray) {
+		metadata[property.Name] = property.Value
+	}
+	assert.Equal(t, amf.NewNumber(float64(len(contents))), metadata["filesize"])
+	return metadata, tags[1:]
+}
+
+func keyframePositions(metadata map[string]amf.ValueType) amf.StrictArray {
+	for _, property := range metadata["keyframes"].(amf.Object) {
+		if property.Name == "filepositions" {
+			return property.Value.(amf.StrictArray)
+		}
+	}
+	return nil
+}
+
+func TestRecordPublishType(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStreamWithType(t, clientConn, "testStream", record.PublishTypeRecord)
+	testutil.SendTestHeaders(t, clientConn, streamId, 1280, testSequenceHeader)
+	publishTestGop(t, clientConn, streamId, 0)
+	publishTestGop(t, clientConn, streamId, 2000)
+	testutil.SendTestCommand(t, clientConn, streamId, amf.NewString("FCUnpublish"), amf.NewNumber(5), amf.NewNull())
+
+	path := waitTestRecording(t, recordedFiles)
+	assert.Equal(t, "testApp", filepath.Base(filepath.Dir(path)))
+	assert.Regexp(t, `^testStream-\d{8}-\d{6}\.flv$`, filepath.Base(path))
+	metadata, tags := readTestRecording(t, path)
+	assert.Equal(t, amf.NewNumber(1280), metadata["width"])
+	assert.Equal(t, amf.NewNumber(2.04), metadata["duration"])
+	assert.Len(t, tags, 8)
+	assert.Equal(t, []byte{0x17, 0x00, 0, 0, 0, 1, 0x64, 0, 0x1F}, tags[0].Data)
+	assert.Equal(t, uint32(2040), tags[7].Timestamp)
+	positions := keyframePositions(metadata)
+	assert.Len(t, positions, 2)
+	contents, _ := os.ReadFile(path)
+	for _, position := range positions {
+		// every indexed position is the start of a video keyframe tag
+		start := int(position.(amf.Number))
+		assert.Equal(t, flv.TagTypeVideo, contents[start])
+		assert.Equal(t, byte(0x17), contents[start+flv.TagHeaderSize])
+	}
+}
+
+func TestRecordLiveOnlyForConfiguredApps(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{Apps: []string{"otherApp"}})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, clientConn, "testStream")
+	publishTestGop(t, clientConn, streamId, 0)
+	_ = clientConn.Close()
+	select {
+	case <-recordedFiles:
+		t.Fatal("live stream recorded")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	testServer, recordedFiles = startTestingRecorder(t, record.Config{Apps: []string{"testApp"}})
+	clientConn = testutil.DialTestingServer(t, testServer)
+	streamId = testutil.PublishTestStream(t, clientConn, "../testStream")
+	publishTestGop(t, clientConn, streamId, 0)
+	_ = clientConn.Close()
+	path := waitTestRecording(t, recordedFiles)
+	assert.Equal(t, "testApp", filepath.Base(filepath.Dir(path)))
+	_, tags := readTestRecording(t, path)
+	assert.Len(t, tags, 3)
+}
+
+func TestRecordRotation(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{MaxDuration: time.Second, Template: "{stream}-{index}.flv"})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStreamWithType(t, clientConn, "testStream", record.PublishTypeRecord)
+	testutil.SendTestHeaders(t, clientConn, streamId, 1280, testSequenceHeader)
+	publishTestGop(t, clientConn, streamId, 0)
+	publishTestGop(t, clientConn, streamId, 1000)
+	publishTestGop(t, clientConn, streamId, 2000)
+	_ = clientConn.Close()
+
+	for index := range 3 {
+		path := waitTestRecording(t, recordedFiles)
+		assert.Equal(t, "testStream-"+string(rune('0'+index))+".flv", filepath.Base(path))
+		metadata, tags := readTestRecording(t, path)
+		assert.Equal(t, amf.NewNumber(1280), metadata["width"])
+		// every file starts with the sequence headers and a keyframe at timestamp zero
+		assert.Equal(t, byte(0x00), tags[0].Data[1])
+		assert.Equal(t, byte(0x00), tags[1].Data[1])
+		assert.Equal(t, byte(0x17), tags[2].Data[0])
+		assert.Equal(t, uint32(0), tags[2].Timestamp)
+		assert.Len(t, keyframePositions(metadata), 1)
+	}
+}
+
+func TestRecordRotationKeepsEveryTrack(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{MaxDuration: time.Second})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStreamWithType(t, clientConn, "testStream", record.PublishTypeRecord)
+	testutil.SendTestHeaders(t, clientConn, streamId, 1280, testSequenceHeader)
+	secondTrackHeader := []byte{0x95, 0x00, 'm', 'p', '4', 'a', 1, 0x12, 0x10}
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeAudio, 0, secondTrackHeader)
+	publishTestGop(t, clientConn, streamId, 0)
+	publishTestGop(t, clientConn, streamId, 1000)
+	_ = clientConn.Close()
+
+	waitTestRecording(t, recordedFiles)
+	_, tags := readTestRecording(t, waitTestRecording(t, recordedFiles))
+	// the rotated file starts with the headers of the default and the multitrack tracks
+	assert.Equal(t, []byte{0x17, 0x00, 0, 0, 0, 1, 0x64, 0, 0x1F}, tags[0].Data)
+	assert.Equal(t, []byte{0xAF, 0x00, 0x12, 0x10}, tags[1].Data)
+	assert.Equal(t, secondTrackHeader, tags[2].Data)
+	assert.Equal(t, byte(0x17), tags[3].Data[0])
+}
+
+func TestRecordAppend(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{})
+	var path string
+	for range 2 {
+		clientConn := testutil.DialTestingServer(t, testServer)
+		streamId := testutil.PublishTestStreamWithType(t, clientConn, "testStream", record.PublishTypeAppend)
+		testutil.SendTestHeaders(t, clientConn, streamId, 1280, testSequenceHeader)
+		publishTestGop(t, clientConn, streamId, 0)
+		_ = clientConn.Close()
+		path = waitTestRecording(t, recordedFiles)
+		assert.Equal(t, "testStream.flv", filepath.Base(path))
+	}
+	metadata, tags := readTestRecording(t, path)
+	assert.Len(t, tags, 10)
+	// the second publication continues the timeline of the first one
+	assert.Equal(t, uint32(40), tags[4].Timestamp)
+	assert.Equal(t, uint32(41), tags[5].Timestamp)
+	assert.Equal(t, uint32(81), tags[9].Timestamp)
+	assert.Equal(t, amf.NewNumber(0.081), metadata["duration"])
+	assert.Len(t, keyframePositions(metadata), 2)
+}
+
+func TestRecordThinsKeyframeIndex(t *testing.T) {
+	testServer, recordedFiles := startTestingRecorder(t, record.Config{KeyframeIndexSize: 4})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStreamWithType(t, clientConn, "testStream", record.PublishTypeRecord)
+	for gop := range 9 {
+		publishTestGop(t, clientConn, streamId, uint32(gop)*1000)
+	}
+	_ = clientConn.Close()
+	path := waitTestRecording(t, recordedFiles)
+	metadata, _ := readTestRecording(t, path)
+	positions := keyframePositions(metadata)
+	assert.Len(t, positions, 3)
+	contents, _ := os.ReadFile(path)
+	for _, position := range positions {
+		assert.Equal(t, byte(0x17), contents[int(position.(amf.Number))+flv.TagHeaderSize])
+	}
+}
@@ -0,0 +1,219 @@
+package record
+
+import (
+	"errors"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/stream"
+	"sync"
+	"time"
+)
+
+// recordingQueueSize is the number of messages the disk may lag behind the publisher before the recording stops
+const recordingQueueSize = 8192
+
+var errRecordingTooSlow = errors.New("recording is too slow to write the stream")
+
+// recording subscribes to a stream and writes its messages from its own goroutine, closing it completes the
+// current file before returning
+type recording struct {
+	recorder   *Recorder
+	stream     *stream.Stream
+	appendMode bool
+	messages   chan *conn.Message
+	done       chan struct{}
+	finished   chan struct{}
+	closeOnce  sync.Once
+	file       *file
+	startedAt  time.Time
+	index      int
+	// the headers are written again at the start of every rotated file
+	properties          []amf.ObjectProperty
+	audioSequenceHeader *conn.Message
+	videoSequenceHeader *conn.Message
+	trackHeaders        stream.TrackHeaders
+	hasVideo            bool
+	baseTimestamp       uint32
+	baseSet             bool
+}
+
+func startRecording(recorder *Recorder, recordedStream *stream.Stream, appendMode bool) (*recording, error) {
+	newRecording := &recording{
+		recorder:   recorder,
+		stream:     recordedStream,
+		appendMode: appendMode,
+		messages:   make(chan *conn.Message, recordingQueueSize),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+		// every track is recorded, the multitrack messages are written as published
+		trackHeaders: make(stream.TrackHeaders),
+	}
+	err := newRecording.openFile()
+	if err != nil {
+		return nil, err
+	}
+	go newRecording.run()
+	return newRecording, nil
+}
+
+func (recording *recording) WriteMessage(media *conn.Message) error {
+	select {
+	case <-recording.done:
+		return errRecordingTooSlow
+	default:
+	}
+	select {
+	case recording.messages <- media:
+		return nil
+	default:
+		logger.Get().Errorf("recording of %s stopped, the disk is too slow", recording.stream.Key())
+		return errRecordingTooSlow
+	}
+}
+
+// Close waits for the queued messages to be written and the file to be complete
+func (recording *recording) Close() error {
+	recording.closeOnce.Do(func() {
+		close(recording.done)
+	})
+	<-recording.finished
+	return nil
+}
+
+func (recording *recording) run() {
+	defer close(recording.finished)
+	for {
+		select {
+		case media := <-recording.messages:
+			recording.write(media)
+		case <-recording.done:
+			for len(recording.messages) > 0 {
+				recording.write(<-recording.messages)
+			}
+			recording.closeFile()
+			return
+		}
+	}
+}
+
+func (recording *recording) openFile() error {
+	recording.startedAt = time.Now()
+	config := recording.recorder.Config
+	var err error
+	if recording.appendMode {
+		path := recording.recorder.path(config.AppendTemplate, recording.stream, recording.index, recording.startedAt, true)
+		recording.file, err = openFile(path, config.KeyframeIndexSize)
+	} else {
+		path := recording.recorder.path(config.Template, recording.stream, recording.index, recording.startedAt, false)
+		recording.file, err = createFile(path, config.KeyframeIndexSize)
+	}
+	if err != nil {
+		return err
+	}
+	if recording.properties != nil {
+		recording.file.properties = recording.properties
+	}
+	recording.baseSet = false
+	return nil
+}
+
+func (recording *recording) closeFile() {
+	if recording.file == nil {
+		return
+	}
+	path, err := recording.file.close()
+	recording.file = nil
+	if err != nil {
+		logger.Get().Errorf("error completing the recording of %s: %s", recording.stream.Key(), err)
+	}
+	if path != "" {
+		recording.recorder.recordDone(recording.stream, path, recording.startedAt)
+	}
+}
+
+func (recording *recording) write(media *conn.Message) {
+	if recording.file == nil {
+		// the file failed, the rest of the stream is dropped
+		return
+	}
+	keyframe := false
+	switch media.TypeId {
+	case flv.TagTypeScriptData:
+		if properties, ok := metadataProperties(media.Data); ok {
+			recording.properties = properties
+			recording.file.properties = properties
+			return
+		}
+	case flv.TagTypeAudio:
+		if recording.trackHeaders.Add(media) {
+			break
+		}
+		if flv.IsAudioSequenceHeader(media.Data) {
+			recording.audioSequenceHeader = media
+		}
+		keyframe = !recording.hasVideo
+	case flv.TagTypeVideo:
+		recording.hasVideo = true
+		if !recording.trackHeaders.Add(media) && flv.IsVideoSequenceHeader(media.Data) {
+			recording.videoSequenceHeader = media
+		}
+		keyframe = flv.IsVideoKeyframe(media.Data)
+	default:
+		return
+	}
+	if keyframe && recording.shouldRotate(media.Timestamp) {
+		recording.rotate(media.Timestamp)
+		if recording.file == nil {
+			return
+		}
+	}
+	recording.writeTag(media, keyframe)
+}
+
+func (recording *recording) writeTag(media *conn.Message, keyframe bool) {
+	if !recording.baseSet {
+		recording.baseTimestamp = media.Timestamp
+		recording.baseSet = true
+	}
+	var timestamp uint32
+	if media.Timestamp > recording.baseTimestamp {
+		timestamp = media.Timestamp - recording.baseTimestamp
+	}
+	err := recording.file.writeTag(flv.Tag{Type: media.TypeId, Timestamp: timestamp, Data: media.Data}, keyframe && media.TypeId == flv.TagTypeVideo)
+	if err != nil {
+		logger.Get().Errorf("error writing the recording of %s: %s", recording.stream.Key(), err)
+		recording.closeFile()
+	}
+}
+
+func (recording *recording) shouldRotate(timestamp uint32) bool {
+	config := recording.recorder.Config
+	if config.MaxSize > 0 && recording.file.size >= config.MaxSize {
+		return true
+	}
+	if config.MaxDuration == 0 || !recording.baseSet || timestamp < recording.baseTimestamp {
+		return false
+	}
+	return time.Duration(timestamp-recording.baseTimestamp)*time.Millisecond >= config.MaxDuration
+}
+
+// rotate completes the current file and starts the next one at the given timestamp with the sequence headers
+func (recording *recording) rotate(timestamp uint32) {
+	recording.closeFile()
+	recording.index++
+	err := recording.openFile()
+	if err != nil {
+		logger.Get().Errorf("error rotating the recording of %s: %s", recording.stream.Key(), err)
+		return
+	}
+	recording.baseTimestamp = timestamp
+	recording.baseSet = true
+	headers := append([]*conn.Message{recording.videoSequenceHeader, recording.audioSequenceHeader}, recording.trackHeaders.Messages()...)
+	for _, header := range headers {
+		if header != nil {
+			recording.writeTag(header, false)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"rtmp/logger"
+)
+
+// api manages the push targets and serves the state of the pushes as json:
+//
+//	GET    /api/push
+//	GET    /api/push/targets
+//	GET    /api/push/targets/{app}
+//	POST   /api/push/targets/{app}
+//	DELETE /api/push/targets/{app}?url={url}
+type api struct {
+	pusher *Pusher
+	mux    *http.ServeMux
+}
+
+func newAPI(pusher *Pusher) *api {
+	pushAPI := &api{pusher: pusher, mux: http.NewServeMux()}
+	pushAPI.mux.HandleFunc("GET /api/push", pushAPI.listPushes)
+	pushAPI.mux.HandleFunc("GET /api/push/targets", pushAPI.listTargets)
+	pushAPI.mux.HandleFunc("GET /api/push/targets/{app}", pushAPI.listAppTargets)
+	pushAPI.mux.HandleFunc("POST /api/push/targets/{app}", pushAPI.addTarget)
+	pushAPI.mux.HandleFunc("DELETE /api/push/targets/{app}", pushAPI.removeTarget)
+	return pushAPI
+}
+
+func (pusher *Pusher) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	pusher.api.mux.ServeHTTP(writer, request)
+}
+
+func (pushAPI *api) listPushes(writer http.ResponseWriter, _ *http.Request) {
+	writeJson(writer, http.StatusOK, pushAPI.pusher.Status())
+}
+
+func (pushAPI *api) listTargets(writer http.ResponseWriter, _ *http.Request) {
+	pushAPI.pusher.mutex.Lock()
+	targets := cloneTargets(pushAPI.pusher.Config.Targets)
+	pushAPI.pusher.mutex.Unlock()
+	writeJson(writer, http.StatusOK, targets)
+}
+
+func (pushAPI *api) listAppTargets(writer http.ResponseWriter, request *http.Request) {
+	targets := pushAPI.pusher.Targets(request.PathValue("app"))
+	if targets == nil {
+		targets = make([]Target, 0)
+	}
+	writeJson(writer, http.StatusOK, targets)
+}
+
+func (pushAPI *api) addTarget(writer http.ResponseWriter, request *http.Request) {
+	var target Target
+	err := json.NewDecoder(request.Body).Decode(&target)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid target")
+		return
+	}
+	err = pushAPI.pusher.AddTarget(request.PathValue("app"), target)
+	if errors.Is(err, ErrTargetExists) {
+		writeError(writer, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.Get().Infof("added push target %s to %s", target.URL, request.PathValue("app"))
+	writeJson(writer, http.StatusCreated, target)
+}
+
+func (pushAPI *api) removeTarget(writer http.ResponseWriter, request *http.Request) {
+	err := pushAPI.pusher.RemoveTarget(request.PathValue("app"), request.URL.Query().Get("url"))
+	if err != nil {
+		writeError(writer, http.StatusNotFound, err.Error())
+		return
+	}
+	logger.Get().Infof("removed push target %s from %s", request.URL.Query().Get("url"), request.PathValue("app"))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeJson(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		logger.Get().Debugf("error writing push api response: %s", err)
+	}
+}
+
+func writeError(writer http.ResponseWriter, status int, message string) {
+	writeJson(writer, status, map[string]string{"error": message})
+}
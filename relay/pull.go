@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"rtmp/client"
+	"rtmp/logger"
+	"rtmp/stream"
+	"sync/atomic"
+	"time"
+)
+
+// pull plays a stream of an origin and writes its messages to the local stream published in its place
+type pull struct {
+	puller *Puller
+	app    string
+	name   string
+	url    string
+	// ctx is canceled to stop the pull, once closed or idle
+	ctx    context.Context
+	cancel context.CancelFunc
+	// ready is closed once the stream is published locally or the pull failed with err
+	ready     chan struct{}
+	finished  chan struct{}
+	stream    *stream.Stream
+	err       error
+	bytesIn   atomic.Uint64
+	startedAt time.Time
+}
+
+func newPull(puller *Puller, app string, name string, url string) *pull {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pull{
+		puller:   puller,
+		app:      app,
+		name:     name,
+		url:      url,
+		ctx:      ctx,
+		cancel:   cancel,
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+func (pull *pull) key() string {
+	return stream.Key(pull.app, pull.name)
+}
+
+// start plays the stream from the origin and publishes it, the messages are then written from another goroutine
+func (pull *pull) start() {
+	defer close(pull.ready)
+	origin, err := pull.connect()
+	if err != nil {
+		pull.err = err
+		pull.cancel()
+		pull.puller.remove(pull)
+		close(pull.finished)
+		return
+	}
+	pull.startedAt = time.Now()
+	logger.Get().Infof("pulling %s from %s", pull.key(), pull.url)
+	go pull.run(origin)
+}
+
+func (pull *pull) connect() (*client.Client, error) {
+	origin, err := pull.puller.dial(pull.ctx, pull.url)
+	if err != nil {
+		return nil, err
+	}
+	err = origin.Play(pull.name)
+	if err != nil {
+		_ = origin.Close()
+		return nil, err
+	}
+	pull.stream, err = pull.puller.Streams.Publish(pull.app, pull.name)
+	if err != nil {
+		_ = origin.Close()
+		return nil, err
+	}
+	return origin, nil
+}
+
+func (pull *pull) run(origin *client.Client) {
+	defer close(pull.finished)
+	go pull.watchIdle(origin)
+	for {
+		media, err := origin.ReadMessage()
+		if err != nil {
+			if pull.ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				logger.Get().Errorf("error pulling %s from %s: %s", pull.key(), pull.url, err)
+			}
+			break
+		}
+		pull.bytesIn.Add(uint64(len(media.Data)))
+		pull.stream.WriteMessage(media)
+	}
+	pull.cancel()
+	_ = origin.Close()
+	// a player asking for the stream from now on starts a new pull
+	pull.puller.remove(pull)
+	pull.puller.Streams.Unpublish(pull.stream)
+	logger.Get().Infof("stopped pulling %s from %s", pull.key(), pull.url)
+}
+
+// watchIdle disconnects from the origin once the stream had no subscriber for the idle timeout or the pull stopped
+func (pull *pull) watchIdle(origin *client.Client) {
+	idleTimeout := pull.puller.Config.IdleTimeout
+	ticker := time.NewTicker(max(min(idleTimeout/4, time.Second), time.Millisecond))
+	defer ticker.Stop()
+	var idleSince time.Time
+	for {
+		select {
+		case <-pull.ctx.Done():
+			_ = origin.Close()
+			return
+		case now := <-ticker.C:
+			if len(pull.stream.Subscribers()) > 0 {
+				idleSince = time.Time{}
+			} else if idleSince.IsZero() {
+				idleSince = now
+			} else if now.Sub(idleSince) >= idleTimeout {
+				logger.Get().Infof("%s has no subscriber left", pull.key())
+				pull.cancel()
+			}
+		}
+	}
+}
+
+// close stops the pull and unpublishes the stream
+func (pull *pull) close() {
+	<-pull.ready
+	pull.cancel()
+	<-pull.finished
+}
+
+func (pull *pull) status() (PullStatus, bool) {
+	select {
+	case <-pull.ready:
+	default:
+		return PullStatus{}, false
+	}
+	if pull.err != nil {
+		return PullStatus{}, false
+	}
+	return PullStatus{
+		App:         pull.app,
+		Stream:      pull.name,
+		URL:         pull.url,
+		Subscribers: len(pull.stream.Subscribers()),
+		BytesIn:     pull.bytesIn.Load(),
+		StartedAt:   pull.startedAt,
+	}, true
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"rtmp/client"
+	"rtmp/logger"
+	"rtmp/server"
+	"rtmp/stream"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PullConfig struct {
+	// Origins maps the applications to the origin application their unknown streams are pulled from,
+	// rtmp://host[:port]/app
+	Origins map[string]string
+	// IdleTimeout is how long a pull outlives its last subscriber
+	IdleTimeout time.Duration
+	// Timeout bounds the connection to the origin and every read
+	Timeout time.Duration
+}
+
+// PullStatus is the state of the pull of a stream from an origin
+type PullStatus struct {
+	App         string    `json:"app"`
+	Stream      string    `json:"stream"`
+	URL         string    `json:"url"`
+	Subscribers int       `json:"subscribers"`
+	BytesIn     uint64    `json:"bytes_in"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// Puller plays the streams of the applications with an origin from it the first time a player asks for one, the
+// pulled stream is published locally until it has had no subscriber for IdleTimeout
+type Puller struct {
+	server.NopHandler
+	Config  PullConfig
+	Streams *stream.Registry
+	// Locate finds the origin application of a stream, rtmp://host[:port]/app, Config.Origins is used when nil
+	Locate func(app string, name string) (string, bool)
+	pulls  map[string]*pull
+	mutex  sync.Mutex
+}
+
+func NewPuller(config PullConfig, streams *stream.Registry) *Puller {
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = 10 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &Puller{
+		Config:  config,
+		Streams: streams,
+		pulls:   make(map[string]*pull),
+	}
+}
+
+// OnPlay pulls the unknown streams, the play fails with the stream not found when the origin does not have it
+func (puller *Puller) OnPlay(_ *server.Session, request *server.PlayRequest) error {
+	if _, live := puller.Streams.Get(request.App, request.Name); live {
+		return nil
+	}
+	if _, ok := puller.origin(request.App, request.Name); !ok {
+		return nil
+	}
+	_, err := puller.Pull(request.App, request.Name)
+	if err != nil && !errors.Is(err, stream.ErrAlreadyPublished) {
+		logger.Get().Errorf("error pulling %s: %s", stream.Key(request.App, request.Name), err)
+	}
+	return nil
+}
+
+// Pull publishes a stream of the origin of its application, the players asking for it at the same time share
+// the pull
+func (puller *Puller) Pull(app string, name string) (*stream.Stream, error) {
+	originURL, ok := puller.origin(app, name)
+	if !ok {
+		return nil, stream.ErrNotPublished
+	}
+	key := stream.Key(app, name)
+	puller.mutex.Lock()
+	existingPull, ok := puller.pulls[key]
+	if !ok {
+		existingPull = newPull(puller, app, name, originURL)
+		puller.pulls[key] = existingPull
+	}
+	puller.mutex.Unlock()
+	if !ok {
+		existingPull.start()
+	}
+	<-existingPull.ready
+	return existingPull.stream, existingPull.err
+}
+
+// Pulling tells whether a stream is pulled from its origin
+func (puller *Puller) Pulling(app string, name string) bool {
+	puller.mutex.Lock()
+	defer puller.mutex.Unlock()
+	_, ok := puller.pulls[stream.Key(app, name)]
+	return ok
+}
+
+// Status lists the pulls sorted by stream
+func (puller *Puller) Status() []PullStatus {
+	puller.mutex.Lock()
+	statuses := make([]PullStatus, 0, len(puller.pulls))
+	for _, existingPull := range puller.pulls {
+		if status, ok := existingPull.status(); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	puller.mutex.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return stream.Key(statuses[i].App, statuses[i].Stream) < stream.Key(statuses[j].App, statuses[j].Stream)
+	})
+	return statuses
+}
+
+// ServeHTTP serves the state of the pulls as json at GET /api/pull
+func (puller *Puller) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeError(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJson(writer, http.StatusOK, puller.Status())
+}
+
+// SetOrigins replaces the origins of the applications, the streams already pulled keep being pulled from their
+// former origin until their subscribers leave
+func (puller *Puller) SetOrigins(origins map[string]string) {
+	puller.mutex.Lock()
+	defer puller.mutex.Unlock()
+	puller.Config.Origins = maps.Clone(origins)
+}
+
+// Close stops every pull
+func (puller *Puller) Close() error {
+	puller.mutex.Lock()
+	pulls := make([]*pull, 0, len(puller.pulls))
+	for _, existingPull := range puller.pulls {
+		pulls = append(pulls, existingPull)
+	}
+	puller.mutex.Unlock()
+	for _, existingPull := range pulls {
+		existingPull.close()
+	}
+	return nil
+}
+
+func (puller *Puller) origin(app string, name string) (string, bool) {
+	if puller.Locate != nil {
+		return puller.Locate(app, name)
+	}
+	puller.mutex.Lock()
+	defer puller.mutex.Unlock()
+	originURL, ok := puller.Config.Origins[app]
+	return originURL, ok
+}
+
+func (puller *Puller) remove(endedPull *pull) {
+	puller.mutex.Lock()
+	defer puller.mutex.Unlock()
+	if puller.pulls[endedPull.key()] == endedPull {
+		delete(puller.pulls, endedPull.key())
+	}
+}
+
+func (puller *Puller) dial(ctx context.Context, rawURL string) (*client.Client, error) {
+	return client.Dial(ctx, rawURL, puller.Config.Timeout)
+}
@@ -0,0 +1,130 @@
+package relay_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/amf"
+	"rtmp/message"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestingPuller(t *testing.T, originServer *server.Server) (*server.Server, *relay.Puller) {
+	t.Helper()
+	edgeServer := testutil.StartTestingServer(t)
+	puller := relay.NewPuller(relay.PullConfig{
+		Origins:     map[string]string{"testApp": targetURL(originServer, "testApp")},
+		IdleTimeout: 100 * time.Millisecond,
+		Timeout:     time.Second,
+	}, edgeServer.Streams)
+	edgeServer.Handler = puller
+	t.Cleanup(func() {
+		_ = puller.Close()
+	})
+	return edgeServer, puller
+}
+
+func TestPullOnDemand(t *testing.T) {
+	originServer := testutil.StartTestingServer(t)
+	edgeServer, puller := startTestingPuller(t, originServer)
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestHeaders(t, publisherConn, streamId, 128, testSequenceHeader)
+	assert.Empty(t, puller.Status())
+
+	playerConn := testutil.DialTestingServer(t, edgeServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	assert.Equal(t, testSequenceHeader, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	secondPlayerConn := testutil.DialTestingServer(t, edgeServer)
+	testutil.PlayTestStream(t, secondPlayerConn, "testStream")
+	keyframe := []byte{0x17, 0x01, 0, 0, 0, 0x65, 1, 2, 3}
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 40, keyframe)
+	assert.Equal(t, keyframe, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	assert.Equal(t, testSequenceHeader, testutil.WaitTestMedia(t, secondPlayerConn, message.TypeVideo).Data)
+	received := testutil.WaitTestMedia(t, secondPlayerConn, message.TypeVideo)
+	assert.Equal(t, keyframe, received.Data)
+	assert.Equal(t, uint32(40), received.Timestamp)
+
+	// both players share a single pull
+	originStream, ok := originServer.Streams.Get("testApp", "testStream")
+	assert.True(t, ok)
+	assert.Len(t, originStream.Subscribers(), 1)
+	statuses := puller.Status()
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, 2, statuses[0].Subscribers)
+	assert.Greater(t, statuses[0].BytesIn, uint64(0))
+	apiServer := httptest.NewServer(puller)
+	t.Cleanup(apiServer.Close)
+	response, err := http.Get(apiServer.URL + "/api/pull")
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&statuses))
+	_ = response.Body.Close()
+	assert.Equal(t, "testStream", statuses[0].Stream)
+
+	// the pull outlives its last player for the idle timeout
+	_ = playerConn.Close()
+	_ = secondPlayerConn.Close()
+	assert.Eventually(t, func() bool {
+		_, ok := edgeServer.Streams.Get("testApp", "testStream")
+		return !ok && len(puller.Status()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(originStream.Subscribers()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPullKeepsStreamDuringIdleTimeout(t *testing.T) {
+	originServer := testutil.StartTestingServer(t)
+	edgeServer, _ := startTestingPuller(t, originServer)
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestHeaders(t, publisherConn, streamId, 128, testSequenceHeader)
+	playerConn := testutil.DialTestingServer(t, edgeServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	_ = playerConn.Close()
+	// a player coming back within the idle timeout reuses the pull
+	playerConn = testutil.DialTestingServer(t, edgeServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	time.Sleep(300 * time.Millisecond)
+	_, ok := edgeServer.Streams.Get("testApp", "testStream")
+	assert.True(t, ok)
+}
+
+func TestPullEndsWithOrigin(t *testing.T) {
+	originServer := testutil.StartTestingServer(t)
+	edgeServer, puller := startTestingPuller(t, originServer)
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	playerConn := testutil.DialTestingServer(t, edgeServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+
+	_ = publisherConn.Close()
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+	assert.Eventually(t, func() bool {
+		return len(puller.Status()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPullUnknownStream(t *testing.T) {
+	originServer := testutil.StartTestingServer(t)
+	edgeServer, puller := startTestingPuller(t, originServer)
+	playerConn := testutil.DialTestingServer(t, edgeServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(playerConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, playerConn, "_result")
+	testutil.SendTestCommand(t, playerConn, 0, amf.NewString("createStream"), amf.NewNumber(2), amf.NewNull())
+	result := testutil.WaitTestCommand(t, playerConn, "_result")
+	streamId := uint32(result.Parts[3].(amf.Number))
+	testutil.SendTestCommand(t, playerConn, streamId, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("unknownStream"))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.StreamNotFound")
+	assert.Empty(t, puller.Status())
+	_, ok := edgeServer.Streams.Get("testApp", "unknownStream")
+	assert.False(t, ok)
+}
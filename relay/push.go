@@ -0,0 +1,265 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"rtmp/amf"
+	"rtmp/client"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/stream"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pushQueueSize is the number of messages a target may lag behind the publisher before the push stops, the messages
+// are drained while reconnecting so only a connected target too slow for the stream stops it
+const pushQueueSize = 8192
+
+var errPushTooSlow = errors.New("push target is too slow to receive the stream")
+
+// push subscribes to a stream and publishes it to a target from its own goroutine, the sequence headers are sent
+// again on every reconnection
+type push struct {
+	pusher   *Pusher
+	stream   *stream.Stream
+	target   Target
+	messages chan *conn.Message
+	// ctx is canceled by Close to interrupt the connection to the target
+	ctx       context.Context
+	cancel    context.CancelFunc
+	finished  chan struct{}
+	closeOnce sync.Once
+	bytesSent atomic.Uint64
+	// the headers a reconnected target needs before the media
+	metadata            *conn.Message
+	audioSequenceHeader *conn.Message
+	videoSequenceHeader *conn.Message
+	trackHeaders        stream.TrackHeaders
+	// waitKeyframe drops the video until a keyframe once reconnected
+	waitKeyframe bool
+	statusMutex  sync.Mutex
+	name         string
+	state        string
+	// lastError is the error of the last reconnection, kept once reconnected
+	lastError   error
+	reconnects  int
+	publishedAt time.Time
+}
+
+func startPush(pusher *Pusher, pushedStream *stream.Stream, target Target) *push {
+	ctx, cancel := context.WithCancel(context.Background())
+	newPush := &push{
+		pusher:       pusher,
+		stream:       pushedStream,
+		target:       target,
+		messages:     make(chan *conn.Message, pushQueueSize),
+		ctx:          ctx,
+		cancel:       cancel,
+		finished:     make(chan struct{}),
+		trackHeaders: make(stream.TrackHeaders),
+		state:        PushStateConnecting,
+	}
+	go newPush.run()
+	return newPush
+}
+
+func (push *push) WriteMessage(media *conn.Message) error {
+	if push.ctx.Err() != nil {
+		return errPushTooSlow
+	}
+	select {
+	case push.messages <- media:
+		return nil
+	default:
+		logger.Get().Errorf("push of %s to %s stopped, the target is too slow", push.stream.Key(), push.target.URL)
+		return errPushTooSlow
+	}
+}
+
+// Close sends the queued messages and disconnects from the target
+func (push *push) Close() error {
+	push.closeOnce.Do(push.cancel)
+	<-push.finished
+	return nil
+}
+
+func (push *push) run() {
+	defer close(push.finished)
+	defer push.pusher.remove(push)
+	failures := 0
+	for {
+		target, err := push.connect()
+		if err == nil {
+			failures = 0
+			err = push.forward(target)
+			_ = target.Close()
+		}
+		if push.ctx.Err() != nil {
+			logger.Get().Infof("stopped pushing %s to %s", push.stream.Key(), push.target.URL)
+			return
+		}
+		failures++
+		logPushError(push, err)
+		push.setState(PushStateReconnecting, err)
+		if !push.wait(push.pusher.reconnectDelay(failures)) {
+			return
+		}
+		push.statusMutex.Lock()
+		push.reconnects++
+		push.statusMutex.Unlock()
+	}
+}
+
+// connect publishes the stream on the target and sends the headers
+func (push *push) connect() (*client.Client, error) {
+	targetURL, err := client.ParseURL(push.target.URL)
+	if err != nil {
+		return nil, err
+	}
+	name := targetName(push.target, targetURL, push.stream)
+	push.statusMutex.Lock()
+	push.name = name
+	push.statusMutex.Unlock()
+	push.setState(PushStateConnecting, nil)
+	target, err := client.Dial(push.ctx, push.target.URL, push.pusher.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = target.Publish(name)
+	if err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	headers := append([]*conn.Message{push.metadata, push.videoSequenceHeader, push.audioSequenceHeader}, push.trackHeaders.Messages()...)
+	for _, header := range headers {
+		if header == nil {
+			continue
+		}
+		err = push.send(target, header)
+		if err != nil {
+			_ = target.Close()
+			return nil, err
+		}
+	}
+	push.waitKeyframe = true
+	logger.Get().Infof("pushing %s to %s as %s", push.stream.Key(), push.target.URL, name)
+	push.statusMutex.Lock()
+	push.state = PushStatePublishing
+	push.publishedAt = time.Now()
+	push.statusMutex.Unlock()
+	return target, nil
+}
+
+// forward sends the messages of the stream until the push is closed or the target fails
+func (push *push) forward(target *client.Client) error {
+	for {
+		select {
+		case media := <-push.messages:
+			err := push.write(target, media)
+			if err != nil {
+				return err
+			}
+		case <-target.Done():
+			return errors.New("disconnected by the target")
+		case <-push.ctx.Done():
+			for len(push.messages) > 0 {
+				err := push.write(target, <-push.messages)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// write sends a message of the stream, the headers are remembered for the next reconnection
+func (push *push) write(target *client.Client, media *conn.Message) error {
+	if push.remember(media) {
+		return push.send(target, media)
+	}
+	if push.waitKeyframe && media.TypeId == flv.TagTypeVideo {
+		if !flv.IsVideoKeyframe(media.Data) {
+			return nil
+		}
+		push.waitKeyframe = false
+	}
+	return push.send(target, media)
+}
+
+func (push *push) send(target *client.Client, media *conn.Message) error {
+	if media.TypeId == flv.TagTypeScriptData {
+		// the stream keeps the metadata without the @setDataFrame a publisher sends it with
+		media = &conn.Message{TypeId: media.TypeId, Timestamp: media.Timestamp, Data: append(amf.NewString("@setDataFrame").Encode(), media.Data...)}
+	}
+	err := target.WriteMessage(media)
+	if err != nil {
+		return err
+	}
+	push.bytesSent.Add(uint64(len(media.Data)))
+	return nil
+}
+
+// remember keeps the headers and tells whether the message is one
+func (push *push) remember(media *conn.Message) bool {
+	switch {
+	case media.TypeId == flv.TagTypeScriptData:
+		push.metadata = media
+	case push.trackHeaders.Add(media):
+	case media.TypeId == flv.TagTypeAudio && flv.IsAudioSequenceHeader(media.Data):
+		push.audioSequenceHeader = media
+	case media.TypeId == flv.TagTypeVideo && flv.IsVideoSequenceHeader(media.Data):
+		push.videoSequenceHeader = media
+	default:
+		return false
+	}
+	return true
+}
+
+// wait drains the queue for the given delay, it returns false once the push is closed
+func (push *push) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case media := <-push.messages:
+			push.remember(media)
+		case <-timer.C:
+			return true
+		case <-push.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (push *push) setState(state string, err error) {
+	push.statusMutex.Lock()
+	defer push.statusMutex.Unlock()
+	push.state = state
+	if err != nil {
+		push.lastError = err
+	}
+	push.publishedAt = time.Time{}
+}
+
+func (push *push) status() Status {
+	push.statusMutex.Lock()
+	defer push.statusMutex.Unlock()
+	status := Status{
+		App:             push.stream.App,
+		Stream:          push.stream.Name,
+		URL:             push.target.URL,
+		Name:            push.name,
+		State:           push.state,
+		Reconnects:      push.reconnects,
+		BytesSent:       push.bytesSent.Load(),
+		PublishingSince: push.publishedAt,
+	}
+	if push.lastError != nil {
+		status.Error = push.lastError.Error()
+	}
+	return status
+}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"rtmp/client"
+	"rtmp/logger"
+	"rtmp/server"
+	"rtmp/stream"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PushStateConnecting   = "connecting"
+	PushStatePublishing   = "publishing"
+	PushStateReconnecting = "reconnecting"
+)
+
+var (
+	ErrTargetExists   = errors.New("push target already exists")
+	ErrTargetNotFound = errors.New("push target not found")
+)
+
+// Target is a server the streams of an application are pushed to
+type Target struct {
+	// URL is the application of the server, rtmp://host[:port]/app, or a stream of it
+	URL string `json:"url"`
+	// Name is the name the streams are published under, {app} and {stream} are replaced by the application and the
+	// name of the pushed stream, the stream of URL or the pushed stream name when empty
+	Name string `json:"name,omitempty"`
+}
+
+type Config struct {
+	// Targets lists the targets of every application
+	Targets map[string][]Target
+	// ReconnectDelay is the delay before the first reconnection, it doubles up to MaxReconnectDelay on every failure
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// Timeout bounds the connection to the targets and every write
+	Timeout time.Duration
+}
+
+// Status is the state of the push of a stream to a target
+type Status struct {
+	App        string `json:"app"`
+	Stream     string `json:"stream"`
+	URL        string `json:"url"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Error      string `json:"error,omitempty"`
+	Reconnects int    `json:"reconnects"`
+	BytesSent  uint64 `json:"bytes_sent"`
+	// PublishingSince is when the current connection started publishing, zero while it is not publishing
+	PublishingSince time.Time `json:"publishing_since,omitzero"`
+}
+
+// Pusher publishes the streams of the applications with targets to other servers, the pushes reconnect until the
+// stream is unpublished or the target removed
+type Pusher struct {
+	server.NopHandler
+	Config  Config
+	Streams *stream.Registry
+	pushes  map[*push]struct{}
+	mutex   sync.Mutex
+	api     *api
+}
+
+func NewPusher(config Config, streams *stream.Registry) *Pusher {
+	if config.ReconnectDelay == 0 {
+		config.ReconnectDelay = time.Second
+	}
+	if config.MaxReconnectDelay == 0 {
+		config.MaxReconnectDelay = 30 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	config.Targets = cloneTargets(config.Targets)
+	pusher := &Pusher{
+		Config:  config,
+		Streams: streams,
+		pushes:  make(map[*push]struct{}),
+	}
+	pusher.api = newAPI(pusher)
+	return pusher
+}
+
+func (pusher *Pusher) OnPublish(_ *server.Session, request *server.PublishRequest) error {
+	publishedStream, ok := pusher.Streams.Get(request.App, request.Name)
+	if !ok {
+		return nil
+	}
+	for _, target := range pusher.Targets(request.App) {
+		pusher.start(publishedStream, target)
+	}
+	return nil
+}
+
+// Targets returns the targets of an application
+func (pusher *Pusher) Targets(app string) []Target {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	return slices.Clone(pusher.Config.Targets[app])
+}
+
+// AddTarget pushes the streams of an application to a new target, the streams already published included
+func (pusher *Pusher) AddTarget(app string, target Target) error {
+	_, err := client.ParseURL(target.URL)
+	if err != nil {
+		return err
+	}
+	pusher.mutex.Lock()
+	if slices.Contains(pusher.Config.Targets[app], target) {
+		pusher.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrTargetExists, target.URL)
+	}
+	pusher.Config.Targets[app] = append(pusher.Config.Targets[app], target)
+	pusher.mutex.Unlock()
+	pusher.startPublished(app, target)
+	return nil
+}
+
+// RemoveTarget stops pushing the streams of an application to the targets with the given url
+func (pusher *Pusher) RemoveTarget(app string, url string) error {
+	pusher.mutex.Lock()
+	targets := pusher.Config.Targets[app]
+	remaining := slices.DeleteFunc(slices.Clone(targets), func(target Target) bool {
+		return target.URL == url
+	})
+	if len(remaining) == len(targets) {
+		pusher.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrTargetNotFound, url)
+	}
+	if len(remaining) == 0 {
+		delete(pusher.Config.Targets, app)
+	} else {
+		pusher.Config.Targets[app] = remaining
+	}
+	stopped := make([]*push, 0)
+	for push := range pusher.pushes {
+		if push.stream.App == app && push.target.URL == url {
+			stopped = append(stopped, push)
+		}
+	}
+	pusher.mutex.Unlock()
+	for _, push := range stopped {
+		push.stream.Unsubscribe(push)
+		_ = push.Close()
+	}
+	return nil
+}
+
+// SetTargets replaces the targets of every application, the pushes to the targets removed stop and the streams
+// already published are pushed to the targets added
+func (pusher *Pusher) SetTargets(targets map[string][]Target) error {
+	for _, appTargets := range targets {
+		for _, target := range appTargets {
+			_, err := client.ParseURL(target.URL)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	pusher.mutex.Lock()
+	previous := pusher.Config.Targets
+	pusher.Config.Targets = cloneTargets(targets)
+	stopped := make([]*push, 0)
+	for push := range pusher.pushes {
+		if !slices.Contains(targets[push.stream.App], push.target) {
+			stopped = append(stopped, push)
+		}
+	}
+	pusher.mutex.Unlock()
+	for _, push := range stopped {
+		push.stream.Unsubscribe(push)
+		_ = push.Close()
+	}
+	for app, appTargets := range targets {
+		for _, target := range appTargets {
+			if !slices.Contains(previous[app], target) {
+				pusher.startPublished(app, target)
+			}
+		}
+	}
+	return nil
+}
+
+// Status lists the pushes sorted by stream and target
+func (pusher *Pusher) Status() []Status {
+	pusher.mutex.Lock()
+	statuses := make([]Status, 0, len(pusher.pushes))
+	for push := range pusher.pushes {
+		statuses = append(statuses, push.status())
+	}
+	pusher.mutex.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].App != statuses[j].App {
+			return statuses[i].App < statuses[j].App
+		}
+		if statuses[i].Stream != statuses[j].Stream {
+			return statuses[i].Stream < statuses[j].Stream
+		}
+		return statuses[i].URL < statuses[j].URL
+	})
+	return statuses
+}
+
+func (pusher *Pusher) start(pushedStream *stream.Stream, target Target) {
+	newPush := startPush(pusher, pushedStream, target)
+	pusher.mutex.Lock()
+	pusher.pushes[newPush] = struct{}{}
+	pusher.mutex.Unlock()
+	err := pushedStream.Subscribe(newPush)
+	if err != nil {
+		_ = newPush.Close()
+	}
+}
+
+// startPublished pushes the streams of an application already published to a target
+func (pusher *Pusher) startPublished(app string, target Target) {
+	for _, publishedStream := range pusher.Streams.Streams() {
+		if publishedStream.App == app {
+			pusher.start(publishedStream, target)
+		}
+	}
+}
+
+func (pusher *Pusher) remove(push *push) {
+	pusher.mutex.Lock()
+	defer pusher.mutex.Unlock()
+	delete(pusher.pushes, push)
+}
+
+// reconnectDelay is the delay before a reconnection after the given number of consecutive failures
+func (pusher *Pusher) reconnectDelay(failures int) time.Duration {
+	delay := pusher.Config.ReconnectDelay
+	for range failures - 1 {
+		delay *= 2
+		if delay >= pusher.Config.MaxReconnectDelay {
+			return pusher.Config.MaxReconnectDelay
+		}
+	}
+	return delay
+}
+
+func cloneTargets(targets map[string][]Target) map[string][]Target {
+	cloned := make(map[string][]Target, len(targets))
+	for app, appTargets := range targets {
+		cloned[app] = slices.Clone(appTargets)
+	}
+	return cloned
+}
+
+// targetName is the name a stream is published under on a target
+func targetName(target Target, targetURL *client.URL, pushedStream *stream.Stream) string {
+	if target.Name == "" && targetURL.Stream != "" {
+		return targetURL.Stream
+	}
+	name := target.Name
+	if name == "" {
+		name = "{stream}"
+	}
+	return strings.NewReplacer("{app}", pushedStream.App, "{stream}", pushedStream.Name).Replace(name)
+}
+
+func logPushError(push *push, err error) {
+	logger.Get().Errorf("error pushing %s to %s: %s", push.stream.Key(), push.target.URL, err)
+}
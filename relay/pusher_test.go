@@ -0,0 +1,203 @@
+package relay_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/message"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSequenceHeader = []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0x00, 0x0A, 0xFF, 0xE1, 0x00, 0x07, 0x67, 0x42, 0x00, 0x0A, 0xF8, 0x41, 0xA2, 0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80}
+
+func startTestingPusher(t *testing.T, targets map[string][]relay.Target) (*server.Server, *relay.Pusher) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	pusher := relay.NewPusher(relay.Config{Targets: targets, ReconnectDelay: 20 * time.Millisecond, Timeout: time.Second}, testServer.Streams)
+	testServer.Handler = pusher
+	return testServer, pusher
+}
+
+func targetURL(targetServer *server.Server, app string) string {
+	return "rtmp://" + targetServer.Addr().String() + "/" + app
+}
+
+func waitTestPushState(t *testing.T, pusher *relay.Pusher, state string) relay.Status {
+	t.Helper()
+	var statuses []relay.Status
+	assert.Eventually(t, func() bool {
+		statuses = pusher.Status()
+		return len(statuses) == 1 && statuses[0].State == state
+	}, 3*time.Second, 10*time.Millisecond)
+	if len(statuses) != 1 {
+		t.FailNow()
+	}
+	return statuses[0]
+}
+
+func TestPushStream(t *testing.T) {
+	targetServer := testutil.StartTestingServer(t)
+	originServer, pusher := startTestingPusher(t, map[string][]relay.Target{
+		"testApp": {{URL: targetURL(targetServer, "testApp"), Name: "{app}-{stream}"}},
+	})
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestHeaders(t, publisherConn, streamId, 128, testSequenceHeader)
+	status := waitTestPushState(t, pusher, relay.PushStatePublishing)
+	assert.Equal(t, "testApp-testStream", status.Name)
+	assert.Equal(t, targetURL(targetServer, "testApp"), status.URL)
+
+	playerConn := testutil.DialTestingServer(t, targetServer)
+	testutil.PlayTestStream(t, playerConn, "testApp-testStream")
+	assert.Equal(t, testSequenceHeader, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	pushedStream, ok := targetServer.Streams.Get("testApp", "testApp-testStream")
+	assert.True(t, ok)
+	assert.Equal(t, 128, pushedStream.Info().Width)
+	keyframe := []byte{0x17, 0x01, 0, 0, 0, 0x65, 1, 2, 3}
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 40, keyframe)
+	received := testutil.WaitTestMedia(t, playerConn, message.TypeVideo)
+	assert.Equal(t, keyframe, received.Data)
+	assert.Equal(t, uint32(40), received.Timestamp)
+	assert.Greater(t, pusher.Status()[0].BytesSent, uint64(0))
+
+	// the push stops with the stream
+	_ = publisherConn.Close()
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+	assert.Eventually(t, func() bool {
+		return len(pusher.Status()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPushReconnects(t *testing.T) {
+	targetServer := testutil.StartTestingServer(t)
+	originServer, pusher := startTestingPusher(t, map[string][]relay.Target{
+		"testApp": {{URL: targetURL(targetServer, "testApp/pushed")}},
+	})
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestHeaders(t, publisherConn, streamId, 128, testSequenceHeader)
+	waitTestPushState(t, pusher, relay.PushStatePublishing)
+
+	// kicked by the target, the push publishes again with the headers
+	pushSession, ok := targetServer.Publisher("testApp", "pushed")
+	assert.True(t, ok)
+	_ = pushSession.Close()
+	assert.Eventually(t, func() bool {
+		statuses := pusher.Status()
+		return len(statuses) == 1 && statuses[0].Reconnects == 1 && statuses[0].State == relay.PushStatePublishing
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "disconnected by the target", pusher.Status()[0].Error)
+	playerConn := testutil.DialTestingServer(t, targetServer)
+	testutil.PlayTestStream(t, playerConn, "pushed")
+	assert.Equal(t, testSequenceHeader, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	// the video restarts at a keyframe
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 40, []byte{0x27, 0x01, 0, 0, 0, 0x41, 1})
+	keyframe := []byte{0x17, 0x01, 0, 0, 0, 0x65, 2}
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 80, keyframe)
+	assert.Equal(t, keyframe, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+}
+
+func TestPushUnreachableTarget(t *testing.T) {
+	targetServer := testutil.StartTestingServer(t)
+	unreachableURL := targetURL(targetServer, "live")
+	_ = targetServer.Listeners()[0].Close()
+	originServer, pusher := startTestingPusher(t, map[string][]relay.Target{"testApp": {{URL: unreachableURL}}})
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	status := waitTestPushState(t, pusher, relay.PushStateReconnecting)
+	assert.NotEmpty(t, status.Error)
+	assert.Equal(t, "testStream", status.Name)
+}
+
+func TestPushAPI(t *testing.T) {
+	targetServer := testutil.StartTestingServer(t)
+	originServer, pusher := startTestingPusher(t, nil)
+	apiServer := httptest.NewServer(pusher)
+	t.Cleanup(apiServer.Close)
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	testutil.SendTestHeaders(t, publisherConn, streamId, 128, testSequenceHeader)
+
+	// a target added while the stream is live starts pushing it
+	target, _ := json.Marshal(relay.Target{URL: targetURL(targetServer, "live")})
+	response, err := http.Post(apiServer.URL+"/api/push/targets/testApp", "application/json", bytes.NewReader(target))
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, err = http.Post(apiServer.URL+"/api/push/targets/testApp", "application/json", bytes.NewReader(target))
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	response, err = http.Post(apiServer.URL+"/api/push/targets/testApp", "application/json", bytes.NewReader([]byte(`{"url":"http://example.com"}`)))
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Eventually(t, func() bool {
+		_, ok := targetServer.Streams.Get("live", "testStream")
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	var targets map[string][]relay.Target
+	response, err = http.Get(apiServer.URL + "/api/push/targets")
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&targets))
+	_ = response.Body.Close()
+	assert.Equal(t, map[string][]relay.Target{"testApp": {{URL: targetURL(targetServer, "live")}}}, targets)
+	var statuses []relay.Status
+	response, err = http.Get(apiServer.URL + "/api/push")
+	assert.Nil(t, err)
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&statuses))
+	_ = response.Body.Close()
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, relay.PushStatePublishing, statuses[0].State)
+
+	// removing the target stops the push
+	request, _ := http.NewRequest(http.MethodDelete, apiServer.URL+"/api/push/targets/testApp?url="+targetURL(targetServer, "live"), nil)
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Empty(t, pusher.Status())
+	assert.Eventually(t, func() bool {
+		_, ok := targetServer.Streams.Get("live", "testStream")
+		return !ok
+	}, 3*time.Second, 10*time.Millisecond)
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestPushSetTargets(t *testing.T) {
+	firstTarget := testutil.StartTestingServer(t)
+	secondTarget := testutil.StartTestingServer(t)
+	originServer, pusher := startTestingPusher(t, map[string][]relay.Target{
+		"testApp": {{URL: targetURL(firstTarget, "testApp")}},
+	})
+	publisherConn := testutil.DialTestingServer(t, originServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	waitTestPushState(t, pusher, relay.PushStatePublishing)
+
+	err := pusher.SetTargets(map[string][]relay.Target{"testApp": {{URL: "http://example.com/live"}}})
+	assert.NotNil(t, err)
+	assert.Len(t, pusher.Targets("testApp"), 1)
+	// the stream moves from the removed target to the added one
+	err = pusher.SetTargets(map[string][]relay.Target{"testApp": {{URL: targetURL(secondTarget, "testApp")}}})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		statuses := pusher.Status()
+		return len(statuses) == 1 && statuses[0].URL == targetURL(secondTarget, "testApp") &&
+			statuses[0].State == relay.PushStatePublishing
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, published := firstTarget.Streams.Get("testApp", "testStream")
+		return !published
+	}, 3*time.Second, 10*time.Millisecond)
+}
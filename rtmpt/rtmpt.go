@@ -0,0 +1,385 @@
+package rtmpt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"rtmp/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contentType = "application/x-fcs"
+
+// the intervals the clients wait before polling again, the interval grows while the server has nothing to send
+const (
+	minInterval = 0x01
+	maxInterval = 0x21
+)
+
+// maxPending is the data written to a connection and not polled yet, the writes block beyond it
+const maxPending = 1 << 20
+
+// maxRequestSize bounds the data sent by a single request
+const maxRequestSize = 4 << 20
+
+// Listener accepts the rtmp connections tunneled over http, every connection is a session opened with
+// POST /open/1, its data is sent with POST /send/{id}/{sequence} and polled with POST /idle/{id}/{sequence}
+// until POST /close/{id}/{sequence}
+type Listener struct {
+	// IdleTimeout closes the connections whose client stopped polling
+	IdleTimeout time.Duration
+	netListener net.Listener
+	httpServer  *http.Server
+	accepted    chan *Conn
+	sessions    map[string]*Conn
+	mutex       sync.Mutex
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// Listen serves rtmpt on a tcp address, over https when a tls config is given
+func Listen(address string, tlsConfig *tls.Config) (*Listener, error) {
+	netListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		netListener = tls.NewListener(netListener, tlsConfig)
+	}
+	return NewListener(netListener), nil
+}
+
+// NewListener serves rtmpt on an existing listener
+func NewListener(netListener net.Listener) *Listener {
+	listener := &Listener{
+		IdleTimeout: 30 * time.Second,
+		netListener: netListener,
+		accepted:    make(chan *Conn),
+		sessions:    make(map[string]*Conn),
+		closed:      make(chan struct{}),
+	}
+	listener.httpServer = &http.Server{Handler: listener, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := listener.httpServer.Serve(netListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Get().Errorf("rtmpt listener stopped: %s", err)
+		}
+	}()
+	return listener
+}
+
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accepted:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops serving http and ends the sessions, their connections read io.EOF
+func (listener *Listener) Close() error {
+	err := net.ErrClosed
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+		err = listener.httpServer.Close()
+		listener.mutex.Lock()
+		conns := make([]*Conn, 0, len(listener.sessions))
+		for _, conn := range listener.sessions {
+			conns = append(conns, conn)
+		}
+		listener.mutex.Unlock()
+		for _, conn := range conns {
+			listener.remove(conn)
+		}
+	})
+	return err
+}
+
+func (listener *Listener) Addr() net.Addr {
+	return listener.netListener.Addr()
+}
+
+func (listener *Listener) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	command, rest, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/"), "/")
+	switch command {
+	case "open":
+		listener.open(writer, request)
+	case "send", "idle":
+		id, _, _ := strings.Cut(rest, "/")
+		conn, ok := listener.session(id)
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxRequestSize))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if command == "send" {
+			conn.receive(data)
+		}
+		interval, pending := conn.poll()
+		writeResponse(writer, append([]byte{interval}, pending...))
+	case "close":
+		id, _, _ := strings.Cut(rest, "/")
+		if conn, ok := listener.session(id); ok {
+			listener.remove(conn)
+		}
+		writeResponse(writer, []byte{0x00})
+	default:
+		// the ident requests probing the server are not answered
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (listener *Listener) open(writer http.ResponseWriter, request *http.Request) {
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+	conn := &Conn{
+		id:         hex.EncodeToString(idBytes),
+		listener:   listener,
+		remoteAddr: remoteAddr(request.RemoteAddr),
+		received:   make(chan struct{}, 1),
+		polled:     make(chan struct{}, 1),
+		interval:   minInterval,
+		closed:     make(chan struct{}),
+		hungUp:     make(chan struct{}),
+	}
+	listener.mutex.Lock()
+	listener.sessions[conn.id] = conn
+	listener.mutex.Unlock()
+	conn.idle = time.AfterFunc(listener.IdleTimeout, func() {
+		listener.remove(conn)
+	})
+	select {
+	case listener.accepted <- conn:
+		writeResponse(writer, []byte(conn.id+"\n"))
+	case <-listener.closed:
+		listener.remove(conn)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	case <-request.Context().Done():
+		listener.remove(conn)
+	}
+}
+
+func (listener *Listener) session(id string) (*Conn, bool) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	conn, ok := listener.sessions[id]
+	if ok {
+		conn.idle.Reset(listener.IdleTimeout)
+	}
+	return conn, ok
+}
+
+// remove ends a session once the client closed it or stopped polling, the connection reads the end of the data
+func (listener *Listener) remove(conn *Conn) {
+	listener.mutex.Lock()
+	delete(listener.sessions, conn.id)
+	listener.mutex.Unlock()
+	conn.idle.Stop()
+	conn.hangUpOnce.Do(func() {
+		close(conn.hungUp)
+	})
+}
+
+func writeResponse(writer http.ResponseWriter, body []byte) {
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Cache-Control", "no-cache")
+	_, err := writer.Write(body)
+	if err != nil {
+		logger.Get().Debugf("error writing rtmpt response: %s", err)
+	}
+}
+
+// Conn is an rtmp connection tunneled over http, its reads return the data sent by the client and its writes
+// are returned to the client when it polls
+type Conn struct {
+	id         string
+	listener   *Listener
+	remoteAddr net.Addr
+	mutex      sync.Mutex
+	incoming   bytes.Buffer
+	outgoing   bytes.Buffer
+	// received and polled wake the reads and writes waiting for data and room
+	received      chan struct{}
+	polled        chan struct{}
+	interval      byte
+	readDeadline  time.Time
+	writeDeadline time.Time
+	idle          *time.Timer
+	// closed is closed by Close, the data written before is still returned to the client
+	closed    chan struct{}
+	closeOnce sync.Once
+	// hungUp is closed once the session ended, the reads return io.EOF like once a tcp peer hung up
+	hungUp     chan struct{}
+	hangUpOnce sync.Once
+}
+
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	for {
+		conn.mutex.Lock()
+		if conn.incoming.Len() > 0 {
+			n, _ := conn.incoming.Read(buffer)
+			conn.mutex.Unlock()
+			return n, nil
+		}
+		deadline := conn.readDeadline
+		conn.mutex.Unlock()
+		err := conn.wait(conn.received, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (conn *Conn) Write(buffer []byte) (int, error) {
+	for {
+		conn.mutex.Lock()
+		select {
+		case <-conn.closed:
+			conn.mutex.Unlock()
+			return 0, net.ErrClosed
+		case <-conn.hungUp:
+			conn.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		if conn.outgoing.Len() < maxPending {
+			conn.outgoing.Write(buffer)
+			conn.mutex.Unlock()
+			return len(buffer), nil
+		}
+		deadline := conn.writeDeadline
+		conn.mutex.Unlock()
+		err := conn.wait(conn.polled, deadline)
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrClosedPipe
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close ends the connection, the client polls the data written before it once more and the session then ends
+func (conn *Conn) Close() error {
+	err := net.ErrClosed
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		err = nil
+	})
+	return err
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.listener.Addr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *Conn) SetDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = deadline
+	conn.writeDeadline = deadline
+	return nil
+}
+
+func (conn *Conn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = deadline
+	return nil
+}
+
+func (conn *Conn) SetWriteDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = deadline
+	return nil
+}
+
+func (conn *Conn) receive(data []byte) {
+	conn.mutex.Lock()
+	conn.incoming.Write(data)
+	conn.mutex.Unlock()
+	notify(conn.received)
+}
+
+// poll returns the interval the client should wait before polling again and the data written since the last
+// poll, the session ends once the data written before the close was polled
+func (conn *Conn) poll() (byte, []byte) {
+	conn.mutex.Lock()
+	pending := bytes.Clone(conn.outgoing.Bytes())
+	conn.outgoing.Reset()
+	if len(pending) > 0 {
+		conn.interval = minInterval
+	} else {
+		conn.interval = min(2*conn.interval, maxInterval)
+	}
+	interval := conn.interval
+	conn.mutex.Unlock()
+	notify(conn.polled)
+	select {
+	case <-conn.closed:
+		conn.listener.remove(conn)
+	default:
+	}
+	return interval, pending
+}
+
+func (conn *Conn) wait(signal chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-signal:
+		return nil
+	case <-conn.closed:
+		return net.ErrClosed
+	case <-conn.hungUp:
+		return io.EOF
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func notify(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+func remoteAddr(rawAddr string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(rawAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
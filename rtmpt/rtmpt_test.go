@@ -0,0 +1,165 @@
+package rtmpt_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"rtmp/message"
+	"rtmp/rtmpt"
+	"rtmp/server"
+	"rtmp/testutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTunnel is the client side of an rtmpt connection, it polls the server while reading
+type testTunnel struct {
+	baseURL  string
+	id       string
+	sequence atomic.Uint64
+	pending  bytes.Buffer
+	mutex    sync.Mutex
+	closed   atomic.Bool
+}
+
+func post(t *testing.T, url string, body []byte) (int, []byte) {
+	t.Helper()
+	response, err := http.Post(url, "application/x-fcs", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	return response.StatusCode, data
+}
+
+func openTestTunnel(t *testing.T, baseURL string) *testTunnel {
+	t.Helper()
+	status, id := post(t, baseURL+"/open/1", []byte{0})
+	assert.Equal(t, http.StatusOK, status)
+	tunnel := &testTunnel{baseURL: baseURL, id: strings.TrimSpace(string(id))}
+	t.Cleanup(func() {
+		_ = tunnel.Close()
+	})
+	return tunnel
+}
+
+// exchange sends data with the send command or polls with the idle command, the data received is queued
+func (tunnel *testTunnel) exchange(command string, data []byte) error {
+	url := tunnel.baseURL + "/" + command + "/" + tunnel.id + "/" + strconv.FormatUint(tunnel.sequence.Add(1), 10)
+	response, err := http.Post(url, "application/x-fcs", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return io.EOF
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil || len(body) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	tunnel.mutex.Lock()
+	tunnel.pending.Write(body[1:])
+	tunnel.mutex.Unlock()
+	return nil
+}
+
+func (tunnel *testTunnel) Read(buffer []byte) (int, error) {
+	for {
+		tunnel.mutex.Lock()
+		if tunnel.pending.Len() > 0 {
+			n, _ := tunnel.pending.Read(buffer)
+			tunnel.mutex.Unlock()
+			return n, nil
+		}
+		tunnel.mutex.Unlock()
+		if tunnel.closed.Load() {
+			return 0, io.EOF
+		}
+		err := tunnel.exchange("idle", []byte{0})
+		if err != nil {
+			return 0, err
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (tunnel *testTunnel) Write(buffer []byte) (int, error) {
+	err := tunnel.exchange("send", buffer)
+	if err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
+
+func (tunnel *testTunnel) Close() error {
+	if !tunnel.closed.Swap(true) {
+		_, _ = http.Post(tunnel.baseURL+"/close/"+tunnel.id+"/0", "application/x-fcs", bytes.NewReader([]byte{0}))
+	}
+	return nil
+}
+
+func (tunnel *testTunnel) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (tunnel *testTunnel) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (tunnel *testTunnel) SetDeadline(time.Time) error      { return nil }
+func (tunnel *testTunnel) SetReadDeadline(time.Time) error  { return nil }
+func (tunnel *testTunnel) SetWriteDeadline(time.Time) error { return nil }
+
+func startTestingTunnel(t *testing.T, idleTimeout time.Duration) (*server.Server, string) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener := rtmpt.NewListener(netListener)
+	listener.IdleTimeout = idleTimeout
+	assert.Nil(t, testServer.AddListener(&server.Listener{Listener: listener}))
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return testServer, "http://" + listener.Addr().String()
+}
+
+func TestTunneledPublish(t *testing.T) {
+	testServer, baseURL := startTestingTunnel(t, 30*time.Second)
+	status, _ := post(t, baseURL+"/fcs/ident2", []byte{0})
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = post(t, baseURL+"/idle/unknown/1", []byte{0})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	tunnel := openTestTunnel(t, baseURL)
+	publisherConn := testutil.ConnectTestingServer(t, testServer, tunnel)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	sessions := testServer.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "127.0.0.1", sessions[0].RemoteAddr().(*net.TCPAddr).IP.String())
+
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x01, 0, 0, 0, 1})
+	assert.Equal(t, []byte{0x17, 0x01, 0, 0, 0, 1}, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+
+	// closing the tunnel ends the session
+	_ = tunnel.Close()
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	testServer, baseURL := startTestingTunnel(t, 200*time.Millisecond)
+	tunnel := openTestTunnel(t, baseURL)
+	testutil.ConnectTestingServer(t, testServer, tunnel)
+	// the client stops polling
+	tunnel.closed.Store(true)
+	assert.Eventually(t, func() bool {
+		return testServer.Stats().ActiveConnections == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	status, _ := post(t, baseURL+"/idle/"+tunnel.id+"/100", []byte{0})
+	assert.Equal(t, http.StatusNotFound, status)
+}
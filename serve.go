@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"rtmp/access"
+	"rtmp/admin"
+	"rtmp/cluster"
+	"rtmp/config"
+	"rtmp/hls"
+	"rtmp/httpflv"
+	"rtmp/logger"
+	"rtmp/metrics"
+	"rtmp/record"
+	"rtmp/relay"
+	"rtmp/server"
+	"rtmp/vod"
+	"rtmp/webhook"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listenFlag collects the listeners given as tcp://host:port, tls://host:port, unix:///path or rtmpt://host:port
+type listenFlag []config.Listener
+
+func (listeners *listenFlag) String() string {
+	return fmt.Sprint(*listeners)
+}
+
+func (listeners *listenFlag) Set(rawURL string) error {
+	listenURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	listener := config.Listener{Network: listenURL.Scheme, Address: listenURL.Host}
+	if listener.Network == server.NetworkUnix {
+		listener.Address = listenURL.Path
+	}
+	if listenURL.Query().Has("proxy_protocol") {
+		listener.ProxyProtocol = true
+	}
+	*listeners = append(*listeners, listener)
+	return nil
+}
+
+// instance is a running server, reload applies the settings of its configuration file that can change while
+// serving
+type instance struct {
+	configPath string
+	// config is the configuration applied, the settings read on a reload that need a restart are left out
+	config       *config.Config
+	server       *server.Server
+	httpListener net.Listener
+	// adminListener serves the admin api apart from the viewers
+	adminListener net.Listener
+	// clusterListener receives the announcements of the peers, nil outside of a cluster
+	clusterListener net.Listener
+	access          *access.Filter
+	notifier        *webhook.Notifier
+	hls             *hls.Muxer
+	pusher          *relay.Pusher
+	puller          *relay.Puller
+	// node is nil outside of a cluster
+	node *cluster.Node
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", "", "yaml or toml configuration file, reloaded on SIGHUP")
+	check := flags.Bool("check", false, "validate the configuration and exit")
+	var listeners listenFlag
+	flags.Var(&listeners, "listen", "listener url replacing the ones of the configuration, tcp://host:port, "+
+		"tls://host:port, unix:///path or rtmpt://host:port with ?proxy_protocol behind a proxy sending one, repeatable")
+	certFile := flags.String("tls-cert", "", "certificate of the tls and rtmpt listeners given with -listen")
+	keyFile := flags.String("tls-key", "", "private key of the tls and rtmpt listeners given with -listen")
+	_ = flags.Parse(args)
+	serverConfig := config.Default()
+	if *configPath != "" {
+		var err error
+		serverConfig, err = config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+	}
+	if len(listeners) > 0 {
+		for index := range listeners {
+			if listeners[index].Network == server.NetworkTLS || listeners[index].Network == server.NetworkRTMPT {
+				listeners[index].TLSCert = *certFile
+				listeners[index].TLSKey = *keyFile
+			}
+		}
+		serverConfig.Listeners = listeners
+		err := serverConfig.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if *check {
+		fmt.Println("the configuration is valid")
+		return nil
+	}
+	err := logger.Configure(serverConfig.Log.Level, serverConfig.Log.Format)
+	if err != nil {
+		return err
+	}
+	running, err := newInstance(serverConfig)
+	if err != nil {
+		return err
+	}
+	running.configPath = *configPath
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				running.reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return running.run(ctx)
+}
+
+func newInstance(serverConfig *config.Config) (*instance, error) {
+	rtmpServer := server.NewServer()
+	serverConfig.Configure(rtmpServer)
+	err := addListeners(rtmpServer, serverConfig.Listeners)
+	if err != nil {
+		return nil, err
+	}
+	running := &instance{config: serverConfig, server: rtmpServer}
+	if serverConfig.HTTP.Address != "" {
+		running.httpListener, err = net.Listen("tcp", serverConfig.HTTP.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if serverConfig.Admin.Address != "" {
+		running.adminListener, err = net.Listen("tcp", serverConfig.Admin.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	running.access, err = access.NewFilter(serverConfig.AccessConfig())
+	if err != nil {
+		return nil, err
+	}
+	running.notifier = webhook.NewNotifier(serverConfig.WebhookConfig())
+	// the streams of the recorded applications and the ones published with the record or append type are recorded
+	recorder := record.NewRecorder(serverConfig.RecordConfig(), rtmpServer.Streams)
+	recorder.OnRecordDone = running.notifier.OnRecordDone
+	running.hls = hls.NewMuxer(serverConfig.HLSConfig(), rtmpServer.Streams)
+	running.hls.Admit = running.admitViewer
+	running.pusher = relay.NewPusher(serverConfig.PushConfig(), rtmpServer.Streams)
+	// the filter comes first to reject before the others, the webhooks authorize before the streams are handled
+	handlers := server.Handlers{running.access, running.notifier, recorder, running.hls, running.pusher}
+	if clusterConfig, ok := serverConfig.ClusterConfig(); ok {
+		// the node pulls the streams published on its peers instead of the origins of the applications
+		running.node = cluster.NewNode(clusterConfig, rtmpServer.Streams)
+		running.clusterListener, err = net.Listen("tcp", serverConfig.Cluster.Address)
+		if err != nil {
+			return nil, err
+		}
+		running.puller = running.node.Puller
+		handlers = append(handlers, running.node)
+	} else {
+		running.puller = relay.NewPuller(serverConfig.PullConfig(), rtmpServer.Streams)
+		handlers = append(handlers, running.puller)
+	}
+	rtmpServer.Handler = handlers
+	// the recordings can be played once they ended
+	rtmpServer.VOD = vod.NewDirectory(recorder.Config.Directory)
+	return running, nil
+}
+
+func (running *instance) run(ctx context.Context) error {
+	var httpServers []*http.Server
+	if running.httpListener != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/hls/", http.StripPrefix("/hls", running.hls))
+		// the live streams are also served as http-flv at /{app}/{stream}.flv
+		flvHandler := httpflv.NewHandler(running.server.Streams)
+		flvHandler.Admit = running.admitViewer
+		mux.Handle("/", flvHandler)
+		httpServers = append(httpServers, serveHTTP("http", mux, running.httpListener))
+	}
+	if running.adminListener != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/api/", admin.NewAPI(running.server))
+		mux.Handle("/api/push", running.pusher)
+		mux.Handle("/api/push/", running.pusher)
+		mux.Handle("/api/pull", running.puller)
+		mux.Handle("/metrics", metrics.Handler(running.server))
+		httpServers = append(httpServers, serveHTTP("admin", mux, running.adminListener))
+	}
+	if running.node != nil {
+		// the peers reach the announcements without reaching the admin api
+		httpServers = append(httpServers, serveHTTP("cluster", running.node, running.clusterListener))
+		go running.node.Run(ctx)
+	}
+	err := running.server.Serve(ctx)
+	_ = running.puller.Close()
+	for _, httpServer := range httpServers {
+		_ = httpServer.Close()
+	}
+	running.notifier.Wait()
+	if err != nil && !errors.Is(err, server.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveHTTP serves the handler on the listener until the returned server is closed
+func serveHTTP(name string, handler http.Handler, listener net.Listener) *http.Server {
+	// the clients slow to send their headers do not hold a connection for long
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Get().Errorf("%s server stopped: %s", name, err)
+		}
+	}()
+	return httpServer
+}
+
+// admitViewer applies the access rules and the player limits to the http-flv and hls viewers
+func (running *instance) admitViewer(request *http.Request, app string, name string) (func(), error) {
+	err := running.access.CheckViewer(request, app)
+	if err != nil {
+		return nil, err
+	}
+	err = running.server.AdmitPlayer(app, name)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		running.server.ReleasePlayer(app, name)
+	}, nil
+}
+
+// reload applies the access rules, the push targets, the pull origins, the webhooks, the limits and the log level
+// of the configuration file, the other settings are applied on the next start. The applications recorded and
+// muxed to hls are part of the recording and hls settings, the recorder and the muxer are not rebuilt
+func (running *instance) reload() {
+	if running.configPath == "" {
+		logger.Get().Warn("no configuration file to reload, the server was started without -config")
+		return
+	}
+	loaded, err := config.Load(running.configPath)
+	if err != nil {
+		logger.Get().Errorf("keeping the current configuration: %s", err)
+		return
+	}
+	err = running.access.SetConfig(loaded.AccessConfig())
+	if err != nil {
+		logger.Get().Errorf("keeping the current configuration: %s", err)
+		return
+	}
+	applied := *running.config
+	applied.Applications = loaded.Applications
+	err = running.pusher.SetTargets(loaded.PushTargets())
+	if err != nil {
+		logger.Get().Errorf("keeping the current push targets, they apply on the next start: %s", err)
+		applied.Applications = keepPushTargets(loaded.Applications, running.config.Applications)
+	}
+	running.puller.SetOrigins(loaded.PullOrigins())
+	running.notifier.SetConfig(loaded.WebhookConfig())
+	running.server.SetLimits(loaded.ServerLimits())
+	_ = logger.SetLevel(loaded.Log.Level)
+	applied.Auth = loaded.Auth
+	applied.Limits = loaded.Limits
+	applied.Log.Level = loaded.Log.Level
+	for _, section := range []struct {
+		name    string
+		changed bool
+	}{
+		{"http", !reflect.DeepEqual(applied.HTTP, loaded.HTTP)},
+		{"admin", !reflect.DeepEqual(applied.Admin, loaded.Admin)},
+		{"server", !reflect.DeepEqual(applied.Server, loaded.Server)},
+		{"recording", !reflect.DeepEqual(applied.Recording, loaded.Recording)},
+		{"hls", !reflect.DeepEqual(applied.HLS, loaded.HLS)},
+		{"relay", !reflect.DeepEqual(applied.Relay, loaded.Relay)},
+		{"cluster", !reflect.DeepEqual(applied.Cluster, loaded.Cluster)},
+		{"log.format", applied.Log.Format != loaded.Log.Format},
+	} {
+		if section.changed {
+			logger.Get().Warnf("the %s settings changed, they apply on the next start", section.name)
+		}
+	}
+	running.config = &applied
+	logger.Get().Infof("reloaded %s", running.configPath)
+}
+
+// keepPushTargets is the applications loaded with the push targets still running, the ones of the previous
+// applications
+func keepPushTargets(loaded map[string]config.Application, previous map[string]config.Application) map[string]config.Application {
+	applications := make(map[string]config.Application, len(loaded))
+	for app, application := range loaded {
+		application.Push = previous[app].Push
+		applications[app] = application
+	}
+	for app, application := range previous {
+		if _, ok := applications[app]; !ok && len(application.Push) > 0 {
+			applications[app] = config.Application{Push: application.Push}
+		}
+	}
+	return applications
+}
+
+// addListeners adds the listeners passed by systemd and the configured ones, the default one without any
+func addListeners(rtmpServer *server.Server, listeners []config.Listener) error {
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 && len(activated) == 0 {
+		listeners = []config.Listener{config.DefaultListener}
+	}
+	for _, listener := range listeners {
+		listenerConfig, err := listener.ListenerConfig()
+		if err != nil {
+			return err
+		}
+		opened, err := server.Listen(listenerConfig)
+		if err != nil {
+			return err
+		}
+		activated = append(activated, opened)
+	}
+	for _, listener := range activated {
+		err = rtmpServer.AddListener(listener)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activatedListeners are the sockets passed by systemd socket activation
+func activatedListeners() ([]*server.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	listeners := make([]*server.Listener, 0, count)
+	// the passed descriptors start after stdin, stdout and stderr
+	for fd := 3; fd < 3+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %w", fd, err)
+		}
+		listeners = append(listeners, &server.Listener{Listener: listener})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"net/url"
+	"rtmp/amf"
+)
+
+// Handler observes the lifecycle of every connection, its methods are invoked synchronously and
+// never concurrently for the same connection, in this order:
+//
+//	OnHandshakeComplete, OnConnect, then for every message stream OnCreateStream followed either by
+//	OnPublish, OnMediaMessage for each media message and OnUnpublish or by OnPlay and OnStop,
+//	and finally OnDisconnect
+//
+// Returning an error from the methods with an error result rejects the action, the peer receives
+// the status code of a *StatusError or a generic rejection otherwise. OnUnpublish, OnStop and OnDisconnect
+// are invoked even when the server ends the action, for the actions that were accepted only.
+type Handler interface {
+	OnHandshakeComplete(session *Session) error
+	OnConnect(session *Session, request *ConnectRequest) error
+	OnCreateStream(session *Session, streamId uint32) error
+	OnPublish(session *Session, request *PublishRequest) error
+	OnUnpublish(session *Session, request *PublishRequest)
+	OnPlay(session *Session, request *PlayRequest) error
+	OnStop(session *Session, request *PlayRequest)
+	OnMediaMessage(session *Session, media *MediaMessage) error
+	OnDisconnect(session *Session, err error)
+}
+
+type ConnectRequest struct {
+	App            string
+	TcUrl          string
+	FlashVer       string
+	SwfUrl         string
+	PageUrl        string
+	ObjectEncoding float64
+	// FourCCList is the codecs an enhanced rtmp client supports, nil for the other clients
+	FourCCList []string
+	Properties amf.Object
+	Arguments  []amf.ValueType
+}
+
+type PublishRequest struct {
+	StreamId uint32
+	App      string
+	Name     string
+	Args     url.Values
+	// Type is live, record or append
+	Type string
+}
+
+type PlayRequest struct {
+	StreamId uint32
+	App      string
+	Name     string
+	Args     url.Values
+	// Start is -2 for live or recorded, -1 for live only or the position in seconds
+	Start float64
+	// Duration is -1 to play until the end or the duration in seconds
+	Duration float64
+	Reset    bool
+}
+
+type MediaMessage struct {
+	StreamId  uint32
+	TypeId    uint8
+	Timestamp uint32
+	Data      []byte
+}
+
+// StatusError rejects an action with a specific status code, for instance NetStream.Publish.BadName
+type StatusError struct {
+	Code        string
+	Description string
+	// Redirect is the url the peer should connect to instead, sent as ex.redirect along with the 302 ex.code
+	Redirect string
+}
+
+func (statusError *StatusError) Error() string {
+	return statusError.Code + ": " + statusError.Description
+}
+
+// NopHandler accepts everything, embed it to implement only some of the Handler methods
+type NopHandler struct{}
+
+func (NopHandler) OnHandshakeComplete(*Session) error           { return nil }
+func (NopHandler) OnConnect(*Session, *ConnectRequest) error    { return nil }
+func (NopHandler) OnCreateStream(*Session, uint32) error        { return nil }
+func (NopHandler) OnPublish(*Session, *PublishRequest) error    { return nil }
+func (NopHandler) OnUnpublish(*Session, *PublishRequest)        {}
+func (NopHandler) OnPlay(*Session, *PlayRequest) error          { return nil }
+func (NopHandler) OnStop(*Session, *PlayRequest)                {}
+func (NopHandler) OnMediaMessage(*Session, *MediaMessage) error { return nil }
+func (NopHandler) OnDisconnect(*Session, error)                 {}
+
+// Handlers chains handlers, every handler is invoked in order and the first rejection stops the chain, the
+// handlers that accepted a publish or a play rejected by a later one get OnUnpublish or OnStop in reverse order
+type Handlers []Handler
+
+func (handlers Handlers) OnHandshakeComplete(session *Session) error {
+	for _, handler := range handlers {
+		if err := handler.OnHandshakeComplete(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnConnect(session *Session, request *ConnectRequest) error {
+	for _, handler := range handlers {
+		if err := handler.OnConnect(session, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnCreateStream(session *Session, streamId uint32) error {
+	for _, handler := range handlers {
+		if err := handler.OnCreateStream(session, streamId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnPublish(session *Session, request *PublishRequest) error {
+	for index, handler := range handlers {
+		if err := handler.OnPublish(session, request); err != nil {
+			for accepted := index - 1; accepted >= 0; accepted-- {
+				handlers[accepted].OnUnpublish(session, request)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnUnpublish(session *Session, request *PublishRequest) {
+	for _, handler := range handlers {
+		handler.OnUnpublish(session, request)
+	}
+}
+
+func (handlers Handlers) OnPlay(session *Session, request *PlayRequest) error {
+	for index, handler := range handlers {
+		if err := handler.OnPlay(session, request); err != nil {
+			for accepted := index - 1; accepted >= 0; accepted-- {
+				handlers[accepted].OnStop(session, request)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnStop(session *Session, request *PlayRequest) {
+	for _, handler := range handlers {
+		handler.OnStop(session, request)
+	}
+}
+
+func (handlers Handlers) OnMediaMessage(session *Session, media *MediaMessage) error {
+	for _, handler := range handlers {
+		if err := handler.OnMediaMessage(session, media); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handlers Handlers) OnDisconnect(session *Session, err error) {
+	for _, handler := range handlers {
+		handler.OnDisconnect(session, err)
+	}
+}
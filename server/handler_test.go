@@ -0,0 +1,180 @@
+package server_test
+
+import (
+	"errors"
+	"rtmp/amf"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingHandler struct {
+	server.NopHandler
+	events       []string
+	mutex        sync.Mutex
+	disconnected chan struct{}
+	rejectWith   error
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{disconnected: make(chan struct{}, 10)}
+}
+
+func (handler *recordingHandler) record(event string) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	handler.events = append(handler.events, event)
+}
+
+func (handler *recordingHandler) recorded() []string {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return append([]string{}, handler.events...)
+}
+
+func (handler *recordingHandler) OnHandshakeComplete(*server.Session) error {
+	handler.record("handshake")
+	return nil
+}
+
+func (handler *recordingHandler) OnConnect(_ *server.Session, request *server.ConnectRequest) error {
+	handler.record("connect " + request.App)
+	return handler.rejectWith
+}
+
+func (handler *recordingHandler) OnCreateStream(*server.Session, uint32) error {
+	handler.record("createStream")
+	return nil
+}
+
+func (handler *recordingHandler) OnPublish(_ *server.Session, request *server.PublishRequest) error {
+	handler.record("publish " + request.Name + " " + request.Args.Get("key"))
+	return nil
+}
+
+func (handler *recordingHandler) OnUnpublish(_ *server.Session, request *server.PublishRequest) {
+	handler.record("unpublish " + request.Name)
+}
+
+func (handler *recordingHandler) OnPlay(_ *server.Session, request *server.PlayRequest) error {
+	handler.record("play " + request.Name)
+	return nil
+}
+
+func (handler *recordingHandler) OnStop(_ *server.Session, request *server.PlayRequest) {
+	handler.record("stop " + request.Name)
+}
+
+func (handler *recordingHandler) OnMediaMessage(*server.Session, *server.MediaMessage) error {
+	handler.record("media")
+	return nil
+}
+
+func (handler *recordingHandler) OnDisconnect(*server.Session, error) {
+	handler.record("disconnect")
+	handler.disconnected <- struct{}{}
+}
+
+func TestHandlerEventsOrder(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := newRecordingHandler()
+	testServer.Handler = handler
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, clientConn, "testStream?key=secret")
+	testutil.SendTestMedia(t, clientConn, streamId, message.TypeVideo, 40, []byte{0x17, 0x01})
+	time.Sleep(100 * time.Millisecond)
+	_ = clientConn.Close()
+	select {
+	case <-handler.disconnected:
+	case <-time.After(3 * time.Second):
+		t.FailNow()
+	}
+	assert.Equal(t, []string{
+		"handshake",
+		"connect testApp",
+		"createStream",
+		"publish testStream secret",
+		"media",
+		"unpublish testStream",
+		"disconnect",
+	}, handler.recorded())
+}
+
+func TestHandlerRejectsConnect(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := newRecordingHandler()
+	handler.rejectWith = errors.New("unknown application")
+	testServer.Handler = handler
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	errorCommand := testutil.WaitTestCommand(t, clientConn, "_error")
+	assert.Equal(t, "NetConnection.Connect.Rejected", testutil.StatusCode(errorCommand.Parts[3].(amf.Object)))
+}
+
+func TestHandlerRedirectsConnect(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := newRecordingHandler()
+	handler.rejectWith = &server.StatusError{Code: "NetConnection.Connect.Rejected", Description: "Moved.", Redirect: "rtmp://other/testApp"}
+	testServer.Handler = handler
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	errorCommand := testutil.WaitTestCommand(t, clientConn, "_error")
+	info := errorCommand.Parts[3].(amf.Object)
+	assert.Equal(t, "NetConnection.Connect.Rejected", testutil.StatusCode(info))
+	assert.Equal(t, amf.ObjectProperty{Name: "ex", Value: amf.NewObject(
+		amf.ObjectProperty{Name: "code", Value: amf.NewNumber(302)},
+		amf.ObjectProperty{Name: "redirect", Value: amf.NewString("rtmp://other/testApp")},
+	)}, info[len(info)-1])
+}
+
+type rejectingPublishHandler struct {
+	server.NopHandler
+}
+
+func (rejectingPublishHandler) OnPublish(*server.Session, *server.PublishRequest) error {
+	return &server.StatusError{Code: "NetStream.Publish.BadName", Description: "Invalid stream key."}
+}
+
+func (rejectingPublishHandler) OnPlay(*server.Session, *server.PlayRequest) error {
+	return &server.StatusError{Code: "NetStream.Play.Failed", Description: "Not allowed."}
+}
+
+func TestHandlerRejectsPublish(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := newRecordingHandler()
+	testServer.Handler = server.Handlers{handler, rejectingPublishHandler{}}
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Publish.BadName")
+	_, published := testServer.Streams.Get("testApp", "testStream")
+	assert.False(t, published)
+	// the handler that accepted the publish is told it ended
+	assert.Equal(t, []string{"handshake", "connect testApp", "publish testStream ", "unpublish testStream"}, handler.recorded())
+}
+
+func TestHandlerRejectsPlay(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := newRecordingHandler()
+	testServer.Handler = server.Handlers{handler, rejectingPublishHandler{}}
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("play"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Failed")
+	assert.Equal(t, []string{"handshake", "connect testApp", "play testStream", "stop testStream"}, handler.recorded())
+}
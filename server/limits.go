@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net"
+	"rtmp/stream"
+	"sync"
+	"sync/atomic"
+)
+
+// the limits the Stats.Rejections are counted by
+const (
+	LimitConnections      = "connections"
+	LimitConnectionsPerIP = "connections_per_ip"
+	LimitPublishersPerApp = "publishers_per_app"
+	LimitPlayersPerApp    = "players_per_app"
+	LimitPlayersPerStream = "players_per_stream"
+)
+
+// Limits bounds the resources used by the clients, zero disables a limit
+type Limits struct {
+	// MaxConnections and MaxConnectionsPerIP bound the open connections, the connections beyond them complete
+	// the handshake and their connect command is rejected
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// MaxHandshakes bounds the handshakes in progress, the accepted connections wait for a slot before being
+	// handled. The rejected connections keep their slot until they are closed so they are bounded too
+	MaxHandshakes int
+	// MaxPublishersPerApp, MaxPlayersPerApp and MaxPlayersPerStream bound the streams published and played
+	MaxPublishersPerApp int
+	MaxPlayersPerApp    int
+	MaxPlayersPerStream int
+}
+
+var (
+	errTooManyConnections       = &StatusError{Code: "NetConnection.Connect.Rejected", Description: "Too many connections."}
+	errTooManyConnectionsFromIP = &StatusError{Code: "NetConnection.Connect.Rejected", Description: "Too many connections from your address."}
+	errTooManyPublishers        = &StatusError{Code: "NetStream.Publish.Rejected", Description: "Too many publishers."}
+	errTooManyPlayers           = &StatusError{Code: "NetStream.Play.Failed", Description: "Too many players."}
+)
+
+// admission counts the connections and streams the limits apply to
+type admission struct {
+	limits           *Limits
+	handshakes       int
+	handshakeEnded   *sync.Cond
+	connections      int
+	connectionsPerIP map[string]int
+	publishers       map[string]int
+	players          map[string]int
+	streamPlayers    map[string]int
+	rejections       map[string]uint64
+	mutex            sync.Mutex
+}
+
+func newAdmission(limits *Limits) *admission {
+	newAdmission := &admission{
+		limits:           limits,
+		connectionsPerIP: make(map[string]int),
+		publishers:       make(map[string]int),
+		players:          make(map[string]int),
+		streamPlayers:    make(map[string]int),
+		rejections:       make(map[string]uint64),
+	}
+	newAdmission.handshakeEnded = sync.NewCond(&newAdmission.mutex)
+	return newAdmission
+}
+
+// acquireHandshake waits for a handshake slot, it returns false once the server is shutting down
+func (admission *admission) acquireHandshake(shuttingDown *atomic.Bool) bool {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	for admission.limits.MaxHandshakes > 0 && admission.handshakes >= admission.limits.MaxHandshakes {
+		if shuttingDown.Load() {
+			return false
+		}
+		admission.handshakeEnded.Wait()
+	}
+	admission.handshakes++
+	return true
+}
+
+func (admission *admission) releaseHandshake() {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	admission.handshakes--
+	admission.handshakeEnded.Signal()
+}
+
+// setLimits changes the limits, the connections and streams already admitted are kept
+func (admission *admission) setLimits(limits Limits) {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	*admission.limits = limits
+	// the waiting connections may fit in the new limit
+	admission.handshakeEnded.Broadcast()
+}
+
+// wakeHandshakes wakes the connections waiting for a handshake slot up so they see the shutdown
+func (admission *admission) wakeHandshakes() {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	admission.handshakeEnded.Broadcast()
+}
+
+func (admission *admission) admitConnection(ip string) error {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	if admission.limits.MaxConnections > 0 && admission.connections >= admission.limits.MaxConnections {
+		admission.rejections[LimitConnections]++
+		return errTooManyConnections
+	}
+	if admission.limits.MaxConnectionsPerIP > 0 && admission.connectionsPerIP[ip] >= admission.limits.MaxConnectionsPerIP {
+		admission.rejections[LimitConnectionsPerIP]++
+		return errTooManyConnectionsFromIP
+	}
+	admission.connections++
+	admission.connectionsPerIP[ip]++
+	return nil
+}
+
+func (admission *admission) releaseConnection(ip string) {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	admission.connections--
+	decrement(admission.connectionsPerIP, ip)
+}
+
+func (admission *admission) admitPublisher(app string) error {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	if admission.limits.MaxPublishersPerApp > 0 && admission.publishers[app] >= admission.limits.MaxPublishersPerApp {
+		admission.rejections[LimitPublishersPerApp]++
+		return errTooManyPublishers
+	}
+	admission.publishers[app]++
+	return nil
+}
+
+func (admission *admission) releasePublisher(app string) {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	decrement(admission.publishers, app)
+}
+
+func (admission *admission) admitPlayer(app string, name string) error {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	if admission.limits.MaxPlayersPerApp > 0 && admission.players[app] >= admission.limits.MaxPlayersPerApp {
+		admission.rejections[LimitPlayersPerApp]++
+		return errTooManyPlayers
+	}
+	key := stream.Key(app, name)
+	if admission.limits.MaxPlayersPerStream > 0 && admission.streamPlayers[key] >= admission.limits.MaxPlayersPerStream {
+		admission.rejections[LimitPlayersPerStream]++
+		return errTooManyPlayers
+	}
+	admission.players[app]++
+	admission.streamPlayers[key]++
+	return nil
+}
+
+func (admission *admission) releasePlayer(app string, name string) {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	decrement(admission.players, app)
+	decrement(admission.streamPlayers, stream.Key(app, name))
+}
+
+func (admission *admission) rejectionCounts() map[string]uint64 {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	rejections := make(map[string]uint64, len(admission.rejections))
+	for limit, count := range admission.rejections {
+		rejections[limit] = count
+	}
+	return rejections
+}
+
+// decrement removes the keys dropping to zero so the maps do not grow with every address and stream
+func decrement(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// remoteIP is the address of a peer without its port
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
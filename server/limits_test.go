@@ -0,0 +1,140 @@
+package server_test
+
+import (
+	"net"
+	"os"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/server"
+	"rtmp/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func statusDescription(info amf.Object) string {
+	for _, property := range info {
+		if property.Name == "description" {
+			description, _ := property.Value.(amf.String)
+			return string(description)
+		}
+	}
+	return ""
+}
+
+func waitTestConnectRejection(t *testing.T, clientConn *conn.Conn) amf.Object {
+	t.Helper()
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	return testutil.WaitTestCommand(t, clientConn, "_error").Parts[3].(amf.Object)
+}
+
+func TestLimitsRejectConnections(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxConnections: 1})
+	firstConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, firstConn, "testStream")
+
+	info := waitTestConnectRejection(t, testutil.DialTestingServer(t, testServer))
+	assert.Equal(t, "NetConnection.Connect.Rejected", testutil.StatusCode(info))
+	assert.Equal(t, "Too many connections.", statusDescription(info))
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitConnections])
+
+	// the slot is freed once the first connection closed
+	_ = firstConn.Close()
+	assert.Eventually(t, func() bool {
+		return testServer.Stats().ActiveConnections == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "testStream")
+}
+
+func TestLimitsRejectConnectionsPerIP(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxConnectionsPerIP: 2})
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "firstStream")
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "secondStream")
+
+	info := waitTestConnectRejection(t, testutil.DialTestingServer(t, testServer))
+	assert.Equal(t, "NetConnection.Connect.Rejected", testutil.StatusCode(info))
+	assert.Equal(t, "Too many connections from your address.", statusDescription(info))
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitConnectionsPerIP])
+}
+
+func TestLimitsRejectPublishers(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxPublishersPerApp: 1})
+	firstConn := testutil.DialTestingServer(t, testServer)
+	firstStreamId := testutil.PublishTestStream(t, firstConn, "firstStream")
+
+	secondConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(secondConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, secondConn, "_result")
+	testutil.SendTestCommand(t, secondConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("secondStream"))
+	testutil.WaitTestStatus(t, secondConn, "NetStream.Publish.Rejected")
+	_, published := testServer.Streams.Get("testApp", "secondStream")
+	assert.False(t, published)
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitPublishersPerApp])
+
+	// the publisher slot is freed once the first stream is unpublished
+	testutil.SendTestCommand(t, firstConn, 0, amf.NewString("deleteStream"), amf.NewNumber(4), amf.NewNull(), amf.NewNumber(float64(firstStreamId)))
+	assert.Eventually(t, func() bool {
+		_, published := testServer.Streams.Get("testApp", "firstStream")
+		return !published
+	}, 3*time.Second, 10*time.Millisecond)
+	testutil.SendTestCommand(t, secondConn, 1, amf.NewString("publish"), amf.NewNumber(3), amf.NewNull(), amf.NewString("secondStream"))
+	testutil.WaitTestStatus(t, secondConn, "NetStream.Publish.Start")
+}
+
+func TestLimitsRejectPlayers(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxPlayersPerStream: 1, MaxPlayersPerApp: 2})
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "firstStream")
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "secondStream")
+	testutil.PublishTestStream(t, testutil.DialTestingServer(t, testServer), "thirdStream")
+	testutil.PlayTestStream(t, testutil.DialTestingServer(t, testServer), "firstStream")
+
+	playerConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(playerConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, playerConn, "_result")
+	testutil.SendTestCommand(t, playerConn, 1, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("firstStream"))
+	status := testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Failed")
+	assert.Equal(t, "Too many players.", statusDescription(status.Parts[3].(amf.Object)))
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitPlayersPerStream])
+
+	testutil.SendTestCommand(t, playerConn, 1, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("secondStream"))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Start")
+	testutil.SendTestCommand(t, playerConn, 2, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("thirdStream"))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Failed")
+	assert.Equal(t, uint64(1), testServer.Stats().Rejections[server.LimitPlayersPerApp])
+}
+
+func TestLimitsBoundHandshakes(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.SetLimits(server.Limits{MaxHandshakes: 1})
+	// the first connection holds the only handshake slot without handshaking
+	firstConn, err := net.Dial("tcp", testServer.Addr().String())
+	assert.Nil(t, err)
+	defer firstConn.Close()
+	secondConn, err := net.Dial("tcp", testServer.Addr().String())
+	assert.Nil(t, err)
+	defer secondConn.Close()
+	_, err = secondConn.Write(append([]byte{3}, make([]byte, 1536)...))
+	assert.Nil(t, err)
+
+	version := make([]byte, 1)
+	_ = secondConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = secondConn.Read(version)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	_ = firstConn.Close()
+	_ = secondConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = secondConn.Read(version)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{3}, version)
+}
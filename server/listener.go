@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"rtmp/rtmpt"
+)
+
+// the networks of the listeners
+const (
+	NetworkTCP   = "tcp"
+	NetworkTLS   = "tls"
+	NetworkUnix  = "unix"
+	NetworkRTMPT = "rtmpt"
+)
+
+var ErrInvalidListener = errors.New("invalid listener")
+
+// ListenerConfig describes a listener opened by Listen
+type ListenerConfig struct {
+	// Network is tcp, tls, unix or rtmpt, tcp when empty
+	Network string
+	// Address is host:port, or the path of the socket of the unix listeners
+	Address string
+	// TLSConfig is required by the tls listeners, the rtmpt listeners serve https with it when set
+	TLSConfig *tls.Config
+	// ProxyProtocol expects a proxy protocol v1 or v2 header before the handshake of every connection, the
+	// addresses it carries replace the ones of the proxy. Enable it only behind a proxy sending one
+	ProxyProtocol bool
+}
+
+// Listener is a listener the server accepts connections from, any net.Listener can be added such as a socket
+// activated one
+type Listener struct {
+	net.Listener
+	ProxyProtocol bool
+}
+
+// Listen opens the listener described by a config, AddListener makes the server accept its connections
+func Listen(config ListenerConfig) (*Listener, error) {
+	var listener net.Listener
+	var err error
+	if config.Network == "" {
+		config.Network = NetworkTCP
+	}
+	switch config.Network {
+	case NetworkTCP:
+		listener, err = net.Listen("tcp", config.Address)
+	case NetworkTLS:
+		if config.TLSConfig == nil {
+			return nil, fmt.Errorf("%w: tls listener %s without tls config", ErrInvalidListener, config.Address)
+		}
+		listener, err = tls.Listen("tcp", config.Address, config.TLSConfig)
+	case NetworkUnix:
+		listener, err = net.Listen("unix", config.Address)
+	case NetworkRTMPT:
+		if config.ProxyProtocol {
+			return nil, fmt.Errorf("%w: rtmpt listener %s with proxy protocol", ErrInvalidListener, config.Address)
+		}
+		listener, err = rtmpt.Listen(config.Address, config.TLSConfig)
+	default:
+		return nil, fmt.Errorf("%w: unknown network %q", ErrInvalidListener, config.Network)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s %s: %w", config.Network, config.Address, err)
+	}
+	return &Listener{Listener: listener, ProxyProtocol: config.ProxyProtocol}, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/logger"
+	"rtmp/message"
+	"strconv"
+	"sync"
+)
+
+// playerQueueSize is the number of messages a player may lag behind the publisher before being dropped
+const playerQueueSize = 2048
+
+var errPlayerTooSlow = errors.New("player is too slow to receive the stream")
+
+// player forwards the messages of a stream to a session playing it, the messages are queued so the
+// publisher never waits for the network
+type player struct {
+	session   *Session
+	streamId  uint32
+	messages  chan *conn.Message
+	done      chan struct{}
+	closeOnce sync.Once
+	// audioTrack and videoTrack are the tracks of the multitrack messages sent alone, -1 sends them as published
+	audioTrack int
+	videoTrack int
+}
+
+func newPlayer(session *Session, streamId uint32) *player {
+	newPlayer := &player{
+		session:    session,
+		streamId:   streamId,
+		messages:   make(chan *conn.Message, playerQueueSize),
+		done:       make(chan struct{}),
+		audioTrack: -1,
+		videoTrack: -1,
+	}
+	return newPlayer
+}
+
+// selectTracks reads the audioTrack and videoTrack arguments of the stream name
+func (player *player) selectTracks(args url.Values) {
+	player.audioTrack = trackArgument(args, "audioTrack")
+	player.videoTrack = trackArgument(args, "videoTrack")
+}
+
+func trackArgument(args url.Values, name string) int {
+	track, err := strconv.Atoi(args.Get(name))
+	if err != nil || track < 0 || track > 255 {
+		return -1
+	}
+	return track
+}
+
+// start sends the queued messages and the following ones, the player queues the messages until started
+func (player *player) start() {
+	go player.run()
+}
+
+func (player *player) WriteMessage(media *conn.Message) error {
+	select {
+	case <-player.done:
+		return errPlayerTooSlow
+	default:
+	}
+	select {
+	case player.messages <- media:
+		return nil
+	default:
+		return errPlayerTooSlow
+	}
+}
+
+// Close is called by the stream once the player stops receiving messages, the queued ones are
+// still sent before the player stops
+func (player *player) Close() error {
+	player.closeOnce.Do(func() {
+		close(player.done)
+	})
+	return nil
+}
+
+func (player *player) run() {
+	for {
+		select {
+		case media := <-player.messages:
+			player.send(media)
+		case <-player.done:
+			if player.session.playing(player) {
+				// the stream ended or dropped the player, the queued messages are sent before telling the session
+				for len(player.messages) > 0 {
+					player.send(<-player.messages)
+				}
+			}
+			player.session.endStreamFromPlayer(player)
+			return
+		}
+	}
+}
+
+func (player *player) send(media *conn.Message) {
+	data, ok := player.selectTrack(media)
+	if !ok {
+		return
+	}
+	outgoingMessage := message.NewMessage(media.TypeId, player.streamId, data)
+	outgoingMessage.Timestamp = media.Timestamp
+	_, err := outgoingMessage.Send(player.session.Conn)
+	if err != nil {
+		logger.Get().Debugf("error sending media to player: %s", err)
+	}
+}
+
+// selectTrack converts the multitrack messages to the selected track, false when they don't carry it
+func (player *player) selectTrack(media *conn.Message) ([]byte, bool) {
+	track := player.videoTrack
+	if media.TypeId == flv.TagTypeAudio {
+		track = player.audioTrack
+	}
+	if track < 0 || !flv.IsMultitrack(media.TypeId, media.Data) {
+		return media.Data, true
+	}
+	multitrack, err := flv.ParseMultitrack(media.TypeId, media.Data)
+	if err != nil {
+		return nil, false
+	}
+	return multitrack.SingleTrack(uint8(track))
+}
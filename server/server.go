@@ -1,83 +1,341 @@
 package server
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"net"
 	"rtmp/conn"
-	"rtmp/handshake"
+	"rtmp/flv"
 	"rtmp/logger"
-	"rtmp/message"
+	"rtmp/stream"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrServerClosed = errors.New("rtmp: server closed")
+	ErrNoListener   = errors.New("rtmp: no listener")
+)
+
 type Server struct {
 	DefaultMaxChunkSize   uint32
 	DefaultNetworkTimeout time.Duration
-	Connections           chan *conn.Conn
-	Listener              net.Listener
+	// DefaultWindowAcknowledgementSize is the window the clients acknowledge the bytes received in
+	DefaultWindowAcknowledgementSize uint32
+	ShutdownTimeout                  time.Duration
+	// ForceCloseTimeout is how long Shutdown waits for the sessions it closed forcibly to end their streams, which
+	// completes their recordings
+	ForceCloseTimeout time.Duration
+	// PingInterval is the period of the ping requests measuring the round trip time, zero disables them
+	PingInterval time.Duration
+	// VOD provides the recorded streams, nil plays live streams only
+	VOD VODSource
+	// PlaybackBurst is the media of a recording sent ahead of real time when the playback starts
+	PlaybackBurst time.Duration
+	// FourCCList is the codecs advertised to the enhanced rtmp clients, the media is relayed whatever the codec
+	FourCCList []string
+	// Limits bounds the connections and streams, SetLimits changes them once the server is serving
+	Limits         Limits
+	Connections    chan *conn.Conn
+	Handler        Handler
+	Streams        *stream.Registry
+	nextSessionId  atomic.Uint64
+	listeners      []*Listener
+	listenersMutex sync.Mutex
+	serving        bool
+	sessions       map[*Session]struct{}
+	sessionsMutex  sync.Mutex
+	sessionsGroup  sync.WaitGroup
+	shuttingDown   atomic.Bool
+	// closed is closed once Shutdown was called
+	closed             chan struct{}
+	closeOnce          sync.Once
+	handshakesAccepted atomic.Uint64
+	handshakesFailed   atomic.Uint64
+	admission          *admission
+	// closedTraffic and decodeErrors are guarded by sessionsMutex
+	closedTraffic Traffic
+	decodeErrors  map[string]uint64
 }
 
-func NewServer(address string) *Server {
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		logger.Get().Panicf("failed to start rtmp server: %s", err)
+// NewServer creates a server without listener, AddListener adds the listeners opened by Listen or any other
+func NewServer() *Server {
+	newServer := &Server{
+		DefaultMaxChunkSize:              128,
+		DefaultNetworkTimeout:            time.Second * 10,
+		DefaultWindowAcknowledgementSize: 2 * 1024,
+		ShutdownTimeout:                  time.Second * 10,
+		ForceCloseTimeout:                time.Second * 5,
+		PingInterval:                     time.Second * 5,
+		PlaybackBurst:                    time.Second * 2,
+		FourCCList:                       []string{flv.FourCCAV1, flv.FourCCVP9, flv.FourCCHEVC, flv.FourCCAVC},
+		Connections:                      make(chan *conn.Conn),
+		Handler:                          NopHandler{},
+		Streams:                          stream.NewRegistry(),
+		sessions:                         make(map[*Session]struct{}),
+		closed:                           make(chan struct{}),
+		decodeErrors:                     make(map[string]uint64),
 	}
+	newServer.admission = newAdmission(&newServer.Limits)
+	return newServer
+}
 
-	return &Server{
-		DefaultMaxChunkSize:   128,
-		DefaultNetworkTimeout: time.Second * 10,
-		Listener:              listener,
-		Connections:           make(chan *conn.Conn),
+// AddListener makes the server accept the connections of a listener, right away once serving. The listener is
+// closed by Shutdown
+func (server *Server) AddListener(listener *Listener) error {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	if server.shuttingDown.Load() {
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	server.listeners = append(server.listeners, listener)
+	if server.serving {
+		go server.accept(listener)
 	}
+	return nil
 }
 
-func (server *Server) Accept() {
+// Listeners returns the listeners in the order they were added
+func (server *Server) Listeners() []*Listener {
+	server.listenersMutex.Lock()
+	defer server.listenersMutex.Unlock()
+	return slices.Clone(server.listeners)
+}
+
+// Addr is the address of the first listener, nil without listener
+func (server *Server) Addr() net.Addr {
+	listeners := server.Listeners()
+	if len(listeners) == 0 {
+		return nil
+	}
+	return listeners[0].Addr()
+}
+
+// Serve accepts the connections of every listener until the context is cancelled or Shutdown is called, a
+// cancelled context shuts the server down gracefully within ShutdownTimeout
+func (server *Server) Serve(ctx context.Context) error {
+	server.listenersMutex.Lock()
+	if len(server.listeners) == 0 {
+		server.listenersMutex.Unlock()
+		return ErrNoListener
+	}
+	if !server.serving && !server.shuttingDown.Load() {
+		server.serving = true
+		for _, listener := range server.listeners {
+			go server.accept(listener)
+		}
+	}
+	server.listenersMutex.Unlock()
 	logger.Get().Infof("rtmp server started")
-	defer func(listener net.Listener) {
-		err := listener.Close()
-		if err != nil {
-			logger.Get().Panicf("error closing listener: %s", err)
+	shutdownErrors := make(chan error, 1)
+	stop := context.AfterFunc(ctx, func() {
+		shutdownContext, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout)
+		defer cancel()
+		shutdownErrors <- server.Shutdown(shutdownContext)
+	})
+	defer stop()
+	<-server.closed
+	if !stop() {
+		// the context triggered the shutdown, waits for it to finish
+		if shutdownErr := <-shutdownErrors; shutdownErr != nil {
+			return shutdownErr
 		}
-	}(server.Listener)
+	}
+	return ErrServerClosed
+}
+
+// accept accepts the connections of a listener until it is closed
+func (server *Server) accept(listener *Listener) {
+	var retryDelay time.Duration
 	for {
-		netConnection, _ := server.Listener.Accept()
-		connection, _ := conn.NewConn(netConnection, server.DefaultMaxChunkSize, server.DefaultNetworkTimeout)
+		netConnection, err := listener.Accept()
+		if err != nil {
+			if server.shuttingDown.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// backs off on transient errors such as running out of file descriptors
+			retryDelay = min(max(2*retryDelay, 5*time.Millisecond), time.Second)
+			logger.Get().Errorf("error accepting connection on %s, retrying in %s: %s", listener.Addr(), retryDelay, err)
+			time.Sleep(retryDelay)
+			continue
+		}
+		retryDelay = 0
+		if !server.admission.acquireHandshake(&server.shuttingDown) {
+			_ = netConnection.Close()
+			continue
+		}
+		connection, err := conn.NewConn(netConnection, server.DefaultMaxChunkSize, server.DefaultNetworkTimeout)
+		if err != nil {
+			logger.Get().Error("Error creating connection ", err)
+			_ = netConnection.Close()
+			server.admission.releaseHandshake()
+			continue
+		}
+		connection.PeerWindowAcknowledgementSize = server.DefaultWindowAcknowledgementSize
+		session := newSession(server, connection, listener.ProxyProtocol)
+		if !server.trackSession(session) {
+			_ = connection.Close()
+			session.releaseHandshakeSlot()
+			continue
+		}
 		select {
 		case server.Connections <- connection:
 		default:
 		}
 		go func() {
-			err := handleConnection(connection)
+			defer server.untrackSession(session)
+			err := session.handle()
 			if err != nil {
 				logger.Get().Error("Error handling connection ", err)
-				connection.Errors <- err
+				select {
+				case connection.Errors <- err:
+				default:
+				}
 			}
 		}()
 	}
 }
 
-func handleConnection(connection *conn.Conn) error {
-	defer func(conn *conn.Conn) {
-		err := conn.Close()
-		if err != nil {
-			logger.Get().Error("Error closing connection ", err)
+// Shutdown stops accepting connections, ends the active streams of every session notifying the peers
+// and closes the connections, the connections still open when the context is done are closed forcibly and
+// Shutdown waits at most ForceCloseTimeout more for their sessions, which may be stuck in a handler
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.listenersMutex.Lock()
+	server.shuttingDown.Store(true)
+	listeners := server.listeners
+	server.listenersMutex.Unlock()
+	server.closeOnce.Do(func() {
+		close(server.closed)
+	})
+	// the connections waiting for a handshake slot are closed
+	server.admission.wakeHandshakes()
+	for _, listener := range listeners {
+		err := listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Get().Errorf("error closing listener %s: %s", listener.Addr(), err)
 		}
-	}(connection)
-	err := handshake.Accept(connection)
-	if err != nil {
-		logger.Get().Error("Handshake failed ", err)
-		return err
 	}
-	for {
-		_, err = message.Accept(connection)
-		if err != nil {
-			logger.Get().Error("Chunk reading failed ", err)
-			return err
+	sessions := server.activeSessions()
+	for _, session := range sessions {
+		go session.shutdown()
+	}
+	done := make(chan struct{})
+	go func() {
+		server.sessionsGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, session := range server.activeSessions() {
+			_ = session.Conn.Close()
 		}
-		if connection.CurrentMessage == nil {
-			err = connection.Close()
-			if err != nil {
-				return err
+		select {
+		case <-done:
+		case <-time.After(server.ForceCloseTimeout):
+		}
+		return ctx.Err()
+	}
+}
+
+// Sessions returns the open sessions ordered by id
+func (server *Server) Sessions() []*Session {
+	sessions := server.activeSessions()
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return sessions
+}
+
+func (server *Server) Session(id uint64) (*Session, bool) {
+	for _, session := range server.activeSessions() {
+		if session.Id == id {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// Publisher returns the session publishing a stream
+func (server *Server) Publisher(app string, name string) (*Session, bool) {
+	publishedStream, ok := server.Streams.Get(app, name)
+	if !ok {
+		return nil, false
+	}
+	for _, session := range server.activeSessions() {
+		for _, sessionStream := range session.Info().Streams {
+			if sessionStream.Type == "publish" && sessionStream.Stream == publishedStream {
+				return session, true
 			}
 		}
 	}
+	return nil, false
+}
+
+// StopStream unpublishes a stream notifying its publisher and players, the publisher is disconnected
+// once it hangs up or after ShutdownTimeout
+func (server *Server) StopStream(app string, name string) bool {
+	publisher, ok := server.Publisher(app, name)
+	if !ok {
+		return false
+	}
+	publisher.shutdown()
+	time.AfterFunc(server.ShutdownTimeout, func() {
+		_ = publisher.Close()
+	})
+	return true
+}
+
+// AdmitPlayer counts a player served over another protocol against the player limits, ReleasePlayer is called once
+// it stops
+func (server *Server) AdmitPlayer(app string, name string) error {
+	return server.admission.admitPlayer(app, name)
+}
+
+func (server *Server) ReleasePlayer(app string, name string) {
+	server.admission.releasePlayer(app, name)
+}
+
+// SetLimits changes the limits while serving, the connections and streams already admitted are kept
+func (server *Server) SetLimits(limits Limits) {
+	server.admission.setLimits(limits)
+}
+
+func (server *Server) trackSession(session *Session) bool {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	// checked under the lock so Shutdown never misses a session
+	if server.shuttingDown.Load() {
+		return false
+	}
+	server.sessions[session] = struct{}{}
+	server.sessionsGroup.Add(1)
+	return true
+}
+
+func (server *Server) untrackSession(session *Session) {
+	session.releaseHandshakeSlot()
+	if session.admitted {
+		server.admission.releaseConnection(session.ip)
+	}
+	server.sessionsMutex.Lock()
+	delete(server.sessions, session)
+	server.closedTraffic.add(session.Conn)
+	server.sessionsMutex.Unlock()
+	server.sessionsGroup.Done()
+}
+
+func (server *Server) activeSessions() []*Session {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	sessions := make([]*Session, 0, len(server.sessions))
+	for session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
 }
@@ -1,11 +1,20 @@
 package server_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rtmp/amf"
 	"rtmp/chunk"
+	"rtmp/message"
 	"rtmp/server"
 	"rtmp/testutil"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,29 +23,32 @@ import (
 
 func TestStartServer(t *testing.T) {
 	testServer := testutil.StartTestingServer(t)
-	_, err := net.Dial("tcp", testServer.Listener.Addr().String())
+	_, err := net.Dial("tcp", testServer.Addr().String())
 	assert.Nil(t, err)
 }
 
 func TestStartServerFail(t *testing.T) {
 	invalidAddress := "notanip:0000"
-	go func() {
-		assert.Panics(t, func() { server.NewServer(invalidAddress) })
-	}()
-	_, err := net.Dial("tcp", invalidAddress)
+	_, err := server.Listen(server.ListenerConfig{Address: invalidAddress})
 	assert.NotNil(t, err)
+	_, err = server.Listen(server.ListenerConfig{Network: server.NetworkTLS, Address: "127.0.0.1:0"})
+	assert.ErrorIs(t, err, server.ErrInvalidListener)
+	_, err = server.Listen(server.ListenerConfig{Network: "udp", Address: "127.0.0.1:0"})
+	assert.ErrorIs(t, err, server.ErrInvalidListener)
+	assert.ErrorIs(t, server.NewServer().Serve(context.Background()), server.ErrNoListener)
 }
 
 func TestServerDefaultSettings(t *testing.T) {
-	testServer := server.NewServer("127.0.0.1:0")
+	testServer := server.NewServer()
 	assert.Equal(t, uint32(128), testServer.DefaultMaxChunkSize)
 	assert.Equal(t, 10*time.Second, testServer.DefaultNetworkTimeout)
+	assert.Equal(t, uint32(2*1024), testServer.DefaultWindowAcknowledgementSize)
 }
 
 func TestServerNetworkTimeout(t *testing.T) {
 	testServer := testutil.StartTestingServer(t)
 	testServer.DefaultNetworkTimeout = 1 * time.Second
-	conn, _ := net.Dial("tcp", testServer.Listener.Addr().String())
+	conn, _ := net.Dial("tcp", testServer.Addr().String())
 	_, err := conn.Write([]byte("test"))
 	assert.Nil(t, err)
 	serverConn := <-testServer.Connections
@@ -48,7 +60,7 @@ func TestServerNetworkTimeout(t *testing.T) {
 
 func TestServerOneConnectionOnlyOneHandshake(t *testing.T) {
 	testServer := testutil.StartTestingServer(t)
-	conn, err := net.Dial("tcp", testServer.Listener.Addr().String())
+	conn, err := net.Dial("tcp", testServer.Addr().String())
 	assert.Nil(t, err)
 	_, err = testutil.RequestTestHandshake(t, conn)
 	assert.Nil(t, err)
@@ -81,3 +93,171 @@ func TestServerReceivesMultipleChunks(t *testing.T) {
 		fmt.Printf("Chunk: %d\n", i)
 	}
 }
+
+func TestServerServeStopsOnContextCancel(t *testing.T) {
+	testServer := server.NewServer()
+	listener, err := server.Listen(server.ListenerConfig{Address: "127.0.0.1:0"})
+	assert.Nil(t, err)
+	assert.Nil(t, testServer.AddListener(listener))
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- testServer.Serve(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-serveErrors:
+		assert.ErrorIs(t, err, server.ErrServerClosed)
+	case <-time.After(3 * time.Second):
+		t.FailNow()
+	}
+	_, err = net.Dial("tcp", testServer.Addr().String())
+	assert.NotNil(t, err)
+}
+
+func TestServerShutdownNotifiesPublisher(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, clientConn, "testStream")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := testServer.Shutdown(ctx)
+	assert.Nil(t, err)
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Unpublish.Success")
+	assert.Equal(t, streamId, testutil.WaitTestUserControl(t, clientConn, message.UserControlStreamEOF))
+}
+
+func TestServerShutdownForceClosesAfterDeadline(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	conn, err := net.Dial("tcp", testServer.Addr().String())
+	assert.Nil(t, err)
+	_, err = testutil.RequestTestHandshake(t, conn)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// the client never hangs up
+	err = testServer.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+type blockingPublishHandler struct {
+	server.NopHandler
+	release chan struct{}
+}
+
+func (handler blockingPublishHandler) OnPublish(*server.Session, *server.PublishRequest) error {
+	<-handler.release
+	return nil
+}
+
+func TestServerShutdownReturnsAtDeadlineWithStuckHandler(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	handler := blockingPublishHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	testServer.Handler = handler
+	testServer.ForceCloseTimeout = 100 * time.Millisecond
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	startedAt := time.Now()
+	err = testServer.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(startedAt), time.Second)
+}
+
+type slowUnpublishHandler struct {
+	server.NopHandler
+	unpublished *atomic.Bool
+}
+
+func (handler slowUnpublishHandler) OnUnpublish(*server.Session, *server.PublishRequest) {
+	time.Sleep(300 * time.Millisecond)
+	handler.unpublished.Store(true)
+}
+
+func TestServerShutdownWaitsForForceClosedSessions(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	unpublished := &atomic.Bool{}
+	testServer.Handler = slowUnpublishHandler{unpublished: unpublished}
+	clientConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, clientConn, "testStream")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// the streams ended at the deadline complete before Shutdown returns
+	err := testServer.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, unpublished.Load())
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	proxyListener, err := server.Listen(server.ListenerConfig{Address: "127.0.0.1:0", ProxyProtocol: true})
+	assert.Nil(t, err)
+	assert.Nil(t, testServer.AddListener(proxyListener))
+	conn, err := net.Dial("tcp", proxyListener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 1935\r\n"))
+	assert.Nil(t, err)
+	_, err = testutil.RequestTestHandshake(t, conn)
+	assert.Nil(t, err)
+	sessions := testServer.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "203.0.113.7:56324", sessions[0].RemoteAddr().String())
+	assert.Equal(t, "192.0.2.1:1935", sessions[0].Conn.LocalAddr().String())
+	assert.Equal(t, 1, sessions[0].Conn.ProxyHeader().Version)
+
+	// the connections without header are closed before the handshake
+	conn, err = net.Dial("tcp", proxyListener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = testutil.RequestTestHandshake(t, conn)
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		return testServer.Stats().DecodeErrors[server.DecodeErrorProxy] == 1
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestServerListensOnUnixSocketAndTLS(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	unixListener, err := server.Listen(server.ListenerConfig{Network: server.NetworkUnix, Address: filepath.Join(t.TempDir(), "rtmp.sock")})
+	assert.Nil(t, err)
+	assert.Nil(t, testServer.AddListener(unixListener))
+	// borrows the certificate of a testing https server
+	httpsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer httpsServer.Close()
+	tlsListener, err := server.Listen(server.ListenerConfig{Network: server.NetworkTLS, Address: "127.0.0.1:0", TLSConfig: httpsServer.TLS})
+	assert.Nil(t, err)
+	assert.Nil(t, testServer.AddListener(tlsListener))
+	assert.Len(t, testServer.Listeners(), 3)
+
+	unixConn, err := net.Dial("unix", unixListener.Addr().String())
+	assert.Nil(t, err)
+	publisherConn := testutil.ConnectTestingServer(t, testServer, unixConn)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(httpsServer.Certificate())
+	tlsConn, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com"})
+	assert.Nil(t, err)
+	playerConn := testutil.ConnectTestingServer(t, testServer, tlsConn)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 0, []byte{0x17, 0x01, 0, 0, 0, 1})
+	assert.Equal(t, []byte{0x17, 0x01, 0, 0, 0, 1}, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+
+	// the listeners are closed by the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_ = testServer.Shutdown(ctx)
+	_, err = net.Dial("unix", unixListener.Addr().String())
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, testServer.AddListener(unixListener), server.ErrServerClosed)
+}
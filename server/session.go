@@ -0,0 +1,893 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"io/fs"
+	"net"
+	"net/url"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/handshake"
+	"rtmp/logger"
+	"rtmp/message"
+	"rtmp/proxyproto"
+	"rtmp/stream"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SessionStateHandshake  = "handshake"
+	SessionStateConnecting = "connecting"
+	SessionStateConnected  = "connected"
+	SessionStatePublishing = "publishing"
+	SessionStatePlaying    = "playing"
+	SessionStateClosing    = "closing"
+)
+
+type Session struct {
+	Id             uint64
+	Conn           *conn.Conn
+	App            string
+	ConnectRequest *ConnectRequest
+	ConnectedAt    time.Time
+	server         *Server
+	streams        map[uint32]*sessionStream
+	nextStreamId   uint32
+	streamsMutex   sync.Mutex
+	// eventsMutex serializes the handler invocations and stream state changes of the session
+	eventsMutex sync.Mutex
+	handshaken  atomic.Bool
+	closing     atomic.Bool
+	done        chan struct{}
+	// ip is the address the connection limits are counted by, the one of the client behind a proxy
+	ip string
+	// rejection answers the connect command of a connection beyond the limits, admitted is set otherwise
+	rejection error
+	admitted  bool
+	// proxied sessions start with a proxy protocol header
+	proxied bool
+	// handshakeSlot is held from the accept until the handshake completes, or until the close once rejected
+	handshakeSlot atomic.Bool
+}
+
+// SessionInfo is a snapshot of a session, safe to read while the session goes on
+type SessionInfo struct {
+	Id          uint64
+	RemoteAddr  net.Addr
+	App         string
+	State       string
+	ConnectedAt time.Time
+	Streams     []SessionStreamInfo
+}
+
+type SessionStreamInfo struct {
+	Id   uint32
+	Name string
+	// Type is publish or play
+	Type   string
+	Stream *stream.Stream
+}
+
+type sessionStream struct {
+	Id             uint32
+	PublishRequest *PublishRequest
+	PlayRequest    *PlayRequest
+	Stream         *stream.Stream
+	player         *player
+	vod            *vodPlayer
+}
+
+// newSession creates the session of a connection holding a handshake slot
+func newSession(server *Server, connection *conn.Conn, proxyProtocol bool) *Session {
+	newSession := &Session{
+		Id:          server.nextSessionId.Add(1),
+		Conn:        connection,
+		ConnectedAt: time.Now(),
+		server:      server,
+		streams:     make(map[uint32]*sessionStream),
+		done:        make(chan struct{}),
+		proxied:     proxyProtocol,
+	}
+	newSession.handshakeSlot.Store(true)
+	return newSession
+}
+
+func (session *Session) RemoteAddr() net.Addr {
+	return session.Conn.RemoteAddr()
+}
+
+// Close disconnects the peer without notifying it
+func (session *Session) Close() error {
+	session.closing.Store(true)
+	return session.Conn.Close()
+}
+
+func (session *Session) Info() SessionInfo {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	info := SessionInfo{
+		Id:          session.Id,
+		RemoteAddr:  session.RemoteAddr(),
+		App:         session.App,
+		ConnectedAt: session.ConnectedAt,
+		Streams:     make([]SessionStreamInfo, 0, len(session.streams)),
+	}
+	publishing, playing := false, false
+	for _, activeStream := range session.streams {
+		if activeStream.PublishRequest != nil {
+			publishing = true
+			info.Streams = append(info.Streams, SessionStreamInfo{Id: activeStream.Id, Name: activeStream.PublishRequest.Name, Type: "publish", Stream: activeStream.Stream})
+		} else if activeStream.PlayRequest != nil {
+			playing = true
+			info.Streams = append(info.Streams, SessionStreamInfo{Id: activeStream.Id, Name: activeStream.PlayRequest.Name, Type: "play", Stream: activeStream.Stream})
+		}
+	}
+	slices.SortFunc(info.Streams, func(a, b SessionStreamInfo) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	switch {
+	case session.closing.Load():
+		info.State = SessionStateClosing
+	case publishing:
+		info.State = SessionStatePublishing
+	case playing:
+		info.State = SessionStatePlaying
+	case session.ConnectRequest != nil:
+		info.State = SessionStateConnected
+	case session.handshaken.Load():
+		info.State = SessionStateConnecting
+	default:
+		info.State = SessionStateHandshake
+	}
+	return info
+}
+
+func (session *Session) handler() Handler {
+	if session.server.Handler == nil {
+		return NopHandler{}
+	}
+	return session.server.Handler
+}
+
+func (session *Session) handle() (err error) {
+	defer func() {
+		session.close(err)
+	}()
+	if session.proxied {
+		err = session.readProxyHeader()
+		if err != nil {
+			return err
+		}
+	}
+	session.ip = remoteIP(session.RemoteAddr())
+	session.rejection = session.server.admission.admitConnection(session.ip)
+	session.admitted = session.rejection == nil
+	err = handshake.Accept(session.Conn)
+	if err != nil {
+		session.server.handshakesFailed.Add(1)
+		logger.Get().Error("Handshake failed ", err)
+		return err
+	}
+	session.server.handshakesAccepted.Add(1)
+	if session.rejection == nil {
+		session.releaseHandshakeSlot()
+	}
+	session.eventsMutex.Lock()
+	err = session.handler().OnHandshakeComplete(session)
+	session.handshaken.Store(err == nil)
+	session.eventsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		receivedMessage, err := message.AcceptMessage(session.Conn)
+		if err != nil {
+			if session.closing.Load() {
+				// the peer hung up after being notified of the shutdown or was kicked
+				return nil
+			}
+			if !isNetworkError(err) {
+				session.server.countDecodeError(DecodeErrorChunk)
+			}
+			logger.Get().Error("Chunk reading failed ", err)
+			return err
+		}
+		session.eventsMutex.Lock()
+		err = session.handleMessage(receivedMessage)
+		session.eventsMutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readProxyHeader reads the proxy protocol header within the network timeout, the slow clients can't hold the
+// handshake slot any longer than the ones not handshaking
+func (session *Session) readProxyHeader() error {
+	netConn := session.Conn.Conn
+	_ = netConn.SetReadDeadline(time.Now().Add(session.Conn.NetworkTimeout))
+	header, err := proxyproto.Read(netConn)
+	if err != nil {
+		if !isNetworkError(err) {
+			session.server.countDecodeError(DecodeErrorProxy)
+		}
+		logger.Get().Errorf("error reading proxy protocol header from %s: %s", netConn.RemoteAddr(), err)
+		return err
+	}
+	session.Conn.SetProxyHeader(header)
+	if header.Source != nil {
+		logger.Get().Debugf("connection %d from %s proxied by %s", session.Id, header.Source, netConn.RemoteAddr())
+	}
+	return nil
+}
+
+func (session *Session) handleMessage(receivedMessage *conn.Message) error {
+	switch receivedMessage.TypeId {
+	case message.TypeAudio, message.TypeVideo, message.TypeDataMessageAmf0:
+		return session.handleMediaMessage(receivedMessage)
+	case message.TypeCommandMessageAmf0:
+	default:
+		return nil
+	}
+	command, err := amf.DecodeCommand(receivedMessage.Data)
+	if err != nil {
+		session.server.countDecodeError(DecodeErrorAmf)
+		return err
+	}
+	logger.Get().Debugf("Command received: %s\n", command)
+	if len(command.Parts) == 0 {
+		return nil
+	}
+	switch command.Parts[0] {
+	case amf.NewString("connect"):
+		return session.doConnectFlow(*command)
+	case amf.NewString("createStream"):
+		return session.doCreateStreamFlow(*command)
+	case amf.NewString("publish"):
+		return session.doPublishFlow(receivedMessage.StreamId, *command)
+	case amf.NewString("play"):
+		return session.doPlayFlow(receivedMessage.StreamId, *command)
+	case amf.NewString("pause"):
+		session.doPauseFlow(receivedMessage.StreamId, *command)
+	case amf.NewString("seek"):
+		return session.doSeekFlow(receivedMessage.StreamId, *command)
+	case amf.NewString("FCUnpublish"), amf.NewString("closeStream"):
+		session.endStream(receivedMessage.StreamId, false)
+	case amf.NewString("deleteStream"):
+		if streamId, ok := numberPart(*command, 3); ok {
+			session.endStream(uint32(streamId), false)
+		}
+	}
+	return nil
+}
+
+func (session *Session) handleMediaMessage(receivedMessage *conn.Message) error {
+	session.streamsMutex.Lock()
+	publishingStream, ok := session.streams[receivedMessage.StreamId]
+	session.streamsMutex.Unlock()
+	if !ok || publishingStream.PublishRequest == nil {
+		return nil
+	}
+	if receivedMessage.TypeId == message.TypeDataMessageAmf0 {
+		receivedMessage.Data = stripSetDataFrame(receivedMessage.Data)
+		receivedMessage.Length = uint32(len(receivedMessage.Data))
+	}
+	media := &MediaMessage{
+		StreamId:  receivedMessage.StreamId,
+		TypeId:    receivedMessage.TypeId,
+		Timestamp: receivedMessage.Timestamp,
+		Data:      receivedMessage.Data,
+	}
+	err := session.handler().OnMediaMessage(session, media)
+	if err != nil {
+		logger.Get().Debugf("media message dropped: %s", err)
+		return nil
+	}
+	publishingStream.Stream.WriteMessage(&conn.Message{
+		Length:    uint32(len(media.Data)),
+		TypeId:    media.TypeId,
+		StreamId:  media.StreamId,
+		Timestamp: media.Timestamp,
+		Data:      media.Data,
+	})
+	return nil
+}
+
+func (session *Session) doConnectFlow(command amf.Command) error {
+	request := &ConnectRequest{}
+	if len(command.Parts) > 2 {
+		if commandObject, ok := command.Parts[2].(amf.Object); ok {
+			request.Properties = commandObject
+			request.App = stringProperty(commandObject, "app")
+			request.TcUrl = stringProperty(commandObject, "tcUrl")
+			request.FlashVer = stringProperty(commandObject, "flashVer")
+			request.SwfUrl = stringProperty(commandObject, "swfUrl")
+			request.PageUrl = stringProperty(commandObject, "pageUrl")
+			request.ObjectEncoding = numberProperty(commandObject, "objectEncoding")
+			request.FourCCList = stringsProperty(commandObject, "fourCcList")
+		}
+	}
+	if len(command.Parts) > 3 {
+		request.Arguments = command.Parts[3:]
+	}
+	transactionId := transactionIdPart(command)
+	err := session.rejection
+	if err == nil {
+		err = session.handler().OnConnect(session, request)
+	}
+	if err != nil {
+		_, sendErr := message.NewCommandMessage(0, errorCommand(transactionId, err, "NetConnection.Connect.Rejected")).Send(session.Conn)
+		if sendErr != nil {
+			return sendErr
+		}
+		return err
+	}
+	session.streamsMutex.Lock()
+	session.App = request.App
+	session.ConnectRequest = request
+	session.streamsMutex.Unlock()
+	connection := session.Conn
+	// server sends window acknowledgement size
+	windowAcknowledgementSizeMessage := message.NewWindowAcknowledgementSizeMessage(int(connection.PeerWindowAcknowledgementSize))
+	_, err = windowAcknowledgementSizeMessage.Send(connection)
+	if err != nil {
+		return err
+	}
+	// server sends set peer bandwidth
+	setPeerBandwidthMessage := message.NewSetPeerBandwidthMessage(int(connection.PeerWindowAcknowledgementSize), message.SetPeerBandwidthLimitTypeHard)
+	_, err = setPeerBandwidthMessage.Send(connection)
+	connection.WindowAcknowledgementSize = connection.PeerWindowAcknowledgementSize
+	if err != nil {
+		return err
+	}
+	// server sends stream begin message
+	streamBeginMessage := message.NewStreamBeginMessage(0)
+	_, err = streamBeginMessage.Send(connection)
+	if err != nil {
+		return err
+	}
+	// server sends result command
+	serverProps := amf.NewObject(
+		amf.ObjectProperty{Name: "fmsVer", Value: amf.NewString("FMS/3,0,1,123")},
+		amf.ObjectProperty{Name: "capabilities", Value: amf.NewNumber(31)},
+	)
+	if request.FourCCList != nil {
+		// enhanced rtmp, tells the client the codecs it can publish and play
+		fourCCList := make(amf.StrictArray, 0, len(session.server.FourCCList))
+		for _, fourCC := range session.server.FourCCList {
+			fourCCList = append(fourCCList, amf.NewString(fourCC))
+		}
+		serverProps = append(serverProps, amf.ObjectProperty{Name: "fourCcList", Value: fourCCList})
+	}
+	infoProps := amf.NewObject(
+		amf.ObjectProperty{Name: "level", Value: amf.NewString("status")},
+		amf.ObjectProperty{Name: "code", Value: amf.NewString("NetConnection.Connect.Success")},
+		amf.ObjectProperty{Name: "description", Value: amf.NewString("Connection succeeded.")},
+		amf.ObjectProperty{Name: "objectEncoding", Value: amf.NewNumber(0)},
+	)
+	resultCommand := amf.NewCommand(amf.NewString("_result"), amf.NewNumber(1), serverProps, infoProps)
+	_, err = message.NewCommandMessage(0, resultCommand).Send(connection)
+	if err != nil {
+		return err
+	}
+	if session.server.PingInterval > 0 {
+		go session.ping(session.server.PingInterval)
+	}
+	return nil
+}
+
+// ping measures the round trip time of the connection until the session closes
+func (session *Session) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := message.NewPingRequestMessage(uint32(session.Conn.Uptime().Milliseconds())).Send(session.Conn)
+		if err != nil {
+			logger.Get().Debugf("error sending ping request: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (session *Session) doCreateStreamFlow(command amf.Command) error {
+	if len(command.Parts) < 2 {
+		return errors.New("createStream command without transaction id")
+	}
+	transactionId := command.Parts[1]
+	streamId := session.createStream()
+	err := session.handler().OnCreateStream(session, streamId)
+	if err != nil {
+		session.streamsMutex.Lock()
+		delete(session.streams, streamId)
+		session.streamsMutex.Unlock()
+		_, err = message.NewCommandMessage(0, errorCommand(transactionId, err, "NetConnection.Call.Failed")).Send(session.Conn)
+		return err
+	}
+	// sends result command
+	resultCommand := amf.NewCommand(amf.NewString("_result"), transactionId, amf.NewNull(), amf.NewNumber(float64(streamId)))
+	_, err = message.NewCommandMessage(0, resultCommand).Send(session.Conn)
+	return err
+}
+
+func (session *Session) doPublishFlow(messageStreamId uint32, command amf.Command) error {
+	if len(command.Parts) < 2 {
+		return errors.New("publish command without transaction id")
+	}
+	if messageStreamId == 0 {
+		// the peer skipped createStream
+		messageStreamId = session.createStream()
+	}
+	streamName, _ := stringPart(command, 3)
+	request := &PublishRequest{
+		StreamId: messageStreamId,
+		App:      session.App,
+		Type:     "live",
+	}
+	request.Name, request.Args = splitStreamName(streamName)
+	if publishType, ok := stringPart(command, 4); ok && publishType != "" {
+		request.Type = publishType
+	}
+	if session.closing.Load() || session.server.shuttingDown.Load() {
+		return session.sendStatus(messageStreamId, "error", "NetStream.Publish.Rejected", "Server is shutting down.")
+	}
+	if session.activeStream(messageStreamId) {
+		return session.sendStatus(messageStreamId, "error", "NetStream.Publish.BadConnection", "Stream is already in use.")
+	}
+	err := session.server.admission.admitPublisher(request.App)
+	if err != nil {
+		return session.sendRejection(messageStreamId, err, "NetStream.Publish.Rejected")
+	}
+	publishedStream, err := session.server.Streams.Publish(request.App, request.Name)
+	if err != nil {
+		session.server.admission.releasePublisher(request.App)
+		return session.sendStatus(messageStreamId, "error", "NetStream.Publish.BadName", request.Name+" is already being published.")
+	}
+	err = session.handler().OnPublish(session, request)
+	if err != nil {
+		session.server.Streams.Unpublish(publishedStream)
+		session.server.admission.releasePublisher(request.App)
+		return session.sendRejection(messageStreamId, err, "NetStream.Publish.Denied")
+	}
+	session.setStream(&sessionStream{Id: messageStreamId, PublishRequest: request, Stream: publishedStream})
+
+	err = session.sendStatus(messageStreamId, "status", "NetStream.Publish.Start", "Publish flow started.")
+	if err != nil {
+		return err
+	}
+	// server sends stream begin message
+	streamBeginMessage := message.NewStreamBeginMessage(messageStreamId)
+	_, err = streamBeginMessage.Send(session.Conn)
+	if err != nil {
+		return err
+	}
+	// sends result command
+	transactionId := command.Parts[1]
+	resultCommand := amf.NewCommand(amf.NewString("_result"), transactionId, amf.NewNull(), amf.NewNumber(float64(messageStreamId)))
+	_, err = message.NewCommandMessage(0, resultCommand).Send(session.Conn)
+	return err
+}
+
+func (session *Session) doPlayFlow(messageStreamId uint32, command amf.Command) error {
+	if messageStreamId == 0 {
+		// the peer skipped createStream
+		messageStreamId = session.createStream()
+	}
+	streamName, _ := stringPart(command, 3)
+	request := &PlayRequest{
+		StreamId: messageStreamId,
+		App:      session.App,
+		Start:    -2,
+		Duration: -1,
+		Reset:    true,
+	}
+	request.Name, request.Args = splitStreamName(streamName)
+	if start, ok := numberPart(command, 4); ok {
+		request.Start = start
+	}
+	if duration, ok := numberPart(command, 5); ok {
+		request.Duration = duration
+	}
+	if len(command.Parts) > 6 {
+		if reset, ok := command.Parts[6].(amf.Boolean); ok {
+			request.Reset = reset != 0
+		}
+	}
+	if session.closing.Load() || session.server.shuttingDown.Load() {
+		return session.sendStatus(messageStreamId, "error", "NetStream.Play.Failed", "Server is shutting down.")
+	}
+	if session.activeStream(messageStreamId) {
+		return session.sendStatus(messageStreamId, "error", "NetStream.Play.Failed", "Stream is already in use.")
+	}
+	err := session.server.admission.admitPlayer(request.App, request.Name)
+	if err != nil {
+		return session.sendRejection(messageStreamId, err, "NetStream.Play.Failed")
+	}
+	err = session.handler().OnPlay(session, request)
+	if err != nil {
+		session.server.admission.releasePlayer(request.App, request.Name)
+		return session.sendRejection(messageStreamId, err, "NetStream.Play.Failed")
+	}
+	if file, ok := session.openVOD(request); ok {
+		return session.playVOD(request, file)
+	}
+	streamPlayer := newPlayer(session, messageStreamId)
+	streamPlayer.selectTracks(request.Args)
+	session.setStream(&sessionStream{Id: messageStreamId, PlayRequest: request, player: streamPlayer})
+	playedStream, err := session.server.Streams.Subscribe(request.App, request.Name, streamPlayer)
+	if err != nil {
+		session.endStream(messageStreamId, false)
+		return session.sendStatus(messageStreamId, "error", "NetStream.Play.StreamNotFound", request.Name+" is not being published.")
+	}
+	session.streamsMutex.Lock()
+	session.streams[messageStreamId].Stream = playedStream
+	session.streamsMutex.Unlock()
+
+	_, err = message.NewStreamBeginMessage(messageStreamId).Send(session.Conn)
+	if err != nil {
+		return err
+	}
+	if request.Reset {
+		err = session.sendStatus(messageStreamId, "status", "NetStream.Play.Reset", "Playing and resetting "+request.Name+".")
+		if err != nil {
+			return err
+		}
+	}
+	err = session.sendStatus(messageStreamId, "status", "NetStream.Play.Start", "Started playing "+request.Name+".")
+	if err != nil {
+		return err
+	}
+	// the cached messages queued while subscribing are sent after the status messages
+	streamPlayer.start()
+	return nil
+}
+
+// openVOD opens the recording to play, a start of -1 only plays live streams, -2 prefers the live stream
+// and a position prefers the recording
+func (session *Session) openVOD(request *PlayRequest) (VODFile, bool) {
+	if session.server.VOD == nil || request.Start == -1 {
+		return nil, false
+	}
+	if _, live := session.server.Streams.Get(request.App, request.Name); live && request.Start < 0 {
+		return nil, false
+	}
+	file, err := session.server.VOD.Open(request.App, request.Name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Get().Errorf("error opening recording of %s: %s", request.Name, err)
+		}
+		return nil, false
+	}
+	return file, true
+}
+
+func (session *Session) playVOD(request *PlayRequest, file VODFile) error {
+	messageStreamId := request.StreamId
+	vodPlayer := newVODPlayer(session, request, file)
+	session.setStream(&sessionStream{Id: messageStreamId, PlayRequest: request, vod: vodPlayer})
+	_, err := message.NewStreamBeginMessage(messageStreamId).Send(session.Conn)
+	if err != nil {
+		return err
+	}
+	if request.Reset {
+		err = session.sendStatus(messageStreamId, "status", "NetStream.Play.Reset", "Playing and resetting "+request.Name+".")
+		if err != nil {
+			return err
+		}
+	}
+	err = session.sendStatus(messageStreamId, "status", "NetStream.Play.Start", "Started playing "+request.Name+".")
+	if err != nil {
+		return err
+	}
+	vodPlayer.start()
+	return nil
+}
+
+// doPauseFlow pauses or resumes a recording, live streams can't be paused
+func (session *Session) doPauseFlow(messageStreamId uint32, command amf.Command) {
+	vodPlayer := session.vodPlayer(messageStreamId)
+	if vodPlayer == nil || len(command.Parts) < 4 {
+		return
+	}
+	pause, ok := command.Parts[3].(amf.Boolean)
+	if !ok {
+		return
+	}
+	vodPlayer.command(vodCommand{pause: pause != 0, unpause: pause == 0})
+}
+
+func (session *Session) doSeekFlow(messageStreamId uint32, command amf.Command) error {
+	vodPlayer := session.vodPlayer(messageStreamId)
+	timestamp, ok := numberPart(command, 3)
+	if vodPlayer == nil || !ok || timestamp < 0 {
+		return session.sendStatus(messageStreamId, "error", "NetStream.Seek.Failed", "Only recordings can be seeked.")
+	}
+	vodPlayer.command(vodCommand{seek: true, timestamp: uint32(timestamp)})
+	return nil
+}
+
+func (session *Session) vodPlayer(streamId uint32) *vodPlayer {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	if playingStream, ok := session.streams[streamId]; ok {
+		return playingStream.vod
+	}
+	return nil
+}
+
+// endStreamFromVODPlayer is called by a vod player once the recording ended, the peer was already notified
+func (session *Session) endStreamFromVODPlayer(endedPlayer *vodPlayer) {
+	session.eventsMutex.Lock()
+	defer session.eventsMutex.Unlock()
+	if session.vodPlayer(endedPlayer.request.StreamId) == endedPlayer {
+		session.endStream(endedPlayer.request.StreamId, false)
+	}
+}
+
+func (session *Session) createStream() uint32 {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	session.nextStreamId++
+	session.streams[session.nextStreamId] = &sessionStream{Id: session.nextStreamId}
+	return session.nextStreamId
+}
+
+func (session *Session) setStream(newStream *sessionStream) {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	session.streams[newStream.Id] = newStream
+	if newStream.Id > session.nextStreamId {
+		session.nextStreamId = newStream.Id
+	}
+}
+
+func (session *Session) activeStream(streamId uint32) bool {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	existingStream, ok := session.streams[streamId]
+	return ok && (existingStream.PublishRequest != nil || existingStream.PlayRequest != nil)
+}
+
+// endStream releases a message stream with the events lock held, the peer is only notified when the
+// server ends it
+func (session *Session) endStream(streamId uint32, notify bool) {
+	session.streamsMutex.Lock()
+	endedStream, ok := session.streams[streamId]
+	delete(session.streams, streamId)
+	session.streamsMutex.Unlock()
+	if !ok {
+		return
+	}
+	if endedStream.PublishRequest != nil {
+		session.server.Streams.Unpublish(endedStream.Stream)
+		session.server.admission.releasePublisher(endedStream.PublishRequest.App)
+		session.handler().OnUnpublish(session, endedStream.PublishRequest)
+		if notify {
+			session.notifyStreamEnd(streamId, "NetStream.Unpublish.Success", endedStream.PublishRequest.Name+" is now unpublished.")
+		}
+	} else if endedStream.PlayRequest != nil {
+		if endedStream.Stream != nil && endedStream.Stream.Unsubscribe(endedStream.player) {
+			_ = endedStream.player.Close()
+		}
+		if endedStream.vod != nil {
+			_ = endedStream.vod.Close()
+		}
+		session.server.admission.releasePlayer(endedStream.PlayRequest.App, endedStream.PlayRequest.Name)
+		session.handler().OnStop(session, endedStream.PlayRequest)
+		if notify {
+			session.notifyStreamEnd(streamId, "NetStream.Play.Stop", "Stopped playing "+endedStream.PlayRequest.Name+".")
+		}
+	}
+}
+
+func (session *Session) notifyStreamEnd(streamId uint32, code string, description string) {
+	var err error
+	if code == "NetStream.Unpublish.Success" {
+		err = session.sendStatus(streamId, "status", code, description)
+		if err == nil {
+			_, err = message.NewStreamEOFMessage(streamId).Send(session.Conn)
+		}
+	} else {
+		_, err = message.NewStreamEOFMessage(streamId).Send(session.Conn)
+		if err == nil {
+			err = session.sendStatus(streamId, "status", code, description)
+		}
+	}
+	if err != nil {
+		logger.Get().Debugf("error notifying stream end: %s", err)
+	}
+}
+
+func (session *Session) playing(streamPlayer *player) bool {
+	session.streamsMutex.Lock()
+	defer session.streamsMutex.Unlock()
+	playingStream, ok := session.streams[streamPlayer.streamId]
+	return ok && playingStream.player == streamPlayer
+}
+
+// endStreamFromPlayer is called by a player once its stream stopped sending messages to it
+func (session *Session) endStreamFromPlayer(endedPlayer *player) {
+	session.eventsMutex.Lock()
+	defer session.eventsMutex.Unlock()
+	if session.playing(endedPlayer) {
+		session.endStream(endedPlayer.streamId, !session.closing.Load())
+	}
+}
+
+func (session *Session) endStreams(notify bool) {
+	session.streamsMutex.Lock()
+	streamIds := make([]uint32, 0, len(session.streams))
+	for streamId := range session.streams {
+		streamIds = append(streamIds, streamId)
+	}
+	session.streamsMutex.Unlock()
+	for _, streamId := range streamIds {
+		session.endStream(streamId, notify)
+	}
+}
+
+// shutdown ends the active streams notifying the peer and half-closes the connection so the
+// notifications are read before the peer hangs up
+func (session *Session) shutdown() {
+	session.eventsMutex.Lock()
+	session.endStreams(true)
+	session.closing.Store(true)
+	session.eventsMutex.Unlock()
+	if halfCloser, ok := session.Conn.Conn.(interface{ CloseWrite() error }); ok {
+		if halfCloser.CloseWrite() == nil {
+			return
+		}
+	}
+	_ = session.Conn.Close()
+}
+
+func (session *Session) releaseHandshakeSlot() {
+	if session.handshakeSlot.Swap(false) {
+		session.server.admission.releaseHandshake()
+	}
+}
+
+func (session *Session) close(err error) {
+	session.eventsMutex.Lock()
+	closing := session.closing.Swap(true)
+	session.endStreams(false)
+	if session.handshaken.Load() {
+		session.handler().OnDisconnect(session, err)
+	}
+	session.eventsMutex.Unlock()
+	close(session.done)
+	closeErr := session.Conn.Close()
+	if closeErr != nil && !closing {
+		logger.Get().Error("Error closing connection ", closeErr)
+	}
+}
+
+func (session *Session) sendStatus(streamId uint32, level string, code string, description string) error {
+	_, err := message.NewStatusMessage(streamId, level, code, description).Send(session.Conn)
+	return err
+}
+
+func (session *Session) sendRejection(streamId uint32, err error, defaultCode string) error {
+	statusCommand := amf.NewCommand(amf.NewString("onStatus"), amf.NewNumber(0), amf.NewNull(), rejectionInfo(err, defaultCode))
+	_, sendErr := message.NewCommandMessage(streamId, statusCommand).Send(session.Conn)
+	return sendErr
+}
+
+func errorCommand(transactionId amf.ValueType, err error, defaultCode string) amf.Command {
+	return amf.NewCommand(amf.NewString("_error"), transactionId, amf.NewNull(), rejectionInfo(err, defaultCode))
+}
+
+// rejectionInfo is the information object of a rejection, with the code of a *StatusError and its redirection
+func rejectionInfo(err error, defaultCode string) amf.Object {
+	code, description := defaultCode, err.Error()
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		code, description = statusError.Code, statusError.Description
+	}
+	infoProps := amf.NewObject(
+		amf.ObjectProperty{Name: "level", Value: amf.NewString("error")},
+		amf.ObjectProperty{Name: "code", Value: amf.NewString(code)},
+		amf.ObjectProperty{Name: "description", Value: amf.NewString(description)},
+	)
+	if statusError != nil && statusError.Redirect != "" {
+		infoProps = append(infoProps, amf.ObjectProperty{Name: "ex", Value: amf.NewObject(
+			amf.ObjectProperty{Name: "code", Value: amf.NewNumber(302)},
+			amf.ObjectProperty{Name: "redirect", Value: amf.NewString(statusError.Redirect)},
+		)})
+	}
+	return infoProps
+}
+
+// splitStreamName separates the query some clients append to the stream name, usually to authenticate
+func splitStreamName(streamName string) (string, url.Values) {
+	name, query, found := strings.Cut(streamName, "?")
+	if !found {
+		return name, url.Values{}
+	}
+	args, err := url.ParseQuery(query)
+	if err != nil {
+		return name, url.Values{}
+	}
+	return name, args
+}
+
+// stripSetDataFrame turns the @setDataFrame command a publisher sends into the data message players expect
+func stripSetDataFrame(data []byte) []byte {
+	setDataFrame := amf.NewString("@setDataFrame").Encode()
+	if len(data) > len(setDataFrame) && string(data[:len(setDataFrame)]) == string(setDataFrame) {
+		return data[len(setDataFrame):]
+	}
+	return data
+}
+
+func transactionIdPart(command amf.Command) amf.ValueType {
+	if len(command.Parts) > 1 {
+		return command.Parts[1]
+	}
+	return amf.NewNumber(0)
+}
+
+func stringPart(command amf.Command, index int) (string, bool) {
+	if len(command.Parts) <= index {
+		return "", false
+	}
+	value, ok := command.Parts[index].(amf.String)
+	return string(value), ok
+}
+
+func numberPart(command amf.Command, index int) (float64, bool) {
+	if len(command.Parts) <= index {
+		return 0, false
+	}
+	value, ok := command.Parts[index].(amf.Number)
+	return float64(value), ok
+}
+
+func stringProperty(object amf.Object, name string) string {
+	for _, property := range object {
+		if property.Name == name {
+			if value, ok := property.Value.(amf.String); ok {
+				return string(value)
+			}
+		}
+	}
+	return ""
+}
+
+// stringsProperty reads an array of strings, nil when the property is missing
+func stringsProperty(object amf.Object, name string) []string {
+	for _, property := range object {
+		if property.Name != name {
+			continue
+		}
+		if array, ok := property.Value.(amf.StrictArray); ok {
+			values := make([]string, 0, len(array))
+			for _, value := range array {
+				if value, ok := value.(amf.String); ok {
+					values = append(values, string(value))
+				}
+			}
+			return values
+		}
+	}
+	return nil
+}
+
+func numberProperty(object amf.Object, name string) float64 {
+	for _, property := range object {
+		if property.Name == name {
+			if value, ok := property.Value.(amf.Number); ok {
+				return float64(value)
+			}
+		}
+	}
+	return 0
+}
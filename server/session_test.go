@@ -0,0 +1,138 @@
+package server_test
+
+import (
+	"rtmp/amf"
+	"rtmp/message"
+	"rtmp/stream"
+	"rtmp/testutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlayReceivesPublishedMedia(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	publisherStreamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	metadata := amf.NewCommand(amf.NewString("@setDataFrame"), amf.NewString("onMetaData"), amf.NewEcmaArray(
+		amf.ObjectProperty{Name: "width", Value: amf.NewNumber(1280)},
+	))
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeDataMessageAmf0, 0, metadata.Encode())
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeVideo, 0, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01})
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeVideo, 0, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02})
+
+	playerConn := testutil.DialTestingServer(t, testServer)
+	playerStreamId := testutil.PlayTestStream(t, playerConn, "testStream")
+	// the late player receives the cached metadata, sequence header and keyframe
+	receivedMetadata := testutil.WaitTestMedia(t, playerConn, message.TypeDataMessageAmf0)
+	decodedMetadata, err := amf.DecodeCommand(receivedMetadata.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, amf.NewString("onMetaData"), decodedMetadata.Parts[0])
+	sequenceHeader := testutil.WaitTestMedia(t, playerConn, message.TypeVideo)
+	assert.Equal(t, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}, sequenceHeader.Data)
+	assert.Equal(t, playerStreamId, sequenceHeader.StreamId)
+	keyframe := testutil.WaitTestMedia(t, playerConn, message.TypeVideo)
+	assert.Equal(t, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}, keyframe.Data)
+	// then the live messages
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeAudio, 1000, []byte{0xAF, 0x01, 0x03})
+	audio := testutil.WaitTestMedia(t, playerConn, message.TypeAudio)
+	assert.Equal(t, []byte{0xAF, 0x01, 0x03}, audio.Data)
+	assert.Equal(t, uint32(1000), audio.Timestamp)
+	// the player is told when the publisher leaves
+	_ = publisherConn.Close()
+	assert.Equal(t, playerStreamId, testutil.WaitTestUserControl(t, playerConn, message.UserControlStreamEOF))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Stop")
+}
+
+func TestPlayUnknownStream(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("unknown"))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.StreamNotFound")
+}
+
+func TestPublishSameStreamTwice(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	firstConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, firstConn, "testStream")
+	secondConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(secondConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, secondConn, "_result")
+	testutil.SendTestCommand(t, secondConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, secondConn, "NetStream.Publish.BadName")
+}
+
+func TestConnectNegotiatesFourCCList(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	testServer.FourCCList = []string{"hvc1", "avc1"}
+	clientConn := testutil.DialTestingServer(t, testServer)
+	testutil.SendTestCommand(t, clientConn, 0, amf.NewString("connect"), amf.NewNumber(1), amf.NewObject(
+		amf.ObjectProperty{Name: "app", Value: amf.NewString("testApp")},
+		amf.ObjectProperty{Name: "fourCcList", Value: amf.StrictArray{amf.NewString("hvc1"), amf.NewString("av01")}},
+	))
+	result := testutil.WaitTestCommand(t, clientConn, "_result")
+	assert.Contains(t, result.Parts[2], amf.ObjectProperty{
+		Name:  "fourCcList",
+		Value: amf.StrictArray{amf.NewString("hvc1"), amf.NewString("avc1")},
+	})
+
+	// the legacy clients are answered without it
+	legacyConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(legacyConn)
+	assert.Nil(t, err)
+	result = testutil.WaitTestCommand(t, legacyConn, "_result")
+	for _, property := range result.Parts[2].(amf.Object) {
+		assert.NotEqual(t, "fourCcList", property.Name)
+	}
+}
+
+func TestPlayReceivesEnhancedRTMPMedia(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	publisherStreamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	sequenceStart := []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x00, 0x0C, 0x00}
+	keyframe := []byte{0x93, 'a', 'v', '0', '1', 0x12, 0x00}
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeVideo, 0, sequenceStart)
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeVideo, 0, []byte{0xA3, 'a', 'v', '0', '1', 0x32})
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeVideo, 40, keyframe)
+
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	// the inter frame before the keyframe is not cached
+	assert.Equal(t, sequenceStart, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+	assert.Equal(t, keyframe, testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Data)
+}
+
+func TestPlaySelectsMultitrackTrack(t *testing.T) {
+	testServer := testutil.StartTestingServer(t)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	publisherStreamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	// the sequence starts of two opus tracks sent one by one
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeAudio, 0, []byte{0x95, 0x00, 'O', 'p', 'u', 's', 0, 0x10})
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeAudio, 0, []byte{0x95, 0x00, 'O', 'p', 'u', 's', 1, 0x11})
+
+	allTracksConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, allTracksConn, "testStream")
+	selectedTrackConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, selectedTrackConn, "testStream?audioTrack=1")
+	// every track header is cached for the late players
+	assert.Equal(t, []byte{0x95, 0x00, 'O', 'p', 'u', 's', 0, 0x10}, testutil.WaitTestMedia(t, allTracksConn, message.TypeAudio).Data)
+	assert.Equal(t, []byte{0x95, 0x00, 'O', 'p', 'u', 's', 1, 0x11}, testutil.WaitTestMedia(t, allTracksConn, message.TypeAudio).Data)
+	assert.Equal(t, []byte{0x90, 'O', 'p', 'u', 's', 0x11}, testutil.WaitTestMedia(t, selectedTrackConn, message.TypeAudio).Data)
+
+	frames := []byte{0x95, 0x11, 'O', 'p', 'u', 's', 0, 0, 0, 1, 0x20, 1, 0, 0, 1, 0x21}
+	testutil.SendTestMedia(t, publisherConn, publisherStreamId, message.TypeAudio, 20, frames)
+	assert.Equal(t, frames, testutil.WaitTestMedia(t, allTracksConn, message.TypeAudio).Data)
+	assert.Equal(t, []byte{0x91, 'O', 'p', 'u', 's', 0x21}, testutil.WaitTestMedia(t, selectedTrackConn, message.TypeAudio).Data)
+	assert.Equal(t, []stream.TrackInfo{
+		{Type: "audio", Id: 0, Codec: "Opus"},
+		{Type: "audio", Id: 1, Codec: "Opus"},
+	}, testServer.Streams.Streams()[0].Info().Tracks)
+}
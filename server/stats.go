@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"rtmp/conn"
+	"time"
+)
+
+const (
+	DecodeErrorChunk = "chunk"
+	DecodeErrorAmf   = "amf"
+	DecodeErrorProxy = "proxy"
+)
+
+// Stats is a snapshot of the server counters, the traffic counters include the closed connections
+type Stats struct {
+	HandshakesAccepted uint64
+	HandshakesFailed   uint64
+	ActiveConnections  int
+	ActivePublishers   int
+	ActivePlayers      int
+	Traffic            Traffic
+	// DecodeErrors counts the connections closed because of undecodable data by kind
+	DecodeErrors map[string]uint64
+	// Rejections counts the connections and streams refused by the limits by limit
+	Rejections map[string]uint64
+}
+
+type Traffic struct {
+	BytesReceived    uint64
+	BytesSent        uint64
+	MessagesReceived [256]uint64
+	MessagesSent     [256]uint64
+	RoundTrips       uint64
+	RoundTripsTime   time.Duration
+}
+
+func (traffic *Traffic) add(connection *conn.Conn) {
+	traffic.BytesReceived += connection.BytesReceived.Load()
+	traffic.BytesSent += connection.BytesSent.Load()
+	for typeId := range traffic.MessagesReceived {
+		traffic.MessagesReceived[typeId] += connection.Stats.MessagesReceived[typeId].Load()
+		traffic.MessagesSent[typeId] += connection.Stats.MessagesSent[typeId].Load()
+	}
+	traffic.RoundTrips += connection.Stats.RoundTrips.Load()
+	traffic.RoundTripsTime += time.Duration(connection.Stats.RoundTripsTime.Load())
+}
+
+func (server *Server) Stats() Stats {
+	server.sessionsMutex.Lock()
+	stats := Stats{
+		HandshakesAccepted: server.handshakesAccepted.Load(),
+		HandshakesFailed:   server.handshakesFailed.Load(),
+		ActiveConnections:  len(server.sessions),
+		Traffic:            server.closedTraffic,
+		DecodeErrors:       make(map[string]uint64, len(server.decodeErrors)),
+		Rejections:         server.admission.rejectionCounts(),
+	}
+	for kind, count := range server.decodeErrors {
+		stats.DecodeErrors[kind] = count
+	}
+	sessions := make([]*Session, 0, len(server.sessions))
+	for session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	server.sessionsMutex.Unlock()
+	for _, session := range sessions {
+		stats.Traffic.add(session.Conn)
+		for _, sessionStream := range session.Info().Streams {
+			if sessionStream.Type == "publish" {
+				stats.ActivePublishers++
+			} else {
+				stats.ActivePlayers++
+			}
+		}
+	}
+	return stats
+}
+
+func (server *Server) countDecodeError(kind string) {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	server.decodeErrors[kind]++
+}
+
+// isNetworkError tells the peer hanging up or timing out apart from the peer sending garbage
+func isNetworkError(err error) bool {
+	var netError net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &netError)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"rtmp/conn"
+	"rtmp/logger"
+	"rtmp/message"
+	"sync"
+	"time"
+)
+
+// VODSource provides the recorded streams, Open returns an error wrapping fs.ErrNotExist when a stream
+// has no recording so the live stream is played instead
+type VODSource interface {
+	Open(app string, name string) (VODFile, error)
+}
+
+type VODFile interface {
+	// ReadMessage returns the next message of the recording and io.EOF once it ended
+	ReadMessage() (*conn.Message, error)
+	// Seek moves to the keyframe at or before the timestamp in milliseconds and returns its timestamp, the
+	// following messages start with the metadata and sequence headers
+	Seek(timestamp uint32) (uint32, error)
+	// Duration is the timestamp of the last message
+	Duration() uint32
+	Close() error
+}
+
+type vodCommand struct {
+	pause     bool
+	unpause   bool
+	seek      bool
+	timestamp uint32
+}
+
+// vodPlayer sends a recording at the pace it was recorded, the first PlaybackBurst of media is sent at once
+// so the player fills its buffer
+type vodPlayer struct {
+	session   *Session
+	request   *PlayRequest
+	file      VODFile
+	commands  chan vodCommand
+	done      chan struct{}
+	closeOnce sync.Once
+	bytesSent uint64
+}
+
+func newVODPlayer(session *Session, request *PlayRequest, file VODFile) *vodPlayer {
+	return &vodPlayer{
+		session:  session,
+		request:  request,
+		file:     file,
+		commands: make(chan vodCommand, 16),
+		done:     make(chan struct{}),
+	}
+}
+
+func (player *vodPlayer) start() {
+	go player.run()
+}
+
+// Close stops the playback without notifying the peer
+func (player *vodPlayer) Close() error {
+	player.closeOnce.Do(func() {
+		close(player.done)
+	})
+	return nil
+}
+
+func (player *vodPlayer) command(command vodCommand) {
+	select {
+	case player.commands <- command:
+	default:
+		logger.Get().Debugf("vod command dropped, too many pending")
+	}
+}
+
+func (player *vodPlayer) run() {
+	defer player.file.Close()
+	streamId := player.request.StreamId
+	burst := player.session.server.PlaybackBurst
+	var startTimestamp uint32
+	if player.request.Start > 0 {
+		timestamp, err := player.file.Seek(uint32(player.request.Start * 1000))
+		if err != nil {
+			player.fail(err)
+			return
+		}
+		startTimestamp = timestamp
+	}
+	endTimestamp := uint32(0)
+	limited := player.request.Duration >= 0
+	if limited {
+		endTimestamp = startTimestamp + uint32(player.request.Duration*1000)
+	}
+	// the clock maps the timestamps to the wall time, it is set again after pauses and seeks
+	var clockTime time.Time
+	var clockTimestamp uint32
+	clockSet := false
+	paused := false
+	var next *conn.Message
+	for {
+		if paused {
+			select {
+			case command := <-player.commands:
+				paused, clockSet, next = player.handleCommand(command, paused, clockSet, next)
+			case <-player.done:
+				return
+			}
+			continue
+		}
+		if next == nil {
+			var err error
+			next, err = player.file.ReadMessage()
+			if errors.Is(err, io.EOF) {
+				player.complete()
+				return
+			}
+			if err != nil {
+				player.fail(err)
+				return
+			}
+		}
+		if limited && next.Timestamp > endTimestamp {
+			player.complete()
+			return
+		}
+		if !clockSet {
+			clockTime, clockTimestamp, clockSet = time.Now(), next.Timestamp, true
+		}
+		var wait time.Duration
+		if next.Timestamp > clockTimestamp {
+			wait = time.Until(clockTime.Add(time.Duration(next.Timestamp-clockTimestamp)*time.Millisecond - burst))
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case command := <-player.commands:
+				timer.Stop()
+				paused, clockSet, next = player.handleCommand(command, paused, clockSet, next)
+				continue
+			case <-player.done:
+				timer.Stop()
+				return
+			}
+		}
+		outgoingMessage := message.NewMessage(next.TypeId, streamId, next.Data)
+		outgoingMessage.Timestamp = next.Timestamp
+		_, err := outgoingMessage.Send(player.session.Conn)
+		if err != nil {
+			logger.Get().Debugf("error sending recorded media: %s", err)
+			return
+		}
+		player.bytesSent += uint64(len(next.Data))
+		next = nil
+	}
+}
+
+func (player *vodPlayer) handleCommand(command vodCommand, paused bool, clockSet bool, next *conn.Message) (bool, bool, *conn.Message) {
+	streamId := player.request.StreamId
+	switch {
+	case command.pause:
+		player.sendStatus("NetStream.Pause.Notify", "Paused "+player.request.Name+".")
+		return true, clockSet, next
+	case command.unpause:
+		player.sendStatus("NetStream.Unpause.Notify", "Unpaused "+player.request.Name+".")
+		return false, false, next
+	case command.seek:
+		timestamp, err := player.file.Seek(command.timestamp)
+		if err != nil {
+			logger.Get().Debugf("error seeking recording: %s", err)
+			_ = player.session.sendStatus(streamId, "error", "NetStream.Seek.Failed", "Seek failed.")
+			return paused, clockSet, next
+		}
+		player.sendStatus("NetStream.Seek.Notify", "Seeking "+player.request.Name+".")
+		player.sendStatus("NetStream.Play.Start", "Started playing "+player.request.Name+".")
+		logger.Get().Debugf("seeked %s to %d", player.request.Name, timestamp)
+		return paused, false, nil
+	}
+	return paused, clockSet, next
+}
+
+// complete tells the peer the recording ended and releases the message stream
+func (player *vodPlayer) complete() {
+	streamId := player.request.StreamId
+	duration := float64(player.file.Duration()) / 1000
+	_, err := message.NewPlayStatusMessage(streamId, "NetStream.Play.Complete", duration, player.bytesSent).Send(player.session.Conn)
+	if err == nil {
+		_, err = message.NewStreamEOFMessage(streamId).Send(player.session.Conn)
+	}
+	if err == nil {
+		err = player.session.sendStatus(streamId, "status", "NetStream.Play.Stop", "Stopped playing "+player.request.Name+".")
+	}
+	if err != nil {
+		logger.Get().Debugf("error notifying playback end: %s", err)
+	}
+	player.session.endStreamFromVODPlayer(player)
+}
+
+func (player *vodPlayer) fail(err error) {
+	logger.Get().Errorf("error playing recording of %s: %s", player.request.Name, err)
+	_ = player.session.sendStatus(player.request.StreamId, "error", "NetStream.Play.Failed", "The recording can't be played.")
+	player.session.endStreamFromVODPlayer(player)
+}
+
+func (player *vodPlayer) sendStatus(code string, description string) {
+	err := player.session.sendStatus(player.request.StreamId, "status", code, description)
+	if err != nil {
+		logger.Get().Debugf("error sending status: %s", err)
+	}
+}
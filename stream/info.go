@@ -0,0 +1,361 @@
+package stream
+
+import (
+	"rtmp/amf"
+	"rtmp/codec"
+	"rtmp/conn"
+	"rtmp/flv"
+	"time"
+)
+
+// bitrateWindow is the period the bitrate is averaged over
+const bitrateWindow = 2 * time.Second
+
+var videoCodecNames = map[uint8]string{
+	2:  "H263",
+	3:  "ScreenVideo",
+	4:  "VP6",
+	5:  "VP6A",
+	6:  "ScreenVideo2",
+	7:  "H264",
+	12: "HEVC",
+}
+
+var fourCCNames = map[string]string{
+	flv.FourCCAVC:  "H264",
+	flv.FourCCHEVC: "HEVC",
+	flv.FourCCAV1:  "AV1",
+	flv.FourCCVP9:  "VP9",
+	flv.FourCCAAC:  "AAC",
+	flv.FourCCOpus: "Opus",
+	flv.FourCCMP3:  "MP3",
+	flv.FourCCFLAC: "FLAC",
+	flv.FourCCAC3:  "AC3",
+	flv.FourCCEAC3: "EAC3",
+}
+
+var audioCodecNames = map[uint8]string{
+	0:  "PCM",
+	1:  "ADPCM",
+	2:  "MP3",
+	3:  "PCM",
+	4:  "Nellymoser",
+	5:  "Nellymoser",
+	6:  "Nellymoser",
+	7:  "G711A",
+	8:  "G711U",
+	10: "AAC",
+	11: "Speex",
+	14: "MP3",
+}
+
+// Info describes the media of a stream, from the media messages when possible and from the metadata otherwise
+type Info struct {
+	VideoCodec string
+	AudioCodec string
+	// VideoProfile, VideoLevel, ChromaFormat and the sample aspect ratio come from the sequence header only
+	VideoProfile string
+	VideoLevel   string
+	ChromaFormat string
+	SARWidth     int
+	SARHeight    int
+	Width        int
+	Height       int
+	FrameRate    float64
+	// AudioProfile is the AAC profile, such as LC or HE-AAC, from the sequence header
+	AudioProfile    string
+	AudioSampleRate int
+	AudioChannels   int
+	// Tracks are the tracks of the multitrack messages
+	Tracks []TrackInfo
+}
+
+type Stats struct {
+	BytesReceived    uint64
+	MessagesReceived uint64
+	// Bitrate is the bits per second received over the last seconds
+	Bitrate float64
+}
+
+// stats accumulates the traffic of a stream, guarded by the stream lock
+type stats struct {
+	bytesReceived    uint64
+	messagesReceived uint64
+	windowStart      time.Time
+	windowBytes      uint64
+	bitrate          float64
+	videoCodec       string
+	audioCodec       string
+	// audioSampleRate and audioChannels come from the legacy headers of the codecs without sequence header
+	audioSampleRate int
+	audioChannels   int
+}
+
+func (streamStats *stats) add(message *conn.Message, now time.Time) {
+	streamStats.bytesReceived += uint64(len(message.Data))
+	streamStats.messagesReceived++
+	if streamStats.windowStart.IsZero() {
+		streamStats.windowStart = now
+	}
+	streamStats.windowBytes += uint64(len(message.Data))
+	if elapsed := now.Sub(streamStats.windowStart); elapsed >= bitrateWindow {
+		streamStats.bitrate = float64(streamStats.windowBytes*8) / elapsed.Seconds()
+		streamStats.windowStart = now
+		streamStats.windowBytes = 0
+	}
+	if len(message.Data) == 0 {
+		return
+	}
+	if message.TypeId == flv.TagTypeVideo {
+		header, err := flv.ParseVideoTagHeader(message.Data)
+		// the tracks of a multitrack message may have different codecs
+		if err == nil && (!header.IsMultitrack || header.FourCC != "") {
+			streamStats.videoCodec = videoCodecName(header)
+		}
+	} else if message.TypeId == flv.TagTypeAudio {
+		header, err := flv.ParseAudioTagHeader(message.Data)
+		if err == nil && (!header.IsMultitrack || header.FourCC != "") {
+			streamStats.audioCodec = audioCodecName(header)
+			streamStats.audioSampleRate = header.SampleRate()
+			streamStats.audioChannels = header.Channels()
+		}
+	}
+}
+
+func (stream *Stream) Stats() Stats {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	bitrate := stream.stats.bitrate
+	if elapsed := time.Since(stream.stats.windowStart); elapsed >= bitrateWindow {
+		// the publisher stalled, the current window is more accurate than the last one
+		bitrate = float64(stream.stats.windowBytes*8) / elapsed.Seconds()
+	}
+	return Stats{
+		BytesReceived:    stream.stats.bytesReceived,
+		MessagesReceived: stream.stats.messagesReceived,
+		Bitrate:          bitrate,
+	}
+}
+
+func (stream *Stream) Info() Info {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	info := Info{}
+	if stream.Metadata != nil {
+		info = metadataInfo(stream.Metadata.Data)
+	}
+	if stream.stats.videoCodec != "" {
+		info.VideoCodec = stream.stats.videoCodec
+	}
+	// the encoders can send wrong metadata, the sequence header is what the decoders use
+	if sps := stream.sps; sps != nil {
+		info.VideoProfile = sps.Profile
+		info.VideoLevel = sps.Level
+		info.ChromaFormat = sps.ChromaFormat
+		info.SARWidth = sps.SARWidth
+		info.SARHeight = sps.SARHeight
+		info.Width = sps.Width
+		info.Height = sps.Height
+		if sps.FrameRate > 0 {
+			info.FrameRate = sps.FrameRate
+		}
+	}
+	if stream.stats.audioCodec != "" {
+		info.AudioCodec = stream.stats.audioCodec
+	}
+	if stream.stats.audioSampleRate > 0 {
+		info.AudioSampleRate = stream.stats.audioSampleRate
+		info.AudioChannels = stream.stats.audioChannels
+	}
+	if config := stream.audioConfig; config != nil {
+		info.AudioProfile = config.profile
+		info.AudioSampleRate = config.sampleRate
+		if config.channels > 0 {
+			info.AudioChannels = config.channels
+		}
+	}
+	if len(stream.trackHeaders) > 0 {
+		info.Tracks = stream.trackHeaders.info()
+	}
+	return info
+}
+
+// metadataInfo reads the onMetaData properties encoders usually send
+func metadataInfo(data []byte) Info {
+	info := Info{}
+	properties := metadataProperties(data)
+	for _, property := range properties {
+		switch value := property.Value.(type) {
+		case amf.Number:
+			switch property.Name {
+			case "width":
+				info.Width = int(value)
+			case "height":
+				info.Height = int(value)
+			case "framerate", "fps":
+				info.FrameRate = float64(value)
+			case "audiosamplerate":
+				info.AudioSampleRate = int(value)
+			case "audiochannels":
+				info.AudioChannels = int(value)
+			case "videocodecid":
+				info.VideoCodec = metadataVideoCodec(value)
+			case "audiocodecid":
+				info.AudioCodec = metadataAudioCodec(value)
+			}
+		case amf.Boolean:
+			if property.Name == "stereo" && info.AudioChannels == 0 {
+				info.AudioChannels = 1
+				if value != 0 {
+					info.AudioChannels = 2
+				}
+			}
+		case amf.String:
+			switch property.Name {
+			case "videocodecid":
+				info.VideoCodec = string(value)
+			case "audiocodecid":
+				info.AudioCodec = string(value)
+			}
+		}
+	}
+	return info
+}
+
+func metadataProperties(data []byte) []amf.ObjectProperty {
+	command, err := amf.DecodeCommand(data)
+	if err != nil {
+		return nil
+	}
+	for _, part := range command.Parts {
+		switch value := part.(type) {
+		case amf.Object:
+			return value
+		case amf.EcmaArray:
+			return value
+		}
+	}
+	return nil
+}
+
+// parseSequenceHeader parses the first sequence parameter set of an AVC or HEVC sequence header
+func parseSequenceHeader(data []byte) *codec.SPS {
+	header, err := flv.ParseVideoTagHeader(data)
+	if err != nil {
+		return nil
+	}
+	var parameterSets [][]byte
+	parse := codec.ParseH264SPS
+	codecId := header.CodecId
+	switch {
+	case header.IsExHeader && header.FourCC == flv.FourCCAVC:
+		codecId = flv.VideoCodecAVC
+	case header.IsExHeader && header.FourCC == flv.FourCCHEVC:
+		codecId = flv.VideoCodecHEVC
+	case header.IsExHeader:
+		return nil
+	}
+	switch codecId {
+	case flv.VideoCodecAVC:
+		record, err := flv.ParseAVCDecoderConfigurationRecord(data[header.Size():])
+		if err != nil {
+			return nil
+		}
+		parameterSets = record.SPS
+	case flv.VideoCodecHEVC:
+		record, err := flv.ParseHEVCDecoderConfigurationRecord(data[header.Size():])
+		if err != nil {
+			return nil
+		}
+		parameterSets, parse = record.SPS, codec.ParseHEVCSPS
+	}
+	if len(parameterSets) == 0 {
+		return nil
+	}
+	sps, err := parse(parameterSets[0])
+	if err != nil {
+		return nil
+	}
+	return sps
+}
+
+// audioConfig describes the audio of a sequence header
+type audioConfig struct {
+	profile    string
+	sampleRate int
+	channels   int
+}
+
+// parseAudioSequenceHeader parses the AudioSpecificConfig of AAC and the identification header of Opus, nil for the
+// other codecs or an invalid configuration
+func parseAudioSequenceHeader(data []byte) *audioConfig {
+	header, err := flv.ParseAudioTagHeader(data)
+	if err != nil || header.IsMultitrack {
+		return nil
+	}
+	payload := data[header.Size():]
+	switch {
+	case header.SoundFormat == flv.SoundFormatAAC, header.FourCC == flv.FourCCAAC:
+		config, err := codec.ParseAudioSpecificConfig(payload)
+		if err != nil {
+			return nil
+		}
+		return &audioConfig{profile: config.Profile(), sampleRate: config.SampleRate(), channels: config.Channels()}
+	case header.FourCC == flv.FourCCOpus:
+		head, err := codec.ParseOpusHead(payload)
+		if err != nil {
+			return nil
+		}
+		// the decoders always output 48 kHz
+		return &audioConfig{sampleRate: 48000, channels: head.Channels}
+	}
+	return nil
+}
+
+func videoCodecName(header *flv.VideoTagHeader) string {
+	if !header.IsExHeader {
+		return codecName(videoCodecNames, header.CodecId)
+	}
+	return fourCCName(header.FourCC)
+}
+
+func audioCodecName(header *flv.AudioTagHeader) string {
+	if !header.IsExHeader {
+		return codecName(audioCodecNames, header.SoundFormat)
+	}
+	return fourCCName(header.FourCC)
+}
+
+func fourCCName(fourCC string) string {
+	if name, ok := fourCCNames[fourCC]; ok {
+		return name
+	}
+	return fourCC
+}
+
+// metadataVideoCodec reads the codec id, the enhanced rtmp encoders send the FourCC as a number
+func metadataVideoCodec(value amf.Number) string {
+	if value < 256 {
+		return codecName(videoCodecNames, uint8(value))
+	}
+	return fourCCName(numberFourCC(value))
+}
+
+func metadataAudioCodec(value amf.Number) string {
+	if value < 256 {
+		return codecName(audioCodecNames, uint8(value))
+	}
+	return fourCCName(numberFourCC(value))
+}
+
+func numberFourCC(value amf.Number) string {
+	fourCC := uint32(value)
+	return string([]byte{byte(fourCC >> 24), byte(fourCC >> 16), byte(fourCC >> 8), byte(fourCC)})
+}
+
+func codecName(names map[uint8]string, codecId uint8) string {
+	if name, ok := names[codecId]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrAlreadyPublished = errors.New("stream is already being published")
+var ErrNotPublished = errors.New("stream is not being published")
+
+type Registry struct {
+	streams map[string]*Stream
+	mutex   sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		streams: make(map[string]*Stream),
+	}
+}
+
+func Key(app string, name string) string {
+	return app + "/" + name
+}
+
+func (registry *Registry) Publish(app string, name string) (*Stream, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	key := Key(app, name)
+	if _, ok := registry.streams[key]; ok {
+		return nil, ErrAlreadyPublished
+	}
+	stream := newStream(app, name)
+	registry.streams[key] = stream
+	return stream, nil
+}
+
+// Unpublish removes the stream and closes its subscribers
+func (registry *Registry) Unpublish(stream *Stream) {
+	registry.mutex.Lock()
+	if registry.streams[stream.Key()] == stream {
+		delete(registry.streams, stream.Key())
+	}
+	registry.mutex.Unlock()
+	for _, subscriber := range stream.close() {
+		_ = subscriber.Close()
+	}
+}
+
+func (registry *Registry) Get(app string, name string) (*Stream, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	stream, ok := registry.streams[Key(app, name)]
+	return stream, ok
+}
+
+func (registry *Registry) Subscribe(app string, name string, subscriber Subscriber) (*Stream, error) {
+	stream, ok := registry.Get(app, name)
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	return stream, stream.Subscribe(subscriber)
+}
+
+// Streams lists the published streams sorted by key
+func (registry *Registry) Streams() []*Stream {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	streams := make([]*Stream, 0, len(registry.streams))
+	for _, stream := range registry.streams {
+		streams = append(streams, stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Key() < streams[j].Key()
+	})
+	return streams
+}
@@ -0,0 +1,157 @@
+package stream
+
+import (
+	"rtmp/codec"
+	"rtmp/conn"
+	"rtmp/flv"
+	"sync"
+	"time"
+)
+
+// maxGopCacheMessages bounds the cache when the publisher sends keyframes too rarely
+const maxGopCacheMessages = 1024
+
+// Subscriber receives the messages of a stream, WriteMessage is called with the stream locked so it must not block
+// and Close is called once the subscriber stops receiving them
+type Subscriber interface {
+	WriteMessage(message *conn.Message) error
+	Close() error
+}
+
+type Stream struct {
+	App                 string
+	Name                string
+	PublishedAt         time.Time
+	Metadata            *conn.Message
+	AudioSequenceHeader *conn.Message
+	VideoSequenceHeader *conn.Message
+	// sps describes the video of the sequence header, nil when it can't be parsed
+	sps *codec.SPS
+	// trackHeaders are the sequence headers of the multitrack messages
+	trackHeaders TrackHeaders
+	// audioConfig describes the audio of the sequence header, nil when it can't be parsed
+	audioConfig *audioConfig
+	gop         []*conn.Message
+	subscribers map[Subscriber]struct{}
+	closed      bool
+	stats       stats
+	mutex       sync.RWMutex
+}
+
+func newStream(app string, name string) *Stream {
+	return &Stream{
+		App:          app,
+		Name:         name,
+		PublishedAt:  time.Now(),
+		subscribers:  make(map[Subscriber]struct{}),
+		trackHeaders: make(TrackHeaders),
+	}
+}
+
+func (stream *Stream) Key() string {
+	return Key(stream.App, stream.Name)
+}
+
+// Subscribe sends the cached metadata, sequence headers and last group of pictures to the subscriber
+// before any live message
+func (stream *Stream) Subscribe(subscriber Subscriber) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.closed {
+		return ErrNotPublished
+	}
+	for _, cachedMessage := range stream.cachedMessages() {
+		err := subscriber.WriteMessage(cachedMessage)
+		if err != nil {
+			return err
+		}
+	}
+	stream.subscribers[subscriber] = struct{}{}
+	return nil
+}
+
+func (stream *Stream) Unsubscribe(subscriber Subscriber) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	_, ok := stream.subscribers[subscriber]
+	delete(stream.subscribers, subscriber)
+	return ok
+}
+
+func (stream *Stream) Subscribers() []Subscriber {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	subscribers := make([]Subscriber, 0, len(stream.subscribers))
+	for subscriber := range stream.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers
+}
+
+// WriteMessage caches the message when needed for late subscribers and forwards it to every subscriber,
+// the subscribers failing to write are dropped
+func (stream *Stream) WriteMessage(message *conn.Message) {
+	stream.mutex.Lock()
+	if stream.closed {
+		stream.mutex.Unlock()
+		return
+	}
+	stream.cache(message)
+	stream.stats.add(message, time.Now())
+	failed := make([]Subscriber, 0)
+	for subscriber := range stream.subscribers {
+		err := subscriber.WriteMessage(message)
+		if err != nil {
+			delete(stream.subscribers, subscriber)
+			failed = append(failed, subscriber)
+		}
+	}
+	stream.mutex.Unlock()
+	for _, subscriber := range failed {
+		_ = subscriber.Close()
+	}
+}
+
+func (stream *Stream) cache(message *conn.Message) {
+	switch {
+	case message.TypeId == flv.TagTypeScriptData:
+		stream.Metadata = message
+	case stream.trackHeaders.Add(message):
+	case message.TypeId == flv.TagTypeAudio && flv.IsAudioSequenceHeader(message.Data):
+		stream.AudioSequenceHeader = message
+		stream.audioConfig = parseAudioSequenceHeader(message.Data)
+	case message.TypeId == flv.TagTypeVideo && flv.IsVideoSequenceHeader(message.Data):
+		stream.VideoSequenceHeader = message
+		stream.sps = parseSequenceHeader(message.Data)
+	case message.TypeId == flv.TagTypeVideo && flv.IsVideoKeyframe(message.Data):
+		stream.gop = append(stream.gop[:0], message)
+	case len(stream.gop) > 0 && len(stream.gop) < maxGopCacheMessages:
+		stream.gop = append(stream.gop, message)
+	case len(stream.gop) > 0:
+		stream.gop = stream.gop[:0]
+	}
+}
+
+func (stream *Stream) cachedMessages() []*conn.Message {
+	cachedMessages := make([]*conn.Message, 0, len(stream.gop)+len(stream.trackHeaders)+3)
+	for _, header := range []*conn.Message{stream.Metadata, stream.VideoSequenceHeader, stream.AudioSequenceHeader} {
+		if header != nil {
+			cachedMessages = append(cachedMessages, header)
+		}
+	}
+	cachedMessages = append(cachedMessages, stream.trackHeaders.Messages()...)
+	return append(cachedMessages, stream.gop...)
+}
+
+// close drops every subscriber, they are closed after the stream lock is released
+func (stream *Stream) close() []Subscriber {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.closed = true
+	subscribers := make([]Subscriber, 0, len(stream.subscribers))
+	for subscriber := range stream.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	stream.subscribers = make(map[Subscriber]struct{})
+	return subscribers
+}
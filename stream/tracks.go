@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"cmp"
+	"maps"
+	"rtmp/conn"
+	"rtmp/flv"
+	"slices"
+)
+
+// TrackKey identifies a track of the multitrack messages
+type TrackKey struct {
+	TagType uint8
+	Id      uint8
+}
+
+// TrackHeaders keeps the last sequence header of every track of the multitrack messages, one message per track
+// since a multitrack sequence header may only carry some of them
+type TrackHeaders map[TrackKey]*conn.Message
+
+// Add keeps the tracks of a multitrack sequence header, false when the message is not one
+func (headers TrackHeaders) Add(message *conn.Message) bool {
+	if !flv.IsMultitrack(message.TypeId, message.Data) {
+		return false
+	}
+	multitrack, err := flv.ParseMultitrack(message.TypeId, message.Data)
+	if err != nil || !multitrack.IsSequenceHeader() {
+		return false
+	}
+	for _, track := range multitrack.Tracks {
+		trackHeader := *message
+		trackHeader.Data = multitrack.OneTrack(track).Encode()
+		trackHeader.Length = uint32(len(trackHeader.Data))
+		headers[TrackKey{message.TypeId, track.Id}] = &trackHeader
+	}
+	return true
+}
+
+// Messages returns the headers of the video tracks then of the audio tracks, in the order of their ids
+func (headers TrackHeaders) Messages() []*conn.Message {
+	keys := slices.SortedFunc(maps.Keys(headers), func(first TrackKey, second TrackKey) int {
+		if first.TagType != second.TagType {
+			return cmp.Compare(second.TagType, first.TagType)
+		}
+		return cmp.Compare(first.Id, second.Id)
+	})
+	messages := make([]*conn.Message, 0, len(keys))
+	for _, key := range keys {
+		messages = append(messages, headers[key])
+	}
+	return messages
+}
+
+// TrackInfo describes a track of the multitrack messages
+type TrackInfo struct {
+	// Type is audio or video
+	Type  string
+	Id    int
+	Codec string
+}
+
+func (headers TrackHeaders) info() []TrackInfo {
+	tracks := make([]TrackInfo, 0, len(headers))
+	for _, header := range headers.Messages() {
+		multitrack, err := flv.ParseMultitrack(header.TypeId, header.Data)
+		if err != nil {
+			continue
+		}
+		track := multitrack.Tracks[0]
+		trackInfo := TrackInfo{Type: "audio", Id: int(track.Id), Codec: fourCCName(track.FourCC)}
+		if header.TypeId == flv.TagTypeVideo {
+			trackInfo.Type = "video"
+		}
+		tracks = append(tracks, trackInfo)
+	}
+	return tracks
+}
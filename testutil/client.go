@@ -0,0 +1,204 @@
+package testutil
+
+import (
+	"encoding/binary"
+	"net"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/message"
+	"rtmp/server"
+	"testing"
+	"time"
+)
+
+// DialTestingServer connects a client that hangs up as soon as the server closes the connection
+func DialTestingServer(t *testing.T, rtmpServer *server.Server) *conn.Conn {
+	t.Helper()
+	netConnection, err := net.Dial("tcp", rtmpServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ConnectTestingServer(t, rtmpServer, netConnection)
+}
+
+// ConnectTestingServer handshakes over a connection to any listener of the server, the client hangs up as soon as
+// the server closes the connection
+func ConnectTestingServer(t *testing.T, rtmpServer *server.Server, netConnection net.Conn) *conn.Conn {
+	t.Helper()
+	clientConn, err := conn.NewConn(netConnection, rtmpServer.DefaultMaxChunkSize, rtmpServer.DefaultNetworkTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// buffers the channels to avoid blocking
+	clientConn.Messages = make(chan *conn.Message, 100)
+	clientConn.Errors = make(chan error, 1)
+	_, err = RequestTestHandshake(t, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer clientConn.Close()
+		for {
+			_, err := message.Accept(clientConn)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+	})
+	return clientConn
+}
+
+func SendTestCommand(t *testing.T, clientConn *conn.Conn, messageStreamId uint32, parts ...amf.ValueType) {
+	t.Helper()
+	_, err := message.NewCommandMessage(messageStreamId, amf.NewCommand(parts...)).Send(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// WaitTestCommand discards the received messages until a command with the given name arrives
+func WaitTestCommand(t *testing.T, clientConn *conn.Conn, name string) *amf.Command {
+	t.Helper()
+	for {
+		select {
+		case receivedMessage := <-clientConn.Messages:
+			if receivedMessage.TypeId != message.TypeCommandMessageAmf0 {
+				continue
+			}
+			command, err := amf.DecodeCommand(receivedMessage.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(command.Parts) > 0 && command.Parts[0] == amf.NewString(name) {
+				return command
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("command %s not received", name)
+		}
+	}
+}
+
+// WaitTestStatus discards the received messages until an onStatus with the given code arrives
+func WaitTestStatus(t *testing.T, clientConn *conn.Conn, code string) *amf.Command {
+	t.Helper()
+	for {
+		command := WaitTestCommand(t, clientConn, "onStatus")
+		if len(command.Parts) < 4 {
+			continue
+		}
+		if info, ok := command.Parts[3].(amf.Object); ok && StatusCode(info) == code {
+			return command
+		}
+	}
+}
+
+// WaitTestUserControl discards the received messages until the given user control event arrives
+func WaitTestUserControl(t *testing.T, clientConn *conn.Conn, eventType uint16) uint32 {
+	t.Helper()
+	for {
+		select {
+		case receivedMessage := <-clientConn.Messages:
+			if receivedMessage.TypeId == message.TypeUserControl && binary.BigEndian.Uint16(receivedMessage.Data[0:2]) == eventType {
+				return binary.BigEndian.Uint32(receivedMessage.Data[2:6])
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("user control event %d not received", eventType)
+		}
+	}
+}
+
+func StatusCode(info amf.Object) string {
+	for _, property := range info {
+		if property.Name == "code" {
+			if code, ok := property.Value.(amf.String); ok {
+				return string(code)
+			}
+		}
+	}
+	return ""
+}
+
+// PublishTestStream connects to the testApp application and publishes a stream, returning its message stream id
+func PublishTestStream(t *testing.T, clientConn *conn.Conn, streamName string) uint32 {
+	t.Helper()
+	return PublishTestStreamWithType(t, clientConn, streamName, "live")
+}
+
+// PublishTestStreamWithType publishes with the live, record or append type
+func PublishTestStreamWithType(t *testing.T, clientConn *conn.Conn, streamName string, publishType string) uint32 {
+	t.Helper()
+	connectCommand := GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WaitTestCommand(t, clientConn, "_result")
+	SendTestCommand(t, clientConn, 0, amf.NewString("createStream"), amf.NewNumber(2), amf.NewNull())
+	result := WaitTestCommand(t, clientConn, "_result")
+	streamId := uint32(result.Parts[3].(amf.Number))
+	SendTestCommand(t, clientConn, streamId, amf.NewString("publish"), amf.NewNumber(3), amf.NewNull(), amf.NewString(streamName), amf.NewString(publishType))
+	WaitTestCommand(t, clientConn, "_result")
+	return streamId
+}
+
+// PlayTestStream connects to the testApp application and plays a stream, returning its message stream id
+// once the play started
+func PlayTestStream(t *testing.T, clientConn *conn.Conn, streamName string) uint32 {
+	t.Helper()
+	connectCommand := GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WaitTestCommand(t, clientConn, "_result")
+	SendTestCommand(t, clientConn, 0, amf.NewString("createStream"), amf.NewNumber(2), amf.NewNull())
+	result := WaitTestCommand(t, clientConn, "_result")
+	streamId := uint32(result.Parts[3].(amf.Number))
+	SendTestCommand(t, clientConn, streamId, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString(streamName))
+	WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+	return streamId
+}
+
+func SendTestMedia(t *testing.T, clientConn *conn.Conn, messageStreamId uint32, typeId uint8, timestamp uint32, data []byte) {
+	t.Helper()
+	mediaMessage := message.NewMessage(typeId, messageStreamId, data)
+	mediaMessage.Timestamp = timestamp
+	_, err := mediaMessage.Send(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// SendTestHeaders sends the metadata of a stream with its width, unless it is zero, then the video sequence header
+// and an aac sequence header
+func SendTestHeaders(t *testing.T, clientConn *conn.Conn, messageStreamId uint32, width int, videoSequenceHeader []byte) {
+	t.Helper()
+	if width > 0 {
+		metadata := amf.NewCommand(
+			amf.NewString("@setDataFrame"),
+			amf.NewString("onMetaData"),
+			amf.NewEcmaArray(amf.ObjectProperty{Name: "width", Value: amf.NewNumber(float64(width))}),
+		)
+		SendTestMedia(t, clientConn, messageStreamId, message.TypeDataMessageAmf0, 0, metadata.Encode())
+	}
+	SendTestMedia(t, clientConn, messageStreamId, message.TypeVideo, 0, videoSequenceHeader)
+	SendTestMedia(t, clientConn, messageStreamId, message.TypeAudio, 0, []byte{0xAF, 0x00, 0x12, 0x10})
+}
+
+// WaitTestMedia discards the received messages until one of the given type arrives
+func WaitTestMedia(t *testing.T, clientConn *conn.Conn, typeId uint8) *conn.Message {
+	t.Helper()
+	for {
+		select {
+		case receivedMessage := <-clientConn.Messages:
+			if receivedMessage.TypeId == typeId {
+				return receivedMessage
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message of type %d not received", typeId)
+		}
+	}
+}
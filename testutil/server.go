@@ -1,6 +1,7 @@
 package testutil
 
 import (
+	"context"
 	"net"
 	"rtmp/conn"
 	"rtmp/message"
@@ -11,13 +12,17 @@ import (
 
 func StartTestingServer(t *testing.T) *server.Server {
 	t.Helper()
-	address := "127.0.0.1:0"
-	rtmpServer := server.NewServer(address)
+	rtmpServer := server.NewServer()
+	listener, err := server.Listen(server.ListenerConfig{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rtmpServer.AddListener(listener)
 	rtmpServer.DefaultNetworkTimeout = 3 * time.Second
 	// buffers the channels to avoid blocking
 	rtmpServer.Connections = make(chan *conn.Conn, 100)
 	go func() {
-		rtmpServer.Accept()
+		_ = rtmpServer.Serve(context.Background())
 	}()
 	return rtmpServer
 }
@@ -27,7 +32,7 @@ func StartTestingServerWithHandshake(t *testing.T) (*server.Server, *conn.Conn)
 	rtmpServer := StartTestingServer(t)
 	// buffers the channels to avoid blocking
 	rtmpServer.Connections = make(chan *conn.Conn, 100)
-	netConnection, _ := net.Dial("tcp", rtmpServer.Listener.Addr().String())
+	netConnection, _ := net.Dial("tcp", rtmpServer.Addr().String())
 	err := netConnection.SetDeadline(time.Now().Add(3 * time.Second))
 	clientConn, _ := conn.NewConn(netConnection, rtmpServer.DefaultMaxChunkSize, rtmpServer.DefaultNetworkTimeout)
 	// buffers the channels to avoid blocking
@@ -37,11 +42,21 @@ func StartTestingServerWithHandshake(t *testing.T) (*server.Server, *conn.Conn)
 		t.Error(err)
 	}
 	_, err = RequestTestHandshake(t, clientConn)
+	testDone := make(chan struct{})
+	t.Cleanup(func() {
+		close(testDone)
+	})
 	go func() {
 		for {
-			_, err = message.Accept(clientConn)
+			_, err := message.Accept(clientConn)
 			if err != nil {
-				t.Error(err)
+				select {
+				case <-testDone:
+					// the test is over, the connection timing out is expected
+				default:
+					t.Error(err)
+				}
+				return
 			}
 		}
 	}()
@@ -0,0 +1,54 @@
+package vod
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"rtmp/server"
+	"strings"
+)
+
+// Directory serves the recordings stored under Root/app, a stream name is the path of its file relative to the
+// application directory with an optional flv: prefix and .flv extension, or with the mp4: prefix and an optional
+// .mp4 extension for the mp4 files
+type Directory struct {
+	Root string
+}
+
+func NewDirectory(root string) *Directory {
+	return &Directory{Root: root}
+}
+
+func (directory *Directory) Open(app string, name string) (server.VODFile, error) {
+	extension := ".flv"
+	if strings.HasPrefix(name, "mp4:") {
+		name, extension = strings.TrimPrefix(name, "mp4:"), ".mp4"
+	} else {
+		name = strings.TrimPrefix(name, "flv:")
+	}
+	if filepath.Ext(name) == "" {
+		name += extension
+	}
+	path, err := directory.path(app, name)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		return OpenFLV(path)
+	case ".mp4", ".m4v", ".m4a", ".mov", ".f4v":
+		return OpenMP4(path)
+	}
+	return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
+
+// path keeps the names sent by the peers from escaping the application directory
+func (directory *Directory) path(app string, name string) (string, error) {
+	appDirectory := filepath.Join(directory.Root, filepath.Base(filepath.Clean("/"+app)))
+	path := filepath.Join(appDirectory, name)
+	relative, err := filepath.Rel(appDirectory, path)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return path, nil
+}
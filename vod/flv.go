@@ -0,0 +1,236 @@
+package vod
+
+import (
+	"errors"
+	"io"
+	"os"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/stream"
+	"slices"
+	"sort"
+)
+
+// seekPointInterval is the minimum interval between the seek points of a recording without video
+const seekPointInterval = 1000
+
+type seekPoint struct {
+	timestamp uint32
+	position  int64
+}
+
+// FLVFile reads a recording tag by tag, the file is scanned when opened to index its keyframes and headers
+type FLVFile struct {
+	file       *os.File
+	dataStart  int64
+	metadata   *conn.Message
+	headers    []*conn.Message
+	seekPoints []seekPoint
+	duration   uint32
+	// pending holds the headers sent again after a seek
+	pending []*conn.Message
+}
+
+func OpenFLV(path string) (*FLVFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	flvFile := &FLVFile{file: file}
+	err = flvFile.scan()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return flvFile, nil
+}
+
+// scan indexes the keyframes, or the audio when there is no video, and keeps the metadata and sequence headers,
+// only the first bytes of the other tags are read
+func (flvFile *FLVFile) scan() error {
+	_, err := flv.ReadHeader(flvFile.file)
+	if err != nil {
+		return err
+	}
+	flvFile.dataStart, err = flvFile.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	position := flvFile.dataStart
+	var videoKeyframes, audioPoints []seekPoint
+	var videoHeader, audioHeader *conn.Message
+	trackHeaders := make(stream.TrackHeaders)
+	for {
+		header, err := flv.ReadTagHeader(flvFile.file)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		prefix := make([]byte, min(header.DataSize, 16))
+		_, err = io.ReadFull(flvFile.file, prefix)
+		if err != nil {
+			// a recording cut while being written is played up to its last complete tag
+			break
+		}
+		var media *conn.Message
+		if isHeader(header.Type, prefix) && (header.Type != flv.TagTypeScriptData || flvFile.metadata == nil) {
+			media, err = flvFile.readTagAt(position)
+			if err != nil {
+				break
+			}
+		}
+		switch {
+		case media != nil && header.Type == flv.TagTypeScriptData:
+			flvFile.metadata = media
+		case media != nil && trackHeaders.Add(media):
+		case media != nil && header.Type == flv.TagTypeVideo:
+			videoHeader = media
+		case media != nil && header.Type == flv.TagTypeAudio:
+			audioHeader = media
+		case header.Type == flv.TagTypeVideo && flv.IsVideoKeyframe(prefix):
+			videoKeyframes = append(videoKeyframes, seekPoint{header.Timestamp, position})
+		case header.Type == flv.TagTypeAudio:
+			if len(audioPoints) == 0 || header.Timestamp >= audioPoints[len(audioPoints)-1].timestamp+seekPointInterval {
+				audioPoints = append(audioPoints, seekPoint{header.Timestamp, position})
+			}
+		}
+		flvFile.duration = max(flvFile.duration, header.Timestamp)
+		position += int64(flv.TagHeaderSize + header.DataSize + flv.TagTrailerSize)
+		_, err = flvFile.file.Seek(position, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	flvFile.seekPoints = videoKeyframes
+	if len(videoKeyframes) == 0 {
+		flvFile.seekPoints = audioPoints
+	}
+	headers := append([]*conn.Message{flvFile.metadata, videoHeader, audioHeader}, trackHeaders.Messages()...)
+	for _, header := range headers {
+		if header != nil {
+			flvFile.headers = append(flvFile.headers, header)
+		}
+	}
+	_, err = flvFile.file.Seek(flvFile.dataStart, io.SeekStart)
+	return err
+}
+
+func (flvFile *FLVFile) readTagAt(position int64) (*conn.Message, error) {
+	_, err := flvFile.file.Seek(position, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := flv.ReadTag(flvFile.file)
+	if err != nil {
+		return nil, err
+	}
+	return tagMessage(tag), nil
+}
+
+func (flvFile *FLVFile) ReadMessage() (*conn.Message, error) {
+	if len(flvFile.pending) > 0 {
+		media := flvFile.pending[0]
+		flvFile.pending = flvFile.pending[1:]
+		return media, nil
+	}
+	for {
+		tag, err := flv.ReadTag(flvFile.file)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tag.Type == flv.TagTypeAudio || tag.Type == flv.TagTypeVideo || tag.Type == flv.TagTypeScriptData {
+			return tagMessage(tag), nil
+		}
+	}
+}
+
+func (flvFile *FLVFile) Seek(timestamp uint32) (uint32, error) {
+	// the last seek point at or before the timestamp
+	index := sort.Search(len(flvFile.seekPoints), func(i int) bool {
+		return flvFile.seekPoints[i].timestamp > timestamp
+	}) - 1
+	if index < 0 {
+		_, err := flvFile.file.Seek(flvFile.dataStart, io.SeekStart)
+		flvFile.pending = nil
+		return 0, err
+	}
+	point := flvFile.seekPoints[index]
+	_, err := flvFile.file.Seek(point.position, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	flvFile.pending = headersAt(flvFile.headers, point.timestamp)
+	return point.timestamp, nil
+}
+
+func (flvFile *FLVFile) Duration() uint32 {
+	return flvFile.duration
+}
+
+func (flvFile *FLVFile) Close() error {
+	return flvFile.file.Close()
+}
+
+// headersAt copies the headers with the timestamp of the position they are sent again at
+func headersAt(headers []*conn.Message, timestamp uint32) []*conn.Message {
+	copies := make([]*conn.Message, 0, len(headers))
+	for _, header := range headers {
+		headerCopy := *header
+		headerCopy.Timestamp = timestamp
+		copies = append(copies, &headerCopy)
+	}
+	return copies
+}
+
+func tagMessage(tag *flv.Tag) *conn.Message {
+	data := tag.Data
+	if tag.Type == flv.TagTypeScriptData && isMetadata(data) {
+		data = cleanMetadata(data)
+	}
+	return &conn.Message{
+		Length:    uint32(len(data)),
+		TypeId:    tag.Type,
+		Timestamp: tag.Timestamp,
+		Data:      data,
+	}
+}
+
+// isHeader tells the tags sent again after a seek
+func isHeader(tagType uint8, prefix []byte) bool {
+	switch tagType {
+	case flv.TagTypeScriptData:
+		return isMetadata(prefix)
+	case flv.TagTypeVideo:
+		return flv.IsVideoSequenceHeader(prefix)
+	case flv.TagTypeAudio:
+		return flv.IsAudioSequenceHeader(prefix)
+	}
+	return false
+}
+
+func isMetadata(data []byte) bool {
+	onMetaData := amf.NewString("onMetaData").Encode()
+	return len(data) > len(onMetaData) && string(data[:len(onMetaData)]) == string(onMetaData)
+}
+
+// cleanMetadata drops the padding the recorder reserves to patch the metadata in place
+func cleanMetadata(data []byte) []byte {
+	command, err := amf.DecodeCommand(data)
+	if err != nil || len(command.Parts) < 2 {
+		return data
+	}
+	properties, ok := command.Parts[1].(amf.EcmaArray)
+	if !ok {
+		return data
+	}
+	properties = slices.DeleteFunc(slices.Clone(properties), func(property amf.ObjectProperty) bool {
+		return property.Name == "_padding"
+	})
+	return amf.NewCommand(command.Parts[0], amf.NewEcmaArray(properties...)).Encode()
+}
@@ -0,0 +1,699 @@
+package vod
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/flv"
+	"slices"
+	"sort"
+)
+
+// maxMoovSize bounds the memory used by the sample tables of a file
+const maxMoovSize = 128 << 20
+
+type mp4Sample struct {
+	offset          int64
+	size            uint32
+	timestamp       uint32
+	compositionTime int32
+	video           bool
+	keyframe        bool
+}
+
+type mp4Track struct {
+	video bool
+	// fourCC is the enhanced rtmp video codec
+	fourCC string
+	// codecId is the flv audio sound format
+	codecId uint8
+	// config is the decoder configuration record of the video or the AudioSpecificConfig of aac
+	config     []byte
+	width      int
+	height     int
+	frameRate  float64
+	sampleRate int
+	channels   int
+	samples    []mp4Sample
+	// editOffset moves the samples to the presentation timeline of the edit list, in milliseconds
+	editOffset int64
+}
+
+// MP4File plays the first H.264, HEVC, AV1 or VP9 track and the first AAC or MP3 track of an ISO-BMFF file, the
+// sample tables are read when opened and the samples are converted to flv audio and video messages, with the
+// enhanced rtmp headers for the codecs other than H.264
+type MP4File struct {
+	file        *os.File
+	headers     []*conn.Message
+	samples     []mp4Sample
+	seekPoints  []int
+	position    int
+	duration    uint32
+	videoFourCC string
+	audioPrefix []byte
+	// pending holds the headers sent before the samples and again after a seek
+	pending []*conn.Message
+}
+
+func OpenMP4(path string) (*MP4File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	mp4File := &MP4File{file: file}
+	err = mp4File.load()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return mp4File, nil
+}
+
+func (mp4File *MP4File) load() error {
+	info, err := mp4File.file.Stat()
+	if err != nil {
+		return err
+	}
+	moov, err := readMoov(mp4File.file, info.Size())
+	if err != nil {
+		return err
+	}
+	boxes, err := parseBoxes(moov)
+	if err != nil {
+		return err
+	}
+	var video, audio *mp4Track
+	timescale := movieTimescale(moov)
+	for _, child := range boxes {
+		if child.boxType != "trak" {
+			continue
+		}
+		track, err := parseTrack(child.data, info.Size(), timescale)
+		if err != nil {
+			return err
+		}
+		switch {
+		case track == nil:
+		case track.video && video == nil:
+			video = track
+		case !track.video && audio == nil:
+			audio = track
+		}
+	}
+	if video == nil && audio == nil {
+		// fragmented files keep their samples out of the moov box
+		return fmt.Errorf("%w: no playable track", ErrInvalidMP4)
+	}
+	applyEditLists(video, audio)
+	for _, track := range []*mp4Track{video, audio} {
+		if track == nil {
+			continue
+		}
+		mp4File.samples = append(mp4File.samples, track.samples...)
+	}
+	// the video goes first so the seek points precede the audio of the same timestamp
+	slices.SortStableFunc(mp4File.samples, func(a, b mp4Sample) int {
+		if a.timestamp != b.timestamp {
+			return cmp.Compare(a.timestamp, b.timestamp)
+		}
+		if a.video == b.video {
+			return 0
+		}
+		if a.video {
+			return -1
+		}
+		return 1
+	})
+	for index, sample := range mp4File.samples {
+		mp4File.duration = max(mp4File.duration, sample.timestamp)
+		if video != nil && sample.video && sample.keyframe {
+			mp4File.seekPoints = append(mp4File.seekPoints, index)
+		}
+		if video == nil {
+			if len(mp4File.seekPoints) == 0 || sample.timestamp >= mp4File.samples[mp4File.seekPoints[len(mp4File.seekPoints)-1]].timestamp+seekPointInterval {
+				mp4File.seekPoints = append(mp4File.seekPoints, index)
+			}
+		}
+	}
+	mp4File.headers = mp4File.buildHeaders(moov, video, audio)
+	mp4File.pending = headersAt(mp4File.headers, 0)
+	return nil
+}
+
+// readMoov reads the movie box, it can be before or after the media data
+func readMoov(file *os.File, fileSize int64) ([]byte, error) {
+	position := int64(0)
+	header := make([]byte, 16)
+	for position+8 <= fileSize {
+		_, err := file.ReadAt(header[:8], position)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = fileSize - position
+		case 1:
+			_, err = file.ReadAt(header[8:16], position+8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || size > fileSize-position {
+			return nil, fmt.Errorf("%w: invalid %s box size", ErrInvalidMP4, header[4:8])
+		}
+		if string(header[4:8]) == "moov" {
+			if size-headerSize > maxMoovSize {
+				return nil, fmt.Errorf("%w: moov box too large", ErrInvalidMP4)
+			}
+			moov := make([]byte, size-headerSize)
+			_, err = file.ReadAt(moov, position+headerSize)
+			if err != nil {
+				return nil, err
+			}
+			return moov, nil
+		}
+		position += size
+	}
+	return nil, fmt.Errorf("%w: missing moov box", ErrInvalidMP4)
+}
+
+// parseTrack returns nil for the tracks with an unsupported codec
+func parseTrack(trak []byte, fileSize int64, movieTimescale uint32) (*mp4Track, error) {
+	mdhd, ok := findBox(trak, "mdia", "mdhd")
+	if !ok || len(mdhd) < 24 {
+		return nil, fmt.Errorf("%w: missing mdhd box", ErrInvalidMP4)
+	}
+	timescale := binary.BigEndian.Uint32(mdhd[12:16])
+	if mdhd[0] == 1 {
+		if len(mdhd) < 32 {
+			return nil, fmt.Errorf("%w: truncated mdhd box", ErrInvalidMP4)
+		}
+		timescale = binary.BigEndian.Uint32(mdhd[20:24])
+	}
+	if timescale == 0 {
+		return nil, fmt.Errorf("%w: zero timescale", ErrInvalidMP4)
+	}
+	hdlr, ok := findBox(trak, "mdia", "hdlr")
+	if !ok || len(hdlr) < 12 {
+		return nil, fmt.Errorf("%w: missing hdlr box", ErrInvalidMP4)
+	}
+	stbl, ok := findBox(trak, "mdia", "minf", "stbl")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing stbl box", ErrInvalidMP4)
+	}
+	stsd, ok := findBox(stbl, "stsd")
+	if !ok || len(stsd) < 8 {
+		return nil, fmt.Errorf("%w: missing stsd box", ErrInvalidMP4)
+	}
+	entries, err := parseBoxes(stsd[8:])
+	if err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("%w: missing sample entry", ErrInvalidMP4)
+	}
+	var track *mp4Track
+	switch string(hdlr[8:12]) {
+	case "vide":
+		track, err = parseVideoEntry(entries[0])
+	case "soun":
+		track, err = parseAudioEntry(entries[0])
+	}
+	if track == nil || err != nil {
+		return nil, err
+	}
+	track.samples, err = parseSamples(stbl, timescale, track.video, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	if track.video && len(track.samples) > 1 {
+		first, last := track.samples[0].timestamp, track.samples[len(track.samples)-1].timestamp
+		if last > first {
+			track.frameRate = float64(len(track.samples)-1) * 1000 / float64(last-first)
+		}
+	}
+	track.editOffset, err = editOffset(trak, timescale, movieTimescale)
+	if err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+// editOffset reads the edit list up to its first edit of the media, the empty edits before it delay the track and
+// its media time skips the priming samples of aac or the composition delay of the b-frames
+func editOffset(trak []byte, timescale uint32, movieTimescale uint32) (int64, error) {
+	elst, ok := findBox(trak, "edts", "elst")
+	if !ok || len(elst) == 0 {
+		return 0, nil
+	}
+	entrySize := 12
+	if elst[0] == 1 {
+		entrySize = 20
+	}
+	entries, count, err := fullBoxTable(elst, entrySize)
+	if err != nil {
+		return 0, err
+	}
+	delay := int64(0)
+	for index := range count {
+		entry := entries[index*entrySize:]
+		duration := uint64(binary.BigEndian.Uint32(entry[0:4]))
+		mediaTime := int64(int32(binary.BigEndian.Uint32(entry[4:8])))
+		if entrySize == 20 {
+			duration = binary.BigEndian.Uint64(entry[0:8])
+			mediaTime = int64(binary.BigEndian.Uint64(entry[8:16]))
+		}
+		if mediaTime == -1 {
+			if movieTimescale > 0 {
+				delay += int64(duration * 1000 / uint64(movieTimescale))
+			}
+			continue
+		}
+		return delay - mediaTime*1000/int64(timescale), nil
+	}
+	return delay, nil
+}
+
+// applyEditLists moves the samples of the tracks by their edit offset, the earliest sample then starts at zero
+// since the flv timestamps can't be negative
+func applyEditLists(tracks ...*mp4Track) {
+	earliest := int64(0)
+	for _, track := range tracks {
+		if track != nil && len(track.samples) > 0 {
+			earliest = min(earliest, int64(track.samples[0].timestamp)+track.editOffset)
+		}
+	}
+	for _, track := range tracks {
+		if track == nil {
+			continue
+		}
+		for index := range track.samples {
+			track.samples[index].timestamp = uint32(int64(track.samples[index].timestamp) + track.editOffset - earliest)
+		}
+	}
+}
+
+func parseVideoEntry(entry box) (*mp4Track, error) {
+	var fourCC, configType string
+	switch entry.boxType {
+	case "avc1", "avc3":
+		fourCC, configType = flv.FourCCAVC, "avcC"
+	case "hvc1", "hev1":
+		fourCC, configType = flv.FourCCHEVC, "hvcC"
+	case "av01":
+		fourCC, configType = flv.FourCCAV1, "av1C"
+	case "vp09":
+		fourCC, configType = flv.FourCCVP9, "vpcC"
+	default:
+		return nil, nil
+	}
+	// the visual sample entry fields precede its boxes
+	if len(entry.data) < 78 {
+		return nil, fmt.Errorf("%w: truncated %s entry", ErrInvalidMP4, entry.boxType)
+	}
+	config, ok := findBox(entry.data[78:], configType)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s box", ErrInvalidMP4, configType)
+	}
+	return &mp4Track{
+		video:  true,
+		fourCC: fourCC,
+		config: config,
+		width:  int(binary.BigEndian.Uint16(entry.data[24:26])),
+		height: int(binary.BigEndian.Uint16(entry.data[26:28])),
+	}, nil
+}
+
+func parseAudioEntry(entry box) (*mp4Track, error) {
+	if entry.boxType != "mp4a" {
+		return nil, nil
+	}
+	if len(entry.data) < 28 {
+		return nil, fmt.Errorf("%w: truncated mp4a entry", ErrInvalidMP4)
+	}
+	// the quicktime versions of the audio sample entry have more fields
+	childrenStart := 28
+	switch binary.BigEndian.Uint16(entry.data[8:10]) {
+	case 1:
+		childrenStart += 16
+	case 2:
+		childrenStart += 36
+	}
+	if len(entry.data) < childrenStart {
+		return nil, fmt.Errorf("%w: truncated mp4a entry", ErrInvalidMP4)
+	}
+	esds, ok := findBox(entry.data[childrenStart:], "esds")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing esds box", ErrInvalidMP4)
+	}
+	objectType, config, err := parseEsds(esds)
+	if err != nil {
+		return nil, err
+	}
+	track := &mp4Track{
+		channels:   int(binary.BigEndian.Uint16(entry.data[16:18])),
+		sampleRate: int(binary.BigEndian.Uint16(entry.data[24:26])),
+	}
+	switch objectType {
+	case 0x40, 0x66, 0x67, 0x68:
+		if len(config) < 2 {
+			return nil, fmt.Errorf("%w: missing AudioSpecificConfig", ErrInvalidMP4)
+		}
+		track.codecId, track.config = flv.SoundFormatAAC, config
+	case 0x69, 0x6B:
+		track.codecId = flv.SoundFormatMP3
+	default:
+		return nil, nil
+	}
+	return track, nil
+}
+
+// parseSamples resolves the sample tables into the position, timestamps and type of every sample
+func parseSamples(stbl []byte, timescale uint32, video bool, fileSize int64) ([]mp4Sample, error) {
+	stsz, ok := findBox(stbl, "stsz")
+	if !ok || len(stsz) < 12 {
+		return nil, fmt.Errorf("%w: missing stsz box", ErrInvalidMP4)
+	}
+	fixedSize := binary.BigEndian.Uint32(stsz[4:8])
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if fixedSize == 0 && count > (len(stsz)-12)/4 {
+		return nil, fmt.Errorf("%w: truncated stsz box", ErrInvalidMP4)
+	}
+	chunkOffsets, err := parseChunkOffsets(stbl)
+	if err != nil {
+		return nil, err
+	}
+	stsc, ok := findBox(stbl, "stsc")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing stsc box", ErrInvalidMP4)
+	}
+	sampleToChunk, chunkRuns, err := fullBoxTable(stsc, 12)
+	if err != nil {
+		return nil, err
+	}
+	stts, ok := findBox(stbl, "stts")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing stts box", ErrInvalidMP4)
+	}
+	timeToSample, timeRuns, err := fullBoxTable(stts, 8)
+	if err != nil {
+		return nil, err
+	}
+	// the tables are smaller than the moov box and the samples of a fixed size fit in the file
+	count = min(count, sampleCount(timeToSample, timeRuns))
+	if fixedSize > 0 {
+		count = int(min(int64(count), fileSize/int64(fixedSize)))
+	}
+	samples := make([]mp4Sample, 0, count)
+
+	// positions
+	sampleIndex := 0
+	for run := 0; run < chunkRuns && sampleIndex < count; run++ {
+		entry := sampleToChunk[run*12:]
+		firstChunk := int(binary.BigEndian.Uint32(entry[0:4]))
+		samplesPerChunk := int(binary.BigEndian.Uint32(entry[4:8]))
+		lastChunk := len(chunkOffsets)
+		if run+1 < chunkRuns {
+			lastChunk = min(lastChunk, int(binary.BigEndian.Uint32(sampleToChunk[(run+1)*12:]))-1)
+		}
+		for chunk := max(firstChunk, 1); chunk <= lastChunk && sampleIndex < count; chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for range samplesPerChunk {
+				if sampleIndex >= count {
+					break
+				}
+				size := fixedSize
+				if size == 0 {
+					size = binary.BigEndian.Uint32(stsz[12+sampleIndex*4:])
+				}
+				if offset+int64(size) > fileSize {
+					return nil, fmt.Errorf("%w: sample out of the file", ErrInvalidMP4)
+				}
+				samples = append(samples, mp4Sample{offset: offset, size: size, video: video, keyframe: true})
+				offset += int64(size)
+				sampleIndex++
+			}
+		}
+	}
+
+	// decoding timestamps
+	decodingTime := uint64(0)
+	sampleIndex = 0
+	for run := 0; run < timeRuns && sampleIndex < len(samples); run++ {
+		runCount := int(binary.BigEndian.Uint32(timeToSample[run*8:]))
+		delta := uint64(binary.BigEndian.Uint32(timeToSample[run*8+4:]))
+		for ; runCount > 0 && sampleIndex < len(samples); runCount-- {
+			samples[sampleIndex].timestamp = uint32(decodingTime * 1000 / uint64(timescale))
+			decodingTime += delta
+			sampleIndex++
+		}
+	}
+
+	// composition offsets, the version 0 offsets are unsigned but encoders write negative ones anyway
+	if ctts, ok := findBox(stbl, "ctts"); ok {
+		offsets, offsetRuns, err := fullBoxTable(ctts, 8)
+		if err != nil {
+			return nil, err
+		}
+		sampleIndex = 0
+		for run := 0; run < offsetRuns && sampleIndex < len(samples); run++ {
+			runCount := int(binary.BigEndian.Uint32(offsets[run*8:]))
+			offset := int64(int32(binary.BigEndian.Uint32(offsets[run*8+4:])))
+			for ; runCount > 0 && sampleIndex < len(samples); runCount-- {
+				samples[sampleIndex].compositionTime = int32(offset * 1000 / int64(timescale))
+				sampleIndex++
+			}
+		}
+	}
+
+	// sync samples, every sample is a sync sample without the table
+	if stss, ok := findBox(stbl, "stss"); ok && video {
+		syncSamples, syncCount, err := fullBoxTable(stss, 4)
+		if err != nil {
+			return nil, err
+		}
+		for index := range samples {
+			samples[index].keyframe = false
+		}
+		for entry := range syncCount {
+			number := int(binary.BigEndian.Uint32(syncSamples[entry*4:]))
+			if number >= 1 && number <= len(samples) {
+				samples[number-1].keyframe = true
+			}
+		}
+	}
+	return samples, nil
+}
+
+func parseChunkOffsets(stbl []byte) ([]int64, error) {
+	if stco, ok := findBox(stbl, "stco"); ok {
+		entries, count, err := fullBoxTable(stco, 4)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]int64, count)
+		for index := range offsets {
+			offsets[index] = int64(binary.BigEndian.Uint32(entries[index*4:]))
+		}
+		return offsets, nil
+	}
+	if co64, ok := findBox(stbl, "co64"); ok {
+		entries, count, err := fullBoxTable(co64, 8)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]int64, count)
+		for index := range offsets {
+			offsets[index] = int64(binary.BigEndian.Uint64(entries[index*8:]))
+		}
+		return offsets, nil
+	}
+	return nil, fmt.Errorf("%w: missing chunk offsets", ErrInvalidMP4)
+}
+
+func sampleCount(timeToSample []byte, runs int) int {
+	count := 0
+	for run := range runs {
+		count += int(binary.BigEndian.Uint32(timeToSample[run*8:]))
+	}
+	return count
+}
+
+// buildHeaders returns the metadata and the sequence headers sent before the samples
+func (mp4File *MP4File) buildHeaders(moov []byte, video *mp4Track, audio *mp4Track) []*conn.Message {
+	properties := []amf.ObjectProperty{
+		{Name: "duration", Value: amf.NewNumber(movieDuration(moov, mp4File.duration))},
+	}
+	headers := make([]*conn.Message, 0, 3)
+	var videoHeader, audioHeader []byte
+	if video != nil {
+		mp4File.videoFourCC = video.fourCC
+		// the enhanced rtmp codecs are identified by their FourCC as a number
+		codecId := float64(binary.BigEndian.Uint32([]byte(video.fourCC)))
+		if video.fourCC == flv.FourCCAVC {
+			codecId = float64(flv.VideoCodecAVC)
+		}
+		properties = append(properties,
+			amf.ObjectProperty{Name: "width", Value: amf.NewNumber(float64(video.width))},
+			amf.ObjectProperty{Name: "height", Value: amf.NewNumber(float64(video.height))},
+			amf.ObjectProperty{Name: "framerate", Value: amf.NewNumber(video.frameRate)},
+			amf.ObjectProperty{Name: "videocodecid", Value: amf.NewNumber(codecId)},
+		)
+		header := videoTagHeader(video.fourCC, true, true, 0)
+		videoHeader = append(header.Encode(), video.config...)
+	}
+	if audio != nil {
+		tagHeader := audioTagHeader(audio)
+		properties = append(properties,
+			amf.ObjectProperty{Name: "audiocodecid", Value: amf.NewNumber(float64(audio.codecId))},
+			amf.ObjectProperty{Name: "audiosamplerate", Value: amf.NewNumber(float64(audio.sampleRate))},
+			amf.ObjectProperty{Name: "audiochannels", Value: amf.NewNumber(float64(audio.channels))},
+		)
+		mp4File.audioPrefix = []byte{tagHeader}
+		if audio.codecId == flv.SoundFormatAAC {
+			mp4File.audioPrefix = []byte{tagHeader, flv.AACPacketTypeRaw}
+			audioHeader = append([]byte{tagHeader, flv.AACPacketTypeSequenceHeader}, audio.config...)
+		}
+	}
+	metadata := amf.NewCommand(amf.NewString("onMetaData"), amf.NewEcmaArray(properties...)).Encode()
+	headers = append(headers, &conn.Message{Length: uint32(len(metadata)), TypeId: flv.TagTypeScriptData, Data: metadata})
+	if videoHeader != nil {
+		headers = append(headers, &conn.Message{Length: uint32(len(videoHeader)), TypeId: flv.TagTypeVideo, Data: videoHeader})
+	}
+	if audioHeader != nil {
+		headers = append(headers, &conn.Message{Length: uint32(len(audioHeader)), TypeId: flv.TagTypeAudio, Data: audioHeader})
+	}
+	return headers
+}
+
+// videoTagHeader returns the header of the video tags, H.264 keeps the legacy header every player understands
+func videoTagHeader(fourCC string, sequenceHeader bool, keyframe bool, compositionTime int32) flv.VideoTagHeader {
+	header := flv.VideoTagHeader{FrameType: flv.FrameTypeInterFrame, CompositionTime: compositionTime}
+	if keyframe {
+		header.FrameType = flv.FrameTypeKeyframe
+	}
+	if fourCC == flv.FourCCAVC {
+		header.CodecId, header.AVCPacketType = flv.VideoCodecAVC, flv.AVCPacketTypeNALU
+		if sequenceHeader {
+			header.AVCPacketType = flv.AVCPacketTypeSequenceHeader
+		}
+		return header
+	}
+	header.IsExHeader, header.FourCC, header.PacketType = true, fourCC, flv.VideoPacketTypeCodedFrames
+	if sequenceHeader {
+		header.PacketType = flv.VideoPacketTypeSequenceStart
+	}
+	return header
+}
+
+// movieTimescale reads the timescale of the mvhd box the durations of the edit lists are in
+func movieTimescale(moov []byte) uint32 {
+	mvhd, ok := findBox(moov, "mvhd")
+	if ok && len(mvhd) >= 16 && mvhd[0] == 0 {
+		return binary.BigEndian.Uint32(mvhd[12:16])
+	}
+	if ok && len(mvhd) >= 24 && mvhd[0] == 1 {
+		return binary.BigEndian.Uint32(mvhd[20:24])
+	}
+	return 0
+}
+
+// movieDuration reads the duration in seconds of the mvhd box, or uses the last timestamp without it
+func movieDuration(moov []byte, lastTimestamp uint32) float64 {
+	mvhd, ok := findBox(moov, "mvhd")
+	if ok && len(mvhd) >= 20 && mvhd[0] == 0 && binary.BigEndian.Uint32(mvhd[12:16]) > 0 {
+		return float64(binary.BigEndian.Uint32(mvhd[16:20])) / float64(binary.BigEndian.Uint32(mvhd[12:16]))
+	}
+	if ok && len(mvhd) >= 32 && mvhd[0] == 1 && binary.BigEndian.Uint32(mvhd[20:24]) > 0 {
+		return float64(binary.BigEndian.Uint64(mvhd[24:32])) / float64(binary.BigEndian.Uint32(mvhd[20:24]))
+	}
+	return float64(lastTimestamp) / 1000
+}
+
+// audioTagHeader returns the first byte of the flv audio tags, aac is always flagged as 44 kHz stereo
+func audioTagHeader(audio *mp4Track) byte {
+	if audio.codecId == flv.SoundFormatAAC {
+		return flv.SoundFormatAAC<<4 | 0x0F
+	}
+	rate := byte(0)
+	switch {
+	case audio.sampleRate >= 44100:
+		rate = 3
+	case audio.sampleRate >= 22050:
+		rate = 2
+	case audio.sampleRate >= 11025:
+		rate = 1
+	}
+	stereo := byte(0)
+	if audio.channels > 1 {
+		stereo = 1
+	}
+	return audio.codecId<<4 | rate<<2 | 1<<1 | stereo
+}
+
+func (mp4File *MP4File) ReadMessage() (*conn.Message, error) {
+	if len(mp4File.pending) > 0 {
+		media := mp4File.pending[0]
+		mp4File.pending = mp4File.pending[1:]
+		return media, nil
+	}
+	if mp4File.position >= len(mp4File.samples) {
+		return nil, io.EOF
+	}
+	sample := mp4File.samples[mp4File.position]
+	mp4File.position++
+	var prefix []byte
+	typeId := flv.TagTypeAudio
+	if sample.video {
+		header := videoTagHeader(mp4File.videoFourCC, false, sample.keyframe, sample.compositionTime)
+		prefix = header.Encode()
+		typeId = flv.TagTypeVideo
+	} else {
+		prefix = mp4File.audioPrefix
+	}
+	data := make([]byte, len(prefix)+int(sample.size))
+	copy(data, prefix)
+	_, err := mp4File.file.ReadAt(data[len(prefix):], sample.offset)
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn.Message{
+		Length:    uint32(len(data)),
+		TypeId:    typeId,
+		Timestamp: sample.timestamp,
+		Data:      data,
+	}, nil
+}
+
+func (mp4File *MP4File) Seek(timestamp uint32) (uint32, error) {
+	// the last seek point at or before the timestamp
+	index := sort.Search(len(mp4File.seekPoints), func(i int) bool {
+		return mp4File.samples[mp4File.seekPoints[i]].timestamp > timestamp
+	}) - 1
+	if index < 0 {
+		mp4File.position = 0
+		mp4File.pending = headersAt(mp4File.headers, 0)
+		return 0, nil
+	}
+	mp4File.position = mp4File.seekPoints[index]
+	pointTimestamp := mp4File.samples[mp4File.position].timestamp
+	mp4File.pending = headersAt(mp4File.headers, pointTimestamp)
+	return pointTimestamp, nil
+}
+
+func (mp4File *MP4File) Duration() uint32 {
+	return mp4File.duration
+}
+
+func (mp4File *MP4File) Close() error {
+	return mp4File.file.Close()
+}
@@ -0,0 +1,155 @@
+package vod
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidMP4 = errors.New("vod: invalid mp4 file")
+
+type box struct {
+	boxType string
+	data    []byte
+}
+
+// parseBoxes splits the payload of a container box in its children
+func parseBoxes(data []byte) ([]box, error) {
+	boxes := make([]box, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated box header", ErrInvalidMP4)
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of its parent
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: truncated %s box header", ErrInvalidMP4, boxType)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: invalid %s box size", ErrInvalidMP4, boxType)
+		}
+		boxes = append(boxes, box{boxType: boxType, data: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findBox walks the nested containers down the path and returns the payload of the last box
+func findBox(data []byte, path ...string) ([]byte, bool) {
+	for _, boxType := range path {
+		boxes, err := parseBoxes(data)
+		if err != nil {
+			return nil, false
+		}
+		found := false
+		for _, child := range boxes {
+			if child.boxType == boxType {
+				data, found = child.data, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// fullBoxTable returns the entries of a table preceded by the version, flags and entry count
+func fullBoxTable(data []byte, entrySize int) ([]byte, int, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("%w: truncated table", ErrInvalidMP4)
+	}
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	if count > (len(data)-8)/entrySize {
+		return nil, 0, fmt.Errorf("%w: truncated table", ErrInvalidMP4)
+	}
+	return data[8:], count, nil
+}
+
+// readDescriptor reads an MPEG-4 descriptor of the esds box, its length spans up to 4 bytes
+func readDescriptor(data []byte) (tag byte, payload []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("%w: truncated descriptor", ErrInvalidMP4)
+	}
+	tag = data[0]
+	length := 0
+	position := 1
+	for range 4 {
+		if position >= len(data) {
+			return 0, nil, nil, fmt.Errorf("%w: truncated descriptor", ErrInvalidMP4)
+		}
+		length = length<<7 | int(data[position]&0x7F)
+		position++
+		if data[position-1]&0x80 == 0 {
+			break
+		}
+	}
+	if length > len(data)-position {
+		return 0, nil, nil, fmt.Errorf("%w: truncated descriptor", ErrInvalidMP4)
+	}
+	return tag, data[position : position+length], data[position+length:], nil
+}
+
+// parseEsds returns the object type and the decoder specific info, the AudioSpecificConfig for AAC
+func parseEsds(data []byte) (objectType byte, config []byte, err error) {
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("%w: truncated esds box", ErrInvalidMP4)
+	}
+	tag, esDescriptor, _, err := readDescriptor(data[4:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x03 || len(esDescriptor) < 3 {
+		return 0, nil, fmt.Errorf("%w: missing es descriptor", ErrInvalidMP4)
+	}
+	flags := esDescriptor[2]
+	esDescriptor = esDescriptor[3:]
+	if flags&0x80 != 0 {
+		// depends on stream
+		esDescriptor = esDescriptor[min(2, len(esDescriptor)):]
+	}
+	if flags&0x40 != 0 && len(esDescriptor) > 0 {
+		// url
+		esDescriptor = esDescriptor[min(1+int(esDescriptor[0]), len(esDescriptor)):]
+	}
+	if flags&0x20 != 0 {
+		// ocr stream
+		esDescriptor = esDescriptor[min(2, len(esDescriptor)):]
+	}
+	for len(esDescriptor) > 0 {
+		var payload []byte
+		tag, payload, esDescriptor, err = readDescriptor(esDescriptor)
+		if err != nil {
+			return 0, nil, err
+		}
+		if tag != 0x04 {
+			continue
+		}
+		if len(payload) < 13 {
+			return 0, nil, fmt.Errorf("%w: truncated decoder config", ErrInvalidMP4)
+		}
+		objectType = payload[0]
+		specific := payload[13:]
+		for len(specific) > 0 {
+			tag, payload, specific, err = readDescriptor(specific)
+			if err != nil {
+				return 0, nil, err
+			}
+			if tag == 0x05 {
+				return objectType, payload, nil
+			}
+		}
+		return objectType, nil, nil
+	}
+	return 0, nil, fmt.Errorf("%w: missing decoder config", ErrInvalidMP4)
+}
@@ -0,0 +1,255 @@
+package vod_test
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"rtmp/amf"
+	"rtmp/message"
+	"rtmp/testutil"
+	"rtmp/vod"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testAvcC = []byte{1, 0x64, 0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x64, 0, 0x1F, 1, 0, 2, 0x68, 0xEE}
+	testAsc  = []byte{0x12, 0x10}
+)
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	data = append(data, boxType...)
+	for _, payload := range payloads {
+		data = append(data, payload...)
+	}
+	return data
+}
+
+func uint32s(values ...uint32) []byte {
+	data := make([]byte, 0, 4*len(values))
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+func mp4Track(handler string, timescale uint32, entry []byte, edits []uint32, chunkOffset uint32, sizes []uint32, deltas []uint32, extra ...[]byte) []byte {
+	sampleSizes := uint32s(0, 0, uint32(len(sizes)))
+	timeToSample := uint32s(0, uint32(len(deltas)))
+	for index, size := range sizes {
+		sampleSizes = append(sampleSizes, uint32s(size)...)
+		timeToSample = append(timeToSample, uint32s(1, deltas[index])...)
+	}
+	tables := [][]byte{
+		mp4Box("stsd", uint32s(0, 1), entry),
+		mp4Box("stts", timeToSample),
+		mp4Box("stsc", uint32s(0, 1, 1, uint32(len(sizes)), 1)),
+		mp4Box("stsz", sampleSizes),
+		mp4Box("stco", uint32s(0, 1, chunkOffset)),
+	}
+	tables = append(tables, extra...)
+	children := [][]byte{}
+	if len(edits) > 0 {
+		// the edits are pairs of a segment duration and a media time, at the normal rate
+		editList := uint32s(0, uint32(len(edits)/2))
+		for index := 0; index < len(edits); index += 2 {
+			editList = append(editList, uint32s(edits[index], edits[index+1], 1<<16)...)
+		}
+		children = append(children, mp4Box("edts", mp4Box("elst", editList)))
+	}
+	children = append(children, mp4Box("mdia",
+		mp4Box("mdhd", uint32s(0, 0, 0, timescale, 0, 0)),
+		mp4Box("hdlr", uint32s(0, 0), []byte(handler), make([]byte, 13)),
+		mp4Box("minf", mp4Box("stbl", tables...)),
+	))
+	return mp4Box("trak", children...)
+}
+
+// writeTestMP4 writes three video frames with a b-frame and two aac frames, the moov box follows the media data
+func writeTestMP4(t *testing.T, path string) {
+	t.Helper()
+	writeTestMP4WithEdits(t, path, nil, nil)
+}
+
+// writeTestMP4WithEdits writes the test file with the edit lists of the video and the audio
+func writeTestMP4WithEdits(t *testing.T, path string, videoEdits []uint32, audioEdits []uint32) {
+	t.Helper()
+	videoSamples := [][]byte{{0, 0, 0, 1, 0x65}, {0, 0, 0, 1, 0x41, 0x9A}, {0, 0, 0, 1, 0x65, 0x88}}
+	audioSamples := [][]byte{{0x21, 0x10}, {0x21, 0x20, 0x30}}
+	ftyp := mp4Box("ftyp", []byte("isom"), uint32s(512), []byte("isomavc1"))
+	mdatPayload := make([]byte, 0)
+	videoSizes, audioSizes := make([]uint32, 0), make([]uint32, 0)
+	for _, sample := range videoSamples {
+		mdatPayload = append(mdatPayload, sample...)
+		videoSizes = append(videoSizes, uint32(len(sample)))
+	}
+	audioOffset := uint32(len(ftyp) + 8 + len(mdatPayload))
+	for _, sample := range audioSamples {
+		mdatPayload = append(mdatPayload, sample...)
+		audioSizes = append(audioSizes, uint32(len(sample)))
+	}
+	mdat := mp4Box("mdat", mdatPayload)
+
+	visualEntry := make([]byte, 78)
+	binary.BigEndian.PutUint16(visualEntry[6:8], 1)
+	binary.BigEndian.PutUint16(visualEntry[24:26], 1280)
+	binary.BigEndian.PutUint16(visualEntry[26:28], 720)
+	audioEntry := make([]byte, 28)
+	binary.BigEndian.PutUint16(audioEntry[6:8], 1)
+	binary.BigEndian.PutUint16(audioEntry[16:18], 2)
+	binary.BigEndian.PutUint16(audioEntry[18:20], 16)
+	binary.BigEndian.PutUint32(audioEntry[24:28], 44100<<16)
+	decoderConfig := append([]byte{0x04, byte(13 + 2 + len(testAsc)), 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, append([]byte{0x05, byte(len(testAsc))}, testAsc...)...)
+	esDescriptor := append([]byte{0x03, 0x80, 0x80, 0x80, byte(3 + len(decoderConfig) + 3), 0, 1, 0}, decoderConfig...)
+	esDescriptor = append(esDescriptor, 0x06, 1, 2)
+
+	moov := mp4Box("moov",
+		mp4Box("mvhd", uint32s(0, 0, 0, 1000, 120), make([]byte, 80)),
+		mp4Track("vide", 90000, mp4Box("avc1", visualEntry, mp4Box("avcC", testAvcC)), videoEdits, uint32(len(ftyp)+8), videoSizes, []uint32{3600, 3600, 3600},
+			mp4Box("ctts", uint32s(0, 3, 1, 7200, 1, 0, 1, 3600)),
+			mp4Box("stss", uint32s(0, 2, 1, 3)),
+		),
+		mp4Track("soun", 44100, mp4Box("mp4a", audioEntry, mp4Box("esds", uint32s(0), esDescriptor)), audioEdits, audioOffset, audioSizes, []uint32{1024, 1024}),
+	)
+	contents := append(append(ftyp, mdat...), moov...)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, contents, 0o644))
+}
+
+func TestMP4File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mp4")
+	writeTestMP4(t, path)
+	file, err := vod.OpenMP4(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, uint32(80), file.Duration())
+
+	metadata, err := file.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, message.TypeDataMessageAmf0, metadata.TypeId)
+	command, err := amf.DecodeCommand(metadata.Data)
+	assert.NoError(t, err)
+	properties := map[string]amf.ValueType{}
+	for _, property := range command.Parts[1].(amf.EcmaArray) {
+		properties[property.Name] = property.Value
+	}
+	assert.Equal(t, amf.NewNumber(0.12), properties["duration"])
+	assert.Equal(t, amf.NewNumber(1280), properties["width"])
+	assert.Equal(t, amf.NewNumber(720), properties["height"])
+	assert.Equal(t, amf.NewNumber(25), properties["framerate"])
+	assert.Equal(t, amf.NewNumber(7), properties["videocodecid"])
+	assert.Equal(t, amf.NewNumber(10), properties["audiocodecid"])
+	assert.Equal(t, amf.NewNumber(44100), properties["audiosamplerate"])
+	assert.Equal(t, amf.NewNumber(2), properties["audiochannels"])
+
+	expected := []struct {
+		typeId    uint8
+		timestamp uint32
+		data      []byte
+	}{
+		{message.TypeVideo, 0, append([]byte{0x17, 0, 0, 0, 0}, testAvcC...)},
+		{message.TypeAudio, 0, append([]byte{0xAF, 0}, testAsc...)},
+		{message.TypeVideo, 0, []byte{0x17, 1, 0, 0, 80, 0, 0, 0, 1, 0x65}},
+		{message.TypeAudio, 0, []byte{0xAF, 1, 0x21, 0x10}},
+		{message.TypeAudio, 23, []byte{0xAF, 1, 0x21, 0x20, 0x30}},
+		{message.TypeVideo, 40, []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 1, 0x41, 0x9A}},
+		{message.TypeVideo, 80, []byte{0x17, 1, 0, 0, 40, 0, 0, 0, 1, 0x65, 0x88}},
+	}
+	for _, expectedMessage := range expected {
+		media, err := file.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expectedMessage.typeId, media.TypeId)
+		assert.Equal(t, expectedMessage.timestamp, media.Timestamp)
+		assert.Equal(t, expectedMessage.data, media.Data)
+		assert.Equal(t, uint32(len(media.Data)), media.Length)
+	}
+	_, err = file.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// the keyframe before the timestamp and the headers again
+	timestamp, err := file.Seek(60)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), timestamp)
+	timestamp, err = file.Seek(90)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(80), timestamp)
+	for _, typeId := range []uint8{message.TypeDataMessageAmf0, message.TypeVideo, message.TypeAudio, message.TypeVideo} {
+		media, err := file.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, typeId, media.TypeId)
+		assert.Equal(t, uint32(80), media.Timestamp)
+	}
+	_, err = file.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestMP4FileEditLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "edits.mp4")
+	// the video skips the 40 ms composition delay, the audio waits 10 ms then skips its 1024 priming samples
+	writeTestMP4WithEdits(t, path, []uint32{120, 3600}, []uint32{10, 0xFFFFFFFF, 110, 1024})
+	file, err := vod.OpenMP4(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	for range 3 {
+		_, err = file.ReadMessage()
+		assert.NoError(t, err)
+	}
+	type sample struct {
+		typeId    uint8
+		timestamp uint32
+	}
+	received := make([]sample, 0)
+	for {
+		media, err := file.ReadMessage()
+		if err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+		received = append(received, sample{media.TypeId, media.Timestamp})
+	}
+	// the video is moved back by 40 ms and the audio by 13 ms, then both by 40 ms to start at zero
+	assert.Equal(t, []sample{
+		{message.TypeVideo, 0},
+		{message.TypeAudio, 27},
+		{message.TypeVideo, 40},
+		{message.TypeAudio, 50},
+		{message.TypeVideo, 80},
+	}, received)
+}
+
+func TestInvalidMP4(t *testing.T) {
+	directory := t.TempDir()
+	contents := map[string][]byte{
+		"empty.mp4":     {},
+		"no-moov.mp4":   mp4Box("ftyp", []byte("isom")),
+		"oversized.mp4": append(uint32s(1000), []byte("moov")...),
+		"no-tracks.mp4": mp4Box("moov", mp4Box("mvhd", make([]byte, 100))),
+	}
+	for name, data := range contents {
+		path := filepath.Join(directory, name)
+		assert.NoError(t, os.WriteFile(path, data, 0o644))
+		_, err := vod.OpenMP4(path)
+		assert.ErrorIs(t, err, vod.ErrInvalidMP4, name)
+	}
+}
+
+func TestPlayMP4(t *testing.T) {
+	testServer, root := startTestingVODServer(t)
+	writeTestMP4(t, filepath.Join(root, "testApp", "movie.mp4"))
+	clientConn := testutil.DialTestingServer(t, testServer)
+	playTestRecording(t, clientConn, "mp4:movie")
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+
+	received, playStatus := waitTestPlayStatus(t, clientConn)
+	assert.Equal(t, "NetStream.Play.Complete", testutil.StatusCode(playStatus))
+	assert.Len(t, received, 8)
+	assert.Equal(t, []byte{0x17, 0, 0, 0, 0}, received[1].Data[:5])
+	assert.Equal(t, []byte{0x17, 1, 0, 0, 40, 0, 0, 0, 1, 0x65, 0x88}, received[7].Data)
+}
@@ -0,0 +1,239 @@
+package vod_test
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"rtmp/amf"
+	"rtmp/conn"
+	"rtmp/flv"
+	"rtmp/message"
+	"rtmp/server"
+	"rtmp/testutil"
+	"rtmp/vod"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestRecording writes a recording with a keyframe every interval until the duration
+func writeTestRecording(t *testing.T, path string, interval uint32, duration uint32) {
+	t.Helper()
+	contents := flv.Header{HasAudio: true, HasVideo: true}.Encode()
+	metadata := amf.NewCommand(amf.NewString("onMetaData"), amf.NewEcmaArray(
+		amf.ObjectProperty{Name: "duration", Value: amf.NewNumber(float64(duration) / 1000)},
+		amf.ObjectProperty{Name: "_padding", Value: amf.NewString("    ")},
+	))
+	tags := []flv.Tag{
+		{Type: flv.TagTypeScriptData, Data: metadata.Encode()},
+		{Type: flv.TagTypeVideo, Data: []byte{0x17, 0x00, 0, 0, 0, 1, 0x64, 0, 0x1F}},
+		{Type: flv.TagTypeAudio, Data: []byte{0xAF, 0x00, 0x12, 0x10}},
+	}
+	for timestamp := uint32(0); timestamp < duration; timestamp += interval {
+		tags = append(tags,
+			flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp, Data: []byte{0x17, 0x01, 0, 0, 0, 0x65}},
+			flv.Tag{Type: flv.TagTypeAudio, Timestamp: timestamp, Data: []byte{0xAF, 0x01, 0x21}},
+			flv.Tag{Type: flv.TagTypeVideo, Timestamp: timestamp + interval/2, Data: []byte{0x27, 0x01, 0, 0, 0, 0x41}},
+		)
+	}
+	for _, tag := range tags {
+		contents = append(contents, tag.Encode()...)
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, contents, 0o644))
+}
+
+func startTestingVODServer(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	testServer := testutil.StartTestingServer(t)
+	root := t.TempDir()
+	testServer.VOD = vod.NewDirectory(root)
+	testServer.PlaybackBurst = 0
+	return testServer, root
+}
+
+func playTestRecording(t *testing.T, clientConn *conn.Conn, name string, arguments ...amf.ValueType) uint32 {
+	t.Helper()
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.NoError(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 0, amf.NewString("createStream"), amf.NewNumber(2), amf.NewNull())
+	result := testutil.WaitTestCommand(t, clientConn, "_result")
+	streamId := uint32(result.Parts[3].(amf.Number))
+	parts := append([]amf.ValueType{amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString(name)}, arguments...)
+	testutil.SendTestCommand(t, clientConn, streamId, parts...)
+	return streamId
+}
+
+// waitTestPlayStatus collects the media received until the onPlayStatus message
+func waitTestPlayStatus(t *testing.T, clientConn *conn.Conn) ([]*conn.Message, amf.Object) {
+	t.Helper()
+	received := make([]*conn.Message, 0)
+	for {
+		select {
+		case receivedMessage := <-clientConn.Messages:
+			if receivedMessage.TypeId == message.TypeDataMessageAmf0 {
+				command, err := amf.DecodeCommand(receivedMessage.Data)
+				assert.NoError(t, err)
+				if command.Parts[0] == amf.NewString("onPlayStatus") {
+					return received, command.Parts[1].(amf.Object)
+				}
+			}
+			if receivedMessage.TypeId == message.TypeAudio || receivedMessage.TypeId == message.TypeVideo || receivedMessage.TypeId == message.TypeDataMessageAmf0 {
+				received = append(received, receivedMessage)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("onPlayStatus not received")
+		}
+	}
+}
+
+func TestFLVFileSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.flv")
+	writeTestRecording(t, path, 1000, 3000)
+	file, err := vod.OpenFLV(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, uint32(2500), file.Duration())
+
+	metadata, err := file.ReadMessage()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(metadata.Data), "_padding")
+
+	timestamp, err := file.Seek(1500)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1000), timestamp)
+	expected := []struct {
+		typeId    uint8
+		timestamp uint32
+		first     byte
+	}{
+		{flv.TagTypeScriptData, 1000, 0x02},
+		{flv.TagTypeVideo, 1000, 0x17},
+		{flv.TagTypeAudio, 1000, 0xAF},
+		{flv.TagTypeVideo, 1000, 0x17},
+		{flv.TagTypeAudio, 1000, 0xAF},
+		{flv.TagTypeVideo, 1500, 0x27},
+	}
+	for _, expectedMessage := range expected {
+		media, err := file.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expectedMessage.typeId, media.TypeId)
+		assert.Equal(t, expectedMessage.timestamp, media.Timestamp)
+		assert.Equal(t, expectedMessage.first, media.Data[0])
+	}
+
+	timestamp, err = file.Seek(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), timestamp)
+	media, err := file.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, flv.TagTypeScriptData, media.TypeId)
+
+	_, err = file.Seek(2900)
+	assert.NoError(t, err)
+	for range 6 {
+		_, err = file.ReadMessage()
+		assert.NoError(t, err)
+	}
+	_, err = file.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDirectoryOpen(t *testing.T) {
+	root := t.TempDir()
+	writeTestRecording(t, filepath.Join(root, "testApp", "test.flv"), 1000, 1000)
+	directory := vod.NewDirectory(root)
+	for _, name := range []string{"test", "test.flv", "flv:test"} {
+		file, err := directory.Open("testApp", name)
+		assert.NoError(t, err, name)
+		_ = file.Close()
+	}
+	for _, name := range []string{"missing", "../otherApp/test", "../../test", "test.txt"} {
+		_, err := directory.Open("testApp", name)
+		assert.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+}
+
+func TestPlayRecording(t *testing.T) {
+	testServer, root := startTestingVODServer(t)
+	writeTestRecording(t, filepath.Join(root, "testApp", "recorded.flv"), 100, 300)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	startedAt := time.Now()
+	streamId := playTestRecording(t, clientConn, "recorded")
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Reset")
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+
+	received, playStatus := waitTestPlayStatus(t, clientConn)
+	// the media is paced in real time
+	assert.GreaterOrEqual(t, time.Since(startedAt), 250*time.Millisecond)
+	assert.Len(t, received, 12)
+	assert.Equal(t, uint32(250), received[11].Timestamp)
+	assert.Equal(t, streamId, received[11].StreamId)
+	assert.Equal(t, "NetStream.Play.Complete", testutil.StatusCode(playStatus))
+	assert.Equal(t, streamId, testutil.WaitTestUserControl(t, clientConn, message.UserControlStreamEOF))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Stop")
+}
+
+func TestPlayRecordingStartAndDuration(t *testing.T) {
+	testServer, root := startTestingVODServer(t)
+	writeTestRecording(t, filepath.Join(root, "testApp", "recorded.flv"), 100, 1000)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	playTestRecording(t, clientConn, "recorded", amf.NewNumber(0.45), amf.NewNumber(0.2))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+
+	received, _ := waitTestPlayStatus(t, clientConn)
+	// the playback starts at the keyframe before the start and lasts the duration
+	assert.Equal(t, uint32(400), received[0].Timestamp)
+	assert.Equal(t, byte(0x17), received[3].Data[0])
+	assert.Equal(t, uint32(400), received[3].Timestamp)
+	assert.Equal(t, uint32(600), received[len(received)-1].Timestamp)
+}
+
+func TestPauseAndSeekRecording(t *testing.T) {
+	testServer, root := startTestingVODServer(t)
+	writeTestRecording(t, filepath.Join(root, "testApp", "recorded.flv"), 1000, 60000)
+	clientConn := testutil.DialTestingServer(t, testServer)
+	streamId := playTestRecording(t, clientConn, "recorded")
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+	testutil.WaitTestMedia(t, clientConn, message.TypeVideo)
+
+	testutil.SendTestCommand(t, clientConn, streamId, amf.NewString("pause"), amf.NewNumber(0), amf.NewNull(), amf.NewBoolean(1), amf.NewNumber(0))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Pause.Notify")
+	testutil.SendTestCommand(t, clientConn, streamId, amf.NewString("seek"), amf.NewNumber(0), amf.NewNull(), amf.NewNumber(30500))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Seek.Notify")
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Play.Start")
+	select {
+	case receivedMessage := <-clientConn.Messages:
+		if receivedMessage.TypeId == message.TypeVideo {
+			t.Fatal("media received while paused")
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+	testutil.SendTestCommand(t, clientConn, streamId, amf.NewString("pause"), amf.NewNumber(0), amf.NewNull(), amf.NewBoolean(0), amf.NewNumber(0))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Unpause.Notify")
+	// the sequence headers come again before the keyframe
+	videoHeader := testutil.WaitTestMedia(t, clientConn, message.TypeVideo)
+	assert.Equal(t, byte(0x00), videoHeader.Data[1])
+	keyframe := testutil.WaitTestMedia(t, clientConn, message.TypeVideo)
+	assert.Equal(t, uint32(30000), keyframe.Timestamp)
+	assert.Equal(t, byte(0x17), keyframe.Data[0])
+}
+
+func TestPlayPrefersLiveStream(t *testing.T) {
+	testServer, root := startTestingVODServer(t)
+	writeTestRecording(t, filepath.Join(root, "testApp", "testStream.flv"), 100, 300)
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	streamId := testutil.PublishTestStream(t, publisherConn, "testStream")
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	testutil.SendTestMedia(t, publisherConn, streamId, message.TypeVideo, 12345, []byte{0x17, 0x01, 0, 0, 0, 0x65})
+	assert.Equal(t, uint32(12345), testutil.WaitTestMedia(t, playerConn, message.TypeVideo).Timestamp)
+
+	liveOnlyConn := testutil.DialTestingServer(t, testServer)
+	playTestRecording(t, liveOnlyConn, "missing", amf.NewNumber(-1))
+	testutil.WaitTestStatus(t, liveOnlyConn, "NetStream.Play.StreamNotFound")
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rtmp/logger"
+	"rtmp/server"
+	"sync"
+	"time"
+)
+
+const (
+	EventConnect     = "on_connect"
+	EventPublish     = "on_publish"
+	EventPublishDone = "on_publish_done"
+	EventPlay        = "on_play"
+	EventPlayDone    = "on_play_done"
+	EventRecordDone  = "on_record_done"
+)
+
+// defaultTimeout bounds every notification when the config sets no timeout
+const defaultTimeout = 5 * time.Second
+
+// Config holds the url called for each event, the events without url are not notified
+type Config struct {
+	OnConnect     string
+	OnPublish     string
+	OnPublishDone string
+	OnPlay        string
+	OnPlayDone    string
+	OnRecordDone  string
+	Timeout       time.Duration
+}
+
+type Event struct {
+	Event      string            `json:"event"`
+	App        string            `json:"app"`
+	Stream     string            `json:"stream,omitempty"`
+	Args       map[string]string `json:"args,omitempty"`
+	TcUrl      string            `json:"tc_url,omitempty"`
+	ClientAddr string            `json:"client_addr,omitempty"`
+	SessionId  uint64            `json:"session_id,omitempty"`
+	Time       time.Time         `json:"time"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	DurationMs int64             `json:"duration_ms,omitempty"`
+	Path       string            `json:"path,omitempty"`
+}
+
+// Notifier posts the events as json to the configured urls, a non 2xx response to on_publish or on_play
+// rejects the action while the other events are notified in the background
+type Notifier struct {
+	server.NopHandler
+	Config     Config
+	Client     *http.Client
+	startTimes map[startKey]time.Time
+	mutex      sync.Mutex
+	pending    sync.WaitGroup
+}
+
+type startKey struct {
+	sessionId uint64
+	streamId  uint32
+}
+
+func NewNotifier(config Config) *Notifier {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Notifier{
+		Config:     config,
+		Client:     &http.Client{},
+		startTimes: make(map[startKey]time.Time),
+	}
+}
+
+// SetConfig replaces the urls and the timeout, the notifications already sent keep the former ones
+func (notifier *Notifier) SetConfig(config Config) {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	notifier.Config = config
+}
+
+func (notifier *Notifier) OnConnect(session *server.Session, request *server.ConnectRequest) error {
+	event := newEvent(EventConnect, session)
+	event.App = request.App
+	event.TcUrl = request.TcUrl
+	notifier.notifyInBackground(notifier.config().OnConnect, event)
+	return nil
+}
+
+func (notifier *Notifier) OnPublish(session *server.Session, request *server.PublishRequest) error {
+	event := newEvent(EventPublish, session)
+	event.Stream = request.Name
+	event.Args = flattenArgs(request.Args)
+	err := notifier.notify(notifier.config().OnPublish, event)
+	if err != nil {
+		return err
+	}
+	notifier.started(session.Id, request.StreamId, event.Time)
+	return nil
+}
+
+func (notifier *Notifier) OnUnpublish(session *server.Session, request *server.PublishRequest) {
+	event := newEvent(EventPublishDone, session)
+	event.Stream = request.Name
+	event.Args = flattenArgs(request.Args)
+	notifier.setTiming(&event, session.Id, request.StreamId)
+	notifier.notifyInBackground(notifier.config().OnPublishDone, event)
+}
+
+func (notifier *Notifier) OnPlay(session *server.Session, request *server.PlayRequest) error {
+	event := newEvent(EventPlay, session)
+	event.Stream = request.Name
+	event.Args = flattenArgs(request.Args)
+	err := notifier.notify(notifier.config().OnPlay, event)
+	if err != nil {
+		return err
+	}
+	notifier.started(session.Id, request.StreamId, event.Time)
+	return nil
+}
+
+func (notifier *Notifier) OnStop(session *server.Session, request *server.PlayRequest) {
+	event := newEvent(EventPlayDone, session)
+	event.Stream = request.Name
+	event.Args = flattenArgs(request.Args)
+	notifier.setTiming(&event, session.Id, request.StreamId)
+	notifier.notifyInBackground(notifier.config().OnPlayDone, event)
+}
+
+func (notifier *Notifier) OnDisconnect(session *server.Session, _ error) {
+	// forgets the actions the connection never ended
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	for key := range notifier.startTimes {
+		if key.sessionId == session.Id {
+			delete(notifier.startTimes, key)
+		}
+	}
+}
+
+// OnRecordDone notifies a finished recording, it is called by the recorder rather than the server
+func (notifier *Notifier) OnRecordDone(app string, stream string, path string, startedAt time.Time) {
+	event := Event{
+		Event:      EventRecordDone,
+		App:        app,
+		Stream:     stream,
+		Path:       path,
+		Time:       time.Now(),
+		StartedAt:  &startedAt,
+		DurationMs: time.Since(startedAt).Milliseconds(),
+	}
+	notifier.notifyInBackground(notifier.config().OnRecordDone, event)
+}
+
+// Wait blocks until the background notifications are sent
+func (notifier *Notifier) Wait() {
+	notifier.pending.Wait()
+}
+
+func (notifier *Notifier) notify(url string, event Event) error {
+	if url == "" {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifier.config().Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := notifier.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%s callback failed: %w", event.Event, err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s callback answered %d", event.Event, response.StatusCode)
+	}
+	return nil
+}
+
+func (notifier *Notifier) notifyInBackground(url string, event Event) {
+	if url == "" {
+		return
+	}
+	notifier.pending.Add(1)
+	go func() {
+		defer notifier.pending.Done()
+		err := notifier.notify(url, event)
+		if err != nil {
+			logger.Get().Errorf("webhook notification failed: %s", err)
+		}
+	}()
+}
+
+func (notifier *Notifier) config() Config {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	return notifier.Config
+}
+
+func (notifier *Notifier) started(sessionId uint64, streamId uint32, startedAt time.Time) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	notifier.startTimes[startKey{sessionId, streamId}] = startedAt
+}
+
+func (notifier *Notifier) setTiming(event *Event, sessionId uint64, streamId uint32) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	key := startKey{sessionId, streamId}
+	startedAt, ok := notifier.startTimes[key]
+	if !ok {
+		return
+	}
+	delete(notifier.startTimes, key)
+	event.StartedAt = &startedAt
+	event.DurationMs = event.Time.Sub(startedAt).Milliseconds()
+}
+
+func newEvent(name string, session *server.Session) Event {
+	return Event{
+		Event:      name,
+		App:        session.App,
+		ClientAddr: session.RemoteAddr().String(),
+		SessionId:  session.Id,
+		Time:       time.Now(),
+	}
+}
+
+func flattenArgs(args map[string][]string) map[string]string {
+	if len(args) == 0 {
+		return nil
+	}
+	flattened := make(map[string]string, len(args))
+	for name, values := range args {
+		if len(values) > 0 {
+			flattened[name] = values[0]
+		}
+	}
+	return flattened
+}
@@ -0,0 +1,124 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rtmp/amf"
+	"rtmp/testutil"
+	"rtmp/webhook"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestingCallbackServer(t *testing.T, status int) (*httptest.Server, chan webhook.Event) {
+	t.Helper()
+	events := make(chan webhook.Event, 10)
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var event webhook.Event
+		err := json.NewDecoder(request.Body).Decode(&event)
+		assert.Nil(t, err)
+		assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+		events <- event
+		writer.WriteHeader(status)
+	}))
+	t.Cleanup(callbackServer.Close)
+	return callbackServer, events
+}
+
+func waitTestEvent(t *testing.T, events chan webhook.Event) webhook.Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("event not received")
+	}
+	return webhook.Event{}
+}
+
+func TestPublishNotifications(t *testing.T) {
+	callbackServer, events := startTestingCallbackServer(t, http.StatusOK)
+	testServer := testutil.StartTestingServer(t)
+	notifier := webhook.NewNotifier(webhook.Config{
+		OnPublish:     callbackServer.URL + "/publish",
+		OnPublishDone: callbackServer.URL + "/publish_done",
+	})
+	testServer.Handler = notifier
+	clientConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, clientConn, "testStream?key=secret")
+	publishEvent := waitTestEvent(t, events)
+	assert.Equal(t, webhook.EventPublish, publishEvent.Event)
+	assert.Equal(t, "testApp", publishEvent.App)
+	assert.Equal(t, "testStream", publishEvent.Stream)
+	assert.Equal(t, "secret", publishEvent.Args["key"])
+	assert.Equal(t, clientConn.LocalAddr().String(), publishEvent.ClientAddr)
+	_ = clientConn.Close()
+	publishDoneEvent := waitTestEvent(t, events)
+	assert.Equal(t, webhook.EventPublishDone, publishDoneEvent.Event)
+	assert.Equal(t, "testStream", publishDoneEvent.Stream)
+	assert.NotNil(t, publishDoneEvent.StartedAt)
+	assert.GreaterOrEqual(t, publishDoneEvent.DurationMs, int64(0))
+}
+
+func TestPublishRejectedByCallback(t *testing.T) {
+	callbackServer, events := startTestingCallbackServer(t, http.StatusForbidden)
+	testServer := testutil.StartTestingServer(t)
+	testServer.Handler = webhook.NewNotifier(webhook.Config{OnPublish: callbackServer.URL})
+	clientConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(clientConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, clientConn, "_result")
+	testutil.SendTestCommand(t, clientConn, 1, amf.NewString("publish"), amf.NewNumber(2), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, clientConn, "NetStream.Publish.Denied")
+	waitTestEvent(t, events)
+	_, published := testServer.Streams.Get("testApp", "testStream")
+	assert.False(t, published)
+}
+
+func TestPlayRejectedWhenCallbackUnreachable(t *testing.T) {
+	callbackServer, _ := startTestingCallbackServer(t, http.StatusOK)
+	callbackServer.Close()
+	testServer := testutil.StartTestingServer(t)
+	testServer.Handler = webhook.NewNotifier(webhook.Config{OnPlay: callbackServer.URL})
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	playerConn := testutil.DialTestingServer(t, testServer)
+	connectCommand := testutil.GenerateTestConnectCommand()
+	_, err := connectCommand.Send(playerConn)
+	assert.Nil(t, err)
+	testutil.WaitTestCommand(t, playerConn, "_result")
+	testutil.SendTestCommand(t, playerConn, 1, amf.NewString("play"), amf.NewNumber(0), amf.NewNull(), amf.NewString("testStream"))
+	testutil.WaitTestStatus(t, playerConn, "NetStream.Play.Failed")
+}
+
+func TestConnectAndPlayDoneNotifications(t *testing.T) {
+	callbackServer, events := startTestingCallbackServer(t, http.StatusNoContent)
+	testServer := testutil.StartTestingServer(t)
+	notifier := webhook.NewNotifier(webhook.Config{
+		OnConnect:  callbackServer.URL,
+		OnPlay:     callbackServer.URL,
+		OnPlayDone: callbackServer.URL,
+	})
+	publisherConn := testutil.DialTestingServer(t, testServer)
+	testutil.PublishTestStream(t, publisherConn, "testStream")
+	testServer.Handler = notifier
+	playerConn := testutil.DialTestingServer(t, testServer)
+	testutil.PlayTestStream(t, playerConn, "testStream")
+	// the connect notification is sent in the background so it may arrive after the play one
+	received := map[string]webhook.Event{}
+	for range 2 {
+		event := waitTestEvent(t, events)
+		received[event.Event] = event
+	}
+	assert.Equal(t, "testApp", received[webhook.EventConnect].App)
+	assert.Equal(t, "testStream", received[webhook.EventPlay].Stream)
+	_ = publisherConn.Close()
+	playDoneEvent := waitTestEvent(t, events)
+	assert.Equal(t, webhook.EventPlayDone, playDoneEvent.Event)
+	assert.NotNil(t, playDoneEvent.StartedAt)
+	notifier.Wait()
+}